@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"mycoolserver/internal/validate"
+	"net/http"
+)
+
+// writeProblem is the one way handlers report errors, every error response
+// is an RFC 9457 problem+json body.
+func writeProblem(w http.ResponseWriter, r *http.Request, problemType string, status int, detail string, fieldErrors ...problem.FieldError) {
+	p := problem.New(problemType, status, detail)
+	p.Errors = fieldErrors
+	problem.Write(w, r, p)
+}
+
+// writeInternalError logs err and sends a 500 that doesn't leak it.
+func writeInternalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logging.FromContext(r.Context()).Error(msg, "err", err)
+	writeProblem(w, r, problem.TypeInternal, http.StatusInternalServerError, "")
+}
+
+// writeValidationError reports every field error in err, which came from
+// the validate package directly or through the users package.  fieldNames
+// renames fields to what the client sent, fields that aren't in it are
+// reported as is.
+func writeValidationError(w http.ResponseWriter, r *http.Request, detail string, err error, fieldNames map[string]string) {
+	var fieldErrs validate.Errors
+	if !errors.As(err, &fieldErrs) {
+		var fieldErr *validate.FieldError
+		if errors.As(err, &fieldErr) {
+			fieldErrs = validate.Errors{fieldErr}
+		}
+	}
+
+	problemErrs := make([]problem.FieldError, 0, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		field := fieldErr.Field
+		if renamed, ok := fieldNames[field]; ok {
+			field = renamed
+		}
+		problemErrs = append(problemErrs, problem.FieldError{Field: field, Detail: fieldErr.Detail})
+	}
+
+	writeProblem(w, r, problem.TypeValidation, http.StatusBadRequest, detail, problemErrs...)
+}
+
+// writeUserError maps errors from the users package to a problem.
+func writeUserError(w http.ResponseWriter, r *http.Request, msg string, err error, fieldNames map[string]string) {
+	switch {
+	case errors.Is(err, users.ErrValidation):
+		writeValidationError(w, r, msg+": "+err.Error(), err, fieldNames)
+	case errors.Is(err, users.ErrNoResultsFound):
+		writeProblem(w, r, problem.TypeNotFound, http.StatusNotFound, "no users found")
+	case errors.Is(err, users.ErrDuplicateEmail):
+		writeProblem(w, r, problem.TypeDuplicate, http.StatusConflict, msg+": "+err.Error(),
+			problem.FieldError{Field: "Email", Detail: err.Error()})
+	case errors.Is(err, users.ErrVersionMismatch):
+		writeProblem(w, r, problem.TypePrecondition, http.StatusPreconditionFailed, msg+": "+err.Error())
+	case errors.Is(err, users.ErrInvalidCredentials):
+		writeProblem(w, r, problem.TypeUnauthorized, http.StatusUnauthorized, msg+": "+err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		writeProblem(w, r, problem.TypeTimeout, http.StatusServiceUnavailable, msg+": request took too long")
+	case errors.Is(err, context.Canceled):
+		// the client has gone, this response is only for the access log
+		logging.FromContext(r.Context()).Debug("request canceled", "err", err)
+		writeProblem(w, r, problem.TypeTimeout, http.StatusServiceUnavailable, msg+": request canceled")
+	case errors.Is(err, users.ErrBusy):
+		// hashes take well under a second, a slot will be free by then
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, problem.TypeUnavailable, http.StatusServiceUnavailable, msg+": server is busy, try again shortly")
+	case errors.Is(err, users.ErrShuttingDown):
+		writeProblem(w, r, problem.TypeUnavailable, http.StatusServiceUnavailable, "server is shutting down")
+	default:
+		writeInternalError(w, r, msg, err)
+	}
+}
@@ -1,3 +1,15 @@
 module mycoolserver
 
 go 1.24.3
+
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/klauspost/compress v1.19.2
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.43.0
+	golang.org/x/sync v0.17.0
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/text v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
+)
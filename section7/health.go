@@ -0,0 +1,54 @@
+package main
+
+import (
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"strings"
+)
+
+// handleHealthz is the liveness check, if it answers at all the process is
+// alive and restarting it won't help
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthOK(w, r)
+}
+
+// handleReadyz is the readiness check, it fails while the server is draining
+// for shutdown or when the user store can't serve requests, so load
+// balancers stop sending traffic here.  Anyone can call it, so the response
+// only names the checks that failed, the reasons go to the log.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	var failures []string
+
+	if s.draining.Load() {
+		logger.Info("readiness check failed", "check", "draining")
+		failures = append(failures, "draining")
+	}
+
+	err := s.userManager.Ping(r.Context())
+	if err != nil {
+		// store errors can include things like file paths
+		logger.Warn("readiness check failed", "check", "users", "err", err)
+		failures = append(failures, "users")
+	}
+
+	if len(failures) > 0 {
+		// don't let anything between here and the client cache a failure
+		w.Header().Set("Cache-Control", "no-store")
+		writeProblem(w, r, problem.TypeUnavailable, http.StatusServiceUnavailable, "failed checks: "+strings.Join(failures, ", "))
+		return
+	}
+
+	writeHealthOK(w, r)
+}
+
+func writeHealthOK(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, err := w.Write([]byte("ok\n"))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error writing response", "err", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	testServer, handler := newTestServer(t)
+
+	// liveness doesn't care about draining
+	testServer.draining.Store(true)
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	if w.Body.String() != "ok\n" {
+		t.Errorf("bad response body, wanted: %q, got: %q", "ok\n", w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	testServer, handler := newTestServer(t)
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code while ready, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	testServer.draining.Store(true)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bad response code while draining, wanted: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	checkProblem(t, w, problem.TypeUnavailable, "failed checks: draining")
+
+	err := testServer.userManager.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("error shutting down user manager: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	checkProblem(t, w, problem.TypeUnavailable, "failed checks: draining, users")
+}
+
+func TestReadyzStoreProbe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := users.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+	defer store.Close()
+
+	testServer := &server{userManager: users.NewManager(users.WithStore(store))}
+	handler := testServer.handler()
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code with a healthy store, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	// the log disappearing out from under the store means writes would be
+	// lost on restart
+	err = os.Remove(path + ".wal")
+	if err != nil {
+		t.Fatalf("error removing user log: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bad response code with a missing log, wanted: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	// the store's error names the log file, which is nobody's business
+	checkProblem(t, w, problem.TypeUnavailable, "failed checks: users")
+}
@@ -0,0 +1,299 @@
+// Package auth works out who is making a request, from a static API key in
+// the X-API-Key header, a signed JWT in an Authorization: Bearer header or a
+// session cookie, and turns away requests that don't say or aren't allowed.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	APIKeyHeader  = "X-API-Key"
+	SessionCookie = "session"
+)
+
+// Methods a Principal can have authenticated with
+const (
+	MethodAPIKey  = "api_key"
+	MethodJWT     = "jwt"
+	MethodSession = "session"
+)
+
+var (
+	// ErrNoCredentials means the request didn't try to authenticate
+	ErrNoCredentials = errors.New("no credentials provided")
+	// ErrInvalidCredentials is wrapped with the reason credentials were
+	// rejected
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is whoever made the request.
+type Principal struct {
+	// Subject is the API key's name, the token's sub claim or the id of the
+	// logged in user
+	Subject string
+	// Method is MethodAPIKey, MethodJWT or MethodSession
+	Method string
+	// Role is the API key's configured role, the token's role claim or the
+	// logged in user's role, this package doesn't interpret it
+	Role   string
+	Scopes []string
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal Require attached to the request, ok is
+// false on public routes.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Authenticator checks credentials against the configured API keys and JWT
+// keys.  One with neither rejects every request, so forgetting to configure
+// it fails closed.
+type Authenticator struct {
+	// apiKeys is keyed by the SHA-256 of the key so the keys themselves
+	// don't have to be kept in memory or in config files
+	apiKeys  map[[sha256.Size]byte]*Principal
+	jwt      *JWTVerifier
+	sessions SessionLookup
+	// trustedOrigin reports whether another origin may use the session
+	// cookie to change things, nil trusts none
+	trustedOrigin func(origin string) bool
+}
+
+// SessionLookup returns the principal for a session cookie's value.  It
+// should wrap ErrInvalidCredentials for sessions that don't exist or have
+// expired, other errors are treated as the server failing.
+type SessionLookup func(ctx context.Context, token string) (*Principal, error)
+
+type Option func(*Authenticator) error
+
+// WithAPIKey accepts the key whose SHA-256 is keyHash, given in hex, as the
+// principal called name.
+func WithAPIKey(name string, keyHash string, role string, scopes ...string) Option {
+	return func(a *Authenticator) error {
+		decoded, err := hex.DecodeString(keyHash)
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("API key %q: hash must be a hex SHA-256", name)
+		}
+
+		hash := [sha256.Size]byte(decoded)
+		if _, ok := a.apiKeys[hash]; ok {
+			return fmt.Errorf("API key %q: same key as another API key", name)
+		}
+
+		a.apiKeys[hash] = &Principal{
+			Subject: name,
+			Method:  MethodAPIKey,
+			Role:    role,
+			Scopes:  slices.Clone(scopes),
+		}
+		return nil
+	}
+}
+
+// WithJWT accepts bearer tokens that v verifies.
+func WithJWT(v *JWTVerifier) Option {
+	return func(a *Authenticator) error {
+		a.jwt = v
+		return nil
+	}
+}
+
+// WithSessions accepts the session cookie, looking sessions up with lookup.
+func WithSessions(lookup SessionLookup) Option {
+	return func(a *Authenticator) error {
+		a.sessions = lookup
+		return nil
+	}
+}
+
+// WithTrustedOrigins lets pages from origins trusted reports true for make
+// unsafe requests with the session cookie, like the ones CORS lets send
+// credentials.  Otherwise only the server's own origin can.
+func WithTrustedOrigins(trusted func(origin string) bool) Option {
+	return func(a *Authenticator) error {
+		a.trustedOrigin = trusted
+		return nil
+	}
+}
+
+func New(opts ...Option) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeys: make(map[[sha256.Size]byte]*Principal),
+	}
+
+	for _, opt := range opts {
+		err := opt(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// HashAPIKey returns what WithAPIKey expects for key, for generating config.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Authenticate returns the principal for the credentials in r,
+// ErrNoCredentials if there aren't any, or an error wrapping
+// ErrInvalidCredentials if they're wrong.  Headers win over the session
+// cookie, a browser sends that whether the client meant to or not.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		p, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+		}
+		return p, nil
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return a.authenticateSession(r)
+	}
+
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, fmt.Errorf("%w: unsupported authorization scheme", ErrInvalidCredentials)
+	}
+
+	if a.jwt == nil {
+		return nil, fmt.Errorf("%w: bearer tokens aren't accepted", ErrInvalidCredentials)
+	}
+
+	return a.jwt.Verify(strings.TrimSpace(token))
+}
+
+func (a *Authenticator) authenticateSession(r *http.Request) (*Principal, error) {
+	if a.sessions == nil {
+		return nil, ErrNoCredentials
+	}
+
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoCredentials
+	}
+
+	return a.sessions(r.Context(), cookie.Value)
+}
+
+// Require is middleware that only lets authenticated requests through, and
+// of those only ones whose principal has every scope listed.  Missing or bad
+// credentials get a 401, missing scopes a 403, and so does a session cookie
+// sent with an unsafe request from another origin.
+func (a *Authenticator) Require(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := logging.FromContext(r.Context())
+
+			p, err := a.Authenticate(r)
+			if err != nil && !errors.Is(err, ErrNoCredentials) && !errors.Is(err, ErrInvalidCredentials) {
+				logger.Error("error checking credentials", "err", err)
+				writeProblem(w, r, problem.TypeInternal, http.StatusInternalServerError, "")
+				return
+			}
+			if err != nil {
+				logger.Info("authentication failed", "err", err)
+				writeUnauthorized(w, r, err)
+				return
+			}
+
+			if p.Method == MethodSession && a.crossOrigin(r) {
+				logger.Info("rejected cross-origin request with a session cookie",
+					"origin", r.Header.Get("Origin"), "sec_fetch_site", r.Header.Get("Sec-Fetch-Site"))
+				writeProblem(w, r, problem.TypeForbidden, http.StatusForbidden,
+					"the session cookie can't be used from another origin, send an API key or a bearer token instead")
+				return
+			}
+
+			for _, scope := range scopes {
+				if !p.HasScope(scope) {
+					logger.Info("missing scope", "principal", p.Subject, "scope", scope)
+					writeProblem(w, r, problem.TypeForbidden, http.StatusForbidden,
+						fmt.Sprintf("%s is missing the %s scope", p.Subject, scope))
+					return
+				}
+			}
+
+			ctx := WithPrincipal(r.Context(), p)
+			ctx = logging.With(ctx, "principal", p.Subject)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// crossOrigin reports whether r is an unsafe request a page on another
+// origin made, which a browser would have sent the session cookie with
+// whether the page was meant to use it or not.  SameSite=Lax doesn't stop
+// that from sibling subdomains, or for form posts, which need no preflight.
+// Browsers send Sec-Fetch-Site, older ones only Origin, and a request with
+// neither isn't from a browser so no page could have forged it.
+func (a *Authenticator) crossOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin != "" && a.trustedOrigin != nil && a.trustedOrigin(origin) {
+		return false
+	}
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return false
+	default:
+		return true
+	}
+
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// writeUnauthorized includes the challenge RFC 6750 asks for, with an error
+// code when a token was sent and didn't work
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	challenge := `Bearer realm="mycoolserver"`
+	detail := "credentials are required, send an API key in the " + APIKeyHeader + " header, a bearer token or a session cookie"
+
+	if !errors.Is(err, ErrNoCredentials) {
+		challenge += `, error="invalid_token"`
+		detail = err.Error()
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeProblem(w, r, problem.TypeUnauthorized, http.StatusUnauthorized, detail)
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, problemType string, status int, detail string) {
+	problem.Write(w, r, problem.New(problemType, status, detail))
+}
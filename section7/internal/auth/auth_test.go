@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+
+	a, err := New(
+		WithAPIKey("reader", HashAPIKey("reader-key"), "", "users:read"),
+		WithAPIKey("writer", HashAPIKey("writer-key"), "admin", "users:read", "users:write"),
+		WithJWT(newTestVerifier(t, JWTOptions{HMACSecret: testSecret})),
+	)
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+	return a
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := map[string][]Option{
+		"bad hash":   {WithAPIKey("bad", "not hex", "")},
+		"short hash": {WithAPIKey("short", "abcd", "")},
+		"same key twice": {
+			WithAPIKey("first", HashAPIKey("key"), ""),
+			WithAPIKey("second", HashAPIKey("key"), ""),
+		},
+	}
+
+	for name, opts := range tests {
+		_, err := New(opts...)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	a := newTestAuthenticator(t)
+	token := signToken(t, "HS256", validClaims(), hmacSigner(testSecret))
+
+	tests := map[string]struct {
+		headers   map[string]string
+		status    int
+		challenge string
+		subject   string
+	}{
+		"no credentials": {
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="mycoolserver"`,
+		},
+		"unknown API key": {
+			headers:   map[string]string{APIKeyHeader: "guess"},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="mycoolserver", error="invalid_token"`,
+		},
+		"basic auth": {
+			headers:   map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="mycoolserver", error="invalid_token"`,
+		},
+		"bad token": {
+			headers:   map[string]string{"Authorization": "Bearer " + token + "x"},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="mycoolserver", error="invalid_token"`,
+		},
+		"missing scope": {
+			headers: map[string]string{APIKeyHeader: "reader-key"},
+			status:  http.StatusForbidden,
+		},
+		"API key": {
+			headers: map[string]string{APIKeyHeader: "writer-key"},
+			status:  http.StatusOK,
+			subject: "writer",
+		},
+		"bearer token": {
+			headers: map[string]string{"Authorization": "Bearer " + token},
+			status:  http.StatusOK,
+			subject: "alice",
+		},
+	}
+
+	for name, test := range tests {
+		var subject string
+		handler := a.Require("users:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := FromContext(r.Context())
+			if ok {
+				subject = p.Subject
+			}
+		}))
+
+		r := httptest.NewRequest(http.MethodPost, "/users", nil)
+		for header, value := range test.headers {
+			r.Header.Set(header, value)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d", name, test.status, w.Code)
+		}
+
+		if w.Header().Get("WWW-Authenticate") != test.challenge {
+			t.Errorf("%s: bad challenge, wanted: %q, got: %q", name, test.challenge, w.Header().Get("WWW-Authenticate"))
+		}
+
+		if subject != test.subject {
+			t.Errorf("%s: bad principal, wanted: %q, got: %q", name, test.subject, subject)
+		}
+
+		if test.status == http.StatusOK {
+			continue
+		}
+
+		var p problem.Problem
+		err := json.Unmarshal(w.Body.Bytes(), &p)
+		if err != nil {
+			t.Errorf("%s: error decoding problem: %v", name, err)
+			continue
+		}
+
+		expectedType := problem.TypeUnauthorized
+		if test.status == http.StatusForbidden {
+			expectedType = problem.TypeForbidden
+		}
+		if p.Type != expectedType {
+			t.Errorf("%s: bad problem type, wanted: %s, got: %s", name, expectedType, p.Type)
+		}
+	}
+}
+
+func TestRequireForbiddenDetail(t *testing.T) {
+	a := newTestAuthenticator(t)
+	handler := a.Require("users:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodDelete, "/users/1", nil)
+	r.Header.Set(APIKeyHeader, "reader-key")
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	expected := "reader is missing the users:write scope"
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("bad detail, wanted: %q, got: %s", expected, w.Body.String())
+	}
+}
+
+func TestNoCredentialsConfigured(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("Authorization", "Bearer abc.def.ghi")
+
+	_, err = a.Authenticate(r)
+	if err == nil {
+		t.Errorf("bearer token accepted with no verifier")
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	lookup := func(ctx context.Context, token string) (*Principal, error) {
+		switch token {
+		case "good":
+			return &Principal{Subject: "user-1", Method: MethodSession}, nil
+		case "broken":
+			return nil, errors.New("session store is down")
+		default:
+			return nil, fmt.Errorf("%w: no such session", ErrInvalidCredentials)
+		}
+	}
+
+	a, err := New(WithSessions(lookup), WithAPIKey("writer", HashAPIKey("writer-key"), "", "users:write"))
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	tests := map[string]struct {
+		cookie  string
+		apiKey  string
+		status  int
+		subject string
+	}{
+		"session":                {cookie: "good", status: http.StatusOK, subject: "user-1"},
+		"expired session":        {cookie: "stale", status: http.StatusUnauthorized},
+		"empty cookie":           {cookie: "", status: http.StatusUnauthorized},
+		"lookup fails":           {cookie: "broken", status: http.StatusInternalServerError},
+		"API key beats a cookie": {cookie: "stale", apiKey: "writer-key", status: http.StatusOK, subject: "writer"},
+	}
+
+	for name, test := range tests {
+		var subject string
+		handler := a.Require()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := FromContext(r.Context())
+			subject = p.Subject
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.AddCookie(&http.Cookie{Name: SessionCookie, Value: test.cookie})
+		if test.apiKey != "" {
+			r.Header.Set(APIKeyHeader, test.apiKey)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d", name, test.status, w.Code)
+		}
+		if subject != test.subject {
+			t.Errorf("%s: bad principal, wanted: %q, got: %q", name, test.subject, subject)
+		}
+	}
+}
+
+func TestSessionCrossOrigin(t *testing.T) {
+	lookup := func(ctx context.Context, token string) (*Principal, error) {
+		return &Principal{Subject: "user-1", Method: MethodSession}, nil
+	}
+	trusted := func(origin string) bool { return origin == "https://app.example.com" }
+
+	a, err := New(WithSessions(lookup), WithTrustedOrigins(trusted), WithAPIKey("writer", HashAPIKey("writer-key"), "", "users:write"))
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	tests := map[string]struct {
+		method       string
+		origin       string
+		secFetchSite string
+		apiKey       string
+		status       int
+	}{
+		"not a browser":          {method: http.MethodPost, status: http.StatusOK},
+		"same origin":            {method: http.MethodPost, origin: "http://example.com", secFetchSite: "same-origin", status: http.StatusOK},
+		"typed in":               {method: http.MethodPost, secFetchSite: "none", status: http.StatusOK},
+		"old browser":            {method: http.MethodPost, origin: "http://example.com", status: http.StatusOK},
+		"old browser elsewhere":  {method: http.MethodPost, origin: "https://evil.example.org", status: http.StatusForbidden},
+		"sibling subdomain":      {method: http.MethodPost, origin: "https://evil.example.com", secFetchSite: "same-site", status: http.StatusForbidden},
+		"cross site form":        {method: http.MethodPut, origin: "https://evil.example.org", secFetchSite: "cross-site", status: http.StatusForbidden},
+		"opaque origin":          {method: http.MethodDelete, origin: "null", status: http.StatusForbidden},
+		"trusted origin":         {method: http.MethodPatch, origin: "https://app.example.com", secFetchSite: "cross-site", status: http.StatusOK},
+		"safe method":            {method: http.MethodGet, origin: "https://evil.example.org", secFetchSite: "cross-site", status: http.StatusOK},
+		"API key from elsewhere": {method: http.MethodPost, origin: "https://evil.example.org", secFetchSite: "cross-site", apiKey: "writer-key", status: http.StatusOK},
+	}
+
+	handler := a.Require()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for name, test := range tests {
+		r := httptest.NewRequest(test.method, "http://example.com/users", nil)
+		r.AddCookie(&http.Cookie{Name: SessionCookie, Value: "good"})
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.secFetchSite != "" {
+			r.Header.Set("Sec-Fetch-Site", test.secFetchSite)
+		}
+		if test.apiKey != "" {
+			r.Header.Set(APIKeyHeader, test.apiKey)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d", name, test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultLeeway allows for clocks that don't quite agree
+const defaultLeeway = time.Minute
+
+// JWTOptions configures a JWTVerifier, at least one key has to be set.  Only
+// the algorithm that goes with each configured key is accepted, so a token
+// can't pick HS256 and pass the RSA public key off as the HMAC secret.
+type JWTOptions struct {
+	// HMACSecret enables HS256
+	HMACSecret []byte
+	// RSAPublicKey enables RS256
+	RSAPublicKey *rsa.PublicKey
+	// Issuer, if set, has to match the iss claim
+	Issuer string
+	// Audience, if set, has to be in the aud claim
+	Audience string
+	// Leeway is how far exp and nbf may be off, zero means a minute
+	Leeway time.Duration
+}
+
+// JWTVerifier checks signed tokens locally, without calling the issuer.
+type JWTVerifier struct {
+	opts JWTOptions
+	now  func() time.Time
+}
+
+func NewJWTVerifier(opts JWTOptions) (*JWTVerifier, error) {
+	if len(opts.HMACSecret) == 0 && opts.RSAPublicKey == nil {
+		return nil, errors.New("a JWT verifier needs an HMAC secret or an RSA public key")
+	}
+
+	// RFC 7518 says HS256 keys must be at least as long as the hash
+	if len(opts.HMACSecret) > 0 && len(opts.HMACSecret) < sha256.Size {
+		return nil, fmt.Errorf("HMAC secret must be at least %d bytes", sha256.Size)
+	}
+
+	if opts.Leeway == 0 {
+		opts.Leeway = defaultLeeway
+	}
+
+	return &JWTVerifier{opts: opts, now: time.Now}, nil
+}
+
+// ParseRSAPublicKey reads a PEM encoded PKIX ("PUBLIC KEY") or PKCS #1
+// ("RSA PUBLIC KEY") key.
+func ParseRSAPublicKey(pemData []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("expected an RSA key, got %T", key)
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %q", block.Type)
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	// Scope is space separated, like OAuth scopes
+	Scope string `json:"scope"`
+	Role  string `json:"role"`
+}
+
+// audience is a string or an array of them, RFC 7519 allows either
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(data, &many)
+	if err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+// Verify checks token's signature and claims and returns who it was issued
+// to.  Errors wrap ErrInvalidCredentials.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	claims, err := v.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	return &Principal{
+		Subject: claims.Subject,
+		Method:  MethodJWT,
+		Role:    claims.Role,
+		Scopes:  strings.Fields(claims.Scope),
+	}, nil
+}
+
+func (v *JWTVerifier) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	// the signature covers the encoded header and payload as sent
+	signed := []byte(parts[0] + "." + parts[1])
+
+	err = v.checkSignature(header.Alg, signed, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	err = v.checkClaims(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+func (v *JWTVerifier) checkSignature(alg string, signed []byte, signature []byte) error {
+	switch alg {
+	case "HS256":
+		if len(v.opts.HMACSecret) == 0 {
+			break
+		}
+
+		mac := hmac.New(sha256.New, v.opts.HMACSecret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("bad token signature")
+		}
+		return nil
+	case "RS256":
+		if v.opts.RSAPublicKey == nil {
+			break
+		}
+
+		digest := sha256.Sum256(signed)
+		err := rsa.VerifyPKCS1v15(v.opts.RSAPublicKey, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return errors.New("bad token signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported token algorithm: %q", alg)
+}
+
+func (v *JWTVerifier) checkClaims(claims *jwtClaims) error {
+	now := v.now()
+
+	if claims.Subject == "" {
+		return errors.New("token has no subject")
+	}
+
+	// tokens that never expire are too dangerous to accept
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+
+	if now.After(numericDate(*claims.ExpiresAt).Add(v.opts.Leeway)) {
+		return errors.New("token has expired")
+	}
+
+	if claims.NotBefore != nil && now.Add(v.opts.Leeway).Before(numericDate(*claims.NotBefore)) {
+		return errors.New("token isn't valid yet")
+	}
+
+	if v.opts.Issuer != "" && claims.Issuer != v.opts.Issuer {
+		return fmt.Errorf("token issuer %q isn't trusted", claims.Issuer)
+	}
+
+	if v.opts.Audience != "" && !slices.Contains(claims.Audience, v.opts.Audience) {
+		return errors.New("token is for a different audience")
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// numericDate converts seconds since the epoch, which may have a fraction
+func numericDate(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testNow    = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+)
+
+// signToken builds a token by hand so tests can make ones a real issuer
+// wouldn't
+func signToken(t *testing.T, alg string, claims map[string]any, sign func(signed []byte) []byte) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatalf("error marshalling header: %v", err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("error marshalling claims: %v", err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hmacSigner(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rsaSigner(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("error signing token: %v", err)
+		}
+		return signature
+	}
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub":   "alice",
+		"iss":   "https://issuer.example.com",
+		"aud":   []string{"mycoolserver", "other"},
+		"exp":   testNow.Add(time.Hour).Unix(),
+		"nbf":   testNow.Add(-time.Hour).Unix(),
+		"scope": "users:read users:write",
+		"role":  "editor",
+	}
+}
+
+func withClaim(name string, value any) map[string]any {
+	claims := validClaims()
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+func newTestVerifier(t *testing.T, opts JWTOptions) *JWTVerifier {
+	t.Helper()
+
+	opts.Issuer = "https://issuer.example.com"
+	opts.Audience = "mycoolserver"
+
+	v, err := NewJWTVerifier(opts)
+	if err != nil {
+		t.Fatalf("error creating verifier: %v", err)
+	}
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func TestVerifyHS256(t *testing.T) {
+	v := newTestVerifier(t, JWTOptions{HMACSecret: testSecret})
+
+	p, err := v.Verify(signToken(t, "HS256", validClaims(), hmacSigner(testSecret)))
+	if err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+
+	expected := &Principal{Subject: "alice", Method: MethodJWT, Role: "editor", Scopes: []string{"users:read", "users:write"}}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("bad principal, wanted: %+v, got: %+v", expected, p)
+	}
+}
+
+func TestVerifyRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error marshalling public key: %v", err)
+	}
+
+	publicKey, err := ParseRSAPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("error parsing public key: %v", err)
+	}
+
+	v := newTestVerifier(t, JWTOptions{RSAPublicKey: publicKey})
+
+	p, err := v.Verify(signToken(t, "RS256", validClaims(), rsaSigner(t, key)))
+	if err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+	if p.Subject != "alice" {
+		t.Errorf("bad subject, wanted: alice, got: %s", p.Subject)
+	}
+
+	// the classic confusion attack, signing with the public key as an HMAC
+	// secret, has to fail when only RS256 is configured
+	forged := signToken(t, "HS256", validClaims(), hmacSigner(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	_, err = v.Verify(forged)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad error for HS256 token, wanted: %v, got: %v", ErrInvalidCredentials, err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	v := newTestVerifier(t, JWTOptions{HMACSecret: testSecret})
+	sign := hmacSigner(testSecret)
+
+	tests := map[string]struct {
+		token    string
+		expected string
+	}{
+		"expired": {
+			token:    signToken(t, "HS256", withClaim("exp", testNow.Add(-2*time.Minute).Unix()), sign),
+			expected: "token has expired",
+		},
+		"not valid yet": {
+			token:    signToken(t, "HS256", withClaim("nbf", testNow.Add(2*time.Minute).Unix()), sign),
+			expected: "token isn't valid yet",
+		},
+		"no expiry": {
+			token:    signToken(t, "HS256", withClaim("exp", nil), sign),
+			expected: "token has no expiry",
+		},
+		"no subject": {
+			token:    signToken(t, "HS256", withClaim("sub", nil), sign),
+			expected: "token has no subject",
+		},
+		"wrong issuer": {
+			token:    signToken(t, "HS256", withClaim("iss", "https://evil.example.com"), sign),
+			expected: "isn't trusted",
+		},
+		"wrong audience": {
+			token:    signToken(t, "HS256", withClaim("aud", "someone-else"), sign),
+			expected: "different audience",
+		},
+		"wrong secret": {
+			token:    signToken(t, "HS256", validClaims(), hmacSigner([]byte("not the secret, not the secret!!"))),
+			expected: "bad token signature",
+		},
+		"alg none": {
+			token:    signToken(t, "none", validClaims(), func([]byte) []byte { return nil }),
+			expected: "unsupported token algorithm",
+		},
+		"RS256 not configured": {
+			token:    signToken(t, "RS256", validClaims(), sign),
+			expected: "unsupported token algorithm",
+		},
+		"two parts": {
+			token:    "abc.def",
+			expected: "malformed token",
+		},
+		"bad base64": {
+			token:    "!!!.def.ghi",
+			expected: "malformed token header",
+		},
+	}
+
+	for name, test := range tests {
+		_, err := v.Verify(test.token)
+		if !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: bad error, wanted: %v, got: %v", name, ErrInvalidCredentials, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: bad error, wanted: %q, got: %q", name, test.expected, err.Error())
+		}
+	}
+}
+
+func TestVerifyLeeway(t *testing.T) {
+	v := newTestVerifier(t, JWTOptions{HMACSecret: testSecret})
+
+	// expired 30 seconds ago is within the default minute of leeway
+	token := signToken(t, "HS256", withClaim("exp", testNow.Add(-30*time.Second).Unix()), hmacSigner(testSecret))
+	_, err := v.Verify(token)
+	if err != nil {
+		t.Errorf("error verifying token within leeway: %v", err)
+	}
+}
+
+func TestNewJWTVerifierErrors(t *testing.T) {
+	tests := map[string]JWTOptions{
+		"no keys":      {},
+		"short secret": {HMACSecret: []byte("short")},
+	}
+
+	for name, opts := range tests {
+		_, err := NewJWTVerifier(opts)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package compression compresses responses with whichever of gzip, brotli
+// and zstd the client prefers, and decompresses request bodies sent with a
+// Content-Encoding.
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings the server knows
+const (
+	Gzip     = "gzip"
+	Brotli   = "br"
+	Zstd     = "zstd"
+	Identity = "identity"
+)
+
+// DefaultEncodings are in the server's order of preference, zstd and
+// brotli make smaller bodies than gzip for about the same work at the
+// levels used here
+var DefaultEncodings = []string{Zstd, Brotli, Gzip}
+
+// DefaultMinSize is about where a compressed body plus the headers saying
+// so stop being smaller than sending it as it is
+const DefaultMinSize = 1024
+
+// encoder is what the gzip, brotli and zstd writers have in common
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools keep writers around between responses, each of them holds
+// buffers and tables that are expensive to make
+var encoderPools = map[string]*sync.Pool{
+	Gzip: {New: func() any {
+		// the level is known to be good so there's no error
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	Brotli: {New: func() any {
+		// the default of 6 is too slow for responses made on the fly
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	Zstd: {New: func() any {
+		// the options are fixed so there's no error
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return w
+	}},
+}
+
+func getEncoder(encoding string, w io.Writer) encoder {
+	enc := encoderPools[encoding].Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func putEncoder(encoding string, enc encoder) {
+	// don't hold on to the response writer
+	enc.Reset(nil)
+	encoderPools[encoding].Put(enc)
+}
+
+// ValidateEncoding returns an error for content codings the package can't
+// produce
+func ValidateEncoding(encoding string) error {
+	if _, ok := encoderPools[encoding]; !ok {
+		return fmt.Errorf("unknown encoding %q, must be gzip, br or zstd", encoding)
+	}
+	return nil
+}
+
+// Negotiate picks the first of encodings, which are in the server's order
+// of preference, with the highest q value in an Accept-Encoding header.
+// It's "" when the body should be sent as it is.
+func Negotiate(acceptEncoding string, encodings []string) string {
+	qs := make(map[string]float64)
+	wildcard := -1.0
+
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil && parsed >= 0 && parsed <= 1 {
+				q = parsed
+			}
+		}
+
+		// x-gzip is the same thing, RFC 9110 says to treat it that way
+		if coding == "x-gzip" {
+			coding = Gzip
+		}
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		qs[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := qs[encoding]
+		if !ok && wildcard >= 0 {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// incompressible are media types, or the start of them, that are already
+// compressed so compressing them again only costs time
+var incompressible = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// compressible are exceptions to incompressible
+var compressible = []string{
+	"image/svg+xml",
+	"image/bmp",
+	"image/x-icon",
+}
+
+// Compressible reports whether a body of mediaType is worth compressing
+func Compressible(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	if slices.Contains(compressible, mediaType) {
+		return true
+	}
+
+	for _, prefix := range incompressible {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
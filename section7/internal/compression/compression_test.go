@@ -0,0 +1,64 @@
+package compression
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]struct {
+		acceptEncoding string
+		expected       string
+	}{
+		"no header":         {acceptEncoding: "", expected: ""},
+		"browser":           {acceptEncoding: "gzip, deflate, br, zstd", expected: Zstd},
+		"only gzip":         {acceptEncoding: "gzip", expected: Gzip},
+		"x-gzip":            {acceptEncoding: "x-gzip", expected: Gzip},
+		"upper case":        {acceptEncoding: "GZIP", expected: Gzip},
+		"q values":          {acceptEncoding: "zstd;q=0.5, br;q=0.8, gzip;q=0.1", expected: Brotli},
+		"refused":           {acceptEncoding: "zstd;q=0, br", expected: Brotli},
+		"wildcard":          {acceptEncoding: "*", expected: Zstd},
+		"wildcard refusals": {acceptEncoding: "*;q=0, gzip", expected: Gzip},
+		"unknown":           {acceptEncoding: "deflate, compress", expected: ""},
+		"identity":          {acceptEncoding: "identity", expected: ""},
+	}
+
+	for name, test := range tests {
+		got := Negotiate(test.acceptEncoding, DefaultEncodings)
+		if got != test.expected {
+			t.Errorf("%s: bad encoding, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := map[string]bool{
+		"application/json":         true,
+		"application/problem+json": true,
+		"text/html":                true,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"IMAGE/JPEG":               false,
+		"video/mp4":                false,
+		"application/zip":          false,
+		"application/gzip":         false,
+		"font/woff2":               false,
+	}
+
+	for mediaType, expected := range tests {
+		if got := Compressible(mediaType); got != expected {
+			t.Errorf("%s: bad compressible, wanted: %v, got: %v", mediaType, expected, got)
+		}
+	}
+}
+
+func TestValidateEncoding(t *testing.T) {
+	for _, encoding := range DefaultEncodings {
+		if err := ValidateEncoding(encoding); err != nil {
+			t.Errorf("%s: unexpected error: %v", encoding, err)
+		}
+	}
+
+	if err := ValidateEncoding("deflate"); err == nil {
+		t.Error("expected an error for deflate")
+	}
+}
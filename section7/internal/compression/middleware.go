@@ -0,0 +1,361 @@
+package compression
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mycoolserver/internal/conditional"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Options struct {
+	// Encodings responses are compressed with, in order of preference.
+	// Request bodies are accepted in any of them.
+	Encodings []string
+	// MinSize is the smallest body that's compressed, zero means
+	// DefaultMinSize
+	MinSize int
+	// MaxRequestBytes is the most a request body may decompress to, it
+	// should match the limit handlers put on bodies
+	MaxRequestBytes int64
+}
+
+// Compressor compresses responses and decompresses requests
+type Compressor struct {
+	encodings       []string
+	minSize         int
+	maxRequestBytes int64
+}
+
+func New(opts Options) (*Compressor, error) {
+	if len(opts.Encodings) == 0 {
+		return nil, errors.New("no encodings given")
+	}
+	for _, encoding := range opts.Encodings {
+		err := ValidateEncoding(encoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxRequestBytes <= 0 {
+		return nil, fmt.Errorf("max request bytes must be positive, got %d", opts.MaxRequestBytes)
+	}
+
+	c := &Compressor{
+		encodings:       opts.Encodings,
+		minSize:         opts.MinSize,
+		maxRequestBytes: opts.MaxRequestBytes,
+	}
+	if c.minSize <= 0 {
+		c.minSize = DefaultMinSize
+	}
+
+	return c, nil
+}
+
+// Handler decompresses request bodies before next sees them and
+// compresses what it sends back
+func (c *Compressor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// whether or not this response is compressed, the next one to a
+		// different Accept-Encoding might be
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !c.decompressRequest(w, r) {
+			return
+		}
+
+		// undo what decide does to strong ETags so handlers see the ones
+		// they made.  A change to a resource is usually sent with a
+		// different Accept-Encoding, or none, than the GET its ETag came
+		// from, and any encoding's copy is the same resource to change.
+		for _, encoding := range c.encodings {
+			conditional.TrimSuffix(r.Header, "If-Match", "-"+encoding)
+		}
+
+		encoding := Negotiate(strings.Join(r.Header.Values("Accept-Encoding"), ","), c.encodings)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// a copy is only still good if it's the one this request would
+		// get, so If-None-Match only loses this encoding's suffix
+		ifNoneMatch := http.Header{"If-None-Match": r.Header.Values("If-None-Match")}
+		conditional.TrimSuffix(r.Header, "If-None-Match", "-"+encoding)
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: c.minSize, status: http.StatusOK, ifNoneMatch: ifNoneMatch}
+		next.ServeHTTP(cw, r)
+
+		err := cw.Close()
+		if err != nil {
+			logging.FromContext(r.Context()).Error("error compressing response", "encoding", encoding, "err", err)
+		}
+	})
+}
+
+// decompressRequest swaps the request body for one that's decompressed and
+// limited to maxRequestBytes, before and after decompression, so a small
+// body can't expand into something huge.  If it returns false an error
+// response has already been written.
+func (c *Compressor) decompressRequest(w http.ResponseWriter, r *http.Request) bool {
+	contentEncoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if contentEncoding == "" || contentEncoding == Identity {
+		r.Header.Del("Content-Encoding")
+		return true
+	}
+
+	accepted := false
+	for _, encoding := range c.encodings {
+		accepted = accepted || encoding == contentEncoding
+	}
+	if !accepted {
+		// RFC 7694, tell the client what it could have sent instead
+		w.Header().Set("Accept-Encoding", strings.Join(c.encodings, ", "))
+		problem.Write(w, r, problem.New(problem.TypeUnsupported, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("unsupported Content-Encoding header: %q, use one of %s", contentEncoding, strings.Join(c.encodings, ", "))))
+		return false
+	}
+
+	compressed := http.MaxBytesReader(w, r.Body, c.maxRequestBytes)
+
+	var decompressed io.ReadCloser
+	var err error
+	switch contentEncoding {
+	case Gzip:
+		decompressed, err = gzip.NewReader(compressed)
+	case Brotli:
+		decompressed = io.NopCloser(brotli.NewReader(compressed))
+	case Zstd:
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(compressed,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(uint64(c.maxRequestBytes)),
+		)
+		if err == nil {
+			decompressed = decoder.IOReadCloser()
+		}
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Debug("error decompressing request body", "encoding", contentEncoding, "err", err)
+		problem.Write(w, r, problem.New(problem.TypeBadRequestBody, http.StatusBadRequest,
+			fmt.Sprintf("error decompressing request body: %v", err)))
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, readCloser{decompressed, closers{decompressed, r.Body}}, c.maxRequestBytes)
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+
+	return true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers closes all of them, returning the first error
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		err := c.Close()
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// compressWriter holds on to the start of the body until there's enough
+// of it to decide whether to compress
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	// ifNoneMatch is the request's header before its tags were trimmed
+	ifNoneMatch http.Header
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+
+	decided bool
+	enc     encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	// informational responses go straight through, they have no body
+	if status >= 100 && status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+
+	w.status = status
+	w.wroteHeader = true
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+
+		err := w.decide()
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressed or not, and whatever's been buffered
+func (w *compressWriter) decide() error {
+	w.decided = true
+	header := w.Header()
+
+	if w.shouldCompress() {
+		if header.Get("Content-Type") == "" {
+			// net/http would sniff the compressed bytes otherwise
+			header.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+
+		// the compressed body is a different representation, so it needs
+		// its own strong ETag
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", suffixETag(etag, w.encoding))
+		}
+
+		w.enc = getEncoder(w.encoding, w.ResponseWriter)
+	} else if w.status == http.StatusNotModified {
+		// a 304 has no body to compress, but it has to carry the ETag of
+		// the compressed copy the client already has
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			suffixed := suffixETag(etag, w.encoding)
+			if !conditional.IfNoneMatch(w.ifNoneMatch, suffixed) {
+				header.Set("ETag", suffixed)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// suffixETag marks a strong ETag as belonging to the representation
+// compressed with encoding
+func suffixETag(etag, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+func (w *compressWriter) shouldCompress() bool {
+	header := w.Header()
+
+	if len(w.buf) < w.minSize {
+		return false
+	}
+	// no body, or a part of one the client will put together with others
+	if w.status < 200 || w.status == http.StatusNoContent || w.status == http.StatusNotModified || w.status == http.StatusPartialContent {
+		return false
+	}
+	// the handler has compressed it already
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return Compressible(mediaType)
+}
+
+// Flush sends everything so far, compressing it first if it's being
+// compressed
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		err := w.decide()
+		if err != nil {
+			return
+		}
+	}
+	if w.enc != nil {
+		err := w.enc.Flush()
+		if err != nil {
+			return
+		}
+	}
+
+	// writers that can't flush just buffer, which is fine
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close finishes the response, it has to be called once the handler is done
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		err := w.decide()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.enc == nil {
+		return nil
+	}
+
+	err := w.enc.Close()
+	putEncoder(w.encoding, w.enc)
+	w.enc = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the real writer for deadlines
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,409 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"mycoolserver/internal/conditional"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestCompressor(t *testing.T) *Compressor {
+	t.Helper()
+
+	c, err := New(Options{Encodings: DefaultEncodings, MaxRequestBytes: 1024})
+	if err != nil {
+		t.Fatalf("error creating compressor: %v", err)
+	}
+	return c
+}
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := getEncoder(encoding, &buf)
+	_, err := enc.Write(data)
+	if err != nil {
+		t.Fatalf("error compressing: %v", err)
+	}
+	err = enc.Close()
+	if err != nil {
+		t.Fatalf("error compressing: %v", err)
+	}
+	putEncoder(encoding, enc)
+
+	return buf.Bytes()
+}
+
+func decompress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var r io.Reader
+	switch encoding {
+	case Gzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error decompressing: %v", err)
+		}
+		r = gr
+	case Brotli:
+		r = brotli.NewReader(bytes.NewReader(data))
+	case Zstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error decompressing: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return data
+	}
+
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error decompressing %s: %v", encoding, err)
+	}
+	return decompressed
+}
+
+func TestCompressResponses(t *testing.T) {
+	c := newTestCompressor(t)
+	large := []byte(`{"message": "` + strings.Repeat("hello ", 500) + `"}`)
+
+	tests := map[string]struct {
+		acceptEncoding string
+		method         string
+		status         int
+		header         map[string]string
+		body           []byte
+		// chunks writes the body a byte at a time
+		chunks   bool
+		expected string
+	}{
+		"zstd":               {acceptEncoding: "zstd", body: large, expected: Zstd},
+		"brotli":             {acceptEncoding: "br", body: large, expected: Brotli},
+		"gzip":               {acceptEncoding: "gzip", body: large, expected: Gzip},
+		"chunks":             {acceptEncoding: "gzip", body: large, chunks: true, expected: Gzip},
+		"errors":             {acceptEncoding: "gzip", status: http.StatusNotFound, body: large, expected: Gzip},
+		"no sniff":           {acceptEncoding: "gzip", header: map[string]string{"Content-Type": ""}, body: []byte(strings.Repeat("text ", 500)), expected: Gzip},
+		"small":              {acceptEncoding: "gzip", body: []byte(`{"message": "hi"}`)},
+		"no accept encoding": {body: large},
+		"image": {
+			acceptEncoding: "gzip",
+			header:         map[string]string{"Content-Type": "image/png"},
+			body:           large,
+		},
+		"already encoded": {
+			acceptEncoding: "gzip",
+			header:         map[string]string{"Content-Encoding": Brotli},
+			body:           compress(t, Brotli, large),
+			expected:       Brotli,
+		},
+		"no transform": {
+			acceptEncoding: "gzip",
+			header:         map[string]string{"Cache-Control": "no-transform"},
+			body:           large,
+		},
+		"partial": {acceptEncoding: "gzip", status: http.StatusPartialContent, body: large},
+		"head":    {acceptEncoding: "gzip", method: http.MethodHead},
+		"no body": {acceptEncoding: "gzip", status: http.StatusNoContent},
+	}
+
+	for name, test := range tests {
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "1")
+			for header, value := range test.header {
+				w.Header().Set(header, value)
+				if value == "" {
+					w.Header().Del(header)
+				}
+			}
+
+			status := test.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			w.WriteHeader(status)
+
+			if test.chunks {
+				for i := range test.body {
+					w.Write(test.body[i : i+1])
+				}
+				return
+			}
+			w.Write(test.body)
+		}))
+
+		method := test.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, "/", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Content-Encoding"); got != test.expected {
+			t.Errorf("%s: bad Content-Encoding, wanted: %q, got: %q", name, test.expected, got)
+		}
+		if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("%s: bad Vary, wanted: Accept-Encoding, got: %q", name, vary)
+		}
+		if test.status != 0 && w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d", name, test.status, w.Code)
+		}
+
+		body := w.Body.Bytes()
+		if test.expected != "" && test.expected != test.header["Content-Encoding"] {
+			if w.Header().Get("Content-Length") != "" {
+				t.Errorf("%s: Content-Length should be removed from compressed responses", name)
+			}
+			if len(body) >= len(test.body) {
+				t.Errorf("%s: body wasn't compressed, %d bytes became %d", name, len(test.body), len(body))
+			}
+			if w.Header().Get("Content-Type") == "" {
+				t.Errorf("%s: compressed responses need a Content-Type", name)
+			}
+			body = decompress(t, test.expected, body)
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Errorf("%s: bad body, wanted %d bytes, got %d", name, len(test.body), len(body))
+		}
+	}
+}
+
+func TestCompressedETags(t *testing.T) {
+	c := newTestCompressor(t)
+
+	var ifNoneMatch string
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(bytes.Repeat([]byte("a"), 2048))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", `"v0-gzip", "v0"`)
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if etag := w.Header().Get("ETag"); etag != `"v1-gzip"` {
+		t.Errorf("bad ETag, wanted: %q, got: %q", `"v1-gzip"`, etag)
+	}
+	if ifNoneMatch != `"v0", "v0"` {
+		t.Errorf("bad If-None-Match for the handler, wanted: %q, got: %q", `"v0", "v0"`, ifNoneMatch)
+	}
+}
+
+func TestNotModifiedETags(t *testing.T) {
+	c := newTestCompressor(t)
+
+	var ifNoneMatch string
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		etag := `"v1-br"`
+		w.Header().Set("ETag", etag)
+		if !conditional.IfNoneMatch(r.Header, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(bytes.Repeat([]byte("a"), 2048))
+	}))
+
+	get := func(acceptEncoding string, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// the handler's own tag ends in what looks like an encoding, it mustn't
+	// be mistaken for one we added
+	w := get("gzip", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag != `"v1-br-gzip"` {
+		t.Fatalf("bad first response, wanted: 200 with %q, got: %d with %q", `"v1-br-gzip"`, w.Code, etag)
+	}
+
+	w = get("gzip", etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("bad status revalidating, wanted: %d, got: %d", http.StatusNotModified, w.Code)
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("bad ETag on the 304, wanted: %q, got: %q", etag, got)
+	}
+	if ifNoneMatch != `"v1-br"` {
+		t.Errorf("bad If-None-Match for the handler, wanted: %q, got: %q", `"v1-br"`, ifNoneMatch)
+	}
+
+	// a copy fetched without compression revalidates as itself
+	w = get("gzip", `"v1-br"`)
+	if got := w.Header().Get("ETag"); w.Code != http.StatusNotModified || got != `"v1-br"` {
+		t.Errorf("bad uncompressed revalidation, wanted: 304 with %q, got: %d with %q", `"v1-br"`, w.Code, got)
+	}
+
+	// the gzip copy isn't the one a br client would get, so only the
+	// negotiated encoding's suffix is taken off
+	w = get("br", etag)
+	if w.Code != http.StatusOK || ifNoneMatch != etag {
+		t.Errorf("bad response to another encoding's tag, wanted: 200 with %q for the handler, got: %d with %q", etag, w.Code, ifNoneMatch)
+	}
+}
+
+func TestIfMatchAnyEncoding(t *testing.T) {
+	c := newTestCompressor(t)
+
+	var ifMatch string
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch = r.Header.Get("If-Match")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := map[string]struct {
+		acceptEncoding string
+		ifMatch        string
+		expected       string
+	}{
+		"no Accept-Encoding": {ifMatch: `"v1-gzip"`, expected: `"v1"`},
+		"another encoding":   {acceptEncoding: "br", ifMatch: `"v1-gzip"`, expected: `"v1"`},
+		"in a list":          {ifMatch: `"v1-zstd", "v2"`, expected: `"v1", "v2"`},
+		"weak":               {ifMatch: `W/"v1-gzip"`, expected: `W/"v1-gzip"`},
+		"not an encoding":    {ifMatch: `"v1-deflate"`, expected: `"v1-deflate"`},
+	}
+
+	for name, test := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		if test.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		r.Header.Set("If-Match", test.ifMatch)
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if ifMatch != test.expected {
+			t.Errorf("%s: bad If-Match for the handler, wanted: %q, got: %q", name, test.expected, ifMatch)
+		}
+	}
+}
+
+func TestDecompressRequests(t *testing.T) {
+	c := newTestCompressor(t)
+	body := []byte(`{"FirstName": "Ada"}`)
+
+	tests := map[string]struct {
+		contentEncoding string
+		body            []byte
+		status          int
+		// readErr is what the handler gets reading the body
+		readErr bool
+	}{
+		"none":     {body: body, status: http.StatusOK},
+		"identity": {contentEncoding: Identity, body: body, status: http.StatusOK},
+		"gzip":     {contentEncoding: Gzip, body: compress(t, Gzip, body), status: http.StatusOK},
+		"brotli":   {contentEncoding: Brotli, body: compress(t, Brotli, body), status: http.StatusOK},
+		"zstd":     {contentEncoding: "ZSTD", body: compress(t, Zstd, body), status: http.StatusOK},
+		"unknown":  {contentEncoding: "deflate", body: body, status: http.StatusUnsupportedMediaType},
+		"broken":   {contentEncoding: Gzip, body: body, status: http.StatusBadRequest},
+		// a few hundred bytes that decompress to far more than the limit
+		"bomb": {contentEncoding: Gzip, body: compress(t, Gzip, make([]byte, 1<<20)), status: http.StatusOK, readErr: true},
+	}
+
+	for name, test := range tests {
+		var got []byte
+		var readErr error
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, readErr = io.ReadAll(r.Body)
+			if r.Header.Get("Content-Encoding") != "" {
+				t.Errorf("%s: Content-Encoding should be removed once the body is decompressed", name)
+			}
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(test.body))
+		if test.contentEncoding != "" {
+			req.Header.Set("Content-Encoding", test.contentEncoding)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d\nbody: %s", name, test.status, w.Code, w.Body.String())
+			continue
+		}
+
+		switch {
+		case w.Code == http.StatusUnsupportedMediaType:
+			if accept := w.Header().Get("Accept-Encoding"); accept != "zstd, br, gzip" {
+				t.Errorf("%s: bad Accept-Encoding, wanted: %q, got: %q", name, "zstd, br, gzip", accept)
+			}
+			checkProblemType(t, name, w, problem.TypeUnsupported)
+		case w.Code == http.StatusBadRequest:
+			checkProblemType(t, name, w, problem.TypeBadRequestBody)
+		case test.readErr:
+			var maxBytesErr *http.MaxBytesError
+			if !errors.As(readErr, &maxBytesErr) {
+				t.Errorf("%s: bad read error, wanted: a MaxBytesError, got: %v", name, readErr)
+			}
+			if len(got) > 1024 {
+				t.Errorf("%s: read %d bytes, more than the 1024 allowed", name, len(got))
+			}
+		default:
+			if readErr != nil || !bytes.Equal(got, body) {
+				t.Errorf("%s: bad body, wanted: %q, got: %q (%v)", name, body, got, readErr)
+			}
+		}
+	}
+}
+
+func checkProblemType(t *testing.T, name string, w *httptest.ResponseRecorder, problemType string) {
+	t.Helper()
+
+	var p problem.Problem
+	err := json.Unmarshal(w.Body.Bytes(), &p)
+	if err != nil {
+		t.Fatalf("%s: error decoding problem: %v", name, err)
+	}
+	if p.Type != problemType {
+		t.Errorf("%s: bad problem type, wanted: %q, got: %q", name, problemType, p.Type)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := map[string]Options{
+		"no encodings":     {MaxRequestBytes: 1},
+		"unknown encoding": {Encodings: []string{"deflate"}, MaxRequestBytes: 1},
+		"no request limit": {Encodings: DefaultEncodings},
+	}
+
+	for name, opts := range tests {
+		_, err := New(opts)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
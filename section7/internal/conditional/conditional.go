@@ -0,0 +1,157 @@
+// Package conditional evaluates the If-Match and If-None-Match headers of
+// RFC 9110 against a resource's entity tag.
+package conditional
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Strong returns opaque as a strong entity tag, it mustn't contain a double
+// quote
+func Strong(opaque string) string {
+	return `"` + opaque + `"`
+}
+
+// entityTag is one entry of an If-Match or If-None-Match list
+type entityTag struct {
+	weak   bool
+	opaque string
+}
+
+// parse reads a list of entity tags from every value of a header.
+// wildcard is true for "*", entries that aren't entity tags are skipped so
+// they match nothing.
+func parse(values []string) (tags []entityTag, wildcard bool) {
+	for _, value := range values {
+		for rest := value; rest != ""; {
+			rest = strings.TrimLeft(rest, " \t,")
+			if rest == "" {
+				break
+			}
+
+			if rest[0] == '*' {
+				wildcard = true
+				rest = rest[1:]
+				continue
+			}
+
+			var tag entityTag
+			if strings.HasPrefix(rest, "W/") {
+				tag.weak = true
+				rest = rest[2:]
+			}
+
+			// commas are allowed inside the quotes, so the list can't be
+			// split on them first
+			if !strings.HasPrefix(rest, `"`) {
+				_, rest, _ = strings.Cut(rest, ",")
+				continue
+			}
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+
+			tag.opaque = rest[1 : end+1]
+			tags = append(tags, tag)
+			rest = rest[end+2:]
+		}
+	}
+
+	return tags, wildcard
+}
+
+// IfMatch reports whether the If-Match header lets a change to a resource
+// whose current tag is etag go ahead.  It compares strongly, as RFC 9110
+// requires, so weak tags never match.  It's true when there's no If-Match
+// header.
+func IfMatch(header http.Header, etag string) bool {
+	values := header.Values("If-Match")
+	if len(values) == 0 {
+		return true
+	}
+
+	current, ok := parseOne(etag)
+	if !ok {
+		return false
+	}
+
+	tags, wildcard := parse(values)
+	if wildcard {
+		return true
+	}
+	for _, tag := range tags {
+		if !tag.weak && !current.weak && tag.opaque == current.opaque {
+			return true
+		}
+	}
+	return false
+}
+
+// IfNoneMatch reports whether the If-None-Match header lets a request for a
+// resource whose current tag is etag go ahead.  It compares weakly, so when
+// it's false for a GET or HEAD the client's copy is still good and gets a
+// 304.  It's true when there's no If-None-Match header.
+func IfNoneMatch(header http.Header, etag string) bool {
+	values := header.Values("If-None-Match")
+	if len(values) == 0 {
+		return true
+	}
+
+	current, ok := parseOne(etag)
+	if !ok {
+		return true
+	}
+
+	tags, wildcard := parse(values)
+	if wildcard {
+		return false
+	}
+	for _, tag := range tags {
+		if tag.opaque == current.opaque {
+			return false
+		}
+	}
+	return true
+}
+
+// TrimSuffix removes suffix from the end of the strong entity tags in the
+// named header, for undoing something added to a tag after the handler made
+// it.  It reports whether any tag had it, entries that aren't entity tags
+// are dropped since they match nothing anyway.
+func TrimSuffix(header http.Header, name, suffix string) bool {
+	tags, wildcard := parse(header.Values(name))
+
+	trimmed := false
+	list := make([]string, 0, len(tags)+1)
+	if wildcard {
+		list = append(list, "*")
+	}
+	for _, tag := range tags {
+		if !tag.weak && strings.HasSuffix(tag.opaque, suffix) && len(tag.opaque) > len(suffix) {
+			tag.opaque = strings.TrimSuffix(tag.opaque, suffix)
+			trimmed = true
+		}
+
+		if tag.weak {
+			list = append(list, "W/"+Strong(tag.opaque))
+		} else {
+			list = append(list, Strong(tag.opaque))
+		}
+	}
+
+	if trimmed {
+		header.Set(name, strings.Join(list, ", "))
+	}
+	return trimmed
+}
+
+// parseOne reads the single tag a resource has
+func parseOne(etag string) (entityTag, bool) {
+	tags, _ := parse([]string{etag})
+	if len(tags) != 1 {
+		return entityTag{}, false
+	}
+	return tags[0], true
+}
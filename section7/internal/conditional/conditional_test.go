@@ -0,0 +1,88 @@
+package conditional
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	etag := Strong("3-json")
+
+	tests := map[string]struct {
+		values   []string
+		expected bool
+	}{
+		"no header":       {values: nil, expected: true},
+		"match":           {values: []string{`"3-json"`}, expected: true},
+		"stale":           {values: []string{`"2-json"`}, expected: false},
+		"wildcard":        {values: []string{"*"}, expected: true},
+		"in a list":       {values: []string{`"1-json", "3-json"`}, expected: true},
+		"across headers":  {values: []string{`"1-json"`, `"3-json"`}, expected: true},
+		"weak":            {values: []string{`W/"3-json"`}, expected: false},
+		"comma in tag":    {values: []string{`"3,json", "3-json"`}, expected: true},
+		"unquoted":        {values: []string{`3-json`}, expected: false},
+		"unterminated":    {values: []string{`"3-json`}, expected: false},
+		"junk then match": {values: []string{`nope, "3-json"`}, expected: true},
+	}
+
+	for name, test := range tests {
+		header := http.Header{"If-Match": test.values}
+		if got := IfMatch(header, etag); got != test.expected {
+			t.Errorf("%s: bad result, wanted: %v, got: %v", name, test.expected, got)
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	etag := Strong("3-json")
+
+	tests := map[string]struct {
+		values   []string
+		expected bool
+	}{
+		"no header": {values: nil, expected: true},
+		"match":     {values: []string{`"3-json"`}, expected: false},
+		"stale":     {values: []string{`"2-json"`}, expected: true},
+		"wildcard":  {values: []string{"*"}, expected: false},
+		"in a list": {values: []string{`"1-json","3-json"`}, expected: false},
+		"weak":      {values: []string{`W/"3-json"`}, expected: false},
+		"other":     {values: []string{`"3-xml"`}, expected: true},
+	}
+
+	for name, test := range tests {
+		header := http.Header{"If-None-Match": test.values}
+		if got := IfNoneMatch(header, etag); got != test.expected {
+			t.Errorf("%s: bad result, wanted: %v, got: %v", name, test.expected, got)
+		}
+	}
+}
+
+func TestTrimSuffix(t *testing.T) {
+	tests := map[string]struct {
+		values   []string
+		trimmed  bool
+		expected []string
+	}{
+		"no header":       {values: nil},
+		"suffixed":        {values: []string{`"3-json-gzip"`}, trimmed: true, expected: []string{`"3-json"`}},
+		"in a list":       {values: []string{`"2-json", "3-json-gzip"`}, trimmed: true, expected: []string{`"2-json", "3-json"`}},
+		"across headers":  {values: []string{`"2-json-gzip"`, `*`}, trimmed: true, expected: []string{`*, "2-json"`}},
+		"not at the end":  {values: []string{`"3-gzip-json"`}, expected: []string{`"3-gzip-json"`}},
+		"weak":            {values: []string{`W/"3-json-gzip"`}, expected: []string{`W/"3-json-gzip"`}},
+		"weak kept":       {values: []string{`W/"2-json", "3-json-gzip"`}, trimmed: true, expected: []string{`W/"2-json", "3-json"`}},
+		"only the suffix": {values: []string{`"-gzip"`}, expected: []string{`"-gzip"`}},
+	}
+
+	for name, test := range tests {
+		header := http.Header{"If-None-Match": test.values}
+		trimmed := TrimSuffix(header, "If-None-Match", "-gzip")
+
+		if trimmed != test.trimmed {
+			t.Errorf("%s: bad trimmed, wanted: %v, got: %v", name, test.trimmed, trimmed)
+		}
+		if got := header.Values("If-None-Match"); strings.Join(got, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("%s: bad header, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+}
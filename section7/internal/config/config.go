@@ -0,0 +1,857 @@
+// Package config loads the server settings.  Every setting has a default and
+// can be overridden, lowest to highest priority, by a YAML config file,
+// environment variables and command line flags.
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mycoolserver/internal/compression"
+	"mycoolserver/internal/cors"
+	"mycoolserver/internal/tlsconfig"
+	"mycoolserver/internal/users"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable the config reads,
+// MYCOOLSERVER_CONFIG names the config file.
+const EnvPrefix = "MYCOOLSERVER_"
+
+type Config struct {
+	Addr            string        `yaml:"addr"`
+	MaxBodyBytes    int64         `yaml:"max_body_bytes"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// DrainDelay is how long /readyz fails after SIGTERM before the server
+	// stops accepting connections, so load balancers notice first
+	DrainDelay time.Duration `yaml:"drain_delay"`
+	// RequestTimeout bounds how long a handler works on a request, 0 means
+	// no limit
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// RouteTimeouts overrides RequestTimeout for single routes, keyed by the
+	// pattern the route is registered with, like "GET /users"
+	RouteTimeouts map[string]time.Duration `yaml:"route_timeouts,omitempty"`
+	// ValidateRequests checks path and query parameters, headers and bodies
+	// against the OpenAPI document before handlers see them
+	ValidateRequests bool              `yaml:"validate_requests"`
+	LogLevel         string            `yaml:"log_level"`
+	Store            StoreConfig       `yaml:"store"`
+	TLS              TLSConfig         `yaml:"tls"`
+	Auth             AuthConfig        `yaml:"auth"`
+	RateLimit        RateLimitConfig   `yaml:"rate_limit"`
+	CORS             CORSConfig        `yaml:"cors"`
+	Compression      CompressionConfig `yaml:"compression"`
+
+	// PrintConfig is only settable by flag, it asks main to print the
+	// effective config and exit
+	PrintConfig bool `yaml:"-"`
+}
+
+type StoreConfig struct {
+	// Type is memory or file
+	Type         string `yaml:"type"`
+	Path         string `yaml:"path"`
+	CompactAfter int    `yaml:"compact_after"`
+	SyncWrites   bool   `yaml:"sync_writes"`
+}
+
+// TLSConfig turns on HTTPS when both files are set
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MinVersion is 1.2 or 1.3
+	MinVersion string `yaml:"min_version"`
+	// ClientAuth is none, request or require, the last two check client
+	// certificates against ClientCAFile
+	ClientAuth   string `yaml:"client_auth"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// RedirectAddr, if set, is a plain HTTP listener that redirects to HTTPS
+	RedirectAddr string `yaml:"redirect_addr"`
+	// ReloadInterval is how often the certificate files are checked for
+	// changes, 0 only reloads on SIGHUP
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// AuthConfig lists the credentials protected routes accept.  With none of
+// them set every protected route answers 401, Disabled opens them up instead.
+//
+// A fresh install has no users to log in as, so AdminKeySHA256 is how it
+// gets its first admin: hash a random key with
+//
+//	printf %s "$KEY" | sha256sum
+//
+// start the server with MYCOOLSERVER_ADMIN_KEY_SHA256 set to the hash, then
+// send the key in X-API-Key to create a user with POST /users and make them
+// an admin with PUT /users/{id}/role.  Unset it again once they can log in.
+type AuthConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// AdminKeySHA256 is the hex SHA-256 of an API key with the admin role,
+	// its principal is AdminKeyName
+	AdminKeySHA256 string `yaml:"admin_key_sha256,omitempty"`
+	// APIKeys can only be set in the config file
+	APIKeys []APIKeyConfig `yaml:"api_keys,omitempty"`
+	JWT     JWTConfig      `yaml:"jwt"`
+	// SessionTTL is how long a POST /login lasts
+	SessionTTL time.Duration `yaml:"session_ttl"`
+}
+
+// AdminKeyName is the principal AdminKeySHA256 authenticates as, API keys
+// can't use it too
+const AdminKeyName = "admin"
+
+// APIKeyConfig holds the SHA-256 of a key rather than the key, so the config
+// file isn't a secret.  Role and Scopes both grant actions, see the policy
+// package.
+type APIKeyConfig struct {
+	Name   string   `yaml:"name"`
+	SHA256 string   `yaml:"sha256"`
+	Role   string   `yaml:"role,omitempty"`
+	Scopes []string `yaml:"scopes,omitempty"`
+}
+
+// RateLimitConfig gives every client a token bucket per route.  A client is
+// the principal on protected routes and the remote IP on public ones, and
+// requests that fail authentication use up a bucket for their IP too.
+type RateLimitConfig struct {
+	// Default applies to routes not in Routes
+	Default RateLimit `yaml:"default"`
+	// Routes overrides Default for single routes, keyed by the pattern the
+	// route is registered with.  The config file adds to the default routes,
+	// a rate of 0 turns one off.
+	Routes map[string]RateLimit `yaml:"routes,omitempty"`
+	// MaxClients bounds the buckets each route keeps, the least recently
+	// seen client's is dropped first
+	MaxClients int `yaml:"max_clients"`
+}
+
+// RateLimit lets a client make Burst requests at once and then Rate a
+// second, a zero Rate turns it off
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// CORSConfig lets browsers on other origins call the server, it's off until
+// AllowedOrigins has something in it
+type CORSConfig struct {
+	// AllowedOrigins are like https://app.example.com, https://*.example.com
+	// for every subdomain or * for anywhere
+	AllowedOrigins []string `yaml:"allowed_origins,omitempty"`
+	AllowedMethods []string `yaml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	ExposedHeaders []string `yaml:"exposed_headers"`
+	// AllowCredentials sends cookies and Authorization headers, it can't be
+	// used with the * origin.  Pages on the allowed origins can then change
+	// things with the session cookie, which is otherwise only accepted from
+	// the server's own origin.
+	AllowCredentials bool `yaml:"allow_credentials"`
+	// MaxAge is how long browsers cache a preflight
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Enabled reports whether any origin is allowed
+func (c CORSConfig) Enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+// JWTConfig turns on bearer tokens when either key file is set
+type JWTConfig struct {
+	// HMACSecretFile holds the HS256 secret, at least 32 bytes
+	HMACSecretFile string `yaml:"hmac_secret_file"`
+	// RSAPublicKeyFile is a PEM public key for RS256
+	RSAPublicKeyFile string `yaml:"rsa_public_key_file"`
+	// Issuer and Audience, if set, have to match the token's iss and aud
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+}
+
+// CompressionConfig picks how responses are compressed, request bodies are
+// accepted in any of Encodings too
+type CompressionConfig struct {
+	// Encodings are gzip, br and zstd in the server's order of preference,
+	// empty turns compression off
+	Encodings []string `yaml:"encodings"`
+	// MinSize is the smallest response body worth compressing
+	MinSize int `yaml:"min_size"`
+}
+
+// Enabled reports whether responses are compressed
+func (c CompressionConfig) Enabled() bool {
+	return len(c.Encodings) > 0
+}
+
+// Enabled reports whether bearer tokens are accepted
+func (j JWTConfig) Enabled() bool {
+	return j.HMACSecretFile != "" || j.RSAPublicKeyFile != ""
+}
+
+// Enabled reports whether the server should use HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+func Default() *Config {
+	return &Config{
+		Addr:            ":8080",
+		MaxBodyBytes:    1048576,
+		ShutdownTimeout: 10 * time.Second,
+		DrainDelay:      5 * time.Second,
+		RequestTimeout:  30 * time.Second,
+		LogLevel:        "info",
+		Store: StoreConfig{
+			Type:         "file",
+			Path:         "users.json",
+			CompactAfter: 1000,
+			SyncWrites:   true,
+		},
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ClientAuth:     "none",
+			ReloadInterval: time.Minute,
+		},
+		Auth: AuthConfig{
+			SessionTTL: 24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Default: RateLimit{Rate: 20, Burst: 40},
+			// creating users and logging in are what a flood or a password
+			// guesser would go after
+			Routes: map[string]RateLimit{
+				"POST /users":    {Rate: 1, Burst: 5},
+				"POST /add-user": {Rate: 1, Burst: 5},
+				"POST /login":    {Rate: 0.2, Burst: 5},
+			},
+			MaxClients: 10000,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{
+				"Authorization", "Content-Type", "Content-Encoding", "X-API-Key", "X-Request-ID",
+				"If-Match", "If-None-Match", "userFirst", "userLast",
+			},
+			ExposedHeaders: []string{
+				"X-Request-ID", "Location", "Deprecation", "Link", "ETag",
+				"Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+			},
+			MaxAge: 10 * time.Minute,
+		},
+		Compression: CompressionConfig{
+			Encodings: []string{compression.Zstd, compression.Brotli, compression.Gzip},
+			MinSize:   compression.DefaultMinSize,
+		},
+	}
+}
+
+// setting ties one config value to its flag and environment variable, the
+// environment variable is EnvPrefix plus the flag name upper cased with
+// dashes turned into underscores
+type setting struct {
+	flag  string
+	usage string
+	// boolean flags can be given without a value
+	boolean bool
+	// set parses a flag or environment value into the config
+	set func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"addr", "address to listen on", false, func(c *Config, v string) error {
+		c.Addr = v
+		return nil
+	}},
+	{"max-body-bytes", "largest request body accepted", false, func(c *Config, v string) error {
+		return parseInt64(&c.MaxBodyBytes, v)
+	}},
+	{"shutdown-timeout", "how long to wait for requests to finish on shutdown", false, func(c *Config, v string) error {
+		return parseDuration(&c.ShutdownTimeout, v)
+	}},
+	{"drain-delay", "how long to report not ready after SIGTERM before shutting down", false, func(c *Config, v string) error {
+		return parseDuration(&c.DrainDelay, v)
+	}},
+	{"request-timeout", "how long a request may take before it's abandoned, 0 means no limit", false, func(c *Config, v string) error {
+		return parseDuration(&c.RequestTimeout, v)
+	}},
+	{"route-timeouts", `per route request timeouts, comma separated like "GET /users=5s,POST /users=2s"`, false, func(c *Config, v string) error {
+		return parseRouteTimeouts(&c.RouteTimeouts, v)
+	}},
+	{"validate-requests", "reject requests that don't match the OpenAPI document before they reach a handler", true, func(c *Config, v string) error {
+		return parseBool(&c.ValidateRequests, v)
+	}},
+	{"log-level", "debug, info, warn or error", false, func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"store", "user storage backend: memory or file", false, func(c *Config, v string) error {
+		c.Store.Type = v
+		return nil
+	}},
+	{"store-path", "path of the user snapshot when using the file backend, the log is kept next to it", false, func(c *Config, v string) error {
+		c.Store.Path = v
+		return nil
+	}},
+	{"store-compact-after", "log records written before the file backend takes a new snapshot, 0 disables", false, func(c *Config, v string) error {
+		return parseInt(&c.Store.CompactAfter, v)
+	}},
+	{"store-sync-writes", "fsync every write to the file backend", true, func(c *Config, v string) error {
+		return parseBool(&c.Store.SyncWrites, v)
+	}},
+	{"tls-cert", "TLS certificate file, enables HTTPS together with tls-key", false, func(c *Config, v string) error {
+		c.TLS.CertFile = v
+		return nil
+	}},
+	{"tls-key", "TLS private key file", false, func(c *Config, v string) error {
+		c.TLS.KeyFile = v
+		return nil
+	}},
+	{"tls-min-version", "oldest TLS version accepted: 1.2 or 1.3", false, func(c *Config, v string) error {
+		c.TLS.MinVersion = v
+		return nil
+	}},
+	{"tls-client-auth", "client certificates: none, request or require", false, func(c *Config, v string) error {
+		c.TLS.ClientAuth = v
+		return nil
+	}},
+	{"tls-client-ca", "CA bundle that client certificates are checked against", false, func(c *Config, v string) error {
+		c.TLS.ClientCAFile = v
+		return nil
+	}},
+	{"tls-redirect-addr", "address for a plain HTTP listener that redirects to HTTPS, empty disables", false, func(c *Config, v string) error {
+		c.TLS.RedirectAddr = v
+		return nil
+	}},
+	{"tls-reload-interval", "how often to check the certificate files for changes, 0 only reloads on SIGHUP", false, func(c *Config, v string) error {
+		return parseDuration(&c.TLS.ReloadInterval, v)
+	}},
+	{"auth-disabled", "let requests through to protected routes without credentials", true, func(c *Config, v string) error {
+		return parseBool(&c.Auth.Disabled, v)
+	}},
+	{"admin-key-sha256", "hex SHA-256 of an API key with the admin role, for creating the first admin", false, func(c *Config, v string) error {
+		c.Auth.AdminKeySHA256 = v
+		return nil
+	}},
+	{"session-ttl", "how long a login session lasts", false, func(c *Config, v string) error {
+		return parseDuration(&c.Auth.SessionTTL, v)
+	}},
+	{"jwt-hmac-secret-file", "file holding the secret for HS256 bearer tokens", false, func(c *Config, v string) error {
+		c.Auth.JWT.HMACSecretFile = v
+		return nil
+	}},
+	{"jwt-rsa-public-key-file", "PEM public key for RS256 bearer tokens", false, func(c *Config, v string) error {
+		c.Auth.JWT.RSAPublicKeyFile = v
+		return nil
+	}},
+	{"jwt-issuer", "iss claim bearer tokens must have, empty accepts any", false, func(c *Config, v string) error {
+		c.Auth.JWT.Issuer = v
+		return nil
+	}},
+	{"jwt-audience", "aud claim bearer tokens must include, empty accepts any", false, func(c *Config, v string) error {
+		c.Auth.JWT.Audience = v
+		return nil
+	}},
+	{"rate-limit", `requests a second and burst for each client on routes without their own limit, like "20/40", 0 disables`, false, func(c *Config, v string) error {
+		return parseRateLimit(&c.RateLimit.Default, v)
+	}},
+	{"route-rate-limits", `per route rate limits, comma separated like "POST /users=1/5,POST /login=0.2/5"`, false, func(c *Config, v string) error {
+		return parseRouteRateLimits(&c.RateLimit.Routes, v)
+	}},
+	{"rate-limit-max-clients", "clients tracked per route before the least recently seen is forgotten", false, func(c *Config, v string) error {
+		return parseInt(&c.RateLimit.MaxClients, v)
+	}},
+	{"cors-allowed-origins", "comma separated origins browsers may call from, like https://*.example.com, empty disables CORS", false, func(c *Config, v string) error {
+		c.CORS.AllowedOrigins = parseList(v)
+		return nil
+	}},
+	{"cors-allowed-methods", "comma separated methods browsers may use from other origins", false, func(c *Config, v string) error {
+		c.CORS.AllowedMethods = parseList(v)
+		return nil
+	}},
+	{"cors-allowed-headers", "comma separated request headers browsers may send from other origins", false, func(c *Config, v string) error {
+		c.CORS.AllowedHeaders = parseList(v)
+		return nil
+	}},
+	{"cors-exposed-headers", "comma separated response headers scripts on other origins may read", false, func(c *Config, v string) error {
+		c.CORS.ExposedHeaders = parseList(v)
+		return nil
+	}},
+	{"cors-allow-credentials", "let browsers send cookies and credentials from other origins", true, func(c *Config, v string) error {
+		return parseBool(&c.CORS.AllowCredentials, v)
+	}},
+	{"cors-max-age", "how long browsers may cache a CORS preflight", false, func(c *Config, v string) error {
+		return parseDuration(&c.CORS.MaxAge, v)
+	}},
+	{"compression-encodings", "comma separated encodings to compress responses with, best first, from zstd, br and gzip, empty disables", false, func(c *Config, v string) error {
+		c.Compression.Encodings = parseList(v)
+		return nil
+	}},
+	{"compression-min-size", "smallest response body in bytes worth compressing", false, func(c *Config, v string) error {
+		return parseInt(&c.Compression.MinSize, v)
+	}},
+}
+
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load builds the config from defaults, the config file, the environment and
+// args, which shouldn't include the program name.  getenv is os.Getenv
+// outside of tests.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	var configPath string
+	flagValues := make(map[string]string)
+
+	fs := newFlagSet(c, &configPath, getenv(EnvPrefix+"CONFIG"), flagValues)
+	fs.SetOutput(io.Discard)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if configPath != "" {
+		err = c.loadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		value := getenv(envName(s.flag))
+		if value == "" {
+			continue
+		}
+
+		err = s.set(c, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envName(s.flag), err)
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := flagValues[s.flag]
+		if !ok {
+			continue
+		}
+
+		err = s.set(c, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s: %w", s.flag, err)
+		}
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Usage writes the flag help, including the environment variable for each
+// flag, to w.
+func Usage(w io.Writer) {
+	var configPath string
+	fs := newFlagSet(Default(), &configPath, "", make(map[string]string))
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// newFlagSet records the values of setting flags in flagValues rather than
+// applying them right away, Load applies them last so they win over the file
+// and the environment no matter where they were parsed.
+func newFlagSet(c *Config, configPath *string, defaultConfigPath string, flagValues map[string]string) *flag.FlagSet {
+	fs := flag.NewFlagSet("mycoolserver", flag.ContinueOnError)
+
+	fs.StringVar(configPath, "config", defaultConfigPath, "YAML config file, env "+EnvPrefix+"CONFIG")
+	fs.BoolVar(&c.PrintConfig, "print-config", false, "print the effective config and exit")
+
+	for _, s := range settings {
+		name := s.flag
+		record := func(v string) error {
+			flagValues[name] = v
+			return nil
+		}
+
+		if s.boolean {
+			fs.BoolFunc(name, s.usage+", env "+envName(name), record)
+		} else {
+			fs.Func(name, s.usage+", env "+envName(name), record)
+		}
+	}
+
+	return fs
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr must not be empty"))
+	}
+
+	if c.MaxBodyBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max_body_bytes must be positive, got %d", c.MaxBodyBytes))
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be positive, got %s", c.ShutdownTimeout))
+	}
+
+	if c.DrainDelay < 0 {
+		errs = append(errs, fmt.Errorf("drain_delay must not be negative, got %s", c.DrainDelay))
+	}
+
+	if c.RequestTimeout < 0 {
+		errs = append(errs, fmt.Errorf("request_timeout must not be negative, got %s", c.RequestTimeout))
+	}
+
+	for pattern, timeout := range c.RouteTimeouts {
+		if timeout < 0 {
+			errs = append(errs, fmt.Errorf("route_timeouts[%q] must not be negative, got %s", pattern, timeout))
+		}
+	}
+
+	_, err := c.SlogLevel()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.Store.Type {
+	case "memory":
+	case "file":
+		if c.Store.Path == "" {
+			errs = append(errs, errors.New("store.path is required for the file store"))
+		}
+		if c.Store.CompactAfter < 0 {
+			errs = append(errs, fmt.Errorf("store.compact_after must not be negative, got %d", c.Store.CompactAfter))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown store.type: %q", c.Store.Type))
+	}
+
+	errs = append(errs, c.TLS.validate()...)
+	errs = append(errs, c.Auth.validate()...)
+	errs = append(errs, c.RateLimit.validate()...)
+	errs = append(errs, c.CORS.validate()...)
+	errs = append(errs, c.Compression.validate()...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (t TLSConfig) validate() []error {
+	var errs []error
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("tls.cert_file and tls.key_file must be set together"))
+	}
+
+	_, err := tlsconfig.ParseVersion(t.MinVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid tls.min_version: %w", err))
+	}
+
+	switch t.ClientAuth {
+	case tlsconfig.ClientAuthNone:
+	case tlsconfig.ClientAuthRequest, tlsconfig.ClientAuthRequire:
+		if t.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("tls.client_ca_file is required when tls.client_auth is %s", t.ClientAuth))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown tls.client_auth: %q", t.ClientAuth))
+	}
+
+	if t.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("tls.reload_interval must not be negative, got %s", t.ReloadInterval))
+	}
+
+	if !t.Enabled() && (t.RedirectAddr != "" || t.ClientAuth != tlsconfig.ClientAuthNone) {
+		errs = append(errs, errors.New("tls.redirect_addr and tls.client_auth need tls.cert_file and tls.key_file"))
+	}
+
+	return errs
+}
+
+func (a AuthConfig) validate() []error {
+	var errs []error
+
+	names := make(map[string]bool)
+	if a.AdminKeySHA256 != "" {
+		hash, err := hex.DecodeString(a.AdminKeySHA256)
+		if err != nil || len(hash) != 32 {
+			errs = append(errs, errors.New("auth.admin_key_sha256 must be 64 hex characters"))
+		}
+		names[AdminKeyName] = true
+	}
+
+	for i, key := range a.APIKeys {
+		if key.Name == "" {
+			errs = append(errs, fmt.Errorf("auth.api_keys[%d].name must not be empty", i))
+		} else if names[key.Name] {
+			errs = append(errs, fmt.Errorf("auth.api_keys[%d].name %q is used twice", i, key.Name))
+		}
+		names[key.Name] = true
+
+		hash, err := hex.DecodeString(key.SHA256)
+		if err != nil || len(hash) != 32 {
+			errs = append(errs, fmt.Errorf("auth.api_keys[%d].sha256 must be 64 hex characters", i))
+		}
+
+		if !users.Role(key.Role).Valid() {
+			errs = append(errs, fmt.Errorf("auth.api_keys[%d].role must be viewer, editor or admin, got %q", i, key.Role))
+		}
+	}
+
+	if a.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf("auth.session_ttl must be positive, got %s", a.SessionTTL))
+	}
+
+	if !a.JWT.Enabled() && (a.JWT.Issuer != "" || a.JWT.Audience != "") {
+		errs = append(errs, errors.New("auth.jwt.issuer and auth.jwt.audience need a JWT key file"))
+	}
+
+	return errs
+}
+
+func (r RateLimitConfig) validate() []error {
+	var errs []error
+
+	errs = append(errs, r.Default.validate("rate_limit.default")...)
+	for pattern, limit := range r.Routes {
+		errs = append(errs, limit.validate(fmt.Sprintf("rate_limit.routes[%q]", pattern))...)
+	}
+
+	if r.MaxClients <= 0 {
+		errs = append(errs, fmt.Errorf("rate_limit.max_clients must be positive, got %d", r.MaxClients))
+	}
+
+	return errs
+}
+
+func (l RateLimit) validate(name string) []error {
+	var errs []error
+
+	if l.Rate < 0 {
+		errs = append(errs, fmt.Errorf("%s.rate must not be negative, got %v", name, l.Rate))
+	}
+	if l.Rate > 0 && l.Burst < 1 {
+		errs = append(errs, fmt.Errorf("%s.burst must be at least 1, got %d", name, l.Burst))
+	}
+
+	return errs
+}
+
+func (c CORSConfig) validate() []error {
+	var errs []error
+
+	for i, origin := range c.AllowedOrigins {
+		err := cors.ValidateOrigin(origin)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cors.allowed_origins[%d]: %w", i, err))
+		}
+		if origin == "*" && c.AllowCredentials {
+			errs = append(errs, errors.New("cors.allowed_origins can't include * when cors.allow_credentials is set"))
+		}
+	}
+
+	if c.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("cors.max_age must not be negative, got %s", c.MaxAge))
+	}
+
+	return errs
+}
+
+func (c CompressionConfig) validate() []error {
+	var errs []error
+
+	for i, encoding := range c.Encodings {
+		err := compression.ValidateEncoding(encoding)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("compression.encodings[%d]: %w", i, err))
+		}
+	}
+
+	if c.MinSize < 0 {
+		errs = append(errs, fmt.Errorf("compression.min_size must not be negative, got %d", c.MinSize))
+	}
+
+	return errs
+}
+
+func (c *Config) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	if err != nil {
+		return level, fmt.Errorf("invalid log_level: %q", c.LogLevel)
+	}
+	return level, nil
+}
+
+// Write prints the config as YAML, in the same format the config file uses.
+func (c *Config) Write(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(c)
+	if err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+func parseInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+func parseInt64(dst *int64, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+// parseRouteTimeouts replaces the whole map, so a flag or environment value
+// doesn't merge with routes from the config file
+func parseRouteTimeouts(dst *map[string]time.Duration, v string) error {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range strings.Split(v, ",") {
+		pattern, duration, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return fmt.Errorf("expected pattern=duration, got %q", entry)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil {
+			return err
+		}
+		timeouts[pattern] = d
+	}
+
+	*dst = timeouts
+	return nil
+}
+
+// parseRateLimit reads rate/burst, a lone 0 turns the limit off
+func parseRateLimit(dst *RateLimit, v string) error {
+	v = strings.TrimSpace(v)
+	if v == "0" {
+		*dst = RateLimit{}
+		return nil
+	}
+
+	rate, burst, ok := strings.Cut(v, "/")
+	if !ok {
+		return fmt.Errorf("expected rate/burst, got %q", v)
+	}
+
+	var limit RateLimit
+	var err error
+	limit.Rate, err = strconv.ParseFloat(strings.TrimSpace(rate), 64)
+	if err != nil {
+		return err
+	}
+	limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst))
+	if err != nil {
+		return err
+	}
+
+	*dst = limit
+	return nil
+}
+
+// parseRouteRateLimits replaces the whole map like parseRouteTimeouts
+func parseRouteRateLimits(dst *map[string]RateLimit, v string) error {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(v, ",") {
+		pattern, value, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return fmt.Errorf("expected pattern=rate/burst, got %q", entry)
+		}
+
+		var limit RateLimit
+		err := parseRateLimit(&limit, value)
+		if err != nil {
+			return err
+		}
+		limits[pattern] = limit
+	}
+
+	*dst = limits
+	return nil
+}
+
+// parseList splits a comma separated value, dropping empty entries
+func parseList(v string) []string {
+	var list []string
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func parseBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+func parseDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*dst = d
+	return nil
+}
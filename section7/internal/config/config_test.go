@@ -0,0 +1,269 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatalf("error writing config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load(nil, testEnv(nil))
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	if !reflect.DeepEqual(Default(), c) {
+		t.Errorf("bad config\nwanted: %+v\ngot: %+v", Default(), c)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+addr: ":9000"
+max_body_bytes: 2048
+shutdown_timeout: 30s
+log_level: debug
+store:
+  type: memory
+`)
+
+	// the file sets everything, the environment overrides some of it and
+	// the flags override some of that
+	env := testEnv(map[string]string{
+		"MYCOOLSERVER_CONFIG":           path,
+		"MYCOOLSERVER_ADDR":             ":9001",
+		"MYCOOLSERVER_MAX_BODY_BYTES":   "4096",
+		"MYCOOLSERVER_STORE":            "file",
+		"MYCOOLSERVER_STORE_PATH":       "/tmp/env-users.json",
+		"MYCOOLSERVER_SHUTDOWN_TIMEOUT": "",
+	})
+
+	c, err := Load([]string{
+		"-addr", ":9002", "-store-sync-writes=false", "-route-timeouts", "GET /users=5s, POST /users=1m",
+		"-rate-limit", "0", "-route-rate-limits", "POST /login=0.5/3", "-validate-requests",
+		"-compression-encodings", "gzip",
+	}, env)
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	expected := Default()
+	expected.Addr = ":9002"
+	expected.MaxBodyBytes = 4096
+	expected.ShutdownTimeout = 30 * time.Second
+	expected.LogLevel = "debug"
+	expected.Store.Type = "file"
+	expected.Store.Path = "/tmp/env-users.json"
+	expected.Store.SyncWrites = false
+	expected.ValidateRequests = true
+	expected.Compression.Encodings = []string{"gzip"}
+	expected.RouteTimeouts = map[string]time.Duration{
+		"GET /users":  5 * time.Second,
+		"POST /users": time.Minute,
+	}
+	expected.RateLimit.Default = RateLimit{}
+	expected.RateLimit.Routes = map[string]RateLimit{"POST /login": {Rate: 0.5, Burst: 3}}
+
+	if !reflect.DeepEqual(expected, c) {
+		t.Errorf("bad config\nwanted: %+v\ngot: %+v", expected, c)
+	}
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+	envPath := writeConfigFile(t, `addr: ":9000"`)
+	flagPath := writeConfigFile(t, `addr: ":9001"`)
+
+	c, err := Load([]string{"-config", flagPath, "-print-config"}, testEnv(map[string]string{
+		"MYCOOLSERVER_CONFIG": envPath,
+	}))
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	if c.Addr != ":9001" {
+		t.Errorf("bad addr, the -config flag should win over the environment, got: %q", c.Addr)
+	}
+
+	if !c.PrintConfig {
+		t.Error("-print-config not set")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]struct {
+		args    []string
+		env     map[string]string
+		file    string
+		errText string
+	}{
+		"unknown flag": {
+			args:    []string{"-nope"},
+			errText: "flag provided but not defined",
+		},
+		"bad flag value": {
+			args:    []string{"-max-body-bytes", "lots"},
+			errText: "invalid -max-body-bytes",
+		},
+		"bad env value": {
+			env:     map[string]string{"MYCOOLSERVER_SHUTDOWN_TIMEOUT": "soon"},
+			errText: "invalid MYCOOLSERVER_SHUTDOWN_TIMEOUT",
+		},
+		"bad route timeout": {
+			args:    []string{"-route-timeouts", "GET /users"},
+			errText: `invalid -route-timeouts: expected pattern=duration, got "GET /users"`,
+		},
+		"unknown file key": {
+			file:    "adress: \":9000\"\n",
+			errText: "field adress not found",
+		},
+		"every invalid setting is reported": {
+			args:    []string{"-max-body-bytes", "0", "-log-level", "loud", "-store", "cloud", "-tls-cert", "cert.pem"},
+			errText: "max_body_bytes must be positive, got 0\ninvalid log_level: \"loud\"\nunknown store.type: \"cloud\"\ntls.cert_file and tls.key_file must be set together",
+		},
+		"bad tls settings": {
+			args:    []string{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-tls-min-version", "1.1", "-tls-client-auth", "require"},
+			errText: "invalid tls.min_version: unsupported TLS version: \"1.1\", must be 1.2 or 1.3\ntls.client_ca_file is required when tls.client_auth is require",
+		},
+		"redirect without tls": {
+			args:    []string{"-tls-redirect-addr", ":80"},
+			errText: "tls.redirect_addr and tls.client_auth need tls.cert_file and tls.key_file",
+		},
+		"bad api keys": {
+			file:    "auth:\n  api_keys:\n    - name: ci\n      sha256: abc\n    - name: ci\n      sha256: " + strings.Repeat("0", 64) + "\n      role: root\n",
+			errText: "auth.api_keys[0].sha256 must be 64 hex characters\nauth.api_keys[1].name \"ci\" is used twice\nauth.api_keys[1].role must be viewer, editor or admin, got \"root\"",
+		},
+		"bad admin key": {
+			args:    []string{"-admin-key-sha256", "secret"},
+			file:    "auth:\n  api_keys:\n    - name: admin\n      sha256: " + strings.Repeat("0", 64) + "\n",
+			errText: "auth.admin_key_sha256 must be 64 hex characters\nauth.api_keys[0].name \"admin\" is used twice",
+		},
+		"zero session ttl": {
+			env:     map[string]string{"MYCOOLSERVER_SESSION_TTL": "0s"},
+			errText: "auth.session_ttl must be positive, got 0s",
+		},
+		"bad rate limit": {
+			args:    []string{"-rate-limit", "fast"},
+			errText: `invalid -rate-limit: expected rate/burst, got "fast"`,
+		},
+		"bad rate limit settings": {
+			file:    "rate_limit:\n  default:\n    rate: -1\n  routes:\n    POST /users:\n      rate: 1\n  max_clients: 0\n",
+			errText: "rate_limit.default.rate must not be negative, got -1\nrate_limit.routes[\"POST /users\"].burst must be at least 1, got 0\nrate_limit.max_clients must be positive, got 0",
+		},
+		"bad cors origins": {
+			args:    []string{"-cors-allowed-origins", "app.example.com, *", "-cors-allow-credentials"},
+			errText: "cors.allowed_origins[0]: invalid origin \"app.example.com\", expected scheme://host[:port]\ncors.allowed_origins can't include * when cors.allow_credentials is set",
+		},
+		"bad compression": {
+			args:    []string{"-compression-encodings", "gzip, deflate", "-compression-min-size", "-1"},
+			errText: "compression.encodings[1]: unknown encoding \"deflate\", must be gzip, br or zstd\ncompression.min_size must not be negative, got -1",
+		},
+		"jwt issuer without a key": {
+			args:    []string{"-jwt-issuer", "https://issuer.example.com"},
+			errText: "auth.jwt.issuer and auth.jwt.audience need a JWT key file",
+		},
+		"leftover arguments": {
+			args:    []string{"serve"},
+			errText: "unexpected arguments",
+		},
+	}
+
+	for name, test := range tests {
+		env := test.env
+		if test.file != "" {
+			env = map[string]string{"MYCOOLSERVER_CONFIG": writeConfigFile(t, test.file)}
+		}
+
+		_, err := Load(test.args, testEnv(env))
+		if err == nil {
+			t.Errorf("%s: no error returned", name)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), test.errText) {
+			t.Errorf("%s: bad error, wanted it to contain: %q, got: %q", name, test.errText, err)
+		}
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	_, err := Load([]string{"-h"}, testEnv(nil))
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("bad error for -h, wanted: %v, got: %v", flag.ErrHelp, err)
+	}
+
+	var usage bytes.Buffer
+	Usage(&usage)
+
+	if !strings.Contains(usage.String(), "MYCOOLSERVER_STORE_PATH") {
+		t.Errorf("usage doesn't mention environment variables:\n%s", usage.String())
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	c := Default()
+	c.Addr = ":9999"
+	c.ShutdownTimeout = 90 * time.Second
+	c.DrainDelay = 0
+	c.RouteTimeouts = map[string]time.Duration{"DELETE /users/{id}": 3 * time.Second}
+	c.TLS.CertFile = "cert.pem"
+	c.TLS.KeyFile = "key.pem"
+	c.TLS.ClientAuth = "require"
+	c.TLS.ClientCAFile = "clients.pem"
+	c.TLS.RedirectAddr = ":8081"
+	c.Auth.APIKeys = []APIKeyConfig{
+		{Name: "ci", SHA256: strings.Repeat("ab", 32), Scopes: []string{"users:read"}},
+		{Name: "ops", SHA256: strings.Repeat("cd", 32), Role: "admin"},
+	}
+	c.Auth.AdminKeySHA256 = strings.Repeat("ef", 32)
+	c.Auth.JWT.HMACSecretFile = "jwt.secret"
+	c.Auth.JWT.Audience = "mycoolserver"
+	c.Auth.SessionTTL = 8 * time.Hour
+	c.RateLimit.Default = RateLimit{Rate: 2.5, Burst: 10}
+	c.RateLimit.Routes["GET /users"] = RateLimit{Rate: 1, Burst: 1}
+	c.RateLimit.MaxClients = 500
+	c.CORS.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org"}
+	c.CORS.AllowedHeaders = []string{"Content-Type"}
+	c.CORS.AllowCredentials = true
+	c.CORS.MaxAge = time.Hour
+
+	var written bytes.Buffer
+	err := c.Write(&written)
+	if err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+
+	loaded, err := Load(nil, testEnv(map[string]string{
+		"MYCOOLSERVER_CONFIG": writeConfigFile(t, written.String()),
+	}))
+	if err != nil {
+		t.Fatalf("error loading written config: %v\n%s", err, written.String())
+	}
+
+	if !reflect.DeepEqual(c, loaded) {
+		t.Errorf("config didn't survive a round trip\nwanted: %+v\ngot: %+v", c, loaded)
+	}
+}
@@ -0,0 +1,298 @@
+// Package cors lets browsers on other origins call the server.  It answers
+// preflight requests itself, using the ServeMux to find out which methods a
+// path has, and adds the Access-Control headers to every other response.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are the settings from config.CORSConfig
+type Options struct {
+	// AllowedOrigins are scheme://host[:port], a host starting with "*."
+	// matches every subdomain of the rest, and "*" matches any origin
+	AllowedOrigins []string
+	// AllowedMethods are checked against the routes too, a method has to be
+	// in both for a path
+	AllowedMethods []string
+	// AllowedHeaders are request headers scripts may send, "*" allows any
+	AllowedHeaders []string
+	// ExposedHeaders are response headers scripts may read
+	ExposedHeaders []string
+	// AllowCredentials lets cookies and Authorization headers through, it
+	// can't be combined with the "*" origin
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight, zero leaves it to
+	// the browser
+	MaxAge time.Duration
+}
+
+// Router is what CORS needs from a ServeMux, it asks it which handler
+// would serve a method on a path
+type Router interface {
+	http.Handler
+	Handler(r *http.Request) (h http.Handler, pattern string)
+}
+
+// origin is a parsed AllowedOrigins entry
+type origin struct {
+	scheme string
+	// host includes the port, and has had the "*." taken off when wildcard
+	// is set
+	host     string
+	wildcard bool
+}
+
+// CORS is built from Options by New
+type CORS struct {
+	origins          []origin
+	anyOrigin        bool
+	methods          []string
+	headers          []string
+	anyHeader        bool
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+// New checks opts and returns a CORS that applies them
+func New(opts Options) (*CORS, error) {
+	c := &CORS{
+		allowCredentials: opts.AllowCredentials,
+		exposedHeaders:   strings.Join(opts.ExposedHeaders, ", "),
+	}
+
+	var errs []error
+	for _, o := range opts.AllowedOrigins {
+		if o == "*" {
+			c.anyOrigin = true
+			continue
+		}
+
+		parsed, err := parseOrigin(o)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.origins = append(c.origins, parsed)
+	}
+
+	if c.anyOrigin && opts.AllowCredentials {
+		errs = append(errs, errors.New(`the "*" origin can't be used with credentials`))
+	}
+
+	for _, method := range opts.AllowedMethods {
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+
+	for _, header := range opts.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+			continue
+		}
+		c.headers = append(c.headers, http.CanonicalHeaderKey(header))
+	}
+
+	if opts.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("max age must not be negative, got %s", opts.MaxAge))
+	}
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(opts.MaxAge.Seconds()))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return c, nil
+}
+
+// ValidateOrigin checks an AllowedOrigins entry
+func ValidateOrigin(o string) error {
+	if o == "*" {
+		return nil
+	}
+	_, err := parseOrigin(o)
+	return err
+}
+
+func parseOrigin(o string) (origin, error) {
+	u, err := url.Parse(strings.ToLower(o))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return origin{}, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", o)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return origin{}, fmt.Errorf("invalid origin %q, an origin has nothing after the host and port", o)
+	}
+
+	parsed := origin{scheme: u.Scheme, host: u.Host}
+	if rest, ok := strings.CutPrefix(u.Host, "*."); ok {
+		parsed.host = rest
+		parsed.wildcard = true
+	}
+	if strings.Contains(parsed.host, "*") {
+		return origin{}, fmt.Errorf("invalid origin %q, * can only be the first label", o)
+	}
+
+	return parsed, nil
+}
+
+// allowedOrigin reports whether the Origin header o may make requests
+func (c *CORS) allowedOrigin(o string) bool {
+	if o == "" {
+		return false
+	}
+	if c.anyOrigin {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(o))
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	for _, allowed := range c.origins {
+		if u.Scheme != allowed.scheme {
+			continue
+		}
+		if !allowed.wildcard && u.Host == allowed.host {
+			return true
+		}
+		// the wildcard needs at least one more label, *.example.com doesn't
+		// match example.com
+		if allowed.wildcard && strings.HasSuffix(u.Host, "."+allowed.host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsCredentials reports whether pages on origin o may make requests
+// with cookies, which is every allowed origin when AllowCredentials is set
+func (c *CORS) AllowsCredentials(o string) bool {
+	return c.allowCredentials && c.allowedOrigin(o)
+}
+
+// Handler answers preflights for router's routes and adds CORS headers to
+// everything router serves
+func (c *CORS) Handler(router Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o := r.Header.Get("Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r, router, o)
+			return
+		}
+
+		// the response depends on the Origin unless every origin gets the
+		// same one
+		if !c.anyOrigin || c.allowCredentials {
+			w.Header().Add("Vary", "Origin")
+		}
+		if c.allowedOrigin(o) {
+			c.setOriginHeaders(w, o)
+			if c.exposedHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", c.exposedHeaders)
+			}
+		}
+
+		router.ServeHTTP(w, r)
+	})
+}
+
+// preflight asks router which of the allowed methods path has, since routes
+// are registered as "POST /users" rather than per path.  A preflight that
+// isn't allowed gets a 403 without CORS headers, which the browser reports
+// as a CORS failure.
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, router Router, o string) {
+	w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	requestMethod := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requestHeaders := parseHeaderList(r.Header.Values("Access-Control-Request-Headers"))
+
+	if !c.allowedOrigin(o) {
+		c.reject(w, r, fmt.Sprintf("origin %q is not allowed", o))
+		return
+	}
+
+	var methods []string
+	for _, method := range c.methods {
+		if routed(router, r, method) {
+			methods = append(methods, method)
+		}
+	}
+	if !slices.Contains(methods, requestMethod) {
+		c.reject(w, r, fmt.Sprintf("method %s is not allowed on %s", requestMethod, r.URL.Path))
+		return
+	}
+
+	for _, header := range requestHeaders {
+		if !c.anyHeader && !slices.Contains(c.headers, header) {
+			c.reject(w, r, fmt.Sprintf("header %s is not allowed", header))
+			return
+		}
+	}
+
+	c.setOriginHeaders(w, o)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(requestHeaders) > 0 {
+		// listing what was asked for works with credentials, where "*"
+		// would be taken literally
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+	}
+	if c.maxAge != "" {
+		w.Header().Set("Access-Control-Max-Age", c.maxAge)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) setOriginHeaders(w http.ResponseWriter, o string) {
+	if c.anyOrigin && !c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", o)
+	}
+	if c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORS) reject(w http.ResponseWriter, r *http.Request, detail string) {
+	logging.FromContext(r.Context()).Info("rejected CORS preflight", "origin", r.Header.Get("Origin"), "reason", detail)
+	problem.Write(w, r, problem.New(problem.TypeForbidden, http.StatusForbidden, detail))
+}
+
+// routed reports whether router has a route for method on r's path.  A
+// HEAD is served by GET routes, the ServeMux handles that for us.
+func routed(router Router, r *http.Request, method string) bool {
+	probe := r.Clone(r.Context())
+	probe.Method = method
+	_, pattern := router.Handler(probe)
+	return pattern != ""
+}
+
+// parseHeaderList splits Access-Control-Request-Headers, which browsers
+// send lower cased and comma separated
+func parseHeaderList(values []string) []string {
+	var headers []string
+	for _, value := range values {
+		for _, header := range strings.Split(value, ",") {
+			header = strings.TrimSpace(header)
+			if header != "" {
+				headers = append(headers, http.CanonicalHeaderKey(header))
+			}
+		}
+	}
+	return headers
+}
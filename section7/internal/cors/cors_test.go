@@ -0,0 +1,263 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMux() *http.ServeMux {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users", ok)
+	mux.HandleFunc("POST /users", ok)
+	mux.HandleFunc("GET /users/{id}", ok)
+	mux.HandleFunc("DELETE /users/{id}", ok)
+	mux.HandleFunc("/json", ok)
+	return mux
+}
+
+func newTestCORS(t *testing.T, opts Options) http.Handler {
+	t.Helper()
+
+	c, err := New(opts)
+	if err != nil {
+		t.Fatalf("error creating CORS: %v", err)
+	}
+	return c.Handler(newTestMux())
+}
+
+var testOptions = Options{
+	AllowedOrigins: []string{"https://app.example.com", "https://*.example.org", "http://localhost:3000"},
+	AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+	AllowedHeaders: []string{"Content-Type", "X-API-Key"},
+	ExposedHeaders: []string{"X-Request-ID", "Retry-After"},
+	MaxAge:         10 * time.Minute,
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	c, err := New(testOptions)
+	if err != nil {
+		t.Fatalf("error creating CORS: %v", err)
+	}
+
+	tests := map[string]bool{
+		"https://app.example.com":      true,
+		"https://APP.example.com":      true,
+		"http://app.example.com":       false,
+		"https://app.example.com:8443": false,
+		"https://evil.com":             false,
+		"https://app.example.com.evil": false,
+		"https://a.example.org":        true,
+		"https://a.b.example.org":      true,
+		"https://example.org":          false,
+		"https://evilexample.org":      false,
+		"http://localhost:3000":        true,
+		"http://localhost":             false,
+		"null":                         false,
+		"":                             false,
+	}
+
+	for origin, expected := range tests {
+		if got := c.allowedOrigin(origin); got != expected {
+			t.Errorf("%q: bad result, wanted: %v, got: %v", origin, expected, got)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	h := newTestCORS(t, testOptions)
+
+	tests := map[string]struct {
+		origin  string
+		path    string
+		method  string
+		headers string
+		status  int
+		methods string
+	}{
+		"collection": {
+			origin: "https://app.example.com", path: "/users", method: "POST", headers: "content-type, x-api-key",
+			status: http.StatusNoContent, methods: "GET, POST",
+		},
+		"single user": {
+			origin: "https://a.example.org", path: "/users/42", method: "DELETE",
+			status: http.StatusNoContent, methods: "GET, DELETE",
+		},
+		"route without a method": {
+			origin: "http://localhost:3000", path: "/json", method: "PUT",
+			status: http.StatusNoContent, methods: "GET, POST, PUT, DELETE",
+		},
+		"method the route doesn't have": {
+			origin: "https://app.example.com", path: "/users", method: "DELETE",
+			status: http.StatusForbidden,
+		},
+		"method that isn't allowed": {
+			origin: "https://app.example.com", path: "/json", method: "PATCH",
+			status: http.StatusForbidden,
+		},
+		"header that isn't allowed": {
+			origin: "https://app.example.com", path: "/users", method: "POST", headers: "x-secret",
+			status: http.StatusForbidden,
+		},
+		"origin that isn't allowed": {
+			origin: "https://evil.com", path: "/users", method: "GET",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for name, test := range tests {
+		r := httptest.NewRequest(http.MethodOptions, test.path, nil)
+		r.Header.Set("Origin", test.origin)
+		r.Header.Set("Access-Control-Request-Method", test.method)
+		if test.headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", test.headers)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad response code, wanted: %v, got: %v\nbody: %s", name, test.status, w.Code, w.Body.String())
+			continue
+		}
+
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		if test.status != http.StatusNoContent {
+			if allowOrigin != "" {
+				t.Errorf("%s: rejected preflight has Access-Control-Allow-Origin: %q", name, allowOrigin)
+			}
+			continue
+		}
+
+		expectedHeaders := map[string]string{
+			"Access-Control-Allow-Origin":  test.origin,
+			"Access-Control-Allow-Methods": test.methods,
+			"Access-Control-Max-Age":       "600",
+		}
+		for header, expected := range expectedHeaders {
+			if got := w.Header().Get(header); got != expected {
+				t.Errorf("%s: bad %s, wanted: %q, got: %q", name, header, expected, got)
+			}
+		}
+
+		if test.headers != "" && w.Header().Get("Access-Control-Allow-Headers") != "Content-Type, X-Api-Key" {
+			t.Errorf("%s: bad Access-Control-Allow-Headers, got: %q", name, w.Header().Get("Access-Control-Allow-Headers"))
+		}
+	}
+}
+
+func TestActualRequest(t *testing.T) {
+	h := newTestCORS(t, testOptions)
+
+	tests := map[string]struct {
+		origin   string
+		expected string
+	}{
+		"allowed":     {origin: "https://app.example.com", expected: "https://app.example.com"},
+		"not allowed": {origin: "https://evil.com"},
+		"same origin": {},
+	}
+
+	for name, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		// the request itself is never blocked, the browser hides the response
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: bad response code, wanted: %v, got: %v", name, http.StatusOK, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.expected {
+			t.Errorf("%s: bad Access-Control-Allow-Origin, wanted: %q, got: %q", name, test.expected, got)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: bad Vary, wanted: Origin, got: %q", name, w.Header().Get("Vary"))
+		}
+		if test.expected != "" && w.Header().Get("Access-Control-Expose-Headers") != "X-Request-ID, Retry-After" {
+			t.Errorf("%s: bad Access-Control-Expose-Headers, got: %q", name, w.Header().Get("Access-Control-Expose-Headers"))
+		}
+	}
+}
+
+func TestAllowsCredentials(t *testing.T) {
+	withoutCredentials, err := New(testOptions)
+	if err != nil {
+		t.Fatalf("error creating CORS: %v", err)
+	}
+	if withoutCredentials.AllowsCredentials("https://app.example.com") {
+		t.Error("credentials allowed without AllowCredentials")
+	}
+
+	opts := testOptions
+	opts.AllowCredentials = true
+	withCredentials, err := New(opts)
+	if err != nil {
+		t.Fatalf("error creating CORS: %v", err)
+	}
+	if !withCredentials.AllowsCredentials("https://app.example.com") {
+		t.Error("credentials not allowed for an allowed origin")
+	}
+	if withCredentials.AllowsCredentials("https://evil.com") {
+		t.Error("credentials allowed for another origin")
+	}
+}
+
+func TestCredentialsAndWildcard(t *testing.T) {
+	credentials := newTestCORS(t, Options{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET"},
+		AllowCredentials: true,
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	credentials.ServeHTTP(w, r)
+
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("bad Access-Control-Allow-Credentials, wanted: true, got: %q", w.Header().Get("Access-Control-Allow-Credentials"))
+	}
+
+	anywhere := newTestCORS(t, Options{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}})
+
+	r = httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("Origin", "https://anyone.example.net")
+	w = httptest.NewRecorder()
+	anywhere.ServeHTTP(w, r)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Vary") != "" {
+		t.Errorf("bad headers for any origin, wanted * without Vary, got: %v", w.Header())
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := map[string]struct {
+		opts    Options
+		errText string
+	}{
+		"no scheme":                   {Options{AllowedOrigins: []string{"app.example.com"}}, "expected scheme://host[:port]"},
+		"path":                        {Options{AllowedOrigins: []string{"https://app.example.com/app"}}, "nothing after the host"},
+		"inner wildcard":              {Options{AllowedOrigins: []string{"https://app.*.example.com"}}, "first label"},
+		"any origin with credentials": {Options{AllowedOrigins: []string{"*"}, AllowCredentials: true}, "can't be used with credentials"},
+		"negative max age":            {Options{MaxAge: -time.Second}, "must not be negative"},
+	}
+
+	for name, test := range tests {
+		_, err := New(test.opts)
+		if err == nil || !strings.Contains(err.Error(), test.errText) {
+			t.Errorf("%s: bad error, wanted it to contain: %q, got: %v", name, test.errText, err)
+		}
+	}
+}
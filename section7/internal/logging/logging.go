@@ -0,0 +1,32 @@
+// Package logging carries a request scoped slog.Logger in a context, so the
+// HTTP layer and the packages it calls log with the same attributes, like the
+// request ID, and their lines can be matched up.
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that carries logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger in ctx, or slog.Default() if there isn't
+// one, so it's always safe to log with.
+func FromContext(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+	return logger
+}
+
+// With adds attributes to the logger in ctx, args are the same as for
+// slog.Logger.With.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestFromContextDefault(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Error("empty context didn't give the default logger")
+	}
+}
+
+func TestWith(t *testing.T) {
+	var logs bytes.Buffer
+	ctx := WithLogger(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)))
+
+	ctx = With(ctx, "request_id", "abc")
+	ctx = With(ctx, "route", "GET /users/{id}")
+
+	FromContext(ctx).Info("hello")
+
+	for _, expected := range []string{"request_id=abc", `route="GET /users/{id}"`, "msg=hello"} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("log line missing %s: %q", expected, logs.String())
+		}
+	}
+}
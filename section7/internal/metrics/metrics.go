@@ -0,0 +1,464 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format, which is all a Prometheus server
+// needs to scrape them.
+//
+// Metrics are created from a Registry and split into series by label values:
+//
+//	requests := reg.NewCounterVec("http_requests_total", "Requests handled.", "pattern")
+//	requests.With("GET /users").Inc()
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the version of the text format WriteText produces
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit request latencies in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is one metric family, everything with the same name
+type collector interface {
+	name() string
+	write(w io.Writer) error
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register panics on a duplicate name, like adding the same route to a
+// ServeMux twice it's a programming mistake
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic(fmt.Sprintf("metrics: %s registered twice", c.name()))
+		}
+	}
+
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every metric, sorted by name, in the text exposition
+// format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	slices.SortFunc(collectors, func(a collector, b collector) int {
+		return strings.Compare(a.name(), b.name())
+	})
+
+	for _, c := range collectors {
+		err := c.write(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler serves the metrics for scraping.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		// once the body has started there's no way to report an error
+		_ = r.WriteText(w)
+	})
+}
+
+// family holds the series of one metric, keyed by their joined label values
+type family[T any] struct {
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+	newT   func() *T
+}
+
+func newFamily[T any](name string, help string, metricType string, labelNames []string, newT func() *T) *family[T] {
+	return &family[T]{
+		metricName: name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		series:     make(map[string]*T),
+		values:     make(map[string][]string),
+		newT:       newT,
+	}
+}
+
+func (f *family[T]) name() string {
+	return f.metricName
+}
+
+// with returns the series for labelValues, creating it the first time
+func (f *family[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.metricName, len(f.labelNames), len(labelValues)))
+	}
+
+	// \xff can't appear in valid UTF-8 so keys can't collide
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = f.newT()
+		f.series[key] = s
+		f.values[key] = slices.Clone(labelValues)
+	}
+	return s
+}
+
+// each calls fn for every series sorted by label values, so the output is
+// stable between scrapes
+func (f *family[T]) each(fn func(labelValues []string, s *T) error) error {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	series := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		series[i] = f.series[key]
+		values[i] = f.values[key]
+	}
+	f.mu.Unlock()
+
+	for i := range keys {
+		err := fn(values[i], series[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family[T]) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, escapeHelp(f.help), f.metricName, f.metricType)
+	return err
+}
+
+// Counter only goes up
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add panics if v is negative, use a Gauge for values that go down
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counters can't decrease")
+	}
+
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) get() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+type CounterVec struct {
+	f *family[Counter]
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{f: newFamily(name, help, "counter", labelNames, func() *Counter { return &Counter{} })}
+	r.register(v)
+	return v
+}
+
+// With returns the counter for the label values, given in the order the
+// label names were.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.f.with(labelValues)
+}
+
+func (v *CounterVec) name() string {
+	return v.f.name()
+}
+
+func (v *CounterVec) write(w io.Writer) error {
+	err := v.f.writeHeader(w)
+	if err != nil {
+		return err
+	}
+
+	return v.f.each(func(labelValues []string, c *Counter) error {
+		return writeSample(w, v.f.metricName, v.f.labelNames, labelValues, "", "", c.get())
+	})
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+type GaugeVec struct {
+	f *family[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{f: newFamily(name, help, "gauge", labelNames, func() *Gauge { return &Gauge{} })}
+	r.register(v)
+	return v
+}
+
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.f.with(labelValues)
+}
+
+func (v *GaugeVec) name() string {
+	return v.f.name()
+}
+
+func (v *GaugeVec) write(w io.Writer) error {
+	err := v.f.writeHeader(w)
+	if err != nil {
+		return err
+	}
+
+	return v.f.each(func(labelValues []string, g *Gauge) error {
+		return writeSample(w, v.f.metricName, v.f.labelNames, labelValues, "", "", g.get())
+	})
+}
+
+// gaugeFunc asks for its value at scrape time, for numbers something else
+// already keeps track of
+type gaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// NewGaugeFunc adds a gauge without labels whose value is fn's result when
+// the metrics are scraped.
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) {
+	r.register(&gaugeFunc{metricName: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.metricName, escapeHelp(g.help), g.metricName)
+	if err != nil {
+		return err
+	}
+
+	return writeSample(w, g.metricName, nil, nil, "", "", g.fn())
+}
+
+// Histogram counts observations into buckets by upper bound
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	// counts[i] is observations <= buckets[i] that didn't fit an earlier
+	// bucket, they're summed when written
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i, _ := slices.BinarySearch(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+type HistogramVec struct {
+	f       *family[Histogram]
+	buckets []float64
+}
+
+// NewHistogramVec panics if buckets isn't sorted, nil means DefaultBuckets.
+// The +Inf bucket is always added.
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets for %s aren't sorted", name))
+	}
+
+	buckets = slices.Clone(buckets)
+	v := &HistogramVec{
+		buckets: buckets,
+		f: newFamily(name, help, "histogram", labelNames, func() *Histogram {
+			return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		}),
+	}
+	r.register(v)
+	return v
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.f.with(labelValues)
+}
+
+func (v *HistogramVec) name() string {
+	return v.f.name()
+}
+
+func (v *HistogramVec) write(w io.Writer) error {
+	err := v.f.writeHeader(w)
+	if err != nil {
+		return err
+	}
+
+	name := v.f.metricName
+	return v.f.each(func(labelValues []string, h *Histogram) error {
+		h.mu.Lock()
+		counts := slices.Clone(h.counts)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += counts[i]
+			err := writeSample(w, name+"_bucket", v.f.labelNames, labelValues, "le", formatFloat(bound), float64(cumulative))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := writeSample(w, name+"_bucket", v.f.labelNames, labelValues, "le", "+Inf", float64(count))
+		if err != nil {
+			return err
+		}
+
+		err = writeSample(w, name+"_sum", v.f.labelNames, labelValues, "", "", sum)
+		if err != nil {
+			return err
+		}
+
+		return writeSample(w, name+"_count", v.f.labelNames, labelValues, "", "", float64(count))
+	})
+}
+
+// writeSample writes one line, extraName and extraValue are for the le label
+// of histogram buckets
+func writeSample(w io.Writer, name string, labelNames []string, labelValues []string, extraName string, extraValue string, value float64) error {
+	var line strings.Builder
+	line.WriteString(name)
+
+	if len(labelNames) > 0 || extraName != "" {
+		line.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			fmt.Fprintf(&line, "%s=\"%s\"", labelName, escapeLabelValue(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				line.WriteByte(',')
+			}
+			fmt.Fprintf(&line, "%s=\"%s\"", extraName, extraValue)
+		}
+		line.WriteByte('}')
+	}
+
+	line.WriteByte(' ')
+	line.WriteString(formatFloat(value))
+	line.WriteByte('\n')
+
+	_, err := io.WriteString(w, line.String())
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+
+	requests := reg.NewCounterVec("http_requests_total", "Requests handled.", "pattern", "status_class")
+	requests.With("POST /users", "2xx").Inc()
+	requests.With("POST /users", "2xx").Add(2)
+	requests.With("GET /users/{id}", "4xx").Inc()
+
+	inFlight := reg.NewGaugeVec("http_requests_in_flight", "Requests being handled.", "pattern")
+	inFlight.With("GET /users").Inc()
+	inFlight.With("GET /users").Inc()
+	inFlight.With("GET /users").Dec()
+
+	latency := reg.NewHistogramVec("http_request_duration_seconds", "Time to handle a request.", []float64{0.1, 1}, "pattern")
+	latency.With("GET /users").Observe(0.05)
+	latency.With("GET /users").Observe(0.1)
+	latency.With("GET /users").Observe(3)
+
+	reg.NewGaugeFunc("users", "Users stored,\nright now.", func() float64 { return 42 })
+
+	var out bytes.Buffer
+	err := reg.WriteText(&out)
+	if err != nil {
+		t.Fatalf("error writing metrics: %v", err)
+	}
+
+	expected := `# HELP http_request_duration_seconds Time to handle a request.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{pattern="GET /users",le="0.1"} 2
+http_request_duration_seconds_bucket{pattern="GET /users",le="1"} 2
+http_request_duration_seconds_bucket{pattern="GET /users",le="+Inf"} 3
+http_request_duration_seconds_sum{pattern="GET /users"} 3.15
+http_request_duration_seconds_count{pattern="GET /users"} 3
+# HELP http_requests_in_flight Requests being handled.
+# TYPE http_requests_in_flight gauge
+http_requests_in_flight{pattern="GET /users"} 1
+# HELP http_requests_total Requests handled.
+# TYPE http_requests_total counter
+http_requests_total{pattern="GET /users/{id}",status_class="4xx"} 1
+http_requests_total{pattern="POST /users",status_class="2xx"} 3
+# HELP users Users stored,\nright now.
+# TYPE users gauge
+users 42
+`
+
+	if out.String() != expected {
+		t.Errorf("bad metrics output\nwanted:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounterVec("odd_total", "Odd labels.", "value").With("a \"quoted\"\\path\nline").Inc()
+
+	var out bytes.Buffer
+	err := reg.WriteText(&out)
+	if err != nil {
+		t.Fatalf("error writing metrics: %v", err)
+	}
+
+	expected := `odd_total{value="a \"quoted\"\\path\nline"} 1`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("bad escaping, wanted: %s, got:\n%s", expected, out.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounterVec("hits_total", "Hits.").With().Inc()
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Header().Get("Content-Type") != ContentType {
+		t.Errorf("bad content type, wanted: %q, got: %q", ContentType, w.Header().Get("Content-Type"))
+	}
+
+	if !strings.Contains(w.Body.String(), "hits_total 1\n") {
+		t.Errorf("counter missing from response:\n%s", w.Body.String())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	tests := map[string]func(reg *Registry){
+		"duplicate name": func(reg *Registry) {
+			reg.NewCounterVec("twice", "")
+			reg.NewGaugeVec("twice", "")
+		},
+		"wrong label count": func(reg *Registry) {
+			reg.NewCounterVec("labelled", "", "a", "b").With("only one")
+		},
+		"negative counter": func(reg *Registry) {
+			reg.NewCounterVec("down", "").With().Add(-1)
+		},
+		"unsorted buckets": func(reg *Registry) {
+			reg.NewHistogramVec("backwards", "", []float64{1, 0.5})
+		},
+	}
+
+	for name, misuse := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", name)
+				}
+			}()
+			misuse(NewRegistry())
+		}()
+	}
+}
@@ -0,0 +1,280 @@
+// Package middleware wraps http.Handlers with the things every request needs:
+// a request ID, an access log line and recovery from panics.
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/metrics"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// RequestIDHeader carries the request ID in both directions, a client or
+// proxy can send one and every response includes it.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength stops clients from filling the logs with huge IDs
+const maxRequestIDLength = 128
+
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h so a request passes through middlewares in the order given,
+// the first one is the outermost.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID the RequestID middleware gave the
+// request, or "" outside of it.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID keeps a well formed X-Request-ID from the client, so IDs can be
+// followed across services, and makes a new one otherwise.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = logging.With(ctx, "request_id", id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Route adds the pattern the ServeMux matched to the request's logger.  The
+// mux only sets the pattern right before calling a handler, so Route has to
+// wrap each handler registered on it rather than the mux itself.
+func Route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(logging.With(r.Context(), "route", r.Pattern)))
+	})
+}
+
+// Timeout gives the request context a deadline d from now, so the work a
+// handler starts is abandoned once the client has waited long enough.  A zero
+// d means no deadline.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// HTTPMetrics counts requests per route, the pattern label is the one the
+// route was registered with so URLs with ids in them don't each get a series.
+type HTTPMetrics struct {
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	inFlight *metrics.GaugeVec
+}
+
+func NewHTTPMetrics(reg *metrics.Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: reg.NewCounterVec("http_requests_total",
+			"HTTP requests handled, by route pattern and status class.", "pattern", "status_class"),
+		latency: reg.NewHistogramVec("http_request_duration_seconds",
+			"Time taken to handle HTTP requests, by route pattern and status class.", nil, "pattern", "status_class"),
+		inFlight: reg.NewGaugeVec("http_requests_in_flight",
+			"HTTP requests being handled right now, by route pattern.", "pattern"),
+	}
+}
+
+// Route returns middleware that records requests to the route registered as
+// pattern.
+func (m *HTTPMetrics) Route(pattern string) Middleware {
+	return func(next http.Handler) http.Handler {
+		inFlight := m.inFlight.With(pattern)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+
+			inFlight.Inc()
+			finished := false
+			defer func() {
+				inFlight.Dec()
+
+				status := sw.Status()
+				// a panic on its way to Recover, which will send a 500
+				if !finished && !sw.wroteHeader {
+					status = http.StatusInternalServerError
+				}
+
+				class := statusClass(status)
+				m.requests.With(pattern, class).Inc()
+				m.latency.With(pattern, class).Observe(time.Since(start).Seconds())
+			}()
+
+			next.ServeHTTP(sw, r)
+			finished = true
+		})
+	}
+}
+
+// statusClass turns 404 into 4xx
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// validRequestID only allows printable ASCII without spaces so an ID can't
+// break a log line
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	// crypto/rand.Read never returns an error
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// AccessLog writes one line per request to logger once it's been handled.
+// The route pattern comes from the ServeMux, so it has to wrap the mux
+// without replacing the request on the way in.
+func AccessLog(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r)
+
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("pattern", r.Pattern),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", sw.Status()),
+				slog.Int64("bytes", sw.bytes),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("request_id", RequestIDFromContext(r.Context())),
+			)
+		})
+	}
+}
+
+// Recover turns a panic in a handler into a logged error and a 500, instead
+// of a dropped connection.  http.ErrAbortHandler is passed on since it's
+// how a handler asks for the connection to be dropped.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logging.FromContext(r.Context()).Error("panic serving request",
+				"err", fmt.Sprint(recovered),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+
+			// too late to change the status, the client gets a cut off
+			// response either way
+			if sw.wroteHeader {
+				return
+			}
+
+			// the request ID header is already set, problem.Write copies it
+			// into the body
+			problem.Write(sw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, ""))
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// statusWriter remembers what was sent through it
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// informational responses come before the real one
+	informational := status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+	if !w.wroteHeader && !informational {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status is 200 for handlers that never wrote anything, like net/http sends
+func (w *statusWriter) Status() int {
+	if !w.wroteHeader {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Flush keeps streaming handlers working through the wrapper
+func (w *statusWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	// writers that can't flush just buffer, which is fine
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the real writer for flushing and
+// deadlines
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,257 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/metrics"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := Chain(http.NotFoundHandler(), record("first"), record("second"), record("third"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if strings.Join(order, ",") != "first,second,third" {
+		t.Errorf("bad middleware order, wanted: first,second,third, got: %v", order)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := map[string]struct {
+		incoming string
+		kept     bool
+	}{
+		"none sent":        {"", false},
+		"sent":             {"upstream-1234", true},
+		"has a space":      {"upstream 1234", false},
+		"has a newline":    {"abc\ndef", false},
+		"way too long":     {strings.Repeat("a", maxRequestIDLength+1), false},
+		"just long enough": {strings.Repeat("a", maxRequestIDLength), true},
+	}
+
+	for name, test := range tests {
+		var seen string
+		h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = RequestIDFromContext(r.Context())
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.incoming != "" {
+			r.Header.Set(RequestIDHeader, test.incoming)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		responseID := w.Header().Get(RequestIDHeader)
+		if responseID == "" || responseID != seen {
+			t.Errorf("%s: response id %q doesn't match the context id %q", name, responseID, seen)
+		}
+
+		if test.kept && seen != test.incoming {
+			t.Errorf("%s: incoming id not kept, got: %q", name, seen)
+		}
+		if !test.kept && seen == test.incoming {
+			t.Errorf("%s: invalid incoming id was kept", name)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+
+	h := Chain(mux, RequestID, AccessLog(logger))
+
+	r := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	r.Header.Set(RequestIDHeader, "log-me")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]any
+	err := json.Unmarshal(logs.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("error decoding log line %q: %v", logs.String(), err)
+	}
+
+	expected := map[string]any{
+		"msg":        "request",
+		"method":     "GET",
+		"pattern":    "GET /users/{id}",
+		"path":       "/users/42",
+		"status":     float64(http.StatusTeapot),
+		"bytes":      float64(len("short and stout")),
+		"request_id": "log-me",
+	}
+
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("bad %s in access log, wanted: %v, got: %v", key, value, line[key])
+		}
+	}
+
+	if _, ok := line["latency"]; !ok {
+		t.Error("no latency in access log")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oh no")
+	}), RequestID, Recover)
+
+	r := httptest.NewRequest(http.MethodGet, "/boom", nil)
+	r.Header.Set(RequestIDHeader, "find-me")
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("bad status code, wanted: %d, got: %d", http.StatusInternalServerError, w.Code)
+	}
+
+	var p problem.Problem
+	err := json.NewDecoder(w.Body).Decode(&p)
+	if err != nil {
+		t.Fatalf("error decoding problem: %v", err)
+	}
+
+	if p.Type != problem.TypeInternal || p.RequestID != "find-me" {
+		t.Errorf("bad problem, wanted type %q with request id find-me, got: %+v", problem.TypeInternal, p)
+	}
+}
+
+func TestRecoverAfterWrite(t *testing.T) {
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("oh no")
+	}))
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Errorf("response changed after it was started, got: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRecoverAbortHandler(t *testing.T) {
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if recover() != http.ErrAbortHandler {
+			t.Error("http.ErrAbortHandler wasn't passed on")
+		}
+	}()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestRequestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /users/{id}", Route(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.FromContext(r.Context()).Info("from the handler")
+	})))
+
+	r := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	r = r.WithContext(logging.WithLogger(r.Context(), logger))
+	r.Header.Set(RequestIDHeader, "trace-me")
+	Chain(mux, RequestID).ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]any
+	err := json.Unmarshal(logs.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("error decoding log line %q: %v", logs.String(), err)
+	}
+
+	if line["request_id"] != "trace-me" || line["route"] != "GET /users/{id}" {
+		t.Errorf("handler logger is missing request attributes: %v", line)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	})
+
+	start := time.Now()
+	Timeout(time.Minute)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !hasDeadline || deadline.Before(start.Add(time.Minute)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Errorf("bad deadline, wanted about a minute from now, got: %v", deadline)
+	}
+
+	Timeout(0)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if hasDeadline {
+		t.Error("zero timeout set a deadline")
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	httpMetrics := NewHTTPMetrics(reg)
+
+	ok := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}), httpMetrics.Route("POST /users"))
+
+	boom := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oh no")
+	}), Recover, httpMetrics.Route("GET /boom"))
+
+	ok.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users", nil))
+	ok.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users", nil))
+	boom.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+	var out bytes.Buffer
+	err := reg.WriteText(&out)
+	if err != nil {
+		t.Fatalf("error writing metrics: %v", err)
+	}
+
+	expectedLines := []string{
+		`http_requests_total{pattern="POST /users",status_class="2xx"} 2`,
+		`http_requests_total{pattern="GET /boom",status_class="5xx"} 1`,
+		`http_request_duration_seconds_count{pattern="POST /users",status_class="2xx"} 2`,
+		`http_requests_in_flight{pattern="POST /users"} 0`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics missing line: %s\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package negotiate
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Media types the server reads and writes
+const (
+	JSON = "application/json"
+	XML  = "application/xml"
+	CBOR = "application/cbor"
+	Form = "application/x-www-form-urlencoded"
+	Text = "text/plain"
+	HTML = "text/html"
+)
+
+// ErrUnsupportedMediaType is returned by ContentType for bodies that
+// can't be decoded
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// Codec reads and writes structs in one format
+type Codec struct {
+	MediaType string
+	// Marshal is nil for formats the server only reads
+	Marshal func(v any) ([]byte, error)
+	// Decode reads a single value into v, rejecting fields v doesn't have
+	// where the format lets it
+	Decode func(r io.Reader, v any) error
+}
+
+// the options are fixed, so an error making the modes is a bug
+var (
+	// RFC 3339 strings keep the nanoseconds the default Unix time drops
+	cborEncoder = must(cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode())
+	cborDecoder = must(cbor.DecOptions{ExtraReturnErrors: cbor.ExtraDecErrorUnknownField}.DecMode())
+)
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+var codecs = map[string]Codec{
+	JSON: {
+		MediaType: JSON,
+		Marshal:   json.Marshal,
+		Decode: func(r io.Reader, v any) error {
+			decoder := json.NewDecoder(r)
+			decoder.DisallowUnknownFields()
+			return decoder.Decode(v)
+		},
+	},
+	// encoding/xml has no way to reject unknown elements, they're ignored
+	XML: {
+		MediaType: XML,
+		Marshal: func(v any) ([]byte, error) {
+			marshalled, err := xml.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return append([]byte(xml.Header), marshalled...), nil
+		},
+		Decode: func(r io.Reader, v any) error {
+			return xml.NewDecoder(r).Decode(v)
+		},
+	},
+	CBOR: {
+		MediaType: CBOR,
+		Marshal:   cborEncoder.Marshal,
+		Decode: func(r io.Reader, v any) error {
+			return cborDecoder.NewDecoder(r).Decode(v)
+		},
+	},
+	Form: {
+		MediaType: Form,
+		Decode:    decodeForm,
+	},
+}
+
+// Lookup returns the codec for mediaType
+func Lookup(mediaType string) (Codec, bool) {
+	codec, ok := codecs[mediaType]
+	return codec, ok
+}
+
+// ContentType parses a Content-Type header and returns the codec for it.
+// Parameters other than a UTF-8 charset are ignored, the media type is
+// matched without regard to case.
+func ContentType(header string) (Codec, error) {
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return Codec{}, fmt.Errorf("%w: %q", ErrUnsupportedMediaType, header)
+	}
+
+	codec, ok := codecs[mediaType]
+	if !ok {
+		return Codec{}, fmt.Errorf("%w: %q", ErrUnsupportedMediaType, header)
+	}
+
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		return Codec{}, fmt.Errorf("%w: charset %q, only utf-8 is supported", ErrUnsupportedMediaType, charset)
+	}
+
+	return codec, nil
+}
+
+// decodeForm sets the string fields of the struct v points to from a form,
+// names match field names without regard to case like encoding/json
+func decodeForm(r io.Reader, v any) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return fmt.Errorf("error parsing form: %w", err)
+	}
+
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("forms can only be decoded into a struct, not %T", v)
+	}
+	target = target.Elem()
+
+	for name, value := range values {
+		field := target.FieldByNameFunc(func(fieldName string) bool {
+			return strings.EqualFold(fieldName, name)
+		})
+		if !field.IsValid() || !field.CanSet() {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		if field.Kind() != reflect.String {
+			return fmt.Errorf("field %q can't be set from a form", name)
+		}
+		if len(value) > 1 {
+			return fmt.Errorf("field %q is given more than once", name)
+		}
+
+		field.SetString(value[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package negotiate
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	ID        string `json:",omitempty" xml:",omitempty"`
+	FirstName string
+	CreatedAt time.Time
+}
+
+func TestContentType(t *testing.T) {
+	tests := map[string]struct {
+		header   string
+		expected string
+	}{
+		"json":           {header: "application/json", expected: JSON},
+		"charset":        {header: "application/json; charset=utf-8", expected: JSON},
+		"upper case":     {header: "Application/JSON; Charset=UTF-8", expected: JSON},
+		"xml":            {header: "application/xml", expected: XML},
+		"cbor":           {header: "application/cbor", expected: CBOR},
+		"form":           {header: "application/x-www-form-urlencoded", expected: Form},
+		"missing":        {header: ""},
+		"unknown":        {header: "text/csv"},
+		"other charset":  {header: "application/json; charset=latin1"},
+		"malformed":      {header: "application/json; charset"},
+		"prefix matched": {header: "application/jsonx"},
+	}
+
+	for name, test := range tests {
+		codec, err := ContentType(test.header)
+		if test.expected == "" {
+			if !errors.Is(err, ErrUnsupportedMediaType) {
+				t.Errorf("%s: bad error, wanted: %v, got: %v", name, ErrUnsupportedMediaType, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error parsing content type: %v", name, err)
+			continue
+		}
+		if codec.MediaType != test.expected {
+			t.Errorf("%s: bad codec, wanted: %s, got: %s", name, test.expected, codec.MediaType)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	user := testUser{
+		ID:        "42",
+		FirstName: "Test",
+		CreatedAt: time.Date(2025, 6, 1, 12, 0, 0, 123456789, time.UTC),
+	}
+
+	for _, mediaType := range []string{JSON, XML, CBOR} {
+		codec, _ := Lookup(mediaType)
+
+		marshalled, err := codec.Marshal(user)
+		if err != nil {
+			t.Errorf("%s: error marshalling: %v", mediaType, err)
+			continue
+		}
+
+		var decoded testUser
+		err = codec.Decode(bytes.NewReader(marshalled), &decoded)
+		if err != nil {
+			t.Errorf("%s: error decoding: %v", mediaType, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(user, decoded) {
+			t.Errorf("%s: user didn't survive a round trip\nwanted: %+v\ngot: %+v", mediaType, user, decoded)
+		}
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	cborCodec, _ := Lookup(CBOR)
+	cborBody, err := cborCodec.Marshal(map[string]string{"FirstName": "Test", "Admin": "yes"})
+	if err != nil {
+		t.Fatalf("error marshalling: %v", err)
+	}
+
+	tests := map[string][]byte{
+		JSON: []byte(`{"FirstName": "Test", "Admin": "yes"}`),
+		CBOR: cborBody,
+		Form: []byte("FirstName=Test&Admin=yes"),
+	}
+
+	for mediaType, body := range tests {
+		codec, _ := Lookup(mediaType)
+
+		var decoded testUser
+		err := codec.Decode(bytes.NewReader(body), &decoded)
+		if err == nil {
+			t.Errorf("%s: unknown field accepted", mediaType)
+		}
+	}
+}
+
+func TestDecodeForm(t *testing.T) {
+	var decoded testUser
+	err := decodeForm(strings.NewReader("firstname=Test+Man&id=42"), &decoded)
+	if err != nil {
+		t.Fatalf("error decoding form: %v", err)
+	}
+
+	if decoded.FirstName != "Test Man" || decoded.ID != "42" {
+		t.Errorf("bad user, got: %+v", decoded)
+	}
+
+	tests := map[string]string{
+		"not a string": "CreatedAt=2025-06-01",
+		"repeated":     "FirstName=a&FirstName=b",
+		"bad escape":   "FirstName=%zz",
+	}
+
+	for name, body := range tests {
+		err := decodeForm(strings.NewReader(body), &decoded)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package negotiate picks the format of request and response bodies from
+// the Content-Type and Accept headers.
+package negotiate
+
+import (
+	"context"
+	"fmt"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptRange is one entry of an Accept header
+type acceptRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// matches reports how specifically r matches mediaType, 0 for not at all
+// and 3 for an exact match
+func (r acceptRange) matches(mediaType string) int {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+
+	switch {
+	case r.typ == typ && r.subtype == subtype:
+		return 3
+	case r.typ == typ && r.subtype == "*":
+		return 2
+	case r.typ == "*" && r.subtype == "*":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// parseAccept skips entries it can't make sense of rather than failing, a
+// client sending junk gets the default like one sending nothing
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+
+	for _, entry := range strings.Split(header, ",") {
+		mediaRange, params, _ := strings.Cut(entry, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(mediaRange)), "/")
+		if !ok || typ == "" || subtype == "" || (typ == "*" && subtype != "*") {
+			continue
+		}
+
+		r := acceptRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil && q >= 0 && q <= 1 {
+				r.q = q
+			}
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges
+}
+
+// Best returns the offer the Accept header prefers.  offers are in the
+// server's order of preference, which breaks ties, and the first is picked
+// when there's no Accept header.  ok is false when the client accepts none
+// of them.
+func Best(accept string, offers []string) (mediaType string, ok bool) {
+	if len(offers) == 0 {
+		return "", false
+	}
+
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return offers[0], true
+	}
+
+	bestQ := 0.0
+	for _, offer := range offers {
+		// the most specific range that matches decides the offer's q, so
+		// "text/*;q=0, text/html" still allows HTML
+		specificity, q := 0, 0.0
+		for _, r := range ranges {
+			if s := r.matches(offer); s > specificity {
+				specificity, q = s, r.q
+			}
+		}
+
+		if q > bestQ {
+			mediaType, bestQ = offer, q
+		}
+	}
+
+	return mediaType, mediaType != ""
+}
+
+type mediaTypeKey struct{}
+
+// MediaType returns the response format Middleware picked, or "" outside
+// of it
+func MediaType(ctx context.Context) string {
+	mediaType, _ := ctx.Value(mediaTypeKey{}).(string)
+	return mediaType
+}
+
+// Middleware picks one of offers for the response before the handler runs,
+// so a request isn't acted on only to find the client can't read the
+// answer.  Clients that accept none of them get a 406.
+func Middleware(offers []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+
+			accept := strings.Join(r.Header.Values("Accept"), ",")
+			mediaType, ok := Best(accept, offers)
+			if !ok {
+				logging.FromContext(r.Context()).Info("no acceptable media type", "accept", accept)
+				problem.Write(w, r, problem.New(problem.TypeNotAcceptable, http.StatusNotAcceptable,
+					fmt.Sprintf("none of the media types in the Accept header are available, this route responds with %s", strings.Join(offers, ", "))))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), mediaTypeKey{}, mediaType)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package negotiate
+
+import (
+	"encoding/json"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBest(t *testing.T) {
+	offers := []string{JSON, XML, CBOR}
+
+	tests := map[string]struct {
+		accept   string
+		expected string
+	}{
+		"no header":             {accept: "", expected: JSON},
+		"exact":                 {accept: "application/xml", expected: XML},
+		"upper case":            {accept: "Application/CBOR", expected: CBOR},
+		"anything":              {accept: "*/*", expected: JSON},
+		"type wildcard":         {accept: "application/*", expected: JSON},
+		"q values":              {accept: "application/json;q=0.5, application/xml;q=0.9", expected: XML},
+		"ties go to the server": {accept: "application/cbor, application/xml", expected: XML},
+		"browser":               {accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", expected: XML},
+		"specific beats wildcard": {
+			accept:   "application/*;q=0, application/cbor",
+			expected: CBOR,
+		},
+		"parameters": {accept: "application/json; charset=utf-8", expected: JSON},
+		"junk":       {accept: "nonsense", expected: JSON},
+		"nothing":    {accept: "text/csv", expected: ""},
+		"refused":    {accept: "*/*;q=0", expected: ""},
+	}
+
+	for name, test := range tests {
+		got, ok := Best(test.accept, offers)
+		if got != test.expected || ok != (test.expected != "") {
+			t.Errorf("%s: bad media type, wanted: %q, got: %q (%v)", name, test.expected, got, ok)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var picked string
+	h := Middleware([]string{Text, JSON, HTML})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		picked = MediaType(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/hello/", nil)
+	r.Header.Add("Accept", "application/xml;q=0.9")
+	r.Header.Add("Accept", "text/html")
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if picked != HTML {
+		t.Errorf("bad media type, wanted: %q, got: %q", HTML, picked)
+	}
+	if w.Header().Get("Vary") != "Accept" {
+		t.Errorf("bad Vary header, wanted: Accept, got: %q", w.Header().Get("Vary"))
+	}
+
+	picked = ""
+	r = httptest.NewRequest(http.MethodGet, "/hello/", nil)
+	r.Header.Set("Accept", "image/png")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("bad response code, wanted: %v, got: %v", http.StatusNotAcceptable, w.Code)
+	}
+	if picked != "" {
+		t.Error("handler ran without an acceptable media type")
+	}
+
+	var decoded problem.Problem
+	err := json.Unmarshal(w.Body.Bytes(), &decoded)
+	if err != nil {
+		t.Fatalf("error decoding problem: %v", err)
+	}
+	if decoded.Type != problem.TypeNotAcceptable {
+		t.Errorf("bad problem type, wanted: %s, got: %s", problem.TypeNotAcceptable, decoded.Type)
+	}
+}
@@ -0,0 +1,27 @@
+package openapi
+
+import (
+	_ "embed"
+	"html/template"
+	"mycoolserver/internal/logging"
+	"net/http"
+)
+
+//go:embed docs.html
+var docsPage string
+
+var docsTemplate = template.Must(template.New("docs").Parse(docsPage))
+
+// DocsHandler serves a page that reads the document at specURL, lists its
+// operations and lets them be tried out from the browser.  It's all in the
+// one page so the docs work without anything from a CDN.
+func DocsHandler(specURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		err := docsTemplate.Execute(w, struct{ SpecURL string }{specURL})
+		if err != nil {
+			logging.FromContext(r.Context()).Error("error writing docs page", "err", err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package openapi
+
+import (
+	"bytes"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net/http"
+)
+
+// ValidateRequests rejects requests that don't match op with a 400 listing
+// every problem, bodies are checked when they're no bigger than limit.
+// Whatever it can't check, like a body in a media type op doesn't list,
+// goes through to the handler.
+func (v *Validator) ValidateRequests(op *Operation, limit int64, decode BodyDecoder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			errs := v.Params(op, r)
+
+			if op.RequestBody != nil {
+				body, ok := readBody(r, limit)
+				if ok {
+					errs = append(errs, v.Body(op, r.Header.Get("Content-Type"), body, decode)...)
+				}
+			}
+
+			if len(errs) > 0 {
+				logging.FromContext(r.Context()).Info("request doesn't match the OpenAPI document",
+					"operation", op.OperationID, "errors", len(errs))
+
+				p := problem.New(problem.TypeValidation, http.StatusBadRequest, "request doesn't match the API description")
+				for _, err := range errs {
+					p.Errors = append(p.Errors, problem.FieldError{Field: err.Path, In: err.In, Detail: err.Detail})
+				}
+				problem.Write(w, r, p)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ValidateResponses passes report the ways responses to requests for op
+// don't match it.  The responses are sent as they are, tests use it to
+// keep the document honest.
+func (v *Validator) ValidateResponses(op *Operation, report func(r *http.Request, errs []ValidationError)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(recorder, r)
+
+			errs := v.Response(op, recorder.status, w.Header(), recorder.body.Bytes())
+			if len(errs) > 0 {
+				report(r, errs)
+			}
+		})
+	}
+}
+
+// responseRecorder keeps a copy of what's written through it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
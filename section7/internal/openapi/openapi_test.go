@@ -0,0 +1,78 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitPattern(t *testing.T) {
+	tests := map[string]struct {
+		method string
+		path   string
+	}{
+		"GET /users/{id}":          {method: "GET", path: "/users/{id}"},
+		"/{$}":                     {method: "", path: "/"},
+		"/hello/":                  {method: "", path: "/hello/"},
+		"POST  /login":             {method: "POST", path: "/login"},
+		"GET /files/{path...}":     {method: "GET", path: "/files/{path}"},
+		"/responses/{user}/hello/": {method: "", path: "/responses/{user}/hello/"},
+	}
+
+	for pattern, test := range tests {
+		method, path := SplitPattern(pattern)
+		if method != test.method || path != test.path {
+			t.Errorf("%q: bad split, wanted: %q %q, got: %q %q", pattern, test.method, test.path, method, path)
+		}
+	}
+}
+
+func TestPathParams(t *testing.T) {
+	tests := map[string][]string{
+		"/users":                   nil,
+		"/users/{id}":              {"id"},
+		"/users/{id}/sessions/{n}": {"id", "n"},
+	}
+
+	for path, expected := range tests {
+		got := PathParams(path)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: bad params, wanted: %v, got: %v", path, expected, got)
+		}
+	}
+}
+
+func TestOperation(t *testing.T) {
+	op := &Operation{OperationID: "getThing"}
+	doc := &Document{Paths: map[string]PathItem{"/things": {"get": op}}}
+
+	if got := doc.Operation(http.MethodGet, "/things"); got != op {
+		t.Errorf("bad operation, wanted: %v, got: %v", op, got)
+	}
+	if got := doc.Operation(http.MethodPost, "/things"); got != nil {
+		t.Errorf("bad operation for a missing method, wanted: nil, got: %v", got)
+	}
+	if got := doc.Operation(http.MethodGet, "/nothing"); got != nil {
+		t.Errorf("bad operation for a missing path, wanted: nil, got: %v", got)
+	}
+}
+
+func TestDocsHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+
+	DocsHandler("/spec.json?a=<b>").ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad status, wanted: %d, got: %d", http.StatusOK, w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("bad Content-Type, wanted: text/html, got: %q", contentType)
+	}
+	if !strings.Contains(w.Body.String(), `data-spec="/spec.json?a=&lt;b&gt;"`) {
+		t.Errorf("spec URL isn't in the page escaped, got:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,219 @@
+package openapi
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of JSON Schema 2020-12 the server's types need
+type Schema struct {
+	Ref         string `json:"$ref,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	// AdditionalProperties is false for structs, the server rejects fields
+	// it doesn't know
+	AdditionalProperties *bool   `json:"additionalProperties,omitempty"`
+	Items                *Schema `json:"items,omitempty"`
+
+	Enum      []string `json:"enum,omitempty"`
+	MinLength *int     `json:"minLength,omitempty"`
+	MaxLength *int     `json:"maxLength,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+
+	ReadOnly  bool `json:"readOnly,omitempty"`
+	WriteOnly bool `json:"writeOnly,omitempty"`
+}
+
+// RefPrefix starts the $ref of every component schema
+const RefPrefix = "#/components/schemas/"
+
+// patterns for the validate package's chars rules, \p classes work in the
+// ECMAScript regexes JSON Schema uses and in Go
+var charsPatterns = map[string]string{
+	"name":  `^[\p{L}\p{M} '’.-]*$`,
+	"alnum": `^[\p{L}\p{N}]*$`,
+}
+
+// Generator turns Go types into schemas.  Named structs are added to the
+// components once and referred to by $ref everywhere else.
+type Generator struct {
+	schemas map[string]*Schema
+}
+
+func NewGenerator() *Generator {
+	return &Generator{schemas: make(map[string]*Schema)}
+}
+
+// Schemas is everything that's been added to the components
+func (g *Generator) Schemas() map[string]*Schema {
+	return g.schemas
+}
+
+// Schema describes the type of v
+func (g *Generator) Schema(v any) *Schema {
+	return g.schemaFor(reflect.TypeOf(v))
+}
+
+// Partial is the schema of v inline with only the required fields given,
+// for operations whose handler checks fewer fields than the type has
+func (g *Generator) Partial(v any, required ...string) *Schema {
+	s := g.Schema(v)
+	component := g.Component(s.Ref)
+	if component == nil {
+		return s
+	}
+
+	partial := *component
+	partial.Required = required
+	return &partial
+}
+
+// Rules is the schema of a string checked with validate rules, for
+// parameters that are validated like struct fields
+func Rules(rules string) (s *Schema, required bool) {
+	s = &Schema{Type: "string"}
+	return s, applyValidateTag(s, rules)
+}
+
+// Component returns the component schema a $ref points to, nil if it's not
+// one of g's
+func (g *Generator) Component(ref string) *Schema {
+	name, ok := strings.CutPrefix(ref, RefPrefix)
+	if !ok {
+		return nil
+	}
+	return g.schemas[name]
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *Generator) schemaFor(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+
+		name := t.Name()
+		if _, ok := g.schemas[name]; !ok {
+			// a placeholder first so a type that refers to itself ends
+			g.schemas[name] = &Schema{}
+			*g.schemas[name] = *g.structSchema(t)
+		}
+		return &Schema{Ref: RefPrefix + name}
+	default:
+		// anything goes, like an interface
+		return &Schema{}
+	}
+}
+
+// structSchema reads the json tag for names, the validate tag for
+// constraints and an openapi tag of readOnly or writeOnly
+func (g *Generator) structSchema(t reflect.Type) *Schema {
+	closed := false
+	s := &Schema{
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: &closed,
+	}
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := g.schemaFor(field.Type)
+		if applyValidateTag(property, field.Tag.Get("validate")) {
+			s.Required = append(s.Required, name)
+		}
+
+		switch field.Tag.Get("openapi") {
+		case "readOnly":
+			property.ReadOnly = true
+		case "writeOnly":
+			property.WriteOnly = true
+		}
+
+		s.Properties[name] = property
+	}
+
+	return s
+}
+
+// applyValidateTag reports whether the field is required
+func applyValidateTag(s *Schema, rules string) bool {
+	required := false
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			// validate's required also rejects blank strings, that's left to
+			// the handlers since PATCH takes them to mean no change
+			required = true
+		case "min":
+			n, err := strconv.Atoi(arg)
+			if err == nil {
+				s.MinLength = intPointer(n)
+			}
+		case "max":
+			n, err := strconv.Atoi(arg)
+			if err == nil {
+				s.MaxLength = intPointer(n)
+			}
+		case "chars":
+			s.Pattern = charsPatterns[arg]
+		case "email":
+			s.Format = "email"
+		}
+	}
+
+	return required
+}
+
+func intPointer(n int) *int {
+	return &n
+}
@@ -0,0 +1,119 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testAddress struct {
+	Street string `validate:"required,max=50"`
+}
+
+type testPerson struct {
+	ID       string    `json:"id" openapi:"readOnly"`
+	Name     string    `json:"name" validate:"trim,required,max=100,chars=name"`
+	Email    string    `json:"email,omitempty" validate:"email"`
+	Secret   string    `json:",omitempty" openapi:"writeOnly"`
+	Born     time.Time `json:"born"`
+	Age      int
+	Tags     []string
+	Home     *testAddress
+	Others   []testAddress
+	Ignored  string `json:"-"`
+	internal string
+}
+
+func TestGeneratorStruct(t *testing.T) {
+	g := NewGenerator()
+
+	ref := g.Schema(testPerson{})
+	if ref.Ref != RefPrefix+"testPerson" {
+		t.Fatalf("bad ref, wanted: %q, got: %q", RefPrefix+"testPerson", ref.Ref)
+	}
+
+	s := g.Component(ref.Ref)
+	if s == nil {
+		t.Fatalf("no component for %q", ref.Ref)
+	}
+
+	if s.Type != "object" || s.AdditionalProperties == nil || *s.AdditionalProperties {
+		t.Errorf("bad object schema, wanted a closed object, got: %+v", s)
+	}
+	if !reflect.DeepEqual(s.Required, []string{"name"}) {
+		t.Errorf("bad required, wanted: [name], got: %v", s.Required)
+	}
+
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	for _, name := range []string{"Ignored", "internal", "-"} {
+		if _, ok := s.Properties[name]; ok {
+			t.Errorf("property %q shouldn't be in the schema, got: %v", name, names)
+		}
+	}
+
+	tests := map[string]*Schema{
+		"id":     {Type: "string", ReadOnly: true},
+		"name":   {Type: "string", MaxLength: intPointer(100), Pattern: charsPatterns["name"]},
+		"email":  {Type: "string", Format: "email"},
+		"Secret": {Type: "string", WriteOnly: true},
+		"born":   {Type: "string", Format: "date-time"},
+		"Age":    {Type: "integer"},
+		"Tags":   {Type: "array", Items: &Schema{Type: "string"}},
+		"Home":   {Ref: RefPrefix + "testAddress"},
+		"Others": {Type: "array", Items: &Schema{Ref: RefPrefix + "testAddress"}},
+	}
+
+	for name, expected := range tests {
+		if !reflect.DeepEqual(s.Properties[name], expected) {
+			t.Errorf("%s: bad schema, wanted: %s, got: %s", name, marshal(t, expected), marshal(t, s.Properties[name]))
+		}
+	}
+
+	if len(g.Schemas()) != 2 {
+		t.Errorf("bad number of components, wanted: 2, got: %d", len(g.Schemas()))
+	}
+}
+
+func TestGeneratorPartial(t *testing.T) {
+	g := NewGenerator()
+
+	partial := g.Partial(testAddress{})
+	if partial.Ref != "" || partial.Type != "object" {
+		t.Errorf("bad partial, wanted an inline object, got: %s", marshal(t, partial))
+	}
+	if len(partial.Required) != 0 {
+		t.Errorf("bad required, wanted none, got: %v", partial.Required)
+	}
+
+	// the component keeps its own required
+	component := g.Component(g.Schema(testAddress{}).Ref)
+	if !reflect.DeepEqual(component.Required, []string{"Street"}) {
+		t.Errorf("bad component required, wanted: [Street], got: %v", component.Required)
+	}
+}
+
+func TestRules(t *testing.T) {
+	s, required := Rules("trim,nfc,required,max=100,chars=alnum")
+	if !required {
+		t.Error("bad required, wanted: true, got: false")
+	}
+
+	expected := &Schema{Type: "string", MaxLength: intPointer(100), Pattern: charsPatterns["alnum"]}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("bad schema, wanted: %s, got: %s", marshal(t, expected), marshal(t, s))
+	}
+}
+
+func marshal(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("error marshalling: %v", err)
+	}
+	return string(b)
+}
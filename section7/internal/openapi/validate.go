@@ -0,0 +1,475 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// InBody is the location of ValidationErrors in a request or response body
+const InBody = "body"
+
+// ValidationError is one way a value doesn't match its schema.  Path is a
+// JSON path like $.Users[0].Email for bodies and the parameter name for
+// everything else.
+type ValidationError struct {
+	In     string
+	Path   string
+	Detail string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.In, e.Path, e.Detail)
+}
+
+// Validator checks requests and responses against the operations in a
+// document.  It understands the keywords Schema has, which is all the
+// Generator writes.
+type Validator struct {
+	doc *Document
+
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+func NewValidator(doc *Document) *Validator {
+	return &Validator{
+		doc:      doc,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+}
+
+// Value checks a value decoded from JSON, with numbers as json.Number,
+// against s.  The errors' paths start at path.
+func (v *Validator) Value(s *Schema, value any, path string) []ValidationError {
+	c := checker{v: v, in: InBody}
+	c.check(s, value, path)
+	return c.errs
+}
+
+// Params checks the path and query parameters and headers op declares.
+// Query parameters it doesn't declare are let through, clients add their
+// own for things like cache busting.
+func (v *Validator) Params(op *Operation, r *http.Request) []ValidationError {
+	var errs []ValidationError
+	query := r.URL.Query()
+
+	for _, param := range op.Parameters {
+		var values []string
+		switch param.In {
+		case InPath:
+			if value := r.PathValue(param.Name); value != "" {
+				values = []string{value}
+			}
+		case InQuery:
+			values = query[param.Name]
+		case InHeader:
+			values = r.Header.Values(param.Name)
+		}
+
+		if len(values) == 0 {
+			if param.Required {
+				errs = append(errs, ValidationError{In: param.In, Path: param.Name, Detail: "is required"})
+			}
+			continue
+		}
+
+		c := checker{v: v, in: param.In}
+		for _, value := range values {
+			c.check(param.Schema, coerce(param.Schema, value), param.Name)
+		}
+		errs = append(errs, c.errs...)
+	}
+
+	return errs
+}
+
+// coerce turns a parameter into the type its schema wants, values that
+// don't parse are left as strings to fail the type check
+func coerce(s *Schema, value string) any {
+	if s == nil {
+		return value
+	}
+
+	switch s.Type {
+	case "integer", "number":
+		if _, ok := new(big.Float).SetString(value); ok {
+			return json.Number(value)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// BodyDecoder turns a body sent as mediaType into the JSON values the
+// schemas describe.  ok is false for bodies it can't make sense of, which
+// are left for the handler to reject.
+type BodyDecoder func(mediaType string, body []byte) (value any, ok bool)
+
+// DecodeJSON is the BodyDecoder for JSON bodies
+func DecodeJSON(body []byte) (any, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value any
+	err := decoder.Decode(&value)
+	if err != nil || decoder.More() {
+		return nil, false
+	}
+	return value, true
+}
+
+// Body checks a request body against the schema op gives for its media
+// type.  Media types op doesn't list and bodies decode can't read aren't
+// checked, the handler decides what to make of them.
+func (v *Validator) Body(op *Operation, contentType string, body []byte, decode BodyDecoder) []ValidationError {
+	if op.RequestBody == nil {
+		return nil
+	}
+
+	if len(body) == 0 {
+		if op.RequestBody.Required {
+			return []ValidationError{{In: InBody, Path: "$", Detail: "a request body is required"}}
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	content, ok := op.RequestBody.Content[mediaType]
+	if !ok {
+		return nil
+	}
+
+	value, ok := decode(mediaType, body)
+	if !ok {
+		return nil
+	}
+
+	return v.Value(content.Schema, value, "$")
+}
+
+// Response checks a response op could have sent.  The status has to be
+// documented, or covered by default, and so does the media type of any
+// body.  Only JSON bodies are checked against their schema.
+func (v *Validator) Response(op *Operation, status int, header http.Header, body []byte) []ValidationError {
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = op.Responses["default"]
+	}
+	if !ok {
+		return []ValidationError{{In: "status", Path: strconv.Itoa(status), Detail: "isn't documented"}}
+	}
+
+	if len(body) == 0 {
+		return nil
+	}
+
+	contentType := header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return []ValidationError{{In: InHeader, Path: "Content-Type", Detail: fmt.Sprintf("%q can't be parsed", contentType)}}
+	}
+	content, ok := response.Content[mediaType]
+	if !ok {
+		return []ValidationError{{In: InHeader, Path: "Content-Type", Detail: fmt.Sprintf("%q isn't documented for status %d", mediaType, status)}}
+	}
+
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+
+	value, ok := DecodeJSON(body)
+	if !ok {
+		return []ValidationError{{In: InBody, Path: "$", Detail: "isn't valid JSON"}}
+	}
+
+	c := checker{v: v, in: InBody, response: true}
+	c.check(content.Schema, value, "$")
+	return c.errs
+}
+
+func (v *Validator) pattern(pattern string) (*regexp.Regexp, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	re, ok := v.patterns[pattern]
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	v.patterns[pattern] = re
+	return re, nil
+}
+
+// checker collects the errors from checking one value
+type checker struct {
+	v  *Validator
+	in string
+	// response values can't have writeOnly properties
+	response bool
+	errs     []ValidationError
+}
+
+func (c *checker) fail(path string, format string, args ...any) {
+	c.errs = append(c.errs, ValidationError{In: c.in, Path: path, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) check(s *Schema, value any, path string) {
+	if s == nil {
+		return
+	}
+
+	// keywords next to a $ref apply as well as the ones it points at
+	if s.Ref != "" {
+		name, _ := strings.CutPrefix(s.Ref, RefPrefix)
+		target, ok := c.v.doc.Components.Schemas[name]
+		if !ok {
+			c.fail(path, "schema %q doesn't exist", s.Ref)
+			return
+		}
+
+		errCount := len(c.errs)
+		c.check(target, value, path)
+		if len(c.errs) > errCount {
+			return
+		}
+
+		rest := *s
+		rest.Ref = ""
+		s = &rest
+	}
+
+	if !c.checkType(s.Type, value, path) {
+		return
+	}
+
+	switch value := value.(type) {
+	case string:
+		c.checkString(s, value, path)
+	case json.Number:
+		c.checkNumber(s, value, path)
+	case map[string]any:
+		c.checkObject(s, value, path)
+	case []any:
+		for i, item := range value {
+			c.check(s.Items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// checkType reports whether the value is the type the schema wants, an
+// empty type allows anything
+func (c *checker) checkType(typ string, value any, path string) bool {
+	ok := true
+
+	switch typ {
+	case "":
+	case "string":
+		_, ok = value.(string)
+	case "boolean":
+		_, ok = value.(bool)
+	case "object":
+		_, ok = value.(map[string]any)
+	case "array":
+		_, ok = value.([]any)
+	case "number":
+		_, ok = value.(json.Number)
+	case "integer":
+		var n json.Number
+		n, ok = value.(json.Number)
+		if ok {
+			f, _ := new(big.Float).SetString(n.String())
+			ok = f != nil && f.IsInt()
+		}
+	}
+
+	if !ok {
+		article := "a"
+		if typ == "object" || typ == "array" || typ == "integer" {
+			article = "an"
+		}
+		c.fail(path, "must be %s %s", article, typ)
+	}
+	return ok
+}
+
+func (c *checker) checkString(s *Schema, value string, path string) {
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, value) {
+		c.fail(path, "must be one of %s", strings.Join(s.Enum, ", "))
+	}
+
+	length := utf8.RuneCountInString(value)
+	if s.MinLength != nil && length < *s.MinLength {
+		c.fail(path, "must be at least %d characters", *s.MinLength)
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		c.fail(path, "must be at most %d characters", *s.MaxLength)
+	}
+
+	if s.Pattern != "" {
+		re, err := c.v.pattern(s.Pattern)
+		if err != nil {
+			c.fail(path, "schema pattern %q is invalid: %v", s.Pattern, err)
+		} else if !re.MatchString(value) {
+			c.fail(path, "must match %s", s.Pattern)
+		}
+	}
+
+	// formats are only checked on values that aren't empty, the validate
+	// package leaves those to required too
+	if value == "" {
+		return
+	}
+	switch s.Format {
+	case "email":
+		address, err := mail.ParseAddress(value)
+		if err != nil || address.Name != "" {
+			c.fail(path, "must be an email address")
+		}
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.fail(path, "must be an RFC 3339 date and time")
+		}
+	}
+}
+
+func (c *checker) checkNumber(s *Schema, value json.Number, path string) {
+	f, err := value.Float64()
+	if err != nil {
+		c.fail(path, "must be a number")
+		return
+	}
+
+	if s.Minimum != nil && f < *s.Minimum {
+		c.fail(path, "must be at least %v", *s.Minimum)
+	}
+	if s.Maximum != nil && f > *s.Maximum {
+		c.fail(path, "must be at most %v", *s.Maximum)
+	}
+}
+
+func (c *checker) checkObject(s *Schema, value map[string]any, path string) {
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the property each name sets, which is what required is about
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if property, ok := c.propertyName(s, name); ok {
+			set[property] = true
+		}
+	}
+	for _, name := range s.Required {
+		if !set[name] {
+			c.fail(propertyPath(path, name), "is required")
+		}
+	}
+
+	for _, name := range names {
+		propertyName, ok := c.propertyName(s, name)
+		property := s.Properties[propertyName]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				c.fail(propertyPath(path, name), "isn't allowed")
+			}
+			continue
+		}
+
+		if c.response && property.WriteOnly {
+			c.fail(propertyPath(path, name), "is write only and can't be sent back")
+			continue
+		}
+
+		c.check(property, value[name], propertyPath(path, name))
+	}
+}
+
+// propertyName finds the property name sets.  Requests are matched the way
+// encoding/json decodes them, the exact name first and then ignoring case,
+// so {"email": ...} is checked as the Email the handler will see.
+// Responses are written with the exact names so they have to use them.
+func (c *checker) propertyName(s *Schema, name string) (string, bool) {
+	if _, ok := s.Properties[name]; ok {
+		return name, true
+	}
+	if c.response {
+		return "", false
+	}
+
+	// sorted so the same property wins every time
+	properties := make([]string, 0, len(s.Properties))
+	for property := range s.Properties {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+
+	for _, property := range properties {
+		if strings.EqualFold(property, name) {
+			return property, true
+		}
+	}
+	return "", false
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// propertyPath uses dot notation for names that allow it and brackets for
+// the rest
+func propertyPath(path string, name string) string {
+	if identifier.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+// readBody reads up to limit bytes of the request body and puts them back
+// for the handler.  ok is false for bodies bigger than limit, or ones that
+// couldn't be read, which are put back as they are for the handler to fail
+// on.
+func readBody(r *http.Request, limit int64) (body []byte, ok bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	rest := io.MultiReader(bytes.NewReader(body), r.Body)
+	if err != nil || int64(len(body)) > limit {
+		r.Body = readCloser{rest, r.Body}
+		return nil, false
+	}
+
+	r.Body = readCloser{bytes.NewReader(body), r.Body}
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,268 @@
+package openapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	ID        string    `openapi:"readOnly"`
+	Name      string    `validate:"required,max=5,chars=name"`
+	Email     string    `validate:"email"`
+	Password  string    `json:",omitempty" openapi:"writeOnly"`
+	Age       int       `json:",omitempty"`
+	Tags      []string  `json:",omitempty"`
+	CreatedAt time.Time `json:",omitzero"`
+}
+
+// newTestDocument has one operation, PUT /users/{id}, that takes and
+// returns a testUser
+func newTestDocument() (*Document, *Operation) {
+	g := NewGenerator()
+
+	op := &Operation{
+		OperationID: "putUser",
+		Parameters: []Parameter{
+			{Name: "id", In: InPath, Required: true, Schema: &Schema{Type: "string"}},
+			{Name: "limit", In: InQuery, Schema: &Schema{Type: "integer", Minimum: floatPointer(1)}},
+			{Name: "order", In: InQuery, Schema: &Schema{Type: "string", Enum: []string{"asc", "desc"}}},
+			{Name: "userFirst", In: InHeader, Required: true, Schema: &Schema{Type: "string", MaxLength: intPointer(3)}},
+		},
+		RequestBody: &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: g.Schema(testUser{})}},
+		},
+		Responses: map[string]Response{
+			"200":     {Content: map[string]MediaType{"application/json": {Schema: g.Schema(testUser{})}}},
+			"204":     {},
+			"default": {Content: map[string]MediaType{"application/problem+json": {Schema: &Schema{Type: "object"}}}},
+		},
+	}
+
+	doc := &Document{
+		Paths:      map[string]PathItem{"/users/{id}": {"put": op}},
+		Components: Components{Schemas: g.Schemas()},
+	}
+	return doc, op
+}
+
+func floatPointer(f float64) *float64 {
+	return &f
+}
+
+func TestValue(t *testing.T) {
+	doc, op := newTestDocument()
+	v := NewValidator(doc)
+	schema := op.RequestBody.Content["application/json"].Schema
+
+	tests := map[string]struct {
+		body     string
+		expected []string
+	}{
+		"valid":            {body: `{"Name": "Zoë", "Email": "z@example.com", "Age": 3, "Tags": ["a"]}`},
+		"empty email":      {body: `{"Name": "Al", "Email": ""}`},
+		"read only sent":   {body: `{"ID": "1", "Name": "Al", "CreatedAt": "2024-01-02T03:04:05.123Z"}`},
+		"missing required": {body: `{}`, expected: []string{"$.Name: is required"}},
+		"unknown field":    {body: `{"Name": "Al", "Nmae": "Al", "odd key": 1}`, expected: []string{"$.Nmae: isn't allowed", `$["odd key"]: isn't allowed`}},
+		"wrong types": {
+			body:     `{"Name": 5, "Age": 1.5, "Tags": "a"}`,
+			expected: []string{"$.Age: must be an integer", "$.Name: must be a string", "$.Tags: must be an array"},
+		},
+		"null":        {body: `{"Name": null}`, expected: []string{"$.Name: must be a string"}},
+		"array items": {body: `{"Name": "Al", "Tags": ["a", 2]}`, expected: []string{"$.Tags[1]: must be a string"}},
+		"constraints": {
+			body: `{"Name": "Al1234", "Email": "nope", "CreatedAt": "yesterday"}`,
+			expected: []string{
+				"$.CreatedAt: must be an RFC 3339 date and time",
+				"$.Email: must be an email address",
+				"$.Name: must be at most 5 characters",
+				`$.Name: must match ^[\p{L}\p{M} '’.-]*$`,
+			},
+		},
+		"not an object": {body: `[]`, expected: []string{"$: must be an object"}},
+		// encoding/json would decode these into Name and Email
+		"other case":          {body: `{"name": "Al", "EMAIL": "nope"}`, expected: []string{"$.EMAIL: must be an email address"}},
+		"other case too long": {body: `{"nAME": "Alfred"}`, expected: []string{"$.nAME: must be at most 5 characters"}},
+	}
+
+	for name, test := range tests {
+		value, ok := DecodeJSON([]byte(test.body))
+		if !ok {
+			t.Fatalf("%s: error decoding %s", name, test.body)
+		}
+
+		got := errorStrings(v.Value(schema, value, "$"))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: bad errors, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	doc, op := newTestDocument()
+	v := NewValidator(doc)
+
+	tests := map[string]struct {
+		target   string
+		header   string
+		expected []string
+	}{
+		"valid":          {target: "/users/1?limit=10&order=desc&other=x", header: "Al"},
+		"missing header": {target: "/users/1", expected: []string{"userFirst: is required"}},
+		"bad query": {
+			target:   "/users/1?limit=0&order=up",
+			header:   "Al",
+			expected: []string{"limit: must be at least 1", "order: must be one of asc, desc"},
+		},
+		"not a number": {target: "/users/1?limit=ten", header: "Al", expected: []string{"limit: must be an integer"}},
+		"every value":  {target: "/users/1?limit=1&limit=0", header: "Al", expected: []string{"limit: must be at least 1"}},
+		"long header":  {target: "/users/1", header: "Alfred", expected: []string{"userFirst: must be at most 3 characters"}},
+	}
+
+	for name, test := range tests {
+		req := httptest.NewRequest(http.MethodPut, test.target, nil)
+		req.SetPathValue("id", "1")
+		if test.header != "" {
+			req.Header.Set("userFirst", test.header)
+		}
+
+		got := errorStrings(v.Params(op, req))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: bad errors, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+}
+
+func TestBody(t *testing.T) {
+	doc, op := newTestDocument()
+	v := NewValidator(doc)
+	decode := func(mediaType string, body []byte) (any, bool) {
+		return DecodeJSON(body)
+	}
+
+	tests := map[string]struct {
+		contentType string
+		body        string
+		expected    []string
+	}{
+		"valid":              {contentType: "application/json; charset=utf-8", body: `{"Name": "Al"}`},
+		"invalid":            {contentType: "application/json", body: `{}`, expected: []string{"$.Name: is required"}},
+		"missing":            {contentType: "application/json", expected: []string{"$: a request body is required"}},
+		"undocumented type":  {contentType: "text/plain", body: `{}`},
+		"not JSON":           {contentType: "application/json", body: `{`},
+		"bad Content-Type":   {contentType: "application/", body: `{}`},
+		"trailing junk":      {contentType: "application/json", body: `{} {}`},
+		"empty content type": {body: `{}`},
+	}
+
+	for name, test := range tests {
+		got := errorStrings(v.Body(op, test.contentType, []byte(test.body), decode))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: bad errors, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+}
+
+func TestResponse(t *testing.T) {
+	doc, op := newTestDocument()
+	v := NewValidator(doc)
+
+	tests := map[string]struct {
+		status      int
+		contentType string
+		body        string
+		expected    []string
+	}{
+		"valid":            {status: http.StatusOK, contentType: "application/json", body: `{"ID": "1", "Name": "Al"}`},
+		"no content":       {status: http.StatusNoContent},
+		"default":          {status: http.StatusNotFound, contentType: "application/problem+json", body: `{}`},
+		"write only":       {status: http.StatusOK, contentType: "application/json", body: `{"Name": "Al", "Password": "x"}`, expected: []string{"$.Password: is write only and can't be sent back"}},
+		"undocumented":     {status: http.StatusOK, contentType: "text/plain", body: "hi", expected: []string{`Content-Type: "text/plain" isn't documented for status 200`}},
+		"invalid JSON":     {status: http.StatusOK, contentType: "application/json", body: `{`, expected: []string{"$: isn't valid JSON"}},
+		"schema violation": {status: http.StatusOK, contentType: "application/json", body: `{}`, expected: []string{"$.Name: is required"}},
+		"other case":       {status: http.StatusOK, contentType: "application/json", body: `{"name": "Al"}`, expected: []string{"$.Name: is required", "$.name: isn't allowed"}},
+	}
+
+	for name, test := range tests {
+		header := http.Header{}
+		if test.contentType != "" {
+			header.Set("Content-Type", test.contentType)
+		}
+
+		got := errorStrings(v.Response(op, test.status, header, []byte(test.body)))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: bad errors, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+
+	// without a default only documented statuses are allowed
+	delete(op.Responses, "default")
+	got := errorStrings(v.Response(op, http.StatusTeapot, http.Header{}, nil))
+	if expected := []string{"418: isn't documented"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("bad errors for an undocumented status, wanted: %q, got: %q", expected, got)
+	}
+}
+
+func TestValidateRequests(t *testing.T) {
+	doc, op := newTestDocument()
+	v := NewValidator(doc)
+
+	var handlerBody string
+	handler := v.ValidateRequests(op, 64, func(mediaType string, body []byte) (any, bool) {
+		return DecodeJSON(body)
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := new(strings.Builder)
+		_, err := io.Copy(body, r.Body)
+		if err != nil {
+			t.Errorf("error reading body in the handler: %v", err)
+		}
+		handlerBody = body.String()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := map[string]struct {
+		body     string
+		header   string
+		status   int
+		expected string
+	}{
+		"valid":   {body: `{"Name": "Al"}`, header: "Al", status: http.StatusNoContent},
+		"invalid": {body: `{"Name": 1}`, status: http.StatusBadRequest},
+		// too big to check, the handler gets all of it to fail on
+		"too big": {body: `{"Name": "` + strings.Repeat("a", 100) + `"}`, header: "Al", status: http.StatusNoContent},
+	}
+
+	for name, test := range tests {
+		handlerBody = ""
+		req := httptest.NewRequest(http.MethodPut, "/users/1", strings.NewReader(test.body))
+		req.SetPathValue("id", "1")
+		req.Header.Set("Content-Type", "application/json")
+		if test.header != "" {
+			req.Header.Set("userFirst", test.header)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d\nbody: %s", name, test.status, w.Code, w.Body.String())
+		}
+		if test.status == http.StatusNoContent && handlerBody != test.body {
+			t.Errorf("%s: bad body in the handler, wanted: %q, got: %q", name, test.body, handlerBody)
+		}
+	}
+}
+
+func errorStrings(errs []ValidationError) []string {
+	var strs []string
+	for _, err := range errs {
+		strs = append(strs, err.Path+": "+err.Detail)
+	}
+	return strs
+}
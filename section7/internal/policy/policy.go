@@ -0,0 +1,141 @@
+// Package policy decides which principals may do what to users.  Roles grant
+// actions on every user, scopes from API keys and tokens grant them too, and
+// anyone logged in gets a few actions on their own record.
+package policy
+
+import (
+	"fmt"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/users"
+	"slices"
+)
+
+// Action is something a route does to users
+type Action string
+
+const (
+	ActionCreateUser Action = "users:create"
+	ActionReadUser   Action = "users:read"
+	ActionListUsers  Action = "users:list"
+	ActionUpdateUser Action = "users:update"
+	ActionDeleteUser Action = "users:delete"
+	// ActionChangePassword needs the current password, ActionResetPassword
+	// doesn't
+	ActionChangePassword Action = "users:change_password"
+	ActionResetPassword  Action = "users:reset_password"
+	ActionSetRole        Action = "users:set_role"
+)
+
+// Reason codes say why a request was denied, they're sent to clients and
+// logged
+const (
+	ReasonNotAuthenticated = "not_authenticated"
+	ReasonRoleNotAllowed   = "role_not_allowed"
+	ReasonNotOwner         = "not_owner"
+)
+
+// Scopes API keys and tokens can carry, users:read grants what the viewer
+// role does and users:write what the editor role does.  Neither can reset a
+// password, delete a user or set a role, Authorize doesn't know the target's
+// role so those would let a key take over an admin's account.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// roleActions is what each role may do to any user, each role has
+// everything the one before it has
+var roleActions = map[users.Role][]Action{
+	users.RoleNone:   nil,
+	users.RoleViewer: {ActionReadUser, ActionListUsers},
+	users.RoleEditor: {ActionReadUser, ActionListUsers, ActionCreateUser, ActionUpdateUser},
+	users.RoleAdmin: {
+		ActionReadUser, ActionListUsers, ActionCreateUser, ActionUpdateUser,
+		ActionDeleteUser, ActionChangePassword, ActionResetPassword, ActionSetRole,
+	},
+}
+
+var scopeActions = map[string][]Action{
+	ScopeUsersRead:  {ActionReadUser, ActionListUsers},
+	ScopeUsersWrite: {ActionCreateUser, ActionUpdateUser, ActionChangePassword},
+}
+
+// ownerActions are what a logged in user may do to their own record
+var ownerActions = []Action{ActionReadUser, ActionUpdateUser, ActionChangePassword}
+
+// Decision is the result of Authorize.  Reason and Detail are empty when
+// the action is allowed.
+type Decision struct {
+	Allowed bool
+	Reason  string
+	// Detail says what was missing, for people
+	Detail string
+}
+
+// Authorize decides whether p may perform action on the user with id
+// ownerID, which is empty for actions that aren't on a single user.
+//
+// Only session principals can own a record, an API key's name or a token's
+// sub claim isn't a user id.
+func Authorize(p *auth.Principal, action Action, ownerID string) Decision {
+	if p == nil {
+		return Decision{Reason: ReasonNotAuthenticated, Detail: "authentication is required"}
+	}
+
+	if slices.Contains(roleActions[users.Role(p.Role)], action) {
+		return Decision{Allowed: true}
+	}
+
+	for _, scope := range p.Scopes {
+		if slices.Contains(scopeActions[scope], action) {
+			return Decision{Allowed: true}
+		}
+	}
+
+	if slices.Contains(ownerActions, action) && ownerID != "" {
+		if p.Method == auth.MethodSession && p.Subject == ownerID {
+			return Decision{Allowed: true}
+		}
+
+		return Decision{
+			Reason: ReasonNotOwner,
+			Detail: fmt.Sprintf("%s can't %s other than their own", describe(p), verb(action)),
+		}
+	}
+
+	return Decision{
+		Reason: ReasonRoleNotAllowed,
+		Detail: fmt.Sprintf("%s can't %s", describe(p), verb(action)),
+	}
+}
+
+// verb turns an action into words for a Detail
+func verb(action Action) string {
+	switch action {
+	case ActionCreateUser:
+		return "create users"
+	case ActionReadUser:
+		return "read users"
+	case ActionListUsers:
+		return "list users"
+	case ActionUpdateUser:
+		return "update users"
+	case ActionDeleteUser:
+		return "delete users"
+	case ActionChangePassword:
+		return "change passwords"
+	case ActionResetPassword:
+		return "reset passwords"
+	case ActionSetRole:
+		return "set roles"
+	default:
+		return string(action)
+	}
+}
+
+func describe(p *auth.Principal) string {
+	if p.Role == "" {
+		return p.Subject
+	}
+	return fmt.Sprintf("%s with the %s role", p.Subject, p.Role)
+}
@@ -0,0 +1,141 @@
+package policy
+
+import (
+	"mycoolserver/internal/auth"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	session := func(id string, role string) *auth.Principal {
+		return &auth.Principal{Subject: id, Method: auth.MethodSession, Role: role}
+	}
+
+	tests := map[string]struct {
+		principal *auth.Principal
+		action    Action
+		ownerID   string
+		allowed   bool
+		reason    string
+	}{
+		"no principal": {
+			action: ActionReadUser,
+			reason: ReasonNotAuthenticated,
+		},
+		"viewer lists": {
+			principal: session("1", "viewer"),
+			action:    ActionListUsers,
+			allowed:   true,
+		},
+		"viewer can't create": {
+			principal: session("1", "viewer"),
+			action:    ActionCreateUser,
+			reason:    ReasonRoleNotAllowed,
+		},
+		"editor updates anyone": {
+			principal: session("1", "editor"),
+			action:    ActionUpdateUser,
+			ownerID:   "2",
+			allowed:   true,
+		},
+		"editor can't delete": {
+			principal: session("1", "editor"),
+			action:    ActionDeleteUser,
+			ownerID:   "2",
+			reason:    ReasonRoleNotAllowed,
+		},
+		"admin sets roles": {
+			principal: session("1", "admin"),
+			action:    ActionSetRole,
+			ownerID:   "2",
+			allowed:   true,
+		},
+		"owner reads": {
+			principal: session("1", ""),
+			action:    ActionReadUser,
+			ownerID:   "1",
+			allowed:   true,
+		},
+		"owner changes password": {
+			principal: session("1", ""),
+			action:    ActionChangePassword,
+			ownerID:   "1",
+			allowed:   true,
+		},
+		"owner can't delete": {
+			principal: session("1", ""),
+			action:    ActionDeleteUser,
+			ownerID:   "1",
+			reason:    ReasonRoleNotAllowed,
+		},
+		"owner can't set own role": {
+			principal: session("1", ""),
+			action:    ActionSetRole,
+			ownerID:   "1",
+			reason:    ReasonRoleNotAllowed,
+		},
+		"not the owner": {
+			principal: session("1", ""),
+			action:    ActionReadUser,
+			ownerID:   "2",
+			reason:    ReasonNotOwner,
+		},
+		"no role can't list": {
+			principal: session("1", ""),
+			action:    ActionListUsers,
+			reason:    ReasonRoleNotAllowed,
+		},
+		"API key named like a user id": {
+			principal: &auth.Principal{Subject: "1", Method: auth.MethodAPIKey},
+			action:    ActionReadUser,
+			ownerID:   "1",
+			reason:    ReasonNotOwner,
+		},
+		"read scope": {
+			principal: &auth.Principal{Subject: "reader", Method: auth.MethodAPIKey, Scopes: []string{ScopeUsersRead}},
+			action:    ActionReadUser,
+			ownerID:   "2",
+			allowed:   true,
+		},
+		"write scope updates": {
+			principal: &auth.Principal{Subject: "writer", Method: auth.MethodJWT, Scopes: []string{ScopeUsersWrite}},
+			action:    ActionUpdateUser,
+			ownerID:   "2",
+			allowed:   true,
+		},
+		// resetting an admin's password and logging in as them would get
+		// around not being able to set roles
+		"write scope can't reset passwords": {
+			principal: &auth.Principal{Subject: "writer", Method: auth.MethodAPIKey, Scopes: []string{ScopeUsersWrite}},
+			action:    ActionResetPassword,
+			ownerID:   "admin-id",
+			reason:    ReasonRoleNotAllowed,
+		},
+		"write scope can't delete": {
+			principal: &auth.Principal{Subject: "writer", Method: auth.MethodJWT, Scopes: []string{ScopeUsersWrite, ScopeUsersRead}},
+			action:    ActionDeleteUser,
+			ownerID:   "2",
+			reason:    ReasonRoleNotAllowed,
+		},
+		"write scope can't set roles": {
+			principal: &auth.Principal{Subject: "writer", Method: auth.MethodJWT, Scopes: []string{ScopeUsersWrite}},
+			action:    ActionSetRole,
+			ownerID:   "2",
+			reason:    ReasonRoleNotAllowed,
+		},
+	}
+
+	for name, test := range tests {
+		decision := Authorize(test.principal, test.action, test.ownerID)
+
+		if decision.Allowed != test.allowed {
+			t.Errorf("%s: bad decision, wanted allowed: %v, got: %+v", name, test.allowed, decision)
+			continue
+		}
+		if decision.Reason != test.reason {
+			t.Errorf("%s: bad reason, wanted: %q, got: %q", name, test.reason, decision.Reason)
+		}
+		if !decision.Allowed && decision.Detail == "" {
+			t.Errorf("%s: denied without a detail", name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Package problem writes error responses in the RFC 9457 problem details
+// format so clients can tell errors apart without matching on strings.
+package problem
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Problem types, clients should switch on these rather than on Title or
+// Detail which are meant for humans.
+const (
+	TypeBlank          = "about:blank"
+	TypeValidation     = "/problems/validation"
+	TypeDuplicate      = "/problems/duplicate"
+	TypeNotFound       = "/problems/not-found"
+	TypeBadRequestBody = "/problems/bad-request-body"
+	TypeUnsupported    = "/problems/unsupported-media-type"
+	TypeInternal       = "/problems/internal"
+	TypeTimeout        = "/problems/timeout"
+	TypeUnavailable    = "/problems/unavailable"
+	TypeUnauthorized   = "/problems/unauthorized"
+	TypeForbidden      = "/problems/forbidden"
+	TypeRateLimited    = "/problems/rate-limited"
+	TypeNotAcceptable  = "/problems/not-acceptable"
+	TypePrecondition   = "/problems/precondition-failed"
+	TypeConflict       = "/problems/conflict"
+)
+
+var titles = map[string]string{
+	TypeValidation:     "Validation failed",
+	TypeDuplicate:      "Resource already exists",
+	TypeNotFound:       "Resource not found",
+	TypeBadRequestBody: "Request body could not be read",
+	TypeUnsupported:    "Unsupported media type",
+	TypeInternal:       "Internal server error",
+	TypeTimeout:        "Request timed out",
+	TypeUnavailable:    "Service unavailable",
+	TypeUnauthorized:   "Authentication required",
+	TypeForbidden:      "Forbidden",
+	TypeRateLimited:    "Too many requests",
+	TypeNotAcceptable:  "Not acceptable",
+	TypePrecondition:   "Precondition failed",
+	TypeConflict:       "Conflict",
+}
+
+// FieldError points at a single invalid field, Field is the name the client
+// used for it (a JSON field, query parameter or header) or, for errors from
+// checking the body against a schema, a JSON path like $.Users[0].Email.
+// In says which part of the request it's in when that isn't obvious.
+type FieldError struct {
+	Field  string `json:"field,omitempty"`
+	In     string `json:"in,omitempty"`
+	Detail string `json:"detail"`
+}
+
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// RequestID is an extension member so a client can quote it when
+	// reporting an error
+	RequestID string `json:"requestId,omitempty"`
+	// Reason is an extension member for denials, a code saying what was
+	// missing
+	Reason string `json:"reason,omitempty"`
+}
+
+// New creates a Problem with the title that goes with problemType, or the
+// status text for TypeBlank and unknown types.
+func New(problemType string, status int, detail string) *Problem {
+	title, ok := titles[problemType]
+	if !ok {
+		title = http.StatusText(status)
+	}
+
+	return &Problem{
+		Type:   problemType,
+		Title:  title,
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// Write sends p as the response.  Instance is filled in from the request
+// path if it isn't set and r isn't nil, RequestID from the X-Request-ID
+// response header if it's been set.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" && r != nil && r.URL != nil {
+		p.Instance = r.URL.Path
+	}
+
+	if p.RequestID == "" {
+		p.RequestID = w.Header().Get("X-Request-ID")
+	}
+
+	marshalled, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("error marshalling problem", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_, err = w.Write(marshalled)
+	if err != nil {
+		slog.Error("error writing problem response body", "err", err)
+	}
+}
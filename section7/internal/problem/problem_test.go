@@ -0,0 +1,78 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/users", nil)
+	w := httptest.NewRecorder()
+
+	p := New(TypeValidation, http.StatusBadRequest, "user is invalid")
+	p.Errors = []FieldError{{Field: "Email", Detail: "invalid email"}}
+
+	Write(w, req, p)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad response code, expected: %v but got: %v", http.StatusBadRequest, w.Code)
+	}
+
+	if contentType := w.Header().Get("Content-Type"); contentType != ContentType {
+		t.Errorf("bad Content-Type, expected: %q but got: %q", ContentType, contentType)
+	}
+
+	var decoded map[string]any
+	err := json.NewDecoder(w.Body).Decode(&decoded)
+	if err != nil {
+		t.Fatalf("error decoding response body: %v", err)
+	}
+
+	expected := map[string]any{
+		"type":     TypeValidation,
+		"title":    "Validation failed",
+		"status":   float64(http.StatusBadRequest),
+		"detail":   "user is invalid",
+		"instance": "/users",
+		"errors": []any{
+			map[string]any{"field": "Email", "detail": "invalid email"},
+		},
+	}
+
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("bad problem\nwanted: %+v\ngot: %+v", expected, decoded)
+	}
+}
+
+func TestNewBlank(t *testing.T) {
+	p := New(TypeBlank, http.StatusTeapot, "")
+
+	if p.Title != http.StatusText(http.StatusTeapot) {
+		t.Errorf("bad title, expected: %q but got: %q", http.StatusText(http.StatusTeapot), p.Title)
+	}
+
+	if p.Error() != p.Title {
+		t.Errorf("bad error text, expected: %q but got: %q", p.Title, p.Error())
+	}
+}
+
+func TestWriteRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/users/nope", nil)
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "abc123")
+
+	Write(w, req, New(TypeNotFound, http.StatusNotFound, ""))
+
+	var decoded Problem
+	err := json.NewDecoder(w.Body).Decode(&decoded)
+	if err != nil {
+		t.Fatalf("error decoding response body: %v", err)
+	}
+
+	if decoded.RequestID != "abc123" {
+		t.Errorf("bad request id, expected: %q but got: %q", "abc123", decoded.RequestID)
+	}
+}
@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/problem"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Rate limit headers from the IETF httpapi draft, the values are whole
+// requests and seconds
+const (
+	HeaderLimit     = "RateLimit-Limit"
+	HeaderRemaining = "RateLimit-Remaining"
+	HeaderReset     = "RateLimit-Reset"
+)
+
+// ClientKey is who a request counts against: the principal when auth.Require
+// found one, so an API key or user gets the same bucket from every address,
+// and the remote IP otherwise.  X-Forwarded-For is ignored, anyone can set
+// it.
+func ClientKey(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok {
+		return "principal:" + p.Method + ":" + p.Subject
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware only lets requests through while key(r)'s bucket in l has
+// tokens.  Every response gets the RateLimit-* headers, a rejected request
+// gets a 429 with Retry-After as well.
+func Middleware(l *Limiter, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result := l.Allow(key(r))
+			if result.Limit == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set(HeaderLimit, strconv.Itoa(result.Limit))
+			w.Header().Set(HeaderRemaining, strconv.Itoa(result.Remaining))
+			w.Header().Set(HeaderReset, strconv.Itoa(ceilSeconds(result.Reset)))
+
+			if !result.Allowed {
+				retryAfter := max(ceilSeconds(result.RetryAfter), 1)
+				logging.FromContext(r.Context()).Info("rate limited", "retry_after", retryAfter)
+
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				problem.Write(w, r, problem.New(problem.TypeRateLimited, http.StatusTooManyRequests,
+					fmt.Sprintf("too many requests, try again in %d seconds", retryAfter)))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// FailureMiddleware limits how many responses failed says are failures,
+// like a 401 for a guessed API key, key(r) can get.  A request only goes
+// through while key(r) has a token left, but a token is only taken once the
+// response turns out to be a failure, so it can sit in front of
+// authentication without limiting clients that have credentials however
+// many requests they have in flight.  Only a rejected request gets the
+// RateLimit-* headers, the ones from Middleware further in are the ones
+// clients should go by.
+func FailureMiddleware(l *Limiter, key func(*http.Request) string, failed func(status int) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientKey := key(r)
+			result := l.Check(clientKey)
+			if result.Limit == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !result.Allowed {
+				retryAfter := max(ceilSeconds(result.RetryAfter), 1)
+				logging.FromContext(r.Context()).Warn("too many failed requests", "retry_after", retryAfter)
+				w.Header().Set(HeaderLimit, strconv.Itoa(result.Limit))
+				w.Header().Set(HeaderRemaining, "0")
+				w.Header().Set(HeaderReset, strconv.Itoa(ceilSeconds(result.Reset)))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				problem.Write(w, r, problem.New(problem.TypeRateLimited, http.StatusTooManyRequests,
+					fmt.Sprintf("too many failed requests, try again in %d seconds", retryAfter)))
+				return
+			}
+
+			// a handler that panics never gets here, so it isn't charged
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			if failed(recorder.status) {
+				l.Allow(clientKey)
+			}
+		})
+	}
+}
+
+// statusRecorder remembers the status a handler sent
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
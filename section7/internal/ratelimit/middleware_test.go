@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 0.5, Burst: 2})
+	h := Middleware(l, ClientKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		status     int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{status: http.StatusNoContent, remaining: "1", reset: "2"},
+		{status: http.StatusNoContent, remaining: "0", reset: "4"},
+		{status: http.StatusTooManyRequests, remaining: "0", reset: "4", retryAfter: "2"},
+	}
+
+	for i, test := range tests {
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+		if w.Code != test.status {
+			t.Fatalf("request %d: bad response code, wanted: %v, got: %v", i, test.status, w.Code)
+		}
+
+		expectedHeaders := map[string]string{
+			HeaderLimit:     "2",
+			HeaderRemaining: test.remaining,
+			HeaderReset:     test.reset,
+			"Retry-After":   test.retryAfter,
+		}
+		for name, expected := range expectedHeaders {
+			if got := w.Header().Get(name); got != expected {
+				t.Errorf("request %d: bad %s header, wanted: %q, got: %q", i, name, expected, got)
+			}
+		}
+
+		if w.Code != http.StatusTooManyRequests {
+			continue
+		}
+
+		var decoded problem.Problem
+		err := json.Unmarshal(w.Body.Bytes(), &decoded)
+		if err != nil {
+			t.Fatalf("error decoding problem: %v", err)
+		}
+		if decoded.Type != problem.TypeRateLimited {
+			t.Errorf("bad problem type, wanted: %s, got: %s", problem.TypeRateLimited, decoded.Type)
+		}
+	}
+}
+
+func TestFailureMiddleware(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 0.5, Burst: 2})
+	h := FailureMiddleware(l, ClientKey, func(status int) bool { return status == http.StatusUnauthorized })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-API-Key") != "right" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	send := func(apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.Header.Set("X-API-Key", apiKey)
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// successes don't use the bucket up
+	for i := range 5 {
+		if w := send("right"); w.Code != http.StatusNoContent || w.Header().Get(HeaderLimit) != "" {
+			t.Fatalf("request %d: bad response, wanted: %v without rate limit headers, got: %v %v", i, http.StatusNoContent, w.Code, w.Header())
+		}
+	}
+
+	tests := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i, expected := range tests {
+		w := send("wrong")
+		if w.Code != expected {
+			t.Fatalf("guess %d: bad response code, wanted: %v, got: %v", i, expected, w.Code)
+		}
+	}
+
+	// the address is out of tokens, whatever it sends
+	w := send("right")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("bad response code after too many failures, wanted: %v, got: %v", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+}
+
+func TestFailureMiddlewareConcurrent(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 0.5, Burst: 1})
+
+	workers := 10
+
+	// every request is in flight at once, like several slow password hashes
+	// from one client or clients behind the same NAT
+	var inFlight sync.WaitGroup
+	inFlight.Add(workers)
+	h := FailureMiddleware(l, ClientKey, func(status int) bool { return status == http.StatusUnauthorized })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlight.Done()
+			inFlight.Wait()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, workers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// we call this w because it's what would normally be passed to a handler
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users", nil))
+			codes <- w.Code
+		}()
+	}
+
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusNoContent {
+			t.Errorf("bad response code for a successful request, wanted: %v, got: %v", http.StatusNoContent, code)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	anonymous := httptest.NewRequest(http.MethodGet, "/", nil)
+	anonymous.RemoteAddr = "192.0.2.1:1234"
+	anonymous.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	authenticated := httptest.NewRequest(http.MethodGet, "/", nil)
+	authenticated = authenticated.WithContext(auth.WithPrincipal(context.Background(),
+		&auth.Principal{Subject: "42", Method: auth.MethodSession}))
+
+	tests := map[string]struct {
+		request  *http.Request
+		expected string
+	}{
+		"anonymous":     {request: anonymous, expected: "ip:192.0.2.1"},
+		"authenticated": {request: authenticated, expected: "principal:session:42"},
+	}
+
+	for name, test := range tests {
+		if got := ClientKey(test.request); got != test.expected {
+			t.Errorf("%s: bad key, wanted: %q, got: %q", name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package ratelimit keeps a token bucket per client so one client can't use
+// up the server.  Buckets are kept in memory and dropped once they're idle
+// or there are too many of them.
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is how many clients a Limiter tracks unless told otherwise
+const DefaultMaxKeys = 10000
+
+// Limit is how fast a bucket refills and how many tokens it holds.  A zero
+// Rate means no limit.
+type Limit struct {
+	// Rate is tokens added per second
+	Rate float64
+	// Burst is the most requests that can be made at once
+	Burst int
+}
+
+// Enabled reports whether l limits anything
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// Result is what Allow decided, along with what's needed for the response
+// headers
+type Result struct {
+	Allowed bool
+	Limit   int
+	// Remaining is the whole tokens left after this request
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request would be allowed, zero
+	// when this one was
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	// updated is when tokens was last worked out
+	updated time.Time
+}
+
+// Limiter is a set of token buckets, one per key.  It's safe for concurrent
+// use.
+type Limiter struct {
+	limit   Limit
+	maxKeys int
+	// idle is how long it takes an empty bucket to fill, after which it's
+	// no different from a new one and can be dropped
+	idle time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+	// buckets holds elements of lru, the front is the most recently used
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type Option func(*Limiter)
+
+// WithMaxKeys bounds how many buckets are kept, the least recently used is
+// dropped to make room for a new one.  Below 1 means DefaultMaxKeys.
+func WithMaxKeys(n int) Option {
+	return func(l *Limiter) {
+		l.maxKeys = n
+	}
+}
+
+// New returns a Limiter giving every key its own bucket with limit.  A Burst
+// below 1 is treated as 1.
+func New(limit Limit, opts ...Option) *Limiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	l := &Limiter{
+		limit:   limit,
+		maxKeys: DefaultMaxKeys,
+		now:     time.Now,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.maxKeys < 1 {
+		l.maxKeys = DefaultMaxKeys
+	}
+	if limit.Enabled() {
+		l.idle = seconds(float64(limit.Burst) / limit.Rate)
+	}
+
+	return l
+}
+
+// Allow takes a token from key's bucket if there is one
+func (l *Limiter) Allow(key string) Result {
+	return l.take(key, true)
+}
+
+// Check reports whether Allow would let key through, without taking a
+// token.  It's for limiting what requests turn out to be, so only the ones
+// that count are charged once they're done.
+func (l *Limiter) Check(key string) Result {
+	return l.take(key, false)
+}
+
+func (l *Limiter) take(key string, consume bool) Result {
+	if !l.limit.Enabled() {
+		return Result{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.evictIdle(now)
+
+	// a key with no bucket has a full one, there's no need to make it just
+	// to look
+	if _, ok := l.buckets[key]; !ok && !consume {
+		return Result{Allowed: true, Limit: l.limit.Burst, Remaining: l.limit.Burst}
+	}
+
+	b := l.get(key, now)
+
+	// refill for the time since the bucket was last used
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(l.limit.Burst), b.tokens+elapsed*l.limit.Rate)
+		b.updated = now
+	}
+
+	result := Result{Limit: l.limit.Burst}
+	if b.tokens >= 1 {
+		if consume {
+			b.tokens--
+		}
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / l.limit.Rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(l.limit.Burst) - b.tokens) / l.limit.Rate)
+
+	return result
+}
+
+// Len is how many buckets are being kept
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+// get finds key's bucket, making a full one if it's new, and marks it as
+// the most recently used.  The caller holds mu.
+func (l *Limiter) get(key string, now time.Time) *bucket {
+	element, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(element)
+		return element.Value.(*bucket)
+	}
+
+	if l.lru.Len() >= l.maxKeys {
+		l.remove(l.lru.Back())
+	}
+
+	b := &bucket{key: key, tokens: float64(l.limit.Burst), updated: now}
+	l.buckets[key] = l.lru.PushFront(b)
+	return b
+}
+
+// evictIdle drops buckets from the back of the list, the least recently
+// used, until it finds one that's still refilling.  The caller holds mu.
+func (l *Limiter) evictIdle(now time.Time) {
+	for element := l.lru.Back(); element != nil; element = l.lru.Back() {
+		if now.Sub(element.Value.(*bucket).updated) < l.idle {
+			return
+		}
+		l.remove(element)
+	}
+}
+
+func (l *Limiter) remove(element *list.Element) {
+	l.lru.Remove(element)
+	delete(l.buckets, element.Value.(*bucket).key)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limit Limit, opts ...Option) (*Limiter, *time.Time) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := New(limit, opts...)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestAllow(t *testing.T) {
+	l, now := newTestLimiter(Limit{Rate: 2, Burst: 3})
+
+	// the bucket starts full
+	for i := range 3 {
+		result := l.Allow("a")
+		if !result.Allowed {
+			t.Fatalf("request %d wasn't allowed", i)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("bad remaining after request %d, wanted: %d, got: %d", i, 2-i, result.Remaining)
+		}
+	}
+
+	result := l.Allow("a")
+	if result.Allowed {
+		t.Fatal("request over the burst was allowed")
+	}
+	if result.RetryAfter != 500*time.Millisecond {
+		t.Errorf("bad retry after, wanted: %v, got: %v", 500*time.Millisecond, result.RetryAfter)
+	}
+	if result.Reset != 1500*time.Millisecond {
+		t.Errorf("bad reset, wanted: %v, got: %v", 1500*time.Millisecond, result.Reset)
+	}
+
+	// other keys have their own bucket
+	if !l.Allow("b").Allowed {
+		t.Error("a different key was limited")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if !l.Allow("a").Allowed {
+		t.Error("request wasn't allowed after the bucket refilled a token")
+	}
+	if l.Allow("a").Allowed {
+		t.Error("request was allowed with an empty bucket")
+	}
+
+	// never more than the burst, however long it's been
+	*now = now.Add(time.Hour)
+	allowed := 0
+	for range 10 {
+		if l.Allow("b").Allowed {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("bad requests allowed after a long wait, wanted: 3, got: %d", allowed)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 1, Burst: 2})
+
+	for range 5 {
+		if !l.Check("a").Allowed {
+			t.Fatal("check was refused with a full bucket")
+		}
+	}
+	if l.Len() != 0 {
+		t.Errorf("bad bucket count after checks, wanted: 0, got: %d", l.Len())
+	}
+
+	l.Allow("a")
+	if result := l.Check("a"); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("bad check with a token left, wanted: allowed with 1 remaining, got: %+v", result)
+	}
+
+	l.Allow("a")
+	if l.Check("a").Allowed {
+		t.Error("check was allowed with an empty bucket")
+	}
+}
+
+func TestAllowDisabled(t *testing.T) {
+	l, _ := newTestLimiter(Limit{})
+
+	for range 100 {
+		if !l.Allow("a").Allowed {
+			t.Fatal("request limited with no limit")
+		}
+	}
+	if l.Len() != 0 {
+		t.Errorf("buckets kept with no limit: %d", l.Len())
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 1, Burst: 1}, WithMaxKeys(2))
+
+	l.Allow("a")
+	l.Allow("b")
+	// a is now the most recently used, so c pushes b out
+	l.Allow("a")
+	l.Allow("c")
+
+	if l.Len() != 2 {
+		t.Errorf("bad number of buckets, wanted: 2, got: %d", l.Len())
+	}
+	if l.Allow("a").Allowed {
+		t.Error("a's bucket was dropped instead of b's")
+	}
+	if !l.Allow("b").Allowed {
+		t.Error("b's bucket wasn't dropped")
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+	l, now := newTestLimiter(Limit{Rate: 1, Burst: 5})
+
+	for i := range 10 {
+		l.Allow(fmt.Sprint(i))
+	}
+
+	// a bucket that's had time to refill is dropped on the next Allow
+	*now = now.Add(5 * time.Second)
+	l.Allow("new")
+
+	if l.Len() != 1 {
+		t.Errorf("idle buckets kept, wanted: 1, got: %d", l.Len())
+	}
+}
+
+func TestAllowConcurrent(t *testing.T) {
+	// the clock doesn't move, so exactly the burst gets through
+	l, _ := newTestLimiter(Limit{Rate: 1, Burst: 50})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.Allow("a").Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 50 {
+		t.Errorf("bad requests allowed, wanted: 50, got: %d", allowed)
+	}
+}
@@ -0,0 +1,254 @@
+// Package tlsconfig builds the server side TLS setup: a certificate that can
+// be swapped without a restart, a modern protocol and cipher policy, optional
+// client certificate checks and a listener that sends plain HTTP to HTTPS.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client auth modes for Options.ClientAuth
+const (
+	ClientAuthNone = "none"
+	// ClientAuthRequest verifies a client certificate if one is sent
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// cipherSuites only applies to TLS 1.2, Go doesn't let 1.3 suites be picked
+// and all of them are fine.  Only forward secret AEAD suites are allowed.
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// Options are the settings from config.TLSConfig that shape the tls.Config
+type Options struct {
+	// MinVersion is "1.2" or "1.3", empty means 1.2
+	MinVersion string
+	// ClientCAFile is a PEM bundle of CAs that sign client certificates
+	ClientCAFile string
+	// ClientAuth is one of the ClientAuth constants, empty means none
+	ClientAuth string
+}
+
+// ParseVersion turns "1.2" or "1.3" into the crypto/tls constant.
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version: %q, must be 1.2 or 1.3", version)
+	}
+}
+
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("unknown client auth mode: %q", mode)
+	}
+}
+
+// ServerConfig returns a tls.Config that gets its certificate from reloader,
+// so new connections pick up a reloaded certificate and open ones are left
+// alone.
+func ServerConfig(reloader *CertReloader, opts Options) (*tls.Config, error) {
+	minVersion, err := ParseVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth, err := parseClientAuth(opts.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+
+	if clientAuth != tls.NoClientCert {
+		if opts.ClientCAFile == "" {
+			return nil, errors.New("client auth needs a client CA file")
+		}
+
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", opts.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// CertReloader holds the current certificate and key pair and loads them
+// again on Reload or when Watch sees the files change.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the pair once, so a bad path fails at startup rather
+// than on the first handshake.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads both files again.  If that fails the old certificate stays in
+// use.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.modTime = modTime
+
+	return nil
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Watch checks the files every interval until ctx is done and reloads when
+// either has a newer modification time.  Polling avoids needing a file
+// notification library and also copes with files being replaced by renames.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := r.changed()
+		if err != nil {
+			slog.Error("error checking TLS certificate files", "err", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		err = r.Reload()
+		if err != nil {
+			slog.Error("error reloading TLS certificate", "err", err)
+			continue
+		}
+		slog.Info("reloaded TLS certificate", "cert", r.certFile)
+	}
+}
+
+func (r *CertReloader) changed() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return !modTime.Equal(r.modTime), nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error checking TLS file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// RedirectHandler sends every request to the same path on HTTPS.  httpsAddr is
+// the address the TLS server listens on, its port is used unless it's 443.
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port in the request
+			host = strings.Trim(r.Host, "[]")
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// 308 rather than 301 so clients repeat POSTs instead of turning them
+		// into GETs
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
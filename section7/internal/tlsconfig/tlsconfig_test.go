@@ -0,0 +1,396 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	tlsCert tls.Certificate
+}
+
+// newTestCert makes a certificate for name signed by parent, or a self signed
+// CA when parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("error generating serial: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		tlsCert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert},
+	}
+}
+
+// writeFiles writes the certificate and key as PEM and returns their paths
+func (c *testCert) writeFiles(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("error marshalling key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600)
+	if err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+
+	return certFile, keyFile
+}
+
+func servedSerial(t *testing.T, r *CertReloader) *big.Int {
+	t.Helper()
+
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("error getting certificate: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("error parsing served certificate: %v", err)
+	}
+
+	return leaf.SerialNumber
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "localhost", nil)
+	certFile, keyFile := first.writeFiles(t, dir)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error creating reloader: %v", err)
+	}
+
+	if servedSerial(t, r).Cmp(first.cert.SerialNumber) != 0 {
+		t.Error("reloader isn't serving the first certificate")
+	}
+
+	second := newTestCert(t, "localhost", nil)
+	second.writeFiles(t, dir)
+
+	err = r.Reload()
+	if err != nil {
+		t.Fatalf("error reloading: %v", err)
+	}
+
+	if servedSerial(t, r).Cmp(second.cert.SerialNumber) != 0 {
+		t.Error("reloader isn't serving the second certificate after Reload")
+	}
+
+	// a broken key shouldn't replace a working certificate
+	err = os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	if err != nil {
+		t.Fatalf("error breaking key: %v", err)
+	}
+
+	err = r.Reload()
+	if err == nil {
+		t.Error("no error reloading a broken key")
+	}
+
+	if servedSerial(t, r).Cmp(second.cert.SerialNumber) != 0 {
+		t.Error("failed reload replaced the certificate")
+	}
+
+	_, err = NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile)
+	if err == nil {
+		t.Error("no error creating a reloader for a missing file")
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "localhost", nil).writeFiles(t, dir)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error creating reloader: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	replacement := newTestCert(t, "localhost", nil)
+	replacement.writeFiles(t, dir)
+
+	// make sure the modification time moves even on filesystems with coarse
+	// timestamps
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		err = os.Chtimes(path, later, later)
+		if err != nil {
+			t.Fatalf("error setting modification time: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, r).Cmp(replacement.cert.SerialNumber) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("watch didn't reload the changed certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTLSServer starts a test server using the config from ServerConfig and
+// returns it with a CA pool that trusts it
+func newTLSServer(t *testing.T, opts Options) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+
+	serverCA := newTestCert(t, "server-ca", nil)
+	certFile, keyFile := newTestCert(t, "localhost", serverCA).writeFiles(t, t.TempDir())
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error creating reloader: %v", err)
+	}
+
+	tlsConfig, err := ServerConfig(r, opts)
+	if err != nil {
+		t.Fatalf("error creating TLS config: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	ts.TLS = tlsConfig
+	// failed handshakes are expected, don't log them
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCA.cert)
+
+	return ts, pool
+}
+
+func newClient(roots *x509.CertPool, clientCert *testCert, maxVersion uint16) *http.Client {
+	tlsConfig := &tls.Config{
+		RootCAs:    roots,
+		MaxVersion: maxVersion,
+		// httptest serves its own certificate to clients that don't send a
+		// server name
+		ServerName: "localhost",
+	}
+	if clientCert != nil {
+		// sent even when the server asks for a different CA, Certificates
+		// would hold it back
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert.tlsCert, nil
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
+
+func TestServerConfigVersions(t *testing.T) {
+	tests := map[string]struct {
+		minVersion    string
+		clientMax     uint16
+		expectSuccess bool
+	}{
+		"1.2 client on default":  {"", tls.VersionTLS12, true},
+		"1.1 client on default":  {"", tls.VersionTLS11, false},
+		"1.3 client on 1.3 only": {"1.3", tls.VersionTLS13, true},
+		"1.2 client on 1.3 only": {"1.3", tls.VersionTLS12, false},
+	}
+
+	for name, test := range tests {
+		ts, roots := newTLSServer(t, Options{MinVersion: test.minVersion})
+
+		resp, err := newClient(roots, nil, test.clientMax).Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if test.expectSuccess && err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if !test.expectSuccess && err == nil {
+			t.Errorf("%s: handshake should have failed", name)
+		}
+	}
+
+	_, err := ParseVersion("1.0")
+	if err == nil {
+		t.Error("no error for TLS 1.0")
+	}
+}
+
+func TestServerConfigClientAuth(t *testing.T) {
+	clientCA := newTestCert(t, "client-ca", nil)
+	client := newTestCert(t, "alice", clientCA)
+	stranger := newTestCert(t, "mallory", newTestCert(t, "other-ca", nil))
+
+	caFile, _ := clientCA.writeFiles(t, t.TempDir())
+
+	tests := map[string]struct {
+		clientAuth     string
+		clientCert     *testCert
+		expectSuccess  bool
+		expectedCaller string
+	}{
+		"required and sent":       {ClientAuthRequire, client, true, "alice"},
+		"required and missing":    {ClientAuthRequire, nil, false, ""},
+		"required and untrusted":  {ClientAuthRequire, stranger, false, ""},
+		"requested and missing":   {ClientAuthRequest, nil, true, ""},
+		"requested and sent":      {ClientAuthRequest, client, true, "alice"},
+		"requested and untrusted": {ClientAuthRequest, stranger, false, ""},
+	}
+
+	for name, test := range tests {
+		ts, roots := newTLSServer(t, Options{ClientAuth: test.clientAuth, ClientCAFile: caFile})
+
+		resp, err := newClient(roots, test.clientCert, 0).Get(ts.URL)
+		if !test.expectSuccess {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: request should have failed", name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		resp.Body.Close()
+
+		if string(body[:n]) != test.expectedCaller {
+			t.Errorf("%s: bad client certificate name, wanted: %q, got: %q", name, test.expectedCaller, body[:n])
+		}
+	}
+
+	_, err := ServerConfig(&CertReloader{}, Options{ClientAuth: ClientAuthRequire})
+	if err == nil {
+		t.Error("no error requiring client certificates without a CA file")
+	}
+
+	_, err = ServerConfig(&CertReloader{}, Options{ClientAuth: "sometimes"})
+	if err == nil {
+		t.Error("no error for unknown client auth mode")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := map[string]struct {
+		httpsAddr string
+		host      string
+		target    string
+		expected  string
+	}{
+		"default port": {
+			httpsAddr: ":443",
+			host:      "example.com",
+			target:    "/users?limit=5",
+			expected:  "https://example.com/users?limit=5",
+		},
+		"custom port replaces the http one": {
+			httpsAddr: ":8443",
+			host:      "example.com:8080",
+			target:    "/hello/",
+			expected:  "https://example.com:8443/hello/",
+		},
+		"ipv6": {
+			httpsAddr: ":443",
+			host:      "[::1]:8080",
+			target:    "/",
+			expected:  "https://[::1]/",
+		},
+	}
+
+	for name, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, test.target, nil)
+		r.Host = test.host
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		RedirectHandler(test.httpsAddr).ServeHTTP(w, r)
+
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: bad status code, wanted: %d, got: %d", name, http.StatusPermanentRedirect, w.Code)
+		}
+
+		if w.Header().Get("Location") != test.expected {
+			t.Errorf("%s: bad location, wanted: %q, got: %q", name, test.expected, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package users
+
+import (
+	"errors"
+	"mycoolserver/internal/validate"
+)
+
+var (
+	ErrNoResultsFound = errors.New("no results found")
+	ErrDuplicateEmail = errors.New("user with this email already exists")
+	ErrShuttingDown   = errors.New("user manager is shutting down")
+	// ErrBusy means too many passwords are being hashed at once, the caller
+	// should try again shortly
+	ErrBusy = errors.New("too many passwords being hashed")
+	// ErrVersionMismatch means the user changed after the caller read it
+	ErrVersionMismatch = errors.New("user has been changed since it was read")
+
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidSession     = errors.New("session is invalid or has expired")
+
+	// ErrValidation matches any *FieldError with errors.Is
+	ErrValidation = validate.ErrInvalid
+
+	ErrInvalidCursor = &FieldError{Field: "Cursor", Detail: "invalid cursor"}
+)
+
+// FieldError reports an invalid value for one field, Field is the name of
+// the struct field or function argument it came from.  Validation of a whole
+// user reports every invalid field at once as a validate.Errors.
+type FieldError = validate.FieldError
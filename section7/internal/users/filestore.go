@@ -0,0 +1,543 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const defaultCompactAfter = 1000
+
+// FileStore keeps users in memory and appends every change to a write-ahead
+// log next to the snapshot file, so they survive a restart or a crash.
+//
+// The snapshot at path is a JSON array of users, the log at path + ".wal"
+// holds one record per line in the form "<crc32 hex> <json>\n".  On open the
+// snapshot is loaded and the log is replayed on top of it.  A record that was
+// only partially written when the process died fails its checksum, and the
+// log is truncated back to the last good record.  A bad record with good ones
+// after it can't have been torn that way, so the store fails to open with
+// ErrCorruptLog rather than lose them.  Records are applied as
+// upserts and deletes by id so replaying a record that already made it into
+// the snapshot is harmless.
+type FileStore struct {
+	mu           sync.Mutex
+	path         string
+	mem          *MemoryStore
+	log          *os.File
+	logSize      int64
+	records      int
+	compactAfter int
+	syncWrites   bool
+}
+
+type FileStoreOption func(*FileStore)
+
+// WithCompactAfter sets how many log records are written before the log is
+// folded into a new snapshot.  Zero or less disables compaction.
+func WithCompactAfter(records int) FileStoreOption {
+	return func(s *FileStore) {
+		s.compactAfter = records
+	}
+}
+
+// WithSyncWrites controls whether every log record is fsynced before the
+// write returns.  It's on by default; turning it off is faster but a power
+// loss can lose the most recent writes.  A kill -9 can't, the data is already
+// with the OS.
+func WithSyncWrites(enabled bool) FileStoreOption {
+	return func(s *FileStore) {
+		s.syncWrites = enabled
+	}
+}
+
+type logOp string
+
+const (
+	opPut    logOp = "put"
+	opDelete logOp = "delete"
+)
+
+type logRecord struct {
+	Op   logOp
+	User *User  `json:",omitempty"`
+	ID   string `json:",omitempty"`
+}
+
+// NewFileStore loads the snapshot at path and replays the log.  Both files
+// are created if they don't exist yet.
+func NewFileStore(path string, opts ...FileStoreOption) (*FileStore, error) {
+	s := FileStore{
+		path:         path,
+		mem:          NewMemoryStore(),
+		compactAfter: defaultCompactAfter,
+		syncWrites:   true,
+	}
+
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	err := s.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.replayLog()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *FileStore) Create(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.mem.GetByID(u.ID)
+	if err == nil {
+		return ErrUserExists
+	}
+
+	err = s.appendRecord(logRecord{Op: opPut, User: &u})
+	if err != nil {
+		return err
+	}
+
+	err = s.mem.Create(u)
+	if err != nil {
+		return err
+	}
+
+	s.maybeCompact()
+
+	return nil
+}
+
+func (s *FileStore) GetByName(first string, last string) (*User, error) {
+	return s.mem.GetByName(first, last)
+}
+
+func (s *FileStore) GetByID(id string) (*User, error) {
+	return s.mem.GetByID(id)
+}
+
+func (s *FileStore) GetByEmail(email string) (*User, error) {
+	return s.mem.GetByEmail(email)
+}
+
+func (s *FileStore) List() ([]User, error) {
+	return s.mem.List()
+}
+
+func (s *FileStore) Update(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.mem.GetByID(u.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.appendRecord(logRecord{Op: opPut, User: &u})
+	if err != nil {
+		return err
+	}
+
+	err = s.mem.Update(u)
+	if err != nil {
+		return err
+	}
+
+	s.maybeCompact()
+
+	return nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.mem.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	err = s.appendRecord(logRecord{Op: opDelete, ID: id})
+	if err != nil {
+		return err
+	}
+
+	err = s.mem.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	s.maybeCompact()
+
+	return nil
+}
+
+// Ping checks the log is still open and is still the file at its path.  If
+// it was deleted or replaced, writes would go somewhere a restart won't find
+// them.
+func (s *FileStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return ErrStoreClosed
+	}
+
+	openInfo, err := s.log.Stat()
+	if err != nil {
+		return fmt.Errorf("error checking open user log: %w", err)
+	}
+
+	pathInfo, err := os.Stat(s.logPath())
+	if err != nil {
+		return fmt.Errorf("error checking user log: %w", err)
+	}
+
+	if !os.SameFile(openInfo, pathInfo) {
+		return fmt.Errorf("user log %s was replaced while open", s.logPath())
+	}
+
+	return nil
+}
+
+// Close flushes the log to disk and closes it.  The store can't be used
+// afterward.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+
+	err := s.log.Sync()
+	if err != nil {
+		s.log.Close()
+		s.log = nil
+		return fmt.Errorf("error syncing user log: %w", err)
+	}
+
+	err = s.log.Close()
+	s.log = nil
+	if err != nil {
+		return fmt.Errorf("error closing user log: %w", err)
+	}
+
+	return nil
+}
+
+// Compact writes the current users to a new snapshot and empties the log.
+func (s *FileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compact()
+}
+
+func (s *FileStore) logPath() string {
+	return s.path + ".wal"
+}
+
+func (s *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error reading user snapshot: %w", err)
+	}
+
+	var snapshot []User
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return fmt.Errorf("error parsing user snapshot: %w", err)
+	}
+
+	for _, u := range snapshot {
+		err = s.mem.Create(u)
+		if err != nil {
+			return fmt.Errorf("error loading user snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStore) replayLog() error {
+	logFile, err := os.OpenFile(s.logPath(), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening user log: %w", err)
+	}
+
+	reader := bufio.NewReader(logFile)
+	var goodSize int64
+	// badErr is set once a record fails to decode, after that the rest of
+	// the log is only read to check it's all garbage
+	var badErr error
+
+	for offset := int64(0); ; {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 && badErr == nil {
+				slog.Warn("dropping incomplete record at end of user log", "offset", goodSize)
+			}
+			break
+		}
+		if err != nil {
+			logFile.Close()
+			return fmt.Errorf("error reading user log: %w", err)
+		}
+
+		record, err := decodeRecord(line)
+		offset += int64(len(line))
+		if badErr != nil {
+			if err == nil {
+				logFile.Close()
+				return fmt.Errorf("%w: bad record at offset %d is followed by good ones, fix or move %s aside: %v",
+					ErrCorruptLog, goodSize, s.logPath(), badErr)
+			}
+			continue
+		}
+		if err != nil {
+			badErr = err
+			continue
+		}
+
+		s.applyRecord(record)
+		goodSize = offset
+		s.records++
+	}
+	if badErr != nil {
+		slog.Warn("dropping corrupt records at end of user log", "offset", goodSize, "err", badErr)
+	}
+
+	// anything past the last good record is a torn write, cut it off so new
+	// records don't end up behind garbage
+	err = logFile.Truncate(goodSize)
+	if err != nil {
+		logFile.Close()
+		return fmt.Errorf("error truncating user log: %w", err)
+	}
+
+	_, err = logFile.Seek(goodSize, io.SeekStart)
+	if err != nil {
+		logFile.Close()
+		return fmt.Errorf("error seeking user log: %w", err)
+	}
+
+	s.log = logFile
+	s.logSize = goodSize
+
+	return nil
+}
+
+func (s *FileStore) applyRecord(record logRecord) {
+	switch record.Op {
+	case opPut:
+		err := s.mem.Update(*record.User)
+		if errors.Is(err, ErrNoResultsFound) {
+			_ = s.mem.Create(*record.User)
+		}
+	case opDelete:
+		_ = s.mem.Delete(record.ID)
+	}
+}
+
+// appendRecord expects the caller to hold s.mu
+func (s *FileStore) appendRecord(record logRecord) error {
+	if s.log == nil {
+		return ErrStoreClosed
+	}
+
+	line, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.log.Write(line)
+	if err != nil {
+		// don't leave half a record behind for the next one to follow
+		_ = s.log.Truncate(s.logSize)
+		_, _ = s.log.Seek(s.logSize, io.SeekStart)
+		return fmt.Errorf("error writing user log: %w", err)
+	}
+
+	s.logSize += int64(len(line))
+	s.records++
+
+	if s.syncWrites {
+		err = s.log.Sync()
+		if err != nil {
+			return fmt.Errorf("error syncing user log: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// maybeCompact expects the caller to hold s.mu and to have applied the last
+// record to s.mem
+func (s *FileStore) maybeCompact() {
+	if s.compactAfter <= 0 || s.records < s.compactAfter {
+		return
+	}
+
+	err := s.compact()
+	if err != nil {
+		// the records are safely in the log, compaction will be retried on
+		// the next write
+		slog.Error("error compacting user log", "err", err)
+	}
+}
+
+// compact expects the caller to hold s.mu
+func (s *FileStore) compact() error {
+	if s.log == nil {
+		return ErrStoreClosed
+	}
+
+	snapshot, err := s.mem.List()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("error marshalling user snapshot: %w", err)
+	}
+
+	err = writeFileAtomic(s.path, data)
+	if err != nil {
+		return err
+	}
+
+	// a crash between the rename above and the truncate below just means
+	// the old records get replayed over a snapshot that already has them
+	err = s.log.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("error truncating user log: %w", err)
+	}
+
+	_, err = s.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking user log: %w", err)
+	}
+
+	err = s.log.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing user log: %w", err)
+	}
+
+	s.logSize = 0
+	s.records = 0
+
+	return nil
+}
+
+func encodeRecord(record logRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling log record: %w", err)
+	}
+
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%08x ", crc32.ChecksumIEEE(data))
+	line.Write(data)
+	line.WriteByte('\n')
+
+	return line.Bytes(), nil
+}
+
+func decodeRecord(line []byte) (logRecord, error) {
+	var record logRecord
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	checksumHex, data, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return record, errors.New("missing checksum")
+	}
+
+	checksum, err := strconv.ParseUint(string(checksumHex), 16, 32)
+	if err != nil {
+		return record, fmt.Errorf("invalid checksum: %q", checksumHex)
+	}
+
+	if crc32.ChecksumIEEE(data) != uint32(checksum) {
+		return record, errors.New("checksum mismatch")
+	}
+
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return record, fmt.Errorf("error parsing log record: %w", err)
+	}
+
+	switch {
+	case record.Op == opPut && record.User != nil:
+	case record.Op == opDelete && record.ID != "":
+	default:
+		return record, fmt.Errorf("invalid log record: %s", data)
+	}
+
+	return record, nil
+}
+
+// writeFileAtomic writes data to a temp file, fsyncs it and renames it over
+// path so a crash never leaves a half written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temp file: %w", err)
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing temp file: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error closing temp file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", path, err)
+	}
+
+	// make the rename itself durable, not every platform supports syncing a
+	// directory so errors here are ignored
+	dirFile, err := os.Open(dir)
+	if err == nil {
+		_ = dirFile.Sync()
+		dirFile.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package users
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+type SortField string
+
+const (
+	SortByCreated   SortField = "created"
+	SortByLastName  SortField = "lastName"
+	SortByFirstName SortField = "firstName"
+)
+
+// ListOptions controls which users ListUsers returns and in what order.  The
+// zero value returns the first DefaultListLimit users, oldest first.
+type ListOptions struct {
+	// Limit is the page size, zero means DefaultListLimit
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor     string
+	SortBy     SortField
+	Descending bool
+
+	// EmailDomain only keeps users whose address is at this domain
+	EmailDomain string
+	// Email only keeps users with exactly this address
+	Email string
+	// NamePrefix only keeps users whose first or last name starts with it
+	NamePrefix string
+}
+
+type ListPage struct {
+	Users []User
+	// NextCursor is empty on the last page
+	NextCursor string
+}
+
+// listCursor points just past the last user of a page.  It holds that user's
+// sort key rather than an offset so pages stay stable while users are added
+// or removed.
+type listCursor struct {
+	SortBy     SortField
+	Descending bool
+	Key        []string
+}
+
+// ListUsers returns one page of users matching opts.  Names and email
+// filters are compared case-insensitively.
+func (m *Manager) ListUsers(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if opts.Limit == 0 {
+		opts.Limit = DefaultListLimit
+	}
+	if opts.Limit < 0 || opts.Limit > MaxListLimit {
+		return nil, &FieldError{
+			Field:  "Limit",
+			Detail: fmt.Sprintf("invalid limit: %d, must be between 1 and %d", opts.Limit, MaxListLimit),
+		}
+	}
+
+	if opts.SortBy == "" {
+		opts.SortBy = SortByCreated
+	}
+
+	switch opts.SortBy {
+	case SortByCreated, SortByLastName, SortByFirstName:
+	default:
+		return nil, &FieldError{Field: "SortBy", Detail: fmt.Sprintf("invalid sort field: %q", opts.SortBy)}
+	}
+
+	var after []string
+	if opts.Cursor != "" {
+		cursor, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		if cursor.SortBy != opts.SortBy || cursor.Descending != opts.Descending {
+			return nil, fmt.Errorf("%w: cursor is for a different sort order", ErrInvalidCursor)
+		}
+
+		after = cursor.Key
+	}
+
+	unlock, err := m.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	allUsers, err := m.store.List()
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	matched := slices.DeleteFunc(allUsers, func(u User) bool {
+		return !opts.matches(u)
+	})
+
+	compare := func(a []string, b []string) int {
+		result := slices.Compare(a, b)
+		if opts.Descending {
+			return -result
+		}
+		return result
+	}
+
+	slices.SortFunc(matched, func(a User, b User) int {
+		return compare(sortKey(a, opts.SortBy), sortKey(b, opts.SortBy))
+	})
+
+	start := 0
+	if after != nil {
+		start, _ = slices.BinarySearchFunc(matched, after, func(u User, key []string) int {
+			// anything equal to the cursor was on the previous page
+			if compare(sortKey(u, opts.SortBy), key) <= 0 {
+				return -1
+			}
+			return 1
+		})
+	}
+
+	end := min(start+opts.Limit, len(matched))
+
+	page := ListPage{
+		Users: matched[start:end],
+	}
+
+	if end < len(matched) {
+		page.NextCursor = encodeCursor(listCursor{
+			SortBy:     opts.SortBy,
+			Descending: opts.Descending,
+			Key:        sortKey(matched[end-1], opts.SortBy),
+		})
+	}
+
+	return &page, nil
+}
+
+func (opts ListOptions) matches(u User) bool {
+	if opts.Email != "" && !strings.EqualFold(u.Email.Address, opts.Email) {
+		return false
+	}
+
+	if opts.EmailDomain != "" {
+		_, domain, _ := strings.Cut(u.Email.Address, "@")
+		if !strings.EqualFold(domain, opts.EmailDomain) {
+			return false
+		}
+	}
+
+	if opts.NamePrefix != "" {
+		prefix := strings.ToLower(opts.NamePrefix)
+		if !strings.HasPrefix(strings.ToLower(u.FirstName), prefix) &&
+			!strings.HasPrefix(strings.ToLower(u.LastName), prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortKey always ends with the id so no two users share a key, which is what
+// lets a cursor point between them.
+func sortKey(u User, field SortField) []string {
+	switch field {
+	case SortByLastName:
+		return []string{strings.ToLower(u.LastName), strings.ToLower(u.FirstName), u.ID}
+	case SortByFirstName:
+		return []string{strings.ToLower(u.FirstName), strings.ToLower(u.LastName), u.ID}
+	default:
+		// zero padded so the strings sort the same way the times do
+		return []string{fmt.Sprintf("%020d", u.CreatedAt.UnixNano()), u.ID}
+	}
+}
+
+func encodeCursor(cursor listCursor) string {
+	// marshalling a struct of strings and bools can't fail
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor listCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || len(cursor.Key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
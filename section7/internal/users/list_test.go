@@ -0,0 +1,227 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newListTestManager(t *testing.T) (*Manager, []*User) {
+	t.Helper()
+
+	testManager := NewManager()
+	testTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time {
+		testTime = testTime.Add(time.Minute)
+		return testTime
+	}
+
+	names := [][3]string{
+		{"Ada", "Lovelace", "ada@example.com"},
+		{"Grace", "Hopper", "grace@navy.example.org"},
+		{"Alan", "Turing", "alan@example.com"},
+		{"Edsger", "Dijkstra", "edsger@example.net"},
+		{"Barbara", "Liskov", "barbara@example.com"},
+		{"alan", "Kay", "kay@example.com"},
+	}
+
+	var created []*User
+	for _, name := range names {
+		u, err := testManager.CreateUser(context.Background(), name[0], name[1], name[2])
+		if err != nil {
+			t.Fatalf("error adding test user: %v", err)
+		}
+		created = append(created, u)
+	}
+
+	return testManager, created
+}
+
+func userIDs(list []User) []string {
+	ids := make([]string, 0, len(list))
+	for _, u := range list {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+func TestListUsers(t *testing.T) {
+	testManager, created := newListTestManager(t)
+
+	ids := func(indexes ...int) []string {
+		result := make([]string, 0, len(indexes))
+		for _, i := range indexes {
+			result = append(result, created[i].ID)
+		}
+		return result
+	}
+
+	tests := map[string]struct {
+		opts     ListOptions
+		expected []string
+	}{
+		"default is oldest first": {
+			opts:     ListOptions{},
+			expected: ids(0, 1, 2, 3, 4, 5),
+		},
+		"newest first": {
+			opts:     ListOptions{Descending: true},
+			expected: ids(5, 4, 3, 2, 1, 0),
+		},
+		"by last name": {
+			opts:     ListOptions{SortBy: SortByLastName},
+			expected: ids(3, 1, 5, 4, 0, 2),
+		},
+		"by first name ignores case": {
+			opts:     ListOptions{SortBy: SortByFirstName},
+			expected: ids(0, 5, 2, 4, 3, 1),
+		},
+		"email domain": {
+			opts:     ListOptions{EmailDomain: "EXAMPLE.com"},
+			expected: ids(0, 2, 4, 5),
+		},
+		"exact email": {
+			opts:     ListOptions{Email: "Grace@navy.example.org"},
+			expected: ids(1),
+		},
+		"name prefix matches first or last name": {
+			opts:     ListOptions{NamePrefix: "l"},
+			expected: ids(0, 4),
+		},
+		"combined filters": {
+			opts:     ListOptions{NamePrefix: "al", EmailDomain: "example.com", Descending: true},
+			expected: ids(5, 2),
+		},
+		"no matches": {
+			opts:     ListOptions{NamePrefix: "zzz"},
+			expected: []string{},
+		},
+	}
+
+	for name, test := range tests {
+		page, err := testManager.ListUsers(context.Background(), test.opts)
+		if err != nil {
+			t.Errorf("%s: error listing users: %v", name, err)
+			continue
+		}
+
+		if result := userIDs(page.Users); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: bad user list\ngot: %v\nwanted: %v", name, result, test.expected)
+		}
+
+		if page.NextCursor != "" {
+			t.Errorf("%s: unexpected cursor on the only page: %q", name, page.NextCursor)
+		}
+	}
+}
+
+func TestListUsersPagination(t *testing.T) {
+	testManager, created := newListTestManager(t)
+
+	for _, sortBy := range []SortField{SortByCreated, SortByLastName, SortByFirstName} {
+		for _, descending := range []bool{false, true} {
+			name := fmt.Sprintf("%s descending=%t", sortBy, descending)
+
+			full, err := testManager.ListUsers(context.Background(), ListOptions{SortBy: sortBy, Descending: descending})
+			if err != nil {
+				t.Fatalf("%s: error listing users: %v", name, err)
+			}
+
+			var paged []string
+			opts := ListOptions{Limit: 4, SortBy: sortBy, Descending: descending}
+			for pages := 0; ; pages++ {
+				if pages > len(created) {
+					t.Fatalf("%s: pagination doesn't end", name)
+				}
+
+				page, err := testManager.ListUsers(context.Background(), opts)
+				if err != nil {
+					t.Fatalf("%s: error listing users: %v", name, err)
+				}
+
+				paged = append(paged, userIDs(page.Users)...)
+
+				if page.NextCursor == "" {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+
+			if expected := userIDs(full.Users); !reflect.DeepEqual(paged, expected) {
+				t.Errorf("%s: bad paged user list\ngot: %v\nwanted: %v", name, paged, expected)
+			}
+		}
+	}
+}
+
+func TestListUsersCursorSurvivesDelete(t *testing.T) {
+	testManager, created := newListTestManager(t)
+
+	page, err := testManager.ListUsers(context.Background(), ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	// removing the last user of the page must not skip or repeat anyone
+	err = testManager.DeleteUser(context.Background(), created[1].ID, AnyVersion)
+	if err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+
+	page, err = testManager.ListUsers(context.Background(), ListOptions{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	expected := []string{created[2].ID, created[3].ID}
+	if result := userIDs(page.Users); !reflect.DeepEqual(result, expected) {
+		t.Errorf("bad user list\ngot: %v\nwanted: %v", result, expected)
+	}
+}
+
+func TestListUsersInvalidOptions(t *testing.T) {
+	testManager, _ := newListTestManager(t)
+
+	page, err := testManager.ListUsers(context.Background(), ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	tests := map[string]struct {
+		opts        ListOptions
+		expectedErr error
+	}{
+		"garbage cursor": {
+			opts:        ListOptions{Cursor: "not a cursor"},
+			expectedErr: ErrInvalidCursor,
+		},
+		"cursor for another sort": {
+			opts:        ListOptions{Cursor: page.NextCursor, SortBy: SortByLastName},
+			expectedErr: ErrInvalidCursor,
+		},
+		"negative limit": {
+			opts: ListOptions{Limit: -1},
+		},
+		"limit too big": {
+			opts: ListOptions{Limit: MaxListLimit + 1},
+		},
+		"unknown sort": {
+			opts: ListOptions{SortBy: "shoeSize"},
+		},
+	}
+
+	for name, test := range tests {
+		_, err := testManager.ListUsers(context.Background(), test.opts)
+		if err == nil {
+			t.Errorf("%s: no error returned", name)
+			continue
+		}
+
+		if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: bad error, wanted: %v, got: %v", name, test.expectedErr, err)
+		}
+	}
+}
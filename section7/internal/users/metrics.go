@@ -0,0 +1,95 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"math"
+	"mycoolserver/internal/metrics"
+)
+
+// managerMetrics are the users side of /metrics, the HTTP side only sees
+// status codes and can't tell a duplicate email from a bad name
+type managerMetrics struct {
+	addFailures *metrics.CounterVec
+	lookups     *metrics.CounterVec
+	logins      *metrics.CounterVec
+}
+
+// WithMetrics records the Manager's metrics in reg, without it they're kept
+// but never exposed.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(m *Manager) {
+		m.registry = reg
+	}
+}
+
+func newManagerMetrics(reg *metrics.Registry, store Store, sessions *sessionStore) *managerMetrics {
+	reg.NewGaugeFunc("users_stored", "Users in the store.", func() float64 {
+		// the store guards its own reads, no need to wait for the Manager
+		all, err := store.List()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(len(all))
+	})
+
+	reg.NewGaugeFunc("users_sessions", "Sessions that haven't been logged out, some may have expired.", func() float64 {
+		return float64(sessions.count())
+	})
+
+	return &managerMetrics{
+		addFailures: reg.NewCounterVec("users_add_failures_total",
+			"Users that couldn't be created, by reason.", "reason"),
+		lookups: reg.NewCounterVec("users_lookups_total",
+			"User lookups by what was looked up and whether a user was found, the miss rate is result=\"miss\" over all of them.", "by", "result"),
+		logins: reg.NewCounterVec("users_logins_total",
+			"Login attempts by result, success, invalid or error.", "result"),
+	}
+}
+
+func (mm *managerMetrics) addFailed(err error) {
+	mm.addFailures.With(failureReason(err)).Inc()
+}
+
+// lookup counts a GetUserBy call, by is id, email or name
+func (mm *managerMetrics) lookup(by string, err error) {
+	result := "hit"
+	switch {
+	case errors.Is(err, ErrNoResultsFound):
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+
+	mm.lookups.With(by, result).Inc()
+}
+
+func (mm *managerMetrics) loggedIn(err error) {
+	result := "success"
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		result = "invalid"
+	case err != nil:
+		result = "error"
+	}
+
+	mm.logins.With(result).Inc()
+}
+
+// failureReason keeps the reason label to a handful of values
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrValidation):
+		return "validation"
+	case errors.Is(err, ErrDuplicateEmail):
+		return "duplicate_email"
+	case errors.Is(err, ErrShuttingDown):
+		return "shutting_down"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "store"
+	}
+}
@@ -0,0 +1,245 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mycoolserver/internal/logging"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// MinPasswordLength is in characters, long passwords beat clever rules
+	MinPasswordLength = 12
+	// MaxPasswordBytes stops someone making every login hash a megabyte
+	MaxPasswordBytes = 1024
+)
+
+// passwordParams are argon2id's costs, memory is in KiB
+type passwordParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+	saltLen uint32
+}
+
+// defaultPasswordParams are the second recommended option from RFC 9106, for
+// when 2 GiB per hash is too much
+var defaultPasswordParams = passwordParams{
+	memory:  64 * 1024,
+	time:    3,
+	threads: 4,
+	keyLen:  32,
+	saltLen: 16,
+}
+
+// validatePassword only looks at length, the field name matches the one
+// clients send
+func validatePassword(field string, password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return &FieldError{Field: field, Detail: fmt.Sprintf("%s must be at least %d characters", field, MinPasswordLength)}
+	}
+
+	if len(password) > MaxPasswordBytes {
+		return &FieldError{Field: field, Detail: fmt.Sprintf("%s must be at most %d bytes", field, MaxPasswordBytes)}
+	}
+
+	return nil
+}
+
+// hashPassword returns an argon2id hash in the PHC string format, which
+// carries its own parameters so they can be raised without breaking old
+// hashes:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func hashPassword(password string, params passwordParams) (string, error) {
+	salt := make([]byte, params.saltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// checkPassword reports whether password matches encoded, an error means the
+// hash itself is broken
+func checkPassword(encoded string, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errMalformedHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, errMalformedHash
+	}
+
+	var params passwordParams
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return false, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errMalformedHash
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 {
+		return false, errMalformedHash
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(expected)))
+
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// defaultHashWait is how long hashing a password waits for one of the
+// Manager's hash slots before giving up with ErrBusy
+const defaultHashWait = time.Second
+
+// acquireHash takes one of the hash slots, it gives up with ErrBusy once
+// it's waited hashWait or with ctx's error if that ends first
+func (m *Manager) acquireHash(ctx context.Context) (func(), error) {
+	waitCtx, cancel := context.WithTimeout(ctx, m.hashWait)
+	defer cancel()
+
+	err := m.hashSlots.Acquire(waitCtx, 1)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logging.FromContext(ctx).Warn("too many passwords being hashed", "waited", m.hashWait)
+		return nil, ErrBusy
+	}
+
+	return func() { m.hashSlots.Release(1) }, nil
+}
+
+// hashPassword is hashPassword with a hash slot
+func (m *Manager) hashPassword(ctx context.Context, password string) (string, error) {
+	release, err := m.acquireHash(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	return hashPassword(password, m.passwordParams)
+}
+
+// checkPassword is checkPassword with a hash slot
+func (m *Manager) checkPassword(ctx context.Context, encoded string, password string) (bool, error) {
+	release, err := m.acquireHash(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	return checkPassword(encoded, password)
+}
+
+// dummyPasswordHash is a hash no one knows the password to
+func (m *Manager) dummyPasswordHash() (string, error) {
+	m.dummyHashOnce.Do(func() {
+		m.dummyHash, m.dummyHashErr = hashPassword("not anyone's password", m.passwordParams)
+	})
+	return m.dummyHash, m.dummyHashErr
+}
+
+// SetPassword replaces the user's password without asking for the old one,
+// for admins, and logs them out everywhere.
+func (m *Manager) SetPassword(ctx context.Context, id string, password string) error {
+	err := validatePassword("Password", password)
+	if err != nil {
+		return err
+	}
+
+	return m.storePassword(ctx, id, password, "")
+}
+
+// ChangePassword replaces the user's password if current is right, and logs
+// them out everywhere.  A wrong current password is ErrInvalidCredentials.
+func (m *Manager) ChangePassword(ctx context.Context, id string, current string, password string) error {
+	err := validatePassword("NewPassword", password)
+	if err != nil {
+		return err
+	}
+
+	user, err := m.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user.PasswordHash == "" || len(current) > MaxPasswordBytes {
+		return ErrInvalidCredentials
+	}
+
+	ok, err := m.checkPassword(ctx, user.PasswordHash, current)
+	if err != nil {
+		return fmt.Errorf("error checking password: %w", err)
+	}
+	if !ok {
+		logging.FromContext(ctx).Info("rejected password change", "user_id", id, "err", ErrInvalidCredentials)
+		return ErrInvalidCredentials
+	}
+
+	return m.storePassword(ctx, id, password, user.PasswordHash)
+}
+
+// storePassword hashes password and saves it.  If expectedHash isn't empty
+// the stored hash has to still be that, so a password checked before taking
+// the lock can't have been changed in the meantime.
+func (m *Manager) storePassword(ctx context.Context, id string, password string, expectedHash string) error {
+	passwordHash, err := m.hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := m.acquire(ctx, writerWeight)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, err := m.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	if expectedHash != "" && user.PasswordHash != expectedHash {
+		return ErrInvalidCredentials
+	}
+
+	user.PasswordHash = passwordHash
+	user.UpdatedAt = m.now().UTC()
+	user.Version++
+
+	err = m.store.Update(*user)
+	if err != nil {
+		return fmt.Errorf("error storing user: %w", err)
+	}
+
+	ended := m.sessions.removeUser(id)
+	logging.FromContext(ctx).Info("changed password", "user_id", id, "sessions_ended", ended)
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// testPasswordParams keep tests fast, nothing else should hash this cheaply
+var testPasswordParams = passwordParams{memory: 64, time: 1, threads: 1, keyLen: 32, saltLen: 16}
+
+const testPassword = "correct horse battery staple"
+
+func newPasswordTestManager(t *testing.T) (*Manager, *User) {
+	t.Helper()
+
+	testManager := NewManager()
+	testManager.passwordParams = testPasswordParams
+
+	user, err := testManager.CreateUserWithPassword(context.Background(), "Test", "Man", "testman@example.com", testPassword)
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	return testManager, user
+}
+
+func TestHashPassword(t *testing.T) {
+	encoded, err := hashPassword(testPassword, testPasswordParams)
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("bad hash format, got: %s", encoded)
+	}
+
+	tests := map[string]bool{
+		testPassword:                    true,
+		"correct horse battery stapl":   false,
+		"correct horse battery staple ": false,
+		"":                              false,
+	}
+
+	for password, expected := range tests {
+		ok, err := checkPassword(encoded, password)
+		if err != nil {
+			t.Errorf("%q: error checking password: %v", password, err)
+		}
+		if ok != expected {
+			t.Errorf("%q: bad result, wanted: %v, got: %v", password, expected, ok)
+		}
+	}
+
+	// the same password salted differently hashes differently
+	again, err := hashPassword(testPassword, testPasswordParams)
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	if again == encoded {
+		t.Error("two hashes of the same password are identical")
+	}
+}
+
+func TestCheckPasswordMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"plaintext",
+		"$2a$10$bcryptbcryptbcryptbcryptbcryptbcryptbcryptbcryptbcrypt",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$aGFzaA",
+		"$argon2id$v=19$m=lots,t=1,p=1$c2FsdHNhbHRzYWx0$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$",
+	}
+
+	for _, encoded := range tests {
+		_, err := checkPassword(encoded, testPassword)
+		if !errors.Is(err, errMalformedHash) {
+			t.Errorf("%q: bad error, wanted: %v, got: %v", encoded, errMalformedHash, err)
+		}
+	}
+}
+
+func TestCreateUserWithPasswordValidation(t *testing.T) {
+	testManager := NewManager()
+	testManager.passwordParams = testPasswordParams
+
+	tests := map[string]string{
+		"too short": "short",
+		"too long":  strings.Repeat("a", MaxPasswordBytes+1),
+	}
+
+	for name, password := range tests {
+		_, err := testManager.CreateUserWithPassword(context.Background(), "Test", "Man", "testman@example.com", password)
+		if !errors.Is(err, ErrValidation) {
+			t.Errorf("%s: bad error, wanted: %v, got: %v", name, ErrValidation, err)
+		}
+	}
+
+	// every invalid field is reported, not just the first
+	_, err := testManager.CreateUserWithPassword(context.Background(), "", "Man", "testman@example.com", "short")
+	if err == nil || !strings.Contains(err.Error(), "FirstName") || !strings.Contains(err.Error(), "Password") {
+		t.Errorf("bad error, wanted both FirstName and Password in it, got: %v", err)
+	}
+}
+
+func TestCreateUserWithoutPassword(t *testing.T) {
+	testManager := NewManager()
+	testManager.passwordParams = testPasswordParams
+
+	user, err := testManager.CreateUser(context.Background(), "Test", "Man", "testman@example.com")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	if user.PasswordHash != "" {
+		t.Errorf("user without a password has a hash: %s", user.PasswordHash)
+	}
+
+	_, err = testManager.Login(context.Background(), "testman@example.com", "")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad error logging in without a password, wanted: %v, got: %v", ErrInvalidCredentials, err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	ctx := context.Background()
+
+	session, err := testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	newPassword := "a much better passphrase"
+
+	err = testManager.ChangePassword(ctx, user.ID, "wrong password!", newPassword)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad error for wrong current password, wanted: %v, got: %v", ErrInvalidCredentials, err)
+	}
+
+	err = testManager.ChangePassword(ctx, user.ID, testPassword, "short")
+	if !errors.Is(err, ErrValidation) {
+		t.Errorf("bad error for short new password, wanted: %v, got: %v", ErrValidation, err)
+	}
+
+	err = testManager.ChangePassword(ctx, user.ID, testPassword, newPassword)
+	if err != nil {
+		t.Fatalf("error changing password: %v", err)
+	}
+
+	_, err = testManager.LookupSession(ctx, session.Token)
+	if !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("session survived a password change, got: %v", err)
+	}
+
+	_, err = testManager.Login(ctx, user.Email.Address, testPassword)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("old password still works, got: %v", err)
+	}
+
+	_, err = testManager.Login(ctx, user.Email.Address, newPassword)
+	if err != nil {
+		t.Errorf("error logging in with new password: %v", err)
+	}
+}
+
+func TestHashSlots(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	testManager.hashSlots = semaphore.NewWeighted(1)
+	testManager.hashWait = 10 * time.Millisecond
+	ctx := context.Background()
+
+	// someone else's hash holds the only slot
+	release, err := testManager.acquireHash(ctx)
+	if err != nil {
+		t.Fatalf("error taking a hash slot: %v", err)
+	}
+
+	_, err = testManager.Login(ctx, user.Email.Address, testPassword)
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("bad error logging in with no hash slots, wanted: %v, got: %v", ErrBusy, err)
+	}
+
+	_, err = testManager.CreateUserWithPassword(ctx, "Other", "Man", "otherman@example.com", testPassword)
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("bad error creating a user with no hash slots, wanted: %v, got: %v", ErrBusy, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = testManager.ChangePassword(canceled, user.ID, testPassword, "a much better passphrase")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("bad error for a canceled wait, wanted: %v, got: %v", context.Canceled, err)
+	}
+
+	release()
+
+	_, err = testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Errorf("error logging in once the slot was free: %v", err)
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	testManager := NewManager()
+	testManager.passwordParams = testPasswordParams
+	ctx := context.Background()
+
+	user, err := testManager.CreateUser(ctx, "Test", "Man", "testman@example.com")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	updateTime := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time { return updateTime }
+
+	err = testManager.SetPassword(ctx, user.ID, testPassword)
+	if err != nil {
+		t.Fatalf("error setting password: %v", err)
+	}
+
+	updated, err := testManager.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if !updated.UpdatedAt.Equal(updateTime) {
+		t.Errorf("bad UpdatedAt, wanted: %v, got: %v", updateTime, updated.UpdatedAt)
+	}
+
+	_, err = testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Errorf("error logging in with the password that was set: %v", err)
+	}
+
+	err = testManager.SetPassword(ctx, "nope", testPassword)
+	if !errors.Is(err, ErrNoResultsFound) {
+		t.Errorf("bad error for unknown user, wanted: %v, got: %v", ErrNoResultsFound, err)
+	}
+}
+
+func TestPasswordSurvivesFileStore(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+
+	testManager := NewManager(WithStore(store))
+	testManager.passwordParams = testPasswordParams
+
+	_, err = testManager.CreateUserWithPassword(context.Background(), "Test", "Man", "testman@example.com", testPassword)
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	err = testManager.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("error shutting down: %v", err)
+	}
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error reopening store: %v", err)
+	}
+	defer store.Close()
+
+	reopened := NewManager(WithStore(store))
+
+	_, err = reopened.Login(context.Background(), "testman@example.com", testPassword)
+	if err != nil {
+		t.Errorf("error logging in after reopening the store: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"mycoolserver/internal/logging"
+)
+
+// Role says what a user may do beyond looking after their own record.
+type Role string
+
+const (
+	// RoleNone is a plain account, what every new user starts as
+	RoleNone   Role = ""
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+// Valid reports whether r is one of the roles above
+func (r Role) Valid() bool {
+	switch r {
+	case RoleNone, RoleViewer, RoleEditor, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetRole changes what the user may do, RoleNone takes their role away.
+func (m *Manager) SetRole(ctx context.Context, id string, role Role) (*User, error) {
+	if !role.Valid() {
+		return nil, &FieldError{Field: "Role", Detail: fmt.Sprintf("invalid role: %q, must be viewer, editor, admin or empty", role)}
+	}
+
+	unlock, err := m.acquire(ctx, writerWeight)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	user, err := m.store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := user.Role
+	user.Role = role
+	user.UpdatedAt = m.now().UTC()
+	user.Version++
+
+	err = m.store.Update(*user)
+	if err != nil {
+		return nil, fmt.Errorf("error storing user: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("changed user role", "user_id", id, "from", previous, "to", role)
+
+	return user, nil
+}
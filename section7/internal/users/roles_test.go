@@ -0,0 +1,57 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetRole(t *testing.T) {
+	testManager := NewManager()
+	createTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time { return createTime }
+
+	created, err := testManager.CreateUser(context.Background(), "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+	if created.Role != RoleNone {
+		t.Errorf("bad role for a new user, wanted: %q, got: %q", RoleNone, created.Role)
+	}
+
+	updateTime := createTime.Add(time.Hour)
+	testManager.now = func() time.Time { return updateTime }
+
+	updated, err := testManager.SetRole(context.Background(), created.ID, RoleEditor)
+	if err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+	if updated.Role != RoleEditor || !updated.UpdatedAt.Equal(updateTime) {
+		t.Errorf("bad user, wanted role %q updated at %v, got: %+v", RoleEditor, updateTime, updated)
+	}
+
+	stored, err := testManager.GetUserByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("error retrieving user: %v", err)
+	}
+	if stored.Role != RoleEditor {
+		t.Errorf("role wasn't stored, wanted: %q, got: %q", RoleEditor, stored.Role)
+	}
+
+	tests := map[string]struct {
+		id       string
+		role     Role
+		expected error
+	}{
+		"invalid role": {id: created.ID, role: "superuser", expected: ErrValidation},
+		"missing user": {id: "nope", role: RoleViewer, expected: ErrNoResultsFound},
+	}
+
+	for name, test := range tests {
+		_, err := testManager.SetRole(context.Background(), test.id, test.role)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: bad error, wanted: %v, got: %v", name, test.expected, err)
+		}
+	}
+}
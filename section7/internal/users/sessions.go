@@ -0,0 +1,222 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mycoolserver/internal/logging"
+	"sync"
+	"time"
+)
+
+// DefaultSessionTTL is how long a login lasts unless WithSessionTTL says
+// otherwise
+const DefaultSessionTTL = 24 * time.Hour
+
+// Session is a login.  Token is the secret the client presents, it's only
+// set on the Session Login returns, the Manager keeps nothing but its hash.
+type Session struct {
+	Token     string
+	UserID    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// WithSessionTTL sets how long sessions last after login.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.sessionTTL = ttl
+	}
+}
+
+// sessionStore keeps sessions in memory, a restart logs everyone out.  It's
+// keyed by the SHA-256 of the token so a heap dump doesn't hand out sessions.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[[sha256.Size]byte]Session
+	// lastSweep is when expired sessions were last dropped, they're also
+	// dropped whenever a lookup finds one
+	lastSweep time.Time
+}
+
+// sweepInterval keeps sweeping away from every single login
+const sweepInterval = time.Minute
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[[sha256.Size]byte]Session)}
+}
+
+func hashToken(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+func (s *sessionStore) add(session Session, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for key, existing := range s.sessions {
+			if !now.Before(existing.ExpiresAt) {
+				delete(s.sessions, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	stored := session
+	stored.Token = ""
+	s.sessions[hashToken(session.Token)] = stored
+}
+
+func (s *sessionStore) get(token string, now time.Time) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := hashToken(token)
+	session, ok := s.sessions[key]
+	if !ok {
+		return nil, ErrInvalidSession
+	}
+
+	if !now.Before(session.ExpiresAt) {
+		delete(s.sessions, key)
+		return nil, ErrInvalidSession
+	}
+
+	return &session, nil
+}
+
+// remove returns the session it ended, nil if there wasn't one
+func (s *sessionStore) remove(token string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := hashToken(token)
+	session, ok := s.sessions[key]
+	if !ok {
+		return nil
+	}
+
+	delete(s.sessions, key)
+	return &session
+}
+
+// removeUser ends every session userID has, returning how many there were
+func (s *sessionStore) removeUser(userID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *sessionStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// newSessionToken is 256 random bits, far too many to guess
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Login checks email and password and starts a session.  Every kind of
+// mismatch, including an unknown email or a user without a password, is
+// ErrInvalidCredentials so callers can't tell which accounts exist.
+func (m *Manager) Login(ctx context.Context, email string, password string) (*Session, error) {
+	logger := logging.FromContext(ctx)
+
+	session, err := m.login(ctx, email, password)
+	m.metrics.loggedIn(err)
+	if err != nil {
+		logger.Info("login failed", "err", err)
+		return nil, err
+	}
+
+	logger.Info("user logged in", "user_id", session.UserID)
+
+	return session, nil
+}
+
+func (m *Manager) login(ctx context.Context, email string, password string) (*Session, error) {
+	// too long to be anyone's password, and too long to hash for free
+	if len(password) > MaxPasswordBytes {
+		return nil, ErrInvalidCredentials
+	}
+
+	user, err := m.GetUserByEmail(ctx, email)
+	if err != nil && !errors.Is(err, ErrNoResultsFound) {
+		return nil, err
+	}
+
+	// hash something either way, otherwise how long a failed login takes
+	// tells whether the email has an account
+	encoded, err := m.dummyPasswordHash()
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && user.PasswordHash != "" {
+		encoded = user.PasswordHash
+	}
+
+	ok, err := m.checkPassword(ctx, encoded, password)
+	if err != nil {
+		return nil, fmt.Errorf("error checking password: %w", err)
+	}
+
+	if !ok || user == nil || user.PasswordHash == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, fmt.Errorf("error generating session token: %w", err)
+	}
+
+	now := m.now().UTC()
+	session := Session{
+		Token:     token,
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.sessionTTL),
+	}
+	m.sessions.add(session, now)
+
+	return &session, nil
+}
+
+// LookupSession returns the session for token, or ErrInvalidSession if it
+// doesn't exist or has expired.
+func (m *Manager) LookupSession(ctx context.Context, token string) (*Session, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.sessions.get(token, m.now())
+}
+
+// Logout ends the session for token, ending one that doesn't exist isn't an
+// error.
+func (m *Manager) Logout(ctx context.Context, token string) error {
+	session := m.sessions.remove(token)
+	if session != nil {
+		logging.FromContext(ctx).Info("user logged out", "user_id", session.UserID)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogin(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	ctx := context.Background()
+
+	loginTime := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time { return loginTime }
+
+	// emails match case-insensitively, like GetUserByEmail
+	session, err := testManager.Login(ctx, "TestMan@example.com", testPassword)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	if session.UserID != user.ID {
+		t.Errorf("bad session user, wanted: %s, got: %s", user.ID, session.UserID)
+	}
+	if len(session.Token) < 40 {
+		t.Errorf("session token is too short: %q", session.Token)
+	}
+	if !session.ExpiresAt.Equal(loginTime.Add(DefaultSessionTTL)) {
+		t.Errorf("bad expiry, wanted: %v, got: %v", loginTime.Add(DefaultSessionTTL), session.ExpiresAt)
+	}
+
+	found, err := testManager.LookupSession(ctx, session.Token)
+	if err != nil {
+		t.Fatalf("error looking up session: %v", err)
+	}
+	if found.UserID != user.ID || found.Token != "" {
+		t.Errorf("bad session, wanted user %s without a token, got: %+v", user.ID, found)
+	}
+
+	another, err := testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Fatalf("error logging in again: %v", err)
+	}
+	if another.Token == session.Token {
+		t.Error("two logins got the same token")
+	}
+}
+
+func TestLoginRejects(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+
+	tests := map[string]struct {
+		email    string
+		password string
+	}{
+		"wrong password":  {email: user.Email.Address, password: "not the right password"},
+		"unknown email":   {email: "nobody@example.com", password: testPassword},
+		"empty password":  {email: user.Email.Address, password: ""},
+		"huge password":   {email: user.Email.Address, password: strings.Repeat("a", MaxPasswordBytes+1)},
+		"password prefix": {email: user.Email.Address, password: testPassword[:20]},
+	}
+
+	for name, test := range tests {
+		session, err := testManager.Login(context.Background(), test.email, test.password)
+		if !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: bad error, wanted: %v, got: %v", name, ErrInvalidCredentials, err)
+		}
+		if session != nil {
+			t.Errorf("%s: got a session: %+v", name, session)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	testManager.sessionTTL = time.Hour
+	ctx := context.Background()
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time { return now }
+
+	session, err := testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	now = now.Add(time.Hour - time.Second)
+	_, err = testManager.LookupSession(ctx, session.Token)
+	if err != nil {
+		t.Errorf("session expired early: %v", err)
+	}
+
+	now = now.Add(time.Second)
+	_, err = testManager.LookupSession(ctx, session.Token)
+	if !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("bad error for expired session, wanted: %v, got: %v", ErrInvalidSession, err)
+	}
+
+	if testManager.sessions.count() != 0 {
+		t.Errorf("expired session wasn't dropped, %d left", testManager.sessions.count())
+	}
+}
+
+func TestSessionSweep(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	testManager.sessionTTL = time.Minute
+	ctx := context.Background()
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time { return now }
+
+	for range 3 {
+		_, err := testManager.Login(ctx, user.Email.Address, testPassword)
+		if err != nil {
+			t.Fatalf("error logging in: %v", err)
+		}
+	}
+
+	// nobody looks the old ones up, the next login clears them out
+	now = now.Add(2 * time.Minute)
+	_, err := testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	if testManager.sessions.count() != 1 {
+		t.Errorf("bad session count after sweep, wanted: 1, got: %d", testManager.sessions.count())
+	}
+}
+
+func TestLogout(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	ctx := context.Background()
+
+	session, err := testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	err = testManager.Logout(ctx, session.Token)
+	if err != nil {
+		t.Fatalf("error logging out: %v", err)
+	}
+
+	_, err = testManager.LookupSession(ctx, session.Token)
+	if !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("bad error after logout, wanted: %v, got: %v", ErrInvalidSession, err)
+	}
+
+	// logging out twice is fine
+	err = testManager.Logout(ctx, session.Token)
+	if err != nil {
+		t.Errorf("error logging out twice: %v", err)
+	}
+}
+
+func TestDeleteUserEndsSessions(t *testing.T) {
+	testManager, user := newPasswordTestManager(t)
+	ctx := context.Background()
+
+	session, err := testManager.Login(ctx, user.Email.Address, testPassword)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	err = testManager.DeleteUser(ctx, user.ID, AnyVersion)
+	if err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+
+	_, err = testManager.LookupSession(ctx, session.Token)
+	if !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("session outlived its user, got: %v", err)
+	}
+}
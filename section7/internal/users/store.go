@@ -0,0 +1,155 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUserExists  = errors.New("user already exists")
+	ErrStoreClosed = errors.New("user store is closed")
+	// ErrCorruptLog means a record in the middle of a FileStore's log is
+	// damaged, the store won't open rather than drop the records after it
+	ErrCorruptLog = errors.New("user log is corrupt")
+)
+
+// Store is the storage backend used by Manager.  Implementations must be safe
+// for concurrent use and must return copies so callers can't modify stored
+// users without going through Update.
+type Store interface {
+	Create(u User) error
+	GetByName(first string, last string) (*User, error)
+	GetByID(id string) (*User, error)
+	GetByEmail(email string) (*User, error)
+	List() ([]User, error)
+	Update(u User) error
+	Delete(id string) error
+	// Ping reports whether the store can still serve requests, it's used for
+	// readiness checks so it should be cheap
+	Ping() error
+	Close() error
+}
+
+// MemoryStore keeps users in a slice, nothing survives a restart.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users []User
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Ping always succeeds, memory doesn't go away.
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+func (s *MemoryStore) Create(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.indexOfID(u.ID) >= 0 {
+		return ErrUserExists
+	}
+
+	s.users = append(s.users, u)
+
+	return nil
+}
+
+func (s *MemoryStore) GetByName(first string, last string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, user := range s.users {
+		if user.FirstName == first && user.LastName == last {
+			result := s.users[i]
+			return &result, nil
+		}
+	}
+
+	return nil, ErrNoResultsFound
+}
+
+func (s *MemoryStore) GetByID(id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.indexOfID(id)
+	if i < 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	result := s.users[i]
+	return &result, nil
+}
+
+// GetByEmail compares addresses case-insensitively
+func (s *MemoryStore) GetByEmail(email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, user := range s.users {
+		if strings.EqualFold(user.Email.Address, email) {
+			result := s.users[i]
+			return &result, nil
+		}
+	}
+
+	return nil, ErrNoResultsFound
+}
+
+func (s *MemoryStore) List() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]User, len(s.users))
+	copy(result, s.users)
+
+	return result, nil
+}
+
+func (s *MemoryStore) Update(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.indexOfID(u.ID)
+	if i < 0 {
+		return ErrNoResultsFound
+	}
+
+	s.users[i] = u
+
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.indexOfID(id)
+	if i < 0 {
+		return ErrNoResultsFound
+	}
+
+	s.users = append(s.users[:i], s.users[i+1:]...)
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// indexOfID expects the caller to hold s.mu
+func (s *MemoryStore) indexOfID(id string) int {
+	for i, user := range s.users {
+		if user.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
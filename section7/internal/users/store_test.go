@@ -0,0 +1,407 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	fileStore, err := NewFileStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   fileStore,
+	}
+}
+
+func testUser(id string, first string, last string) User {
+	return User{
+		ID:        id,
+		FirstName: first,
+		LastName:  last,
+		Email:     mail.Address{Address: first + "." + last + "@example.com"},
+	}
+}
+
+func TestStoreCRUD(t *testing.T) {
+	for name, store := range testStores(t) {
+		first := testUser("1", "foo", "bar")
+		second := testUser("2", "bar", "baz")
+
+		err := store.Create(first)
+		if err != nil {
+			t.Fatalf("%s: error creating user: %v", name, err)
+		}
+		err = store.Create(second)
+		if err != nil {
+			t.Fatalf("%s: error creating user: %v", name, err)
+		}
+
+		err = store.Create(first)
+		if !errors.Is(err, ErrUserExists) {
+			t.Errorf("%s: bad error for duplicate id, wanted: %v, got: %v", name, ErrUserExists, err)
+		}
+
+		byName, err := store.GetByName("bar", "baz")
+		if err != nil {
+			t.Errorf("%s: error getting user by name: %v", name, err)
+		} else if !reflect.DeepEqual(*byName, second) {
+			t.Errorf("%s: bad user by name\nwanted: %+v\ngot: %+v", name, second, *byName)
+		}
+
+		byID, err := store.GetByID("1")
+		if err != nil {
+			t.Errorf("%s: error getting user by id: %v", name, err)
+		} else if !reflect.DeepEqual(*byID, first) {
+			t.Errorf("%s: bad user by id\nwanted: %+v\ngot: %+v", name, first, *byID)
+		}
+
+		updated := first
+		updated.LastName = "quux"
+		err = store.Update(updated)
+		if err != nil {
+			t.Errorf("%s: error updating user: %v", name, err)
+		}
+
+		err = store.Update(testUser("3", "no", "one"))
+		if !errors.Is(err, ErrNoResultsFound) {
+			t.Errorf("%s: bad error for missing update, wanted: %v, got: %v", name, ErrNoResultsFound, err)
+		}
+
+		err = store.Delete("2")
+		if err != nil {
+			t.Errorf("%s: error deleting user: %v", name, err)
+		}
+
+		err = store.Delete("2")
+		if !errors.Is(err, ErrNoResultsFound) {
+			t.Errorf("%s: bad error for missing delete, wanted: %v, got: %v", name, ErrNoResultsFound, err)
+		}
+
+		_, err = store.GetByID("2")
+		if !errors.Is(err, ErrNoResultsFound) {
+			t.Errorf("%s: bad error for deleted user, wanted: %v, got: %v", name, ErrNoResultsFound, err)
+		}
+
+		listed, err := store.List()
+		if err != nil {
+			t.Fatalf("%s: error listing users: %v", name, err)
+		}
+
+		expected := []User{updated}
+		if !reflect.DeepEqual(listed, expected) {
+			t.Errorf("%s: bad user list\nwanted: %+v\ngot: %+v", name, expected, listed)
+		}
+
+		err = store.Close()
+		if err != nil {
+			t.Errorf("%s: error closing store: %v", name, err)
+		}
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	expected := []User{testUser("1", "foo", "bar"), testUser("2", "bar", "baz")}
+	for _, u := range expected {
+		err = store.Create(u)
+		if err != nil {
+			t.Fatalf("error creating user: %v", err)
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error reopening file store: %v", err)
+	}
+
+	listed, err := reopened.List()
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("bad reloaded users\nwanted: %+v\ngot: %+v", expected, listed)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	expected := []User{testUser("1", "foo", "bar"), testUser("2", "bar", "baz")}
+	for _, u := range expected {
+		err = store.Create(u)
+		if err != nil {
+			t.Fatalf("error creating user: %v", err)
+		}
+	}
+
+	// simulate the process dying halfway through writing a third record
+	line, err := encodeRecord(logRecord{Op: opPut, User: &User{ID: "3", FirstName: "baz"}})
+	if err != nil {
+		t.Fatalf("error encoding record: %v", err)
+	}
+
+	logFile, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("error opening log: %v", err)
+	}
+	_, err = logFile.Write(line[:len(line)/2])
+	if err != nil {
+		t.Fatalf("error writing partial record: %v", err)
+	}
+	logFile.Close()
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error reopening file store: %v", err)
+	}
+
+	listed, err := reopened.List()
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("bad recovered users\nwanted: %+v\ngot: %+v", expected, listed)
+	}
+
+	// writes after recovery must not end up behind the torn record
+	third := testUser("3", "baz", "foo")
+	err = reopened.Create(third)
+	if err != nil {
+		t.Fatalf("error creating user after recovery: %v", err)
+	}
+
+	err = reopened.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	reopened, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error reopening file store: %v", err)
+	}
+
+	listed, err = reopened.List()
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	expected = append(expected, third)
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("bad users after recovery\nwanted: %+v\ngot: %+v", expected, listed)
+	}
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	first := testUser("1", "foo", "bar")
+	err = store.Create(first)
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	store.Close()
+
+	logFile, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("error opening log: %v", err)
+	}
+	_, err = logFile.WriteString("00000000 {\"Op\":\"delete\",\"ID\":\"1\"}\n")
+	if err != nil {
+		t.Fatalf("error writing corrupt record: %v", err)
+	}
+	logFile.Close()
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error reopening file store: %v", err)
+	}
+
+	listed, err := reopened.List()
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	expected := []User{first}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("bad recovered users\nwanted: %+v\ngot: %+v", expected, listed)
+	}
+}
+
+func TestFileStoreCorruptMiddle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	for _, u := range []User{testUser("1", "foo", "bar"), testUser("2", "bar", "baz"), testUser("3", "baz", "quux")} {
+		err = store.Create(u)
+		if err != nil {
+			t.Fatalf("error creating user: %v", err)
+		}
+	}
+	store.Close()
+
+	// damage the second record, the third was written after it so it can't
+	// be a torn write
+	contents, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatalf("error reading log: %v", err)
+	}
+	lines := bytes.SplitAfter(contents, []byte("\n"))
+	lines[1] = bytes.Replace(lines[1], []byte("bar"), []byte("BAR"), 1)
+	corrupted := bytes.Join(lines, nil)
+	err = os.WriteFile(path+".wal", corrupted, 0o600)
+	if err != nil {
+		t.Fatalf("error writing log: %v", err)
+	}
+
+	_, err = NewFileStore(path)
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("bad error opening a log with a corrupt record in the middle, wanted: %v, got: %v", ErrCorruptLog, err)
+	}
+
+	// nothing was cut off, the good records are still there to be recovered
+	after, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatalf("error reading log: %v", err)
+	}
+	if !bytes.Equal(after, corrupted) {
+		t.Errorf("log changed by a failed open, wanted %d bytes, got %d", len(corrupted), len(after))
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	store, err := NewFileStore(path, WithCompactAfter(3))
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	first := testUser("1", "foo", "bar")
+	second := testUser("2", "bar", "baz")
+
+	err = store.Create(first)
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	err = store.Create(second)
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	err = store.Delete("1")
+	if err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+
+	logInfo, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatalf("error reading log info: %v", err)
+	}
+	if logInfo.Size() != 0 {
+		t.Errorf("log not emptied by compaction, size: %d", logInfo.Size())
+	}
+
+	var snapshot []User
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading snapshot: %v", err)
+	}
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		t.Fatalf("error parsing snapshot: %v", err)
+	}
+
+	expected := []User{second}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("bad snapshot\nwanted: %+v\ngot: %+v", expected, snapshot)
+	}
+
+	// replaying records that are already in the snapshot must not change
+	// anything, that's what a crash between snapshot and truncate looks like
+	line, err := encodeRecord(logRecord{Op: opPut, User: &second})
+	if err != nil {
+		t.Fatalf("error encoding record: %v", err)
+	}
+	store.Close()
+	err = os.WriteFile(path+".wal", line, 0o600)
+	if err != nil {
+		t.Fatalf("error writing log: %v", err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error reopening file store: %v", err)
+	}
+
+	listed, err := reopened.List()
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("bad users after reopening\nwanted: %+v\ngot: %+v", expected, listed)
+	}
+}
+
+func TestStorePing(t *testing.T) {
+	for name, store := range testStores(t) {
+		err := store.Ping()
+		if err != nil {
+			t.Errorf("%s: error pinging open store: %v", name, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("error closing file store: %v", err)
+	}
+
+	err = store.Ping()
+	if !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("bad error pinging closed store, wanted: %v, got: %v", ErrStoreClosed, err)
+	}
+}
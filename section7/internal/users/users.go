@@ -1,77 +1,490 @@
 package users
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"log/slog"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/metrics"
+	"mycoolserver/internal/validate"
 	"net/mail"
+	"runtime"
+	"sync"
 	"time"
-)
 
-var ErrNoResultsFound = errors.New("no results found")
+	"golang.org/x/sync/semaphore"
+)
 
+// User is identified by its ID, names don't have to be unique.  IDs are
+// UUIDv7 so they sort by creation time.
 type User struct {
+	ID        string
 	FirstName string
 	LastName  string
 	Email     mail.Address
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// PasswordHash is empty for users that can't log in
+	PasswordHash string `json:",omitempty"`
+	Role         Role   `json:",omitempty"`
+	// Version goes up by one with every change, users from before it
+	// existed start at 0
+	Version int64 `json:",omitempty"`
 }
 
+// AnyVersion is passed as the version to UpdateUser and DeleteUser when
+// the change should happen whatever version the user is at.  It isn't 0,
+// since that's a real version for users stored before there were versions.
+const AnyVersion int64 = -1
+
+// Manager is safe for concurrent use by multiple goroutines.  Every method
+// gives up with the context's error if ctx ends before it gets to the store,
+// including while it waits for another operation to finish.
 type Manager struct {
-	users []User
+	// lock makes check-then-write sequences like the duplicate email check in
+	// AddUser atomic, the store itself only guards single operations.  It's a
+	// semaphore rather than a sync.RWMutex so waiting for it can be abandoned,
+	// readers take 1 and writers take all of it.
+	lock         *semaphore.Weighted
+	store        Store
+	uniqueEmails bool
+	now          func() time.Time
+	registry     *metrics.Registry
+	metrics      *managerMetrics
+
+	sessions       *sessionStore
+	sessionTTL     time.Duration
+	passwordParams passwordParams
+	// hashSlots bounds how many passwords are hashed at once, each hash
+	// takes passwordParams.memory so without it a flood of logins from
+	// many addresses could run the server out of memory
+	hashSlots *semaphore.Weighted
+	hashWait  time.Duration
+	// dummyHash is checked against when a login names an unknown user, it's
+	// made on first use since hashing is slow on purpose
+	dummyHashOnce sync.Once
+	dummyHash     string
+	dummyHashErr  error
+
+	// stateMu guards closed, once it's set no new operations start and
+	// Shutdown waits on inflight for the ones already running
+	stateMu   sync.Mutex
+	closed    bool
+	inflight  sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// writerWeight is the whole semaphore, far more readers than could ever run
+// at once
+const writerWeight = 1 << 30
+
+type Option func(*Manager)
+
+// WithStore sets the storage backend, the default is a MemoryStore.
+func WithStore(s Store) Option {
+	return func(m *Manager) {
+		m.store = s
+	}
 }
 
-func NewManager() *Manager {
-	return &Manager{}
+// WithUniqueEmails controls whether two users may share an email address,
+// the default is to reject that.
+func WithUniqueEmails(enabled bool) Option {
+	return func(m *Manager) {
+		m.uniqueEmails = enabled
+	}
 }
 
-func (m *Manager) AddUser(firstName string, lastName string, email string) error {
-	if firstName == "" {
-		return fmt.Errorf("invalid first name: %q", firstName)
+func NewManager(opts ...Option) *Manager {
+	m := Manager{
+		lock:           semaphore.NewWeighted(writerWeight),
+		store:          NewMemoryStore(),
+		uniqueEmails:   true,
+		now:            time.Now,
+		sessions:       newSessionStore(),
+		sessionTTL:     DefaultSessionTTL,
+		passwordParams: defaultPasswordParams,
+		hashSlots:      semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0))),
+		hashWait:       defaultHashWait,
 	}
 
-	if lastName == "" {
-		return fmt.Errorf("invalid last name: %q", lastName)
+	for _, opt := range opts {
+		opt(&m)
 	}
 
-	existingUser, err := m.GetUserByName(firstName, lastName)
-	if err != nil && !errors.Is(err, ErrNoResultsFound) {
-		return fmt.Errorf("error checking if user is already present: %v", err)
+	if m.registry == nil {
+		m.registry = metrics.NewRegistry()
+	}
+	m.metrics = newManagerMetrics(m.registry, m.store, m.sessions)
+
+	return &m
+}
+
+// AddUser creates a user, ctx carries the logger to use, see the logging
+// package.
+func (m *Manager) AddUser(ctx context.Context, firstName string, lastName string, email string) error {
+	_, err := m.CreateUser(ctx, firstName, lastName, email)
+	return err
+}
+
+// CreateUser works like AddUser but also returns the new user.
+func (m *Manager) CreateUser(ctx context.Context, firstName string, lastName string, email string) (*User, error) {
+	return m.CreateUserWithPassword(ctx, firstName, lastName, email, "")
+}
+
+// CreateUserWithPassword works like CreateUser but the user can log in
+// straight away, an empty password means they can't.
+func (m *Manager) CreateUserWithPassword(ctx context.Context, firstName string, lastName string, email string, password string) (*User, error) {
+	newUser, err := m.createUser(ctx, firstName, lastName, email, password)
+	if err != nil {
+		m.metrics.addFailed(err)
+		return nil, err
+	}
+	return newUser, nil
+}
+
+func (m *Manager) createUser(ctx context.Context, firstName string, lastName string, email string, password string) (*User, error) {
+	logger := logging.FromContext(ctx)
+
+	input, parsedAddress, err := validateUser(firstName, lastName, email)
+	if password != "" {
+		err = validate.Join(err, validatePassword("Password", password))
+	}
+	if err != nil {
+		logger.Debug("rejected invalid user", "err", err)
+		return nil, err
 	}
 
-	if existingUser != nil {
-		return errors.New("user with this name already exists")
+	// hashing takes a while, so it's done before taking the lock
+	var passwordHash string
+	if password != "" {
+		passwordHash, err = m.hashPassword(ctx, password)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	parsedAddress, err := mail.ParseAddress(email)
+	now := m.now().UTC()
+
+	id, err := newID(now)
 	if err != nil {
-		return fmt.Errorf("invalid email: %s", email)
+		return nil, fmt.Errorf("error generating user id: %v", err)
 	}
 
 	newUser := User{
+		ID:           id,
+		FirstName:    input.FirstName,
+		LastName:     input.LastName,
+		Email:        *parsedAddress,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		PasswordHash: passwordHash,
+		Version:      1,
+	}
+
+	// the duplicate check and the create must happen under the same lock,
+	// otherwise two requests for the same email can both pass the check
+	unlock, err := m.acquire(ctx, writerWeight)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	err = m.checkDuplicateEmail(parsedAddress.Address, "")
+	if err != nil {
+		logger.Debug("rejected new user", "err", err)
+		return nil, err
+	}
+
+	err = m.store.Create(newUser)
+	if err != nil {
+		return nil, fmt.Errorf("error storing user: %w", err)
+	}
+
+	logger.Info("created user", "user_id", newUser.ID)
+
+	return &newUser, nil
+}
+
+func (m *Manager) GetUserByID(ctx context.Context, id string) (*User, error) {
+	unlock, err := m.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	user, err := m.store.GetByID(id)
+	m.metrics.lookup("id", err)
+	return user, err
+}
+
+// GetUserByEmail compares addresses case-insensitively.  If emails aren't
+// unique the oldest matching user is returned.
+func (m *Manager) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	unlock, err := m.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	user, err := m.store.GetByEmail(email)
+	m.metrics.lookup("email", err)
+	return user, err
+}
+
+// UpdateUser replaces the name and email of the user with the given id.  If
+// version isn't AnyVersion the user has to still be at that version,
+// otherwise it returns ErrVersionMismatch and nothing changes.
+func (m *Manager) UpdateUser(ctx context.Context, id string, version int64, firstName string, lastName string, email string) (*User, error) {
+	logger := logging.FromContext(ctx).With("user_id", id)
+
+	input, parsedAddress, err := validateUser(firstName, lastName, email)
+	if err != nil {
+		logger.Debug("rejected invalid user update", "err", err)
+		return nil, err
+	}
+
+	unlock, err := m.acquire(ctx, writerWeight)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	existingUser, err := m.store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVersion(existingUser, version)
+	if err != nil {
+		logger.Debug("rejected user update", "err", err, "version", version, "current_version", existingUser.Version)
+		return nil, err
+	}
+
+	err = m.checkDuplicateEmail(parsedAddress.Address, id)
+	if err != nil {
+		logger.Debug("rejected user update", "err", err)
+		return nil, err
+	}
+
+	existingUser.FirstName = input.FirstName
+	existingUser.LastName = input.LastName
+	existingUser.Email = *parsedAddress
+	existingUser.UpdatedAt = m.now().UTC()
+	existingUser.Version++
+
+	err = m.store.Update(*existingUser)
+	if err != nil {
+		return nil, fmt.Errorf("error storing user: %w", err)
+	}
+
+	logger.Info("updated user")
+
+	return existingUser, nil
+}
+
+// DeleteUser removes a user and ends their sessions, version works like it
+// does for UpdateUser.
+func (m *Manager) DeleteUser(ctx context.Context, id string, version int64) error {
+	unlock, err := m.acquire(ctx, writerWeight)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if version != AnyVersion {
+		user, err := m.store.GetByID(id)
+		if err != nil {
+			return err
+		}
+
+		err = checkVersion(user, version)
+		if err != nil {
+			logging.FromContext(ctx).Debug("rejected user delete", "user_id", id, "err", err, "version", version, "current_version", user.Version)
+			return err
+		}
+	}
+
+	err = m.store.Delete(id)
+	if err != nil {
+		return err
+	}
+	m.sessions.removeUser(id)
+
+	logging.FromContext(ctx).Info("deleted user", "user_id", id)
+
+	return nil
+}
+
+// GetUserByName returns the oldest user with this name, use GetUserByID to
+// tell apart users that share a name.
+func (m *Manager) GetUserByName(ctx context.Context, first string, last string) (*User, error) {
+	unlock, err := m.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	user, err := m.store.GetByName(first, last)
+	m.metrics.lookup("name", err)
+	return user, err
+}
+
+// Ping checks the Manager is accepting operations and its store is healthy,
+// for readiness checks.
+func (m *Manager) Ping(ctx context.Context) error {
+	unlock, err := m.acquire(ctx, 1)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.store.Ping()
+}
+
+// Shutdown stops new operations, waits for the ones in progress and then
+// flushes and closes the store.  If ctx ends first it returns without closing
+// the store, calling it again picks up where it left off.  The Manager can't
+// be used afterward.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+	logger.Info("user manager shutting down")
+
+	m.stateMu.Lock()
+	m.closed = true
+	m.stateMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for user operations to finish: %w", ctx.Err())
+	}
+
+	m.closeOnce.Do(func() {
+		m.closeErr = m.store.Close()
+	})
+	if m.closeErr != nil {
+		return fmt.Errorf("error closing user store: %w", m.closeErr)
+	}
+
+	logger.Info("user manager shutdown complete")
+
+	return nil
+}
+
+// acquire counts an operation as in flight and takes weight from the lock,
+// 1 to read or writerWeight to write.  It fails if the Manager is shutting
+// down or ctx ends first, otherwise the caller has to call the returned
+// function when it's done.
+func (m *Manager) acquire(ctx context.Context, weight int64) (func(), error) {
+	m.stateMu.Lock()
+	if m.closed {
+		m.stateMu.Unlock()
+		return nil, ErrShuttingDown
+	}
+	m.inflight.Add(1)
+	m.stateMu.Unlock()
+
+	err := m.lock.Acquire(ctx, weight)
+	if err != nil {
+		m.inflight.Done()
+		return nil, err
+	}
+
+	return func() {
+		m.lock.Release(weight)
+		m.inflight.Done()
+	}, nil
+}
+
+// userInput holds the fields a client can set, the rules are the same ones
+// the HTTP layer declares on UserData
+type userInput struct {
+	FirstName string `validate:"trim,nfc,required,max=100,chars=name"`
+	LastName  string `validate:"trim,nfc,required,max=100,chars=name"`
+	Email     string `validate:"trim,required,max=254,email"`
+}
+
+// validateUser returns the normalized names and parsed email, or a
+// validate.Errors listing every invalid field.
+func validateUser(firstName string, lastName string, email string) (*userInput, *mail.Address, error) {
+	input := userInput{
 		FirstName: firstName,
 		LastName:  lastName,
-		Email:     *parsedAddress,
+		Email:     email,
 	}
 
-	m.users = append(m.users, newUser)
+	err := validate.Struct(&input)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	parsedAddress, err := mail.ParseAddress(input.Email)
+	if err != nil {
+		// validate already checked this, but don't trust that blindly
+		return nil, nil, &FieldError{Field: "Email", Detail: fmt.Sprintf("invalid email: %s", email)}
+	}
+
+	return &input, parsedAddress, nil
+}
+
+// checkVersion returns ErrVersionMismatch if version isn't AnyVersion and
+// the user isn't at it
+func checkVersion(u *User, version int64) error {
+	if version != AnyVersion && u.Version != version {
+		return ErrVersionMismatch
+	}
 	return nil
 }
 
-func (m *Manager) GetUserByName(first string, last string) (*User, error) {
-	for i, user := range m.users {
-		if user.FirstName == first && user.LastName == last {
-			// fmt.Printf("address in list: %p\n", &m.users[i])
-			result := m.users[i]
-			// fmt.Printf("address of new var: %p\n", &result)
-			return &result, nil
-		}
+// checkDuplicateEmail returns ErrDuplicateEmail if emails have to be unique
+// and a user other than ignoreID already has this one.  Expects the caller to
+// hold the write lock.
+func (m *Manager) checkDuplicateEmail(email string, ignoreID string) error {
+	if !m.uniqueEmails {
+		return nil
 	}
-	return nil, ErrNoResultsFound
+
+	existingUser, err := m.store.GetByEmail(email)
+	if err != nil && !errors.Is(err, ErrNoResultsFound) {
+		return fmt.Errorf("error checking if email is already in use: %v", err)
+	}
+
+	if existingUser != nil && existingUser.ID != ignoreID {
+		return ErrDuplicateEmail
+	}
+
+	return nil
 }
 
-func (m *Manager) Shutdown() {
-	slog.Info("user manager shutting down")
-	time.Sleep(2 * time.Second)
-	slog.Info("user manager shutdown complete")
+// newID returns a UUIDv7, a 48 bit millisecond timestamp followed by random
+// bits, formatted the usual 8-4-4-4-12 way.
+func newID(now time.Time) (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		return "", err
+	}
+
+	ms := uint64(now.UnixMilli())
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+
+	// version 7 and the RFC 9562 variant
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
 }
@@ -1,14 +1,27 @@
 package users
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/metrics"
+	"mycoolserver/internal/validate"
 	"net/mail"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAddUser(t *testing.T) {
 	testManager := NewManager()
+	testTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	testManager.now = func() time.Time { return testTime }
 
 	testFirstName := "Test"
 	testLastName := "Userman"
@@ -17,26 +30,34 @@ func TestAddUser(t *testing.T) {
 		t.Fatalf("error parsing test email address: %v", err)
 	}
 
-	err = testManager.AddUser(testFirstName, testLastName, testEmail.String())
+	err = testManager.AddUser(context.Background(), testFirstName, testLastName, testEmail.String())
 	if err != nil {
 		t.Fatalf("error creating user: %v", err)
 	}
 
-	if len(testManager.users) != 1 {
-		t.Errorf("bad test manager user count, wanted: %d, got: %d", 1, len(testManager.users))
-		if len(testManager.users) < 1 {
+	storedUsers := listStoredUsers(t, testManager)
+	if len(storedUsers) != 1 {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", 1, len(storedUsers))
+		if len(storedUsers) < 1 {
 			t.Fatal()
 		}
 	}
 
+	foundUser := storedUsers[0]
+	if foundUser.ID == "" {
+		t.Error("added user has no id")
+	}
+
 	expectedUser := User{
+		ID:        foundUser.ID,
 		FirstName: testFirstName,
 		LastName:  testLastName,
 		Email:     *testEmail,
+		CreatedAt: testTime,
+		UpdatedAt: testTime,
+		Version:   1,
 	}
 
-	foundUser := testManager.users[0]
-
 	if !reflect.DeepEqual(expectedUser, foundUser) {
 		t.Errorf("added user data is not correct\nwanted: %+v\ngot: %+v\n", expectedUser, foundUser)
 	}
@@ -49,18 +70,27 @@ func TestAddUserInvalidEmail(t *testing.T) {
 	testLastName := "Userman"
 	testEmail := "foobar"
 
-	err := testManager.AddUser(testFirstName, testLastName, testEmail)
+	err := testManager.AddUser(context.Background(), testFirstName, testLastName, testEmail)
 	if err == nil {
 		t.Error("no error returned for invalid email")
 	} else {
-		expectedErr := "invalid email: foobar"
+		expectedErr := "Email must be a valid email address"
 		if err.Error() != expectedErr {
 			t.Errorf("bad error text, wanted: %s, got: %s", expectedErr, err)
 		}
+
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != "Email" {
+			t.Errorf("error is not a FieldError for Email: %#v", err)
+		}
+
+		if !errors.Is(err, ErrValidation) {
+			t.Errorf("error doesn't match ErrValidation: %v", err)
+		}
 	}
 
-	if len(testManager.users) > 0 {
-		t.Errorf("bad test manager user count, wanted: %d, got: %d", 0, len(testManager.users))
+	if count := len(listStoredUsers(t, testManager)); count > 0 {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", 0, count)
 	}
 }
 
@@ -71,18 +101,22 @@ func TestAddUserEmptyFirstName(t *testing.T) {
 	testLastName := "Userman"
 	testEmail := "foobar"
 
-	err := testManager.AddUser(testFirstName, testLastName, testEmail)
+	err := testManager.AddUser(context.Background(), testFirstName, testLastName, testEmail)
 	if err == nil {
 		t.Error("no error returned for invalid email")
 	} else {
-		expectedErr := "invalid first name: \"\""
-		if err.Error() != expectedErr {
-			t.Errorf("bad error text, wanted: %s, got: %s", expectedErr, err)
+		// every invalid field is reported, not just the first one
+		expectedErr := validate.Errors{
+			{Field: "FirstName", Detail: "FirstName is required"},
+			{Field: "Email", Detail: "Email must be a valid email address"},
+		}
+		if !reflect.DeepEqual(expectedErr, err) {
+			t.Errorf("bad error, wanted: %v, got: %v", expectedErr, err)
 		}
 	}
 
-	if len(testManager.users) > 0 {
-		t.Errorf("bad test manager user count, wanted: %d, got: %d", 0, len(testManager.users))
+	if count := len(listStoredUsers(t, testManager)); count > 0 {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", 0, count)
 	}
 }
 
@@ -93,18 +127,21 @@ func TestAddUserEmptyLastName(t *testing.T) {
 	testLastName := ""
 	testEmail := "foobar"
 
-	err := testManager.AddUser(testFirstName, testLastName, testEmail)
+	err := testManager.AddUser(context.Background(), testFirstName, testLastName, testEmail)
 	if err == nil {
 		t.Error("no error returned for invalid email")
 	} else {
-		expectedErr := "invalid last name: \"\""
-		if err.Error() != expectedErr {
-			t.Errorf("bad error text, wanted: %s, got: %s", expectedErr, err)
+		expectedErr := validate.Errors{
+			{Field: "LastName", Detail: "LastName is required"},
+			{Field: "Email", Detail: "Email must be a valid email address"},
+		}
+		if !reflect.DeepEqual(expectedErr, err) {
+			t.Errorf("bad error, wanted: %v, got: %v", expectedErr, err)
 		}
 	}
 
-	if len(testManager.users) > 0 {
-		t.Errorf("bad test manager user count, wanted: %d, got: %d", 0, len(testManager.users))
+	if count := len(listStoredUsers(t, testManager)); count > 0 {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", 0, count)
 	}
 }
 
@@ -113,52 +150,127 @@ func TestAddUserDuplicateName(t *testing.T) {
 
 	testFirstName := "Test"
 	testLastName := "Userman"
-	testEmail, err := mail.ParseAddress("foo@bar.com")
+
+	err := testManager.AddUser(context.Background(), testFirstName, testLastName, "foo@bar.com")
 	if err != nil {
-		t.Fatalf("error parsing test email address: %v", err)
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	// different people can share a name, they're told apart by id
+	err = testManager.AddUser(context.Background(), testFirstName, testLastName, "baz@bar.com")
+	if err != nil {
+		t.Errorf("error creating user with duplicate name: %v", err)
+	}
+
+	storedUsers := listStoredUsers(t, testManager)
+	if len(storedUsers) != 2 {
+		t.Fatalf("bad test manager user count, wanted: %d, got: %d", 2, len(storedUsers))
+	}
+
+	if storedUsers[0].ID == storedUsers[1].ID {
+		t.Errorf("users share an id: %s", storedUsers[0].ID)
 	}
+}
+
+func TestAddUserDuplicateEmail(t *testing.T) {
+	testManager := NewManager()
 
-	err = testManager.AddUser(testFirstName, testLastName, testEmail.String())
+	err := testManager.AddUser(context.Background(), "Test", "Userman", "foo@bar.com")
 	if err != nil {
 		t.Fatalf("error creating user: %v", err)
 	}
 
-	err = testManager.AddUser(testFirstName, testLastName, testEmail.String())
-	if err == nil {
-		t.Error("no error returned for duplicate user", err)
-	} else {
-		expectedErr := "user with this name already exists"
-		if err.Error() != expectedErr {
-			t.Errorf("bad error text, wanted: %s, got: %s", expectedErr, err)
-		}
+	err = testManager.AddUser(context.Background(), "Other", "Userman", "FOO@bar.com")
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("bad error for duplicate email, wanted: %v, got: %v", ErrDuplicateEmail, err)
 	}
 
-	if len(testManager.users) != 1 {
-		t.Errorf("bad test manager user count, wanted: %d, got: %d", 1, len(testManager.users))
+	if count := len(listStoredUsers(t, testManager)); count != 1 {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", 1, count)
+	}
+
+	sharedManager := NewManager(WithUniqueEmails(false))
+
+	err = sharedManager.AddUser(context.Background(), "Test", "Userman", "foo@bar.com")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	err = sharedManager.AddUser(context.Background(), "Other", "Userman", "foo@bar.com")
+	if err != nil {
+		t.Errorf("error creating user with shared email: %v", err)
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	testManager := NewManager()
+
+	created, err := testManager.CreateUser(context.Background(), "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+
+	found, err := testManager.GetUserByEmail(context.Background(), "F.Bar@example.com")
+	if err != nil {
+		t.Fatalf("error getting user by email: %v", err)
+	}
+
+	if !reflect.DeepEqual(created, found) {
+		t.Errorf("bad user\nwanted: %+v\ngot: %+v", created, found)
+	}
+
+	_, err = testManager.GetUserByEmail(context.Background(), "nope@example.com")
+	if !errors.Is(err, ErrNoResultsFound) {
+		t.Errorf("bad error for missing user, wanted: %v, got: %v", ErrNoResultsFound, err)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	testTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	id, err := newID(testTime)
+	if err != nil {
+		t.Fatalf("error generating id: %v", err)
+	}
+
+	idPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if !idPattern.MatchString(id) {
+		t.Errorf("id is not a UUIDv7: %s", id)
+	}
+
+	later, err := newID(testTime.Add(time.Millisecond))
+	if err != nil {
+		t.Fatalf("error generating id: %v", err)
+	}
+
+	if later <= id {
+		t.Errorf("ids don't sort by time: %s <= %s", later, id)
 	}
 }
 
 func TestGetUserByName(t *testing.T) {
-	testManager := Manager{}
+	testManager := NewManager()
 
 	// create some test users with overlapping names
-	err := testManager.AddUser("foo", "bar", "f.bar@example.com")
+	err := testManager.AddUser(context.Background(), "foo", "bar", "f.bar@example.com")
 	if err != nil {
 		t.Fatalf("error adding test user: %v", err)
 	}
-	err = testManager.AddUser("bar", "baz", "bbaz@example.com")
+	err = testManager.AddUser(context.Background(), "bar", "baz", "bbaz@example.com")
 	if err != nil {
 		t.Fatalf("error adding test user: %v", err)
 	}
-	err = testManager.AddUser("foo", "baz", "fbaz@example.com")
+	err = testManager.AddUser(context.Background(), "foo", "baz", "fbaz@example.com")
 	if err != nil {
 		t.Fatalf("error adding test user: %v", err)
 	}
-	err = testManager.AddUser("baz", "foo", "bazf@example.com")
+	err = testManager.AddUser(context.Background(), "baz", "foo", "bazf@example.com")
 	if err != nil {
 		t.Fatalf("error adding test user: %v", err)
 	}
 
+	storedUsers := listStoredUsers(t, testManager)
+
 	tests := map[string]struct {
 		first       string
 		last        string
@@ -168,19 +280,19 @@ func TestGetUserByName(t *testing.T) {
 		"simple lookup": {
 			first:       "foo",
 			last:        "bar",
-			expected:    &testManager.users[0],
+			expected:    &storedUsers[0],
 			expectedErr: nil,
 		},
 		"last element lookup": {
 			first:       "baz",
 			last:        "foo",
-			expected:    &testManager.users[3],
+			expected:    &storedUsers[3],
 			expectedErr: nil,
 		},
 		"similar name returns correct user": {
 			first:       "foo",
 			last:        "baz",
-			expected:    &testManager.users[2],
+			expected:    &storedUsers[2],
 			expectedErr: nil,
 		},
 		"no match lookup": {
@@ -210,7 +322,7 @@ func TestGetUserByName(t *testing.T) {
 	}
 
 	for name, test := range tests {
-		result, err := testManager.GetUserByName(test.first, test.last)
+		result, err := testManager.GetUserByName(context.Background(), test.first, test.last)
 		if !reflect.DeepEqual(result, test.expected) {
 			t.Errorf("%s: invalid result\ngot: %+v,\nwanted: %+v", name, result, test.expected)
 		}
@@ -219,3 +331,498 @@ func TestGetUserByName(t *testing.T) {
 		}
 	}
 }
+
+func TestConcurrentAddAndGet(t *testing.T) {
+	testManager := NewManager()
+
+	workers := 50
+	usersPerWorker := 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < usersPerWorker; i++ {
+				// names can't contain digits, spell the numbers with letters
+				first := "first" + string(rune('a'+w/26)) + string(rune('a'+w%26))
+				last := "last" + string(rune('a'+i))
+
+				err := testManager.AddUser(context.Background(), first, last, fmt.Sprintf("%s.%s@example.com", first, last))
+				if err != nil {
+					t.Errorf("error adding user %s %s: %v", first, last, err)
+					return
+				}
+
+				_, err = testManager.GetUserByName(context.Background(), first, last)
+				if err != nil {
+					t.Errorf("error getting user %s %s: %v", first, last, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if count := len(listStoredUsers(t, testManager)); count != workers*usersPerWorker {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", workers*usersPerWorker, count)
+	}
+}
+
+func TestConcurrentAddDuplicate(t *testing.T) {
+	testManager := NewManager()
+
+	workers := 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- testManager.AddUser(context.Background(), "Test", "Userman", "foo@bar.com")
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	successes := 0
+	for err := range errs {
+		if err == nil {
+			successes++
+		}
+	}
+
+	if successes != 1 {
+		t.Errorf("bad successful add count, wanted: %d, got: %d", 1, successes)
+	}
+
+	if count := len(listStoredUsers(t, testManager)); count != 1 {
+		t.Errorf("bad test manager user count, wanted: %d, got: %d", 1, count)
+	}
+}
+
+func listStoredUsers(t *testing.T, m *Manager) []User {
+	t.Helper()
+
+	storedUsers, err := m.store.List()
+	if err != nil {
+		t.Fatalf("error listing stored users: %v", err)
+	}
+
+	return storedUsers
+}
+
+func TestGetUserByID(t *testing.T) {
+	testManager := NewManager()
+
+	created, err := testManager.CreateUser(context.Background(), "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+
+	found, err := testManager.GetUserByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("error getting user by id: %v", err)
+	}
+
+	if !reflect.DeepEqual(created, found) {
+		t.Errorf("bad user\nwanted: %+v\ngot: %+v", created, found)
+	}
+
+	_, err = testManager.GetUserByID(context.Background(), "nope")
+	if !errors.Is(err, ErrNoResultsFound) {
+		t.Errorf("bad error for missing user, wanted: %v, got: %v", ErrNoResultsFound, err)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	testManager := NewManager()
+	createTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	updateTime := createTime.Add(time.Hour)
+	testManager.now = func() time.Time { return createTime }
+
+	created, err := testManager.CreateUser(context.Background(), "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+	_, err = testManager.CreateUser(context.Background(), "bar", "baz", "bbaz@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+
+	testManager.now = func() time.Time { return updateTime }
+
+	updated, err := testManager.UpdateUser(context.Background(), created.ID, AnyVersion, "foo", "quux", "fquux@example.com")
+	if err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+
+	expected := User{
+		ID:        created.ID,
+		FirstName: "foo",
+		LastName:  "quux",
+		Email:     mail.Address{Address: "fquux@example.com"},
+		CreatedAt: createTime,
+		UpdatedAt: updateTime,
+		Version:   2,
+	}
+	if !reflect.DeepEqual(expected, *updated) {
+		t.Errorf("bad updated user\nwanted: %+v\ngot: %+v", expected, *updated)
+	}
+
+	found, err := testManager.GetUserByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("error getting updated user: %v", err)
+	}
+	if !reflect.DeepEqual(updated, found) {
+		t.Errorf("update not stored\nwanted: %+v\ngot: %+v", updated, found)
+	}
+
+	// keeping your own email is fine, taking somebody else's isn't
+	_, err = testManager.UpdateUser(context.Background(), created.ID, AnyVersion, "foo", "quux", "fquux@example.com")
+	if err != nil {
+		t.Errorf("error updating user without an email change: %v", err)
+	}
+
+	_, err = testManager.UpdateUser(context.Background(), created.ID, AnyVersion, "foo", "quux", "bbaz@example.com")
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("bad error for duplicate email, wanted: %v, got: %v", ErrDuplicateEmail, err)
+	}
+
+	_, err = testManager.UpdateUser(context.Background(), created.ID, AnyVersion, "foo", "quux", "foobar")
+	if err == nil {
+		t.Error("no error returned for invalid email")
+	}
+
+	_, err = testManager.UpdateUser(context.Background(), "nope", AnyVersion, "foo", "quux", "fquux@example.com")
+	if !errors.Is(err, ErrNoResultsFound) {
+		t.Errorf("bad error for missing user, wanted: %v, got: %v", ErrNoResultsFound, err)
+	}
+}
+
+func TestUpdateUserVersion(t *testing.T) {
+	testManager := NewManager()
+
+	created, err := testManager.CreateUser(context.Background(), "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+	if created.Version != 1 {
+		t.Errorf("bad version for a new user, wanted: 1, got: %d", created.Version)
+	}
+
+	updated, err := testManager.UpdateUser(context.Background(), created.ID, created.Version, "foo", "baz", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error updating user at its current version: %v", err)
+	}
+	if updated.Version != 2 {
+		t.Errorf("bad version after an update, wanted: 2, got: %d", updated.Version)
+	}
+
+	// a second client that read the user before the update loses
+	_, err = testManager.UpdateUser(context.Background(), created.ID, created.Version, "foo", "quux", "f.bar@example.com")
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("bad error for a stale update, wanted: %v, got: %v", ErrVersionMismatch, err)
+	}
+
+	found, err := testManager.GetUserByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if found.LastName != "baz" {
+		t.Errorf("stale update was stored, wanted last name: baz, got: %s", found.LastName)
+	}
+
+	withRole, err := testManager.SetRole(context.Background(), created.ID, RoleViewer)
+	if err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+	if withRole.Version != 3 {
+		t.Errorf("bad version after a role change, wanted: 3, got: %d", withRole.Version)
+	}
+
+	err = testManager.DeleteUser(context.Background(), created.ID, updated.Version)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("bad error for a stale delete, wanted: %v, got: %v", ErrVersionMismatch, err)
+	}
+
+	err = testManager.DeleteUser(context.Background(), created.ID, withRole.Version)
+	if err != nil {
+		t.Errorf("error deleting user at its current version: %v", err)
+	}
+}
+
+func TestConcurrentUpdateUnversioned(t *testing.T) {
+	store := NewMemoryStore()
+	testManager := NewManager(WithStore(store))
+
+	// stored before users had versions, so it's at 0
+	err := store.Create(testUser("old", "foo", "bar"))
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+
+	workers := 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every worker read the user at version 0
+			_, err := testManager.UpdateUser(context.Background(), "old", 0, "foo", "baz", "foo.bar@example.com")
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	successes := 0
+	for err := range errs {
+		if err == nil {
+			successes++
+		} else if !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("bad error for a losing update, wanted: %v, got: %v", ErrVersionMismatch, err)
+		}
+	}
+
+	if successes != 1 {
+		t.Errorf("bad successful update count, wanted: %d, got: %d", 1, successes)
+	}
+
+	found, err := testManager.GetUserByID(context.Background(), "old")
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if found.Version != 1 {
+		t.Errorf("bad version after the updates, wanted: 1, got: %d", found.Version)
+	}
+
+	err = testManager.DeleteUser(context.Background(), "old", 0)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("bad error for a stale delete, wanted: %v, got: %v", ErrVersionMismatch, err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	testManager := NewManager()
+
+	created, err := testManager.CreateUser(context.Background(), "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+
+	err = testManager.DeleteUser(context.Background(), created.ID, AnyVersion)
+	if err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+
+	_, err = testManager.GetUserByID(context.Background(), created.ID)
+	if !errors.Is(err, ErrNoResultsFound) {
+		t.Errorf("bad error for deleted user, wanted: %v, got: %v", ErrNoResultsFound, err)
+	}
+
+	err = testManager.DeleteUser(context.Background(), created.ID, AnyVersion)
+	if !errors.Is(err, ErrNoResultsFound) {
+		t.Errorf("bad error for missing user, wanted: %v, got: %v", ErrNoResultsFound, err)
+	}
+}
+
+func TestAddUserNormalizes(t *testing.T) {
+	testManager := NewManager()
+
+	// "e" followed by a combining acute accent, stored precomposed
+	created, err := testManager.CreateUser(context.Background(), "  Rene\u0301e ", " O'Brien", " renee@example.com ")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	if created.FirstName != "Ren\u00e9e" {
+		t.Errorf("first name not trimmed and normalized: %q", created.FirstName)
+	}
+
+	if created.LastName != "O'Brien" {
+		t.Errorf("last name not trimmed: %q", created.LastName)
+	}
+
+	if created.Email.Address != "renee@example.com" {
+		t.Errorf("email not trimmed: %q", created.Email.Address)
+	}
+
+	_, err = testManager.GetUserByName(context.Background(), "Ren\u00e9e", "O'Brien")
+	if err != nil {
+		t.Errorf("error getting normalized user by name: %v", err)
+	}
+}
+
+func TestManagerLogsWithContextLogger(t *testing.T) {
+	testManager := NewManager()
+
+	var logs bytes.Buffer
+	ctx := logging.WithLogger(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)))
+	ctx = logging.With(ctx, "request_id", "abc123")
+
+	created, err := testManager.CreateUser(ctx, "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	expected := "msg=\"created user\" request_id=abc123 user_id=" + created.ID
+	if !strings.Contains(logs.String(), expected) {
+		t.Errorf("bad log output, wanted it to contain: %q, got: %q", expected, logs.String())
+	}
+}
+
+func TestCanceledContext(t *testing.T) {
+	testManager := NewManager()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := testManager.AddUser(ctx, "foo", "bar", "f.bar@example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("bad error, wanted: %v, got: %v", context.Canceled, err)
+	}
+
+	users := listStoredUsers(t, testManager)
+	if len(users) != 0 {
+		t.Errorf("user was stored with a canceled context: %+v", users)
+	}
+}
+
+func TestLockWaitAbandoned(t *testing.T) {
+	testManager := NewManager()
+
+	// stand in for a slow write
+	unlock, err := testManager.acquire(context.Background(), writerWeight)
+	if err != nil {
+		t.Fatalf("error taking the write lock: %v", err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = testManager.GetUserByID(ctx, "nope")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("bad error, wanted: %v, got: %v", context.DeadlineExceeded, err)
+	}
+
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("lookup didn't give up promptly, waited %s", waited)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	testManager := NewManager()
+
+	unlock, err := testManager.acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("error taking the read lock: %v", err)
+	}
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- testManager.Shutdown(context.Background())
+	}()
+
+	// new operations are turned away while the old one finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = testManager.GetUserByID(context.Background(), "nope")
+		if errors.Is(err, ErrShuttingDown) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("operations still accepted during shutdown, last error: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err = <-shutdownErr:
+		t.Fatalf("shutdown finished with an operation in flight: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlock()
+
+	err = <-shutdownErr
+	if err != nil {
+		t.Errorf("error shutting down: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	testManager := NewManager()
+
+	unlock, err := testManager.acquire(context.Background(), writerWeight)
+	if err != nil {
+		t.Fatalf("error taking the write lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = testManager.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("bad error, wanted: %v, got: %v", context.DeadlineExceeded, err)
+	}
+
+	// trying again once the operation is done finishes the job
+	unlock()
+
+	err = testManager.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("error finishing shutdown: %v", err)
+	}
+}
+
+func TestManagerMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	testManager := NewManager(WithMetrics(reg))
+	ctx := context.Background()
+
+	created, err := testManager.CreateUser(ctx, "foo", "bar", "f.bar@example.com")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	// failures
+	testManager.AddUser(ctx, "foo", "bar", "f.bar@example.com")
+	testManager.AddUser(ctx, "", "bar", "nope")
+
+	// lookups
+	testManager.GetUserByID(ctx, created.ID)
+	testManager.GetUserByID(ctx, "nope")
+	testManager.GetUserByEmail(ctx, "nope@example.com")
+	testManager.GetUserByName(ctx, "foo", "bar")
+
+	var out bytes.Buffer
+	err = reg.WriteText(&out)
+	if err != nil {
+		t.Fatalf("error writing metrics: %v", err)
+	}
+
+	expectedLines := []string{
+		`users_add_failures_total{reason="duplicate_email"} 1`,
+		`users_add_failures_total{reason="validation"} 1`,
+		`users_lookups_total{by="email",result="miss"} 1`,
+		`users_lookups_total{by="id",result="hit"} 1`,
+		`users_lookups_total{by="id",result="miss"} 1`,
+		`users_lookups_total{by="name",result="hit"} 1`,
+		`users_stored 1`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics missing line: %s\n%s", line, out.String())
+		}
+	}
+}
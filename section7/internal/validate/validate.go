@@ -0,0 +1,260 @@
+// Package validate checks request structs against rules declared in their
+// struct tags and reports every invalid field at once.
+//
+// Rules are listed in a `validate` tag, separated by commas:
+//
+//	FirstName string `validate:"trim,nfc,required,max=100,chars=name"`
+//
+// trim and nfc rewrite the value in place before any other rule runs, so the
+// struct has to be passed as a pointer.  The available rules are:
+//
+//	trim       strip leading and trailing whitespace
+//	nfc        Unicode normalize to NFC
+//	required   must not be empty
+//	min=N      at least N characters
+//	max=N      at most N characters
+//	chars=SET  only characters from SET, one of name or alnum
+//	email      a valid email address
+//
+// Errors name fields by their json tag if they have one and by their Go name
+// otherwise, so they match what the client sent.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalid matches any *FieldError with errors.Is
+var ErrInvalid = errors.New("validation failed")
+
+// FieldError reports an invalid value for one field
+type FieldError struct {
+	Field  string
+	Detail string
+}
+
+func (e *FieldError) Error() string {
+	return e.Detail
+}
+
+func (e *FieldError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+// Errors is every problem found in one struct, errors.As finds the first
+// *FieldError in it.
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	details := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		details = append(details, fieldErr.Detail)
+	}
+	return strings.Join(details, "; ")
+}
+
+func (e Errors) Unwrap() []error {
+	unwrapped := make([]error, 0, len(e))
+	for _, fieldErr := range e {
+		unwrapped = append(unwrapped, fieldErr)
+	}
+	return unwrapped
+}
+
+// Struct normalizes and checks every string field of the struct v points to
+// that has a validate tag.  It returns Errors, or nil if everything passed.
+func Struct(v any) error {
+	return check(v, nil)
+}
+
+// StructPartial works like Struct but only checks the named fields, for
+// requests that use a struct without needing all of it.
+func StructPartial(v any, fields ...string) error {
+	only := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		only[field] = true
+	}
+
+	return check(v, only)
+}
+
+// Var normalizes and checks a single value that isn't part of a struct, like
+// a header.
+func Var(field string, value *string, rules string) error {
+	errs := checkValue(field, value, rules)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Join merges the results of several Struct or Var calls into one error.
+func Join(errs ...error) error {
+	var joined Errors
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		var validationErrs Errors
+		if errors.As(err, &validationErrs) {
+			joined = append(joined, validationErrs...)
+			continue
+		}
+
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			joined = append(joined, fieldErr)
+			continue
+		}
+
+		// not something this package made, don't hide it
+		return err
+	}
+
+	if len(joined) == 0 {
+		return nil
+	}
+	return joined
+}
+
+func check(v any, only map[string]bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validate: expected a pointer to a struct, got %T", v))
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	var errs Errors
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+
+		rules, ok := field.Tag.Lookup("validate")
+		if !ok || !field.IsExported() {
+			continue
+		}
+
+		if only != nil && !only[field.Name] {
+			continue
+		}
+
+		if field.Type.Kind() != reflect.String {
+			panic(fmt.Sprintf("validate: field %s of %s is not a string", field.Name, rt))
+		}
+
+		value := rv.Field(i).String()
+		errs = append(errs, checkValue(fieldName(field), &value, rules)...)
+		rv.Field(i).SetString(value)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// checkValue reports at most one error per field, the first rule that fails
+func checkValue(field string, value *string, rules string) Errors {
+	parsed := strings.Split(rules, ",")
+
+	// normalizing first means the other rules see the value that gets stored
+	for _, rule := range parsed {
+		switch rule {
+		case "trim":
+			*value = strings.TrimSpace(*value)
+		case "nfc":
+			*value = norm.NFC.String(*value)
+		}
+	}
+
+	for _, rule := range parsed {
+		detail := checkRule(*value, rule)
+		if detail != "" {
+			return Errors{{Field: field, Detail: field + " " + detail}}
+		}
+	}
+
+	return nil
+}
+
+// checkRule returns what's wrong with value, or "" if it passes
+func checkRule(value string, rule string) string {
+	name, arg, _ := strings.Cut(rule, "=")
+
+	switch name {
+	case "", "trim", "nfc":
+		return ""
+	case "required":
+		if value == "" {
+			return "is required"
+		}
+	case "min":
+		if value != "" && utf8.RuneCountInString(value) < mustAtoi(rule, arg) {
+			return fmt.Sprintf("must be at least %s characters", arg)
+		}
+	case "max":
+		if utf8.RuneCountInString(value) > mustAtoi(rule, arg) {
+			return fmt.Sprintf("must be at most %s characters", arg)
+		}
+	case "chars":
+		allowed, ok := charSets[arg]
+		if !ok {
+			panic(fmt.Sprintf("validate: unknown character set in rule %q", rule))
+		}
+		for _, r := range value {
+			if !allowed(r) {
+				return fmt.Sprintf("contains invalid character %q", r)
+			}
+		}
+	case "email":
+		if value == "" {
+			return ""
+		}
+		_, err := mail.ParseAddress(value)
+		if err != nil {
+			return "must be a valid email address"
+		}
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+
+	return ""
+}
+
+func mustAtoi(rule string, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		panic(fmt.Sprintf("validate: bad number in rule %q", rule))
+	}
+	return n
+}
+
+var charSets = map[string]func(rune) bool{
+	// letters from any script plus the punctuation real names use, like
+	// O'Brien, Jean-Luc or St. John
+	"name": func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsMark(r) ||
+			r == ' ' || r == '\'' || r == '’' || r == '-' || r == '.'
+	},
+	"alnum": func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	},
+}
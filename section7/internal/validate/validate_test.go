@@ -0,0 +1,142 @@
+package validate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testRequest struct {
+	FirstName string `validate:"trim,nfc,required,max=10,chars=name"`
+	LastName  string `json:"last" validate:"trim,required,min=2"`
+	Email     string `validate:"trim,email"`
+	Code      string `validate:"chars=alnum"`
+	Ignored   string
+}
+
+func TestStruct(t *testing.T) {
+	tests := map[string]struct {
+		req      testRequest
+		expected Errors
+	}{
+		"valid": {
+			req: testRequest{FirstName: "Zoë", LastName: "O'Brien", Email: "zoe@example.com"},
+		},
+		"every field wrong": {
+			req: testRequest{FirstName: "  ", LastName: "x", Email: "nope", Code: "a-b", Ignored: "!!"},
+			expected: Errors{
+				{Field: "FirstName", Detail: "FirstName is required"},
+				{Field: "last", Detail: "last must be at least 2 characters"},
+				{Field: "Email", Detail: "Email must be a valid email address"},
+				{Field: "Code", Detail: "Code contains invalid character '-'"},
+			},
+		},
+		"too long counts characters not bytes": {
+			req: testRequest{FirstName: "ÅÅÅÅÅÅÅÅÅÅ", LastName: "ok"},
+		},
+		"too long": {
+			req: testRequest{FirstName: "Bartholomew", LastName: "ok"},
+			expected: Errors{
+				{Field: "FirstName", Detail: "FirstName must be at most 10 characters"},
+			},
+		},
+		"bad characters": {
+			req: testRequest{FirstName: "Bob<b>", LastName: "ok"},
+			expected: Errors{
+				{Field: "FirstName", Detail: "FirstName contains invalid character '<'"},
+			},
+		},
+		"digits in a name": {
+			req: testRequest{FirstName: "B0b", LastName: "ok"},
+			expected: Errors{
+				{Field: "FirstName", Detail: "FirstName contains invalid character '0'"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		err := Struct(&test.req)
+
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+			}
+			continue
+		}
+
+		var errs Errors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: bad error type: %#v", name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(test.expected, errs) {
+			t.Errorf("%s: bad errors\nwanted: %+v\ngot: %+v", name, test.expected, errs)
+		}
+
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: error doesn't match ErrInvalid", name)
+		}
+
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr != errs[0] {
+			t.Errorf("%s: errors.As didn't find the first field error", name)
+		}
+	}
+}
+
+func TestStructNormalizes(t *testing.T) {
+	// "e" followed by a combining acute accent
+	req := testRequest{FirstName: "  Rene\u0301e ", LastName: " Smith\t"}
+
+	err := Struct(&req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if req.FirstName != "Ren\u00e9e" {
+		t.Errorf("first name not trimmed and normalized: %q", req.FirstName)
+	}
+
+	if req.LastName != "Smith" {
+		t.Errorf("last name not trimmed: %q", req.LastName)
+	}
+}
+
+func TestStructPartial(t *testing.T) {
+	req := testRequest{FirstName: "Bob"}
+
+	err := StructPartial(&req, "FirstName")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = StructPartial(&req, "FirstName", "LastName")
+	if err == nil {
+		t.Error("no error for missing last name")
+	}
+}
+
+func TestVarAndJoin(t *testing.T) {
+	first := " "
+	last := "Man"
+
+	err := Join(
+		Var("userFirst", &first, "trim,required"),
+		Var("userLast", &last, "trim,required"),
+	)
+
+	expected := Errors{{Field: "userFirst", Detail: "userFirst is required"}}
+	if !reflect.DeepEqual(expected, err) {
+		t.Errorf("bad errors\nwanted: %+v\ngot: %+v", expected, err)
+	}
+
+	if Join(nil, nil) != nil {
+		t.Error("joining no errors isn't nil")
+	}
+
+	other := errors.New("something else")
+	if !errors.Is(Join(err, other), other) {
+		t.Error("non validation error was hidden by Join")
+	}
+}
@@ -3,56 +3,231 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log/slog"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/compression"
+	"mycoolserver/internal/config"
+	"mycoolserver/internal/cors"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/metrics"
+	"mycoolserver/internal/middleware"
+	"mycoolserver/internal/negotiate"
+	"mycoolserver/internal/openapi"
+	"mycoolserver/internal/policy"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/ratelimit"
+	"mycoolserver/internal/tlsconfig"
 	"mycoolserver/internal/users"
+	"mycoolserver/internal/validate"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// UserData is the JSON shape of a user.  The validate rules match the ones
+// the users package enforces, handlers that only need some of the fields
+// check those with validate.StructPartial.
 type UserData struct {
-	FirstName string
-	LastName  string
-	Email     string
+	ID        string    `json:",omitempty" xml:",omitempty" openapi:"readOnly"`
+	FirstName string    `validate:"trim,nfc,required,max=100,chars=name"`
+	LastName  string    `validate:"trim,nfc,required,max=100,chars=name"`
+	Email     string    `validate:"trim,required,max=254,email"`
+	CreatedAt time.Time `json:",omitzero" openapi:"readOnly"`
+	UpdatedAt time.Time `json:",omitzero" openapi:"readOnly"`
+	// Password is only accepted when creating a user and never sent back,
+	// the users package checks it
+	Password string `json:",omitempty" xml:",omitempty" openapi:"writeOnly"`
+	// Role is only sent back, PUT /users/{id}/role sets it
+	Role string `json:",omitempty" xml:",omitempty" openapi:"readOnly"`
 }
 
+// HelloResponse is the JSON form of a greeting
+type HelloResponse struct {
+	Message string
+}
+
+// media types routes respond with, the first is the default
+var (
+	userFormats  = []string{negotiate.JSON, negotiate.XML, negotiate.CBOR}
+	helloFormats = []string{negotiate.Text, negotiate.JSON, negotiate.HTML}
+)
+
+// defaultMaxBodyBytes is used when a server is created without a config,
+// like in tests
+const defaultMaxBodyBytes = 1048576
+
 type server struct {
-	userManager *users.Manager
+	userManager  *users.Manager
+	maxBodyBytes int64
+	// requestTimeout applies to every route not in routeTimeouts, zero means
+	// requests can take as long as they like
+	requestTimeout time.Duration
+	routeTimeouts  map[string]time.Duration
+	// metrics is served at /metrics, the user manager should record into
+	// it too
+	metrics *metrics.Registry
+	// draining is set once shutdown starts, it makes /readyz fail
+	draining atomic.Bool
+	// auth guards every route that isn't public, nil lets everyone in
+	auth *auth.Authenticator
+	// rateLimit applies to every route not in routeRateLimits, each route
+	// keeps its own buckets of at most rateLimitMaxClients clients.  A zero
+	// limit means no limit.
+	rateLimit           ratelimit.Limit
+	routeRateLimits     map[string]ratelimit.Limit
+	rateLimitMaxClients int
+	// cors answers preflights and adds CORS headers, nil leaves them out
+	cors *cors.CORS
+	// compression compresses responses and decompresses request bodies,
+	// nil leaves bodies as they are
+	compression *compression.Compressor
+	// validateRequests checks requests against the OpenAPI document before
+	// they reach a handler
+	validateRequests bool
+	// checkResponse, if set, is told about responses that don't match the
+	// OpenAPI document.  Only tests set it.
+	checkResponse func(r *http.Request, errs []openapi.ValidationError)
+	// the OpenAPI document is built from the route table the first time
+	// it's asked for
+	openAPIOnce sync.Once
+	openAPIDoc  *openapi.Document
+	openAPISpec []byte
+	openAPIErr  error
 }
 
 func main() {
-	manager := users.NewManager()
-	defer manager.Shutdown()
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			config.Usage(os.Stderr)
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		config.Usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if cfg.PrintConfig {
+		err = cfg.Write(os.Stdout)
+		if err != nil {
+			slog.Error("error printing config", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Load already validated the level
+	level, _ := cfg.SlogLevel()
+	slog.SetLogLoggerLevel(level)
+
+	store, err := newUserStore(cfg.Store)
+	if err != nil {
+		slog.Error("error creating user store", "err", err)
+		os.Exit(1)
+	}
+
+	registry := metrics.NewRegistry()
+	manager := users.NewManager(
+		users.WithStore(store),
+		users.WithMetrics(registry),
+		users.WithSessionTTL(cfg.Auth.SessionTTL),
+	)
+
+	corsHandler, err := newCORS(cfg.CORS)
+	if err != nil {
+		slog.Error("error setting up CORS", "err", err)
+		os.Exit(1)
+	}
+
+	authenticator, err := newAuthenticator(cfg.Auth, manager, corsHandler)
+	if err != nil {
+		slog.Error("error setting up authentication", "err", err)
+		os.Exit(1)
+	}
+
+	compressor, err := newCompressor(cfg.Compression, cfg.MaxBodyBytes)
+	if err != nil {
+		slog.Error("error setting up compression", "err", err)
+		os.Exit(1)
+	}
 
 	s := server{
-		userManager: manager,
+		metrics:        registry,
+		userManager:    manager,
+		maxBodyBytes:   cfg.MaxBodyBytes,
+		requestTimeout: cfg.RequestTimeout,
+		routeTimeouts:  cfg.RouteTimeouts,
+		auth:           authenticator,
+		cors:           corsHandler,
+		compression:    compressor,
+
+		validateRequests: cfg.ValidateRequests,
+
+		rateLimit:           convertRateLimit(cfg.RateLimit.Default),
+		routeRateLimits:     make(map[string]ratelimit.Limit, len(cfg.RateLimit.Routes)),
+		rateLimitMaxClients: cfg.RateLimit.MaxClients,
+	}
+	for pattern, limit := range cfg.RateLimit.Routes {
+		s.routeRateLimits[pattern] = convertRateLimit(limit)
 	}
 
-	mux := http.NewServeMux()
 	httpServer := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+		Addr:    cfg.Addr,
+		Handler: s.handler(),
 	}
 
-	mux.HandleFunc("/{$}", handleRoot)
-	mux.HandleFunc("/goodbye/", handleGoodbye)
-	mux.HandleFunc("/hello/", handleHelloParameterized)
-	mux.HandleFunc("/responses/{user}/hello/", handleUserResponsesHello)
-	mux.HandleFunc("POST /user/hello", s.handleHelloHeader)
-	mux.HandleFunc("POST /json", handleJSON)
-	mux.HandleFunc("POST /add-user", s.addUser)
-	mux.HandleFunc("POST /get-user", s.getUser)
+	// stops the certificate watchers on the way out
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var redirectServer *http.Server
+	if cfg.TLS.Enabled() {
+		httpServer.TLSConfig, err = newTLSConfig(ctx, cfg.TLS)
+		if err != nil {
+			slog.Error("error setting up TLS", "err", err)
+			os.Exit(1)
+		}
+
+		if cfg.TLS.RedirectAddr != "" {
+			redirectServer = &http.Server{
+				Addr:    cfg.TLS.RedirectAddr,
+				Handler: tlsconfig.RedirectHandler(cfg.Addr),
+			}
+
+			go func() {
+				slog.Info("starting HTTPS redirect...", "addr", cfg.TLS.RedirectAddr)
+
+				err := redirectServer.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("HTTP redirect server error", "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
+	}
 
 	go func() {
-		slog.Info("starting server...")
-		err := httpServer.ListenAndServe()
+		slog.Info("starting server...", "addr", cfg.Addr, "tls", cfg.TLS.Enabled())
+
+		var err error
+		if cfg.TLS.Enabled() {
+			// the certificate comes from TLSConfig so it can be reloaded
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("HTTP server error", "err", err)
 			os.Exit(1)
@@ -64,153 +239,469 @@ func main() {
 	go func() {
 		defer wg.Done()
 
-		sigChan := make(chan os.Signal)
+		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 
-		<-sigChan
+		sig := <-sigChan
+		s.draining.Store(true)
+
+		// SIGTERM comes from an orchestrator that's also about to take us out
+		// of the load balancer, keep serving until it's seen /readyz fail.
+		// SIGINT is someone at a terminal who doesn't want to wait.
+		if sig == syscall.SIGTERM && cfg.DrainDelay > 0 {
+			slog.Info("draining before shutdown", "delay", cfg.DrainDelay)
+
+			select {
+			case <-time.After(cfg.DrainDelay):
+			case <-sigChan:
+				slog.Info("second signal, skipping the rest of the drain delay")
+			}
+		}
+
 		slog.Info("shutting down server")
 
-		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 		defer shutdownCancel()
 
+		if redirectServer != nil {
+			err := redirectServer.Shutdown(shutdownCtx)
+			if err != nil {
+				slog.Error("timeout shutting down redirect server", "err", err)
+			}
+		}
+
 		err := httpServer.Shutdown(shutdownCtx)
 		if err != nil {
 			slog.Error("timeout shutting down http server", "err", err)
 		}
+
+		// requests still running after the timeout keep going, so the users
+		// get what's left of it to finish before the store is closed
+		err = manager.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("error shutting down user manager", "err", err)
+		}
 	}()
 
 	wg.Wait()
 	slog.Info("server shutdown complete")
 }
 
-func (s *server) handleHelloHeader(w http.ResponseWriter, r *http.Request) {
-	firstName := r.Header.Get("userFirst")
-	if firstName == "" {
-		http.Error(w, "invalid first name provided", http.StatusBadRequest)
-		return
+// newTLSConfig loads the certificate and keeps it fresh, reloading on SIGHUP
+// and, if the config asks for it, whenever the files change.  Connections
+// already open keep the certificate they started with.
+func newTLSConfig(ctx context.Context, cfg config.TLSConfig) (*tls.Config, error) {
+	reloader, err := tlsconfig.NewCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
 	}
 
-	lastName := r.Header.Get("userLast")
-	if lastName == "" {
-		http.Error(w, "invalid last name provided", http.StatusBadRequest)
-		return
+	if cfg.ReloadInterval > 0 {
+		go reloader.Watch(ctx, cfg.ReloadInterval)
 	}
 
-	user, err := s.userManager.GetUserByName(firstName, lastName)
-	if err != nil {
-		if errors.Is(err, users.ErrNoResultsFound) {
-			http.Error(w, "no users found", http.StatusNotFound)
-		} else {
-			http.Error(w, fmt.Sprintf("error retrieving user: %v\n", err), http.StatusInternalServerError)
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		defer signal.Stop(hupChan)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupChan:
+			}
+
+			err := reloader.Reload()
+			if err != nil {
+				slog.Error("error reloading TLS certificate", "err", err)
+				continue
+			}
+			slog.Info("reloaded TLS certificate", "cert", cfg.CertFile)
 		}
-		return
+	}()
+
+	return tlsconfig.ServerConfig(reloader, tlsconfig.Options{
+		MinVersion:   cfg.MinVersion,
+		ClientCAFile: cfg.ClientCAFile,
+		ClientAuth:   cfg.ClientAuth,
+	})
+}
+
+// newAuthenticator reads the key files the config points at and accepts
+// sessions from manager, from pages on the server's own origin or ones
+// corsHandler lets send credentials.  corsHandler can be nil.  It returns
+// nil when authentication is disabled.
+func newAuthenticator(cfg config.AuthConfig, manager *users.Manager, corsHandler *cors.CORS) (*auth.Authenticator, error) {
+	if cfg.Disabled {
+		slog.Warn("authentication is disabled, protected routes are open to everyone")
+		return nil, nil
 	}
 
-	result := fmt.Sprintf("Hello, %s %s!  Your email is: %s\n", user.FirstName, user.LastName, user.Email.Address)
+	opts := []auth.Option{auth.WithSessions(sessionLookup(manager))}
+	if corsHandler != nil {
+		opts = append(opts, auth.WithTrustedOrigins(corsHandler.AllowsCredentials))
+	}
+	if cfg.AdminKeySHA256 != "" {
+		slog.Warn("the admin key is configured, unset it once an admin user can log in")
+		opts = append(opts, auth.WithAPIKey(config.AdminKeyName, cfg.AdminKeySHA256, string(users.RoleAdmin)))
+	}
+	for _, key := range cfg.APIKeys {
+		opts = append(opts, auth.WithAPIKey(key.Name, key.SHA256, key.Role, key.Scopes...))
+	}
 
-	_, err = w.Write([]byte(result))
-	if err != nil {
-		slog.Error("error writing response body", "err", err)
-		return
+	if cfg.JWT.Enabled() {
+		jwtOpts := auth.JWTOptions{
+			Issuer:   cfg.JWT.Issuer,
+			Audience: cfg.JWT.Audience,
+		}
+
+		if cfg.JWT.HMACSecretFile != "" {
+			secret, err := os.ReadFile(cfg.JWT.HMACSecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading JWT HMAC secret: %w", err)
+			}
+			// editors like to leave a newline at the end
+			jwtOpts.HMACSecret = bytes.TrimSpace(secret)
+		}
+
+		if cfg.JWT.RSAPublicKeyFile != "" {
+			pemData, err := os.ReadFile(cfg.JWT.RSAPublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading JWT RSA public key: %w", err)
+			}
+
+			jwtOpts.RSAPublicKey, err = auth.ParseRSAPublicKey(pemData)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing JWT RSA public key: %w", err)
+			}
+		}
+
+		verifier, err := auth.NewJWTVerifier(jwtOpts)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, auth.WithJWT(verifier))
+	}
+
+	if cfg.AdminKeySHA256 == "" && len(cfg.APIKeys) == 0 && !cfg.JWT.Enabled() {
+		slog.Warn("no API keys or JWT keys configured, only logged in users can use protected routes, " +
+			"set MYCOOLSERVER_ADMIN_KEY_SHA256 to create the first admin")
 	}
+
+	return auth.New(opts...)
 }
 
-func (s *server) addUser(w http.ResponseWriter, r *http.Request) {
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		http.Error(w, fmt.Sprintf("unsupported Content-Type header: %q", contentType), http.StatusUnsupportedMediaType)
-		return
+// newCORS returns nil when no origins are allowed
+func newCORS(cfg config.CORSConfig) (*cors.CORS, error) {
+	if !cfg.Enabled() {
+		return nil, nil
 	}
 
-	// limit to 1MB
-	requestBody := http.MaxBytesReader(w, r.Body, 1048576)
+	return cors.New(cors.Options{
+		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowedMethods:   cfg.AllowedMethods,
+		AllowedHeaders:   cfg.AllowedHeaders,
+		ExposedHeaders:   cfg.ExposedHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	})
+}
 
-	decoder := json.NewDecoder(requestBody)
-	decoder.DisallowUnknownFields()
+// newCompressor returns nil when compression is off.  Request bodies may
+// decompress to as much as handlers read of any body.
+func newCompressor(cfg config.CompressionConfig, maxBodyBytes int64) (*compression.Compressor, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
 
-	var u UserData
+	return compression.New(compression.Options{
+		Encodings:       cfg.Encodings,
+		MinSize:         cfg.MinSize,
+		MaxRequestBytes: maxBodyBytes,
+	})
+}
 
-	err := decoder.Decode(&u)
-	if err != nil {
-		slog.Error("error decoding addUser request body", "err", err)
-		http.Error(w, "bad request body", http.StatusBadRequest)
-		return
+// bodyLimit is the most a handler should read from a request body
+func (s *server) bodyLimit() int64 {
+	if s.maxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
 	}
+	return s.maxBodyBytes
+}
 
-	err = s.userManager.AddUser(u.FirstName, u.LastName, u.Email)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error adding user: %v\n", err), http.StatusBadRequest)
-		return
+// timeoutFor returns how long requests to the route registered as pattern
+// may take
+func (s *server) timeoutFor(pattern string) time.Duration {
+	timeout, ok := s.routeTimeouts[pattern]
+	if !ok {
+		return s.requestTimeout
 	}
+	return timeout
+}
 
-	w.WriteHeader(http.StatusCreated)
+// rateLimitFor returns the limit on each client of the route registered as
+// pattern
+func (s *server) rateLimitFor(pattern string) ratelimit.Limit {
+	limit, ok := s.routeRateLimits[pattern]
+	if !ok {
+		return s.rateLimit
+	}
+	return limit
 }
 
-func (s *server) getUser(w http.ResponseWriter, r *http.Request) {
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		http.Error(w, fmt.Sprintf("unsupported Content-Type header %q", contentType), http.StatusUnsupportedMediaType)
-		return
+// unauthenticated is the failure that counts against an address before
+// authentication
+func unauthenticated(status int) bool {
+	return status == http.StatusUnauthorized
+}
+
+func convertRateLimit(limit config.RateLimit) ratelimit.Limit {
+	return ratelimit.Limit{Rate: limit.Rate, Burst: limit.Burst}
+}
+
+// handler is the whole server, the routes wrapped in middleware that applies
+// to every request
+func (s *server) handler() http.Handler {
+	mux := s.routes()
+	var h http.Handler = mux
+
+	// CORS goes outside the routes so preflights never reach authentication
+	// and every response, errors included, gets its headers
+	if s.cors != nil {
+		h = s.cors.Handler(mux)
+	}
+	// request bodies are decompressed before anything reads them, so the
+	// body limit applies to what they decompress to
+	if s.compression != nil {
+		h = s.compression.Handler(h)
 	}
 
-	// limit to 1MB
-	requestBody := http.MaxBytesReader(w, r.Body, 1048576)
+	return middleware.Chain(h,
+		middleware.RequestID,
+		middleware.AccessLog(slog.Default()),
+		middleware.Recover,
+	)
+}
 
-	decoder := json.NewDecoder(requestBody)
-	decoder.DisallowUnknownFields()
+// route is everything main declares about a route when registering it
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	// public routes are served to anyone, the rest need credentials and the
+	// policy has to allow the principal to perform action
+	public bool
+	action policy.Action
+	// produces are the media types the handler can respond with, routes
+	// without any aren't negotiated
+	produces []string
+}
 
-	var u UserData
+func (s *server) routeTable() []route {
+	return []route{
+		{pattern: "GET /metrics", handler: s.metrics.Handler().ServeHTTP, public: true},
+		{pattern: "GET /healthz", handler: handleHealthz, public: true},
+		{pattern: "GET /readyz", handler: s.handleReadyz, public: true},
+
+		{pattern: "/{$}", handler: handleRoot, public: true},
+		{pattern: "/goodbye/", handler: handleGoodbye, public: true},
+		{pattern: "/hello/", handler: handleHelloParameterized, public: true, produces: helloFormats},
+		{pattern: "/responses/{user}/hello/", handler: handleUserResponsesHello, public: true, produces: helloFormats},
+		{pattern: "POST /user/hello", handler: s.handleHelloHeader, action: policy.ActionReadUser, produces: helloFormats},
+		{pattern: "POST /json", handler: handleJSON, public: true, produces: helloFormats},
+
+		{pattern: "GET /users", handler: s.listUsers, action: policy.ActionListUsers, produces: userFormats},
+		{pattern: "POST /users", handler: s.createUser, action: policy.ActionCreateUser, produces: userFormats},
+		{pattern: "GET /users/{id}", handler: s.getUserByID, action: policy.ActionReadUser, produces: userFormats},
+		{pattern: "PUT /users/{id}", handler: s.replaceUser, action: policy.ActionUpdateUser, produces: userFormats},
+		{pattern: "PATCH /users/{id}", handler: s.patchUser, action: policy.ActionUpdateUser, produces: userFormats},
+		{pattern: "DELETE /users/{id}", handler: s.deleteUser, action: policy.ActionDeleteUser},
+		{pattern: "PUT /users/{id}/password", handler: s.changePassword, action: policy.ActionChangePassword},
+		{pattern: "PUT /users/{id}/role", handler: s.setRole, action: policy.ActionSetRole, produces: userFormats},
+
+		{pattern: "GET /openapi.json", handler: s.handleOpenAPI, public: true},
+		{pattern: "GET /docs", handler: openapi.DocsHandler("/openapi.json").ServeHTTP, public: true},
+
+		{pattern: "POST /login", handler: s.login, public: true, produces: userFormats},
+		{pattern: "POST /logout", handler: s.logout, public: true},
+
+		// replaced by the /users resource, kept for existing clients
+		{pattern: "POST /add-user", handler: deprecated("/users", s.addUser), action: policy.ActionCreateUser},
+		{pattern: "POST /get-user", handler: deprecated("/users", s.getUser), action: policy.ActionReadUser, produces: userFormats},
+	}
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	if s.metrics == nil {
+		s.metrics = metrics.NewRegistry()
+	}
+	httpMetrics := middleware.NewHTTPMetrics(s.metrics)
+
+	var validator *openapi.Validator
+	if s.validateRequests || s.checkResponse != nil {
+		doc, _, err := s.openAPI()
+		if err != nil {
+			slog.Error("error building OpenAPI document, requests won't be validated", "err", err)
+		} else {
+			validator = openapi.NewValidator(doc)
+		}
+	}
+
+	registered := make(map[string]bool)
+	for _, rt := range s.routeTable() {
+		registered[rt.pattern] = true
+
+		var op *openapi.Operation
+		if validator != nil {
+			op = s.openAPIDoc.Operation(openAPIMethodPath(rt.pattern))
+		}
+
+		// every route logs with its pattern, the mux only knows which one
+		// matched once it's picked a handler
+		chain := []middleware.Middleware{
+			middleware.Route,
+			httpMetrics.Route(rt.pattern),
+		}
+		// outside everything else so errors from the middleware are checked
+		// too
+		if op != nil && s.checkResponse != nil {
+			chain = append(chain, validator.ValidateResponses(op, s.checkResponse))
+		}
+		// the rate limit goes after authentication so clients with
+		// credentials are limited by who they are rather than where they are.
+		// Requests that fail authentication never get that far, so they're
+		// limited by address first or guessing keys would be free.
+		limit := s.rateLimitFor(rt.pattern)
+		if !rt.public && s.auth != nil {
+			if limit.Enabled() {
+				limiter := ratelimit.New(limit, ratelimit.WithMaxKeys(s.rateLimitMaxClients))
+				chain = append(chain, ratelimit.FailureMiddleware(limiter, ratelimit.ClientKey, unauthenticated))
+			}
+			chain = append(chain, s.auth.Require())
+		}
+		if limit.Enabled() {
+			limiter := ratelimit.New(limit, ratelimit.WithMaxKeys(s.rateLimitMaxClients))
+			chain = append(chain, ratelimit.Middleware(limiter, ratelimit.ClientKey))
+		}
+		if !rt.public && s.auth != nil {
+			chain = append(chain, authorize(rt.action))
+		}
+		if len(rt.produces) > 0 {
+			chain = append(chain, negotiate.Middleware(rt.produces))
+		}
+		if op != nil && s.validateRequests {
+			chain = append(chain, validator.ValidateRequests(op, s.bodyLimit(), schemaBody(routeDocs[rt.pattern].request)))
+		}
+		chain = append(chain, middleware.Timeout(s.timeoutFor(rt.pattern)))
+
+		mux.Handle(rt.pattern, middleware.Chain(rt.handler, chain...))
+	}
 
-	err := decoder.Decode(&u)
+	for pattern := range s.routeTimeouts {
+		if !registered[pattern] {
+			slog.Warn("timeout configured for unknown route", "pattern", pattern)
+		}
+	}
+	for pattern := range s.routeRateLimits {
+		if !registered[pattern] {
+			slog.Warn("rate limit configured for unknown route", "pattern", pattern)
+		}
+	}
+
+	return mux
+}
+
+func newUserStore(cfg config.StoreConfig) (users.Store, error) {
+	switch cfg.Type {
+	case "memory":
+		return users.NewMemoryStore(), nil
+	case "file":
+		return users.NewFileStore(cfg.Path,
+			users.WithCompactAfter(cfg.CompactAfter),
+			users.WithSyncWrites(cfg.SyncWrites),
+		)
+	default:
+		return nil, fmt.Errorf("unknown store type: %q", cfg.Type)
+	}
+}
+
+// nameHeaderRules are the UserData name rules for values sent as headers
+const nameHeaderRules = "trim,nfc,required,max=100,chars=name"
+
+func (s *server) handleHelloHeader(w http.ResponseWriter, r *http.Request) {
+	firstName := r.Header.Get("userFirst")
+	lastName := r.Header.Get("userLast")
+
+	err := validate.Join(
+		validate.Var("userFirst", &firstName, nameHeaderRules),
+		validate.Var("userLast", &lastName, nameHeaderRules),
+	)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error decoding request body: %v\n", err), http.StatusBadRequest)
+		writeValidationError(w, r, "invalid name headers provided", err, nil)
 		return
 	}
 
-	user, err := s.userManager.GetUserByName(u.FirstName, u.LastName)
+	user, err := s.userManager.GetUserByName(r.Context(), firstName, lastName)
 	if err != nil {
-		if errors.Is(err, users.ErrNoResultsFound) {
-			http.Error(w, "no users found", http.StatusNotFound)
-		} else {
-			slog.Error("error retrieving user", "err", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
+		writeUserError(w, r, "error retrieving user", err, nil)
 		return
 	}
 
-	converted := convertUserToUserData(user)
+	writeHello(w, r, fmt.Sprintf("Hello, %s %s!  Your email is: %s", user.FirstName, user.LastName, user.Email.Address))
+}
 
-	marshalled, err := json.Marshal(converted)
+func (s *server) addUser(w http.ResponseWriter, r *http.Request) {
+	var u UserData
+	if !s.decodeBody(w, r, &u) {
+		return
+	}
+
+	_, err := s.userManager.CreateUserWithPassword(r.Context(), u.FirstName, u.LastName, u.Email, u.Password)
 	if err != nil {
-		slog.Error("error marshalling getUser response", "err", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeUserError(w, r, "error adding user", err, nil)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(marshalled)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) getUser(w http.ResponseWriter, r *http.Request) {
+	var u UserData
+	if !s.decodeBody(w, r, &u) {
+		return
+	}
+
+	err := validate.StructPartial(&u, "FirstName", "LastName")
 	if err != nil {
-		// headers are set by write call, best we can do is log an error
-		slog.Error("error writing getUser response body", "err", err)
+		writeValidationError(w, r, "invalid user name provided", err, nil)
+		return
 	}
 
-	return
+	user, err := s.userManager.GetUserByName(r.Context(), u.FirstName, u.LastName)
+	if err != nil {
+		writeUserError(w, r, "error retrieving user", err, nil)
+		return
+	}
+
+	writeUserIfModified(w, r, user)
 }
 
-func handleRoot(w http.ResponseWriter, _ *http.Request) {
+func handleRoot(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write([]byte("Welcome to our homepage!\n"))
 	if err != nil {
-		slog.Error("error writing response", "err", err)
+		logging.FromContext(r.Context()).Error("error writing response", "err", err)
 		return
 	}
 
 	return
 }
 
-func handleGoodbye(w http.ResponseWriter, _ *http.Request) {
+func handleGoodbye(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write([]byte("Goodbye!\n"))
 	if err != nil {
-		slog.Error("error writing response", "err", err)
+		logging.FromContext(r.Context()).Error("error writing response", "err", err)
 		return
 	}
 
@@ -225,57 +716,81 @@ func handleHelloParameterized(w http.ResponseWriter, r *http.Request) {
 		username = userList[0]
 	}
 
-	handleHello(w, username)
+	handleHello(w, r, username)
 }
 
 func handleUserResponsesHello(w http.ResponseWriter, r *http.Request) {
 	username := r.PathValue("user")
 
-	handleHello(w, username)
+	handleHello(w, r, username)
 }
 
 func handleJSON(w http.ResponseWriter, r *http.Request) {
 	byteData, err := io.ReadAll(r.Body)
 	if err != nil || len(byteData) < 1 {
-		slog.Error("error reading request body", "err", err)
-		http.Error(w, "bad request body", http.StatusBadRequest)
+		logging.FromContext(r.Context()).Error("error reading request body", "err", err)
+		writeProblem(w, r, problem.TypeBadRequestBody, http.StatusBadRequest, "bad request body")
 		return
 	}
 
 	var reqData UserData
 	err = json.Unmarshal(byteData, &reqData)
 	if err != nil {
-		slog.Error("error unmarshalling request body", "err", err)
-		http.Error(w, "error parsing request JSON", http.StatusBadRequest)
+		logging.FromContext(r.Context()).Error("error unmarshalling request body", "err", err)
+		writeProblem(w, r, problem.TypeBadRequestBody, http.StatusBadRequest, "error parsing request JSON")
 		return
 	}
 
-	if reqData.FirstName == "" {
-		http.Error(w, "invalid username provided", http.StatusBadRequest)
+	err = validate.StructPartial(&reqData, "FirstName")
+	if err != nil {
+		writeValidationError(w, r, "invalid username provided", err, nil)
 		return
 	}
 
-	handleHello(w, reqData.FirstName)
+	handleHello(w, r, reqData.FirstName)
 }
 
-func handleHello(w http.ResponseWriter, username string) {
+func handleHello(w http.ResponseWriter, r *http.Request, username string) {
+	writeHello(w, r, "Hello, "+username+"!")
+}
+
+// writeHello sends message as text, JSON or HTML, whichever was negotiated.
+// Text is the default.
+func writeHello(w http.ResponseWriter, r *http.Request, message string) {
 	var output bytes.Buffer
-	output.WriteString("Hello, ")
-	output.WriteString(username)
-	output.WriteString("!\n")
+
+	switch negotiate.MediaType(r.Context()) {
+	case negotiate.JSON:
+		writeResponse(w, r, http.StatusOK, HelloResponse{Message: message})
+		return
+	case negotiate.HTML:
+		// the message has names from the client in it
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		output.WriteString("<!DOCTYPE html>\n<html><head><title>Hello</title></head><body><p>")
+		output.WriteString(html.EscapeString(message))
+		output.WriteString("</p></body></html>\n")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		output.WriteString(message)
+		output.WriteString("\n")
+	}
 
 	_, err := w.Write(output.Bytes())
 	if err != nil {
-		slog.Error("error writing response body", "err", err)
+		logging.FromContext(r.Context()).Error("error writing response body", "err", err)
 		return
 	}
 }
 
 func convertUserToUserData(u *users.User) *UserData {
 	converted := UserData{
+		ID:        u.ID,
 		FirstName: u.FirstName,
 		LastName:  u.LastName,
 		Email:     u.Email.Address,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		Role:      string(u.Role),
 	}
 
 	return &converted
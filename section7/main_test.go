@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/config"
+	"mycoolserver/internal/problem"
 	"mycoolserver/internal/users"
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestHandleRoot(t *testing.T) {
@@ -137,7 +143,7 @@ func TestHelloHeader(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	testManager := users.NewManager()
-	err := testManager.AddUser("Test", "Man", "testman@example.com")
+	err := testManager.AddUser(context.Background(), "Test", "Man", "testman@example.com")
 	if err != nil {
 		t.Fatalf("error creating test user: %v", err)
 	}
@@ -176,9 +182,15 @@ func TestHelloHeaderNoHeader(t *testing.T) {
 			desiredCode, w.Code, w.Body.String())
 	}
 
-	expectedMessage := []byte("invalid first name provided\n")
-	if !bytes.Equal(expectedMessage, w.Body.Bytes()) {
-		t.Errorf("bad return, got: %q, expected %q", w.Body.String(), expectedMessage)
+	decoded := checkProblem(t, w, problem.TypeValidation, "invalid name headers provided")
+
+	// both missing headers are reported at once
+	expectedErrs := []problem.FieldError{
+		{Field: "userFirst", Detail: "userFirst is required"},
+		{Field: "userLast", Detail: "userLast is required"},
+	}
+	if !reflect.DeepEqual(expectedErrs, decoded.Errors) {
+		t.Errorf("bad field errors\nwanted: %+v\ngot: %+v", expectedErrs, decoded.Errors)
 	}
 }
 
@@ -225,10 +237,7 @@ func TestHandleJSONEmptyBody(t *testing.T) {
 			desiredCode, w.Code, w.Body.String())
 	}
 
-	expectedMessage := []byte("bad request body\n")
-	if !bytes.Equal(expectedMessage, w.Body.Bytes()) {
-		t.Errorf("bad return, got: %q, expected %q", w.Body.String(), expectedMessage)
-	}
+	checkProblem(t, w, problem.TypeBadRequestBody, "bad request body")
 }
 
 func TestHandleJSONEmptyNameField(t *testing.T) {
@@ -254,10 +263,7 @@ func TestHandleJSONEmptyNameField(t *testing.T) {
 			desiredCode, w.Code, w.Body.String())
 	}
 
-	expectedMessage := []byte("invalid username provided\n")
-	if !bytes.Equal(expectedMessage, w.Body.Bytes()) {
-		t.Errorf("bad return, got: %q, expected %q", w.Body.String(), expectedMessage)
-	}
+	checkProblem(t, w, problem.TypeValidation, "invalid username provided")
 }
 
 func TestAddUser(t *testing.T) {
@@ -291,12 +297,16 @@ func TestAddUser(t *testing.T) {
 			desiredCode, w.Code, w.Body.String())
 	}
 
-	resultUser, err := testManager.GetUserByName(testUser.FirstName, testUser.LastName)
+	resultUser, err := testManager.GetUserByName(context.Background(), testUser.FirstName, testUser.LastName)
 	if err != nil {
 		t.Fatalf("error getting test user back out of manager: %v", err)
 	}
 
-	// convert to UserData so we can compare
+	// convert to UserData so we can compare, the id and timestamps are
+	// generated by the manager
+	testUser.ID = resultUser.ID
+	testUser.CreatedAt = resultUser.CreatedAt
+	testUser.UpdatedAt = resultUser.UpdatedAt
 	convertedResult := convertUserToUserData(resultUser)
 	if !reflect.DeepEqual(&testUser, convertedResult) {
 		t.Errorf("bad retrieved user\nwanted: %v\ngot: %v\n", &testUser, convertedResult)
@@ -334,7 +344,7 @@ func TestGetUser(t *testing.T) {
 		userManager: testManager,
 	}
 
-	err := testManager.AddUser(testFirstName, testLastName, testEmail)
+	err := testManager.AddUser(context.Background(), testFirstName, testLastName, testEmail)
 	if err != nil {
 		t.Fatalf("error inserting test user: %v", err)
 	}
@@ -357,6 +367,11 @@ func TestGetUser(t *testing.T) {
 
 	testServer.getUser(w, req)
 
+	storedUser, err := testManager.GetUserByName(context.Background(), testFirstName, testLastName)
+	if err != nil {
+		t.Fatalf("error getting test user back out of manager: %v", err)
+	}
+
 	desiredCode := http.StatusOK
 	if w.Code != desiredCode {
 		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
@@ -372,9 +387,12 @@ func TestGetUser(t *testing.T) {
 	}
 
 	expectedData := UserData{
+		ID:        storedUser.ID,
 		FirstName: testFirstName,
 		LastName:  testLastName,
 		Email:     testEmail,
+		CreatedAt: storedUser.CreatedAt,
+		UpdatedAt: storedUser.UpdatedAt,
 	}
 
 	if !reflect.DeepEqual(decodedResult, expectedData) {
@@ -402,10 +420,7 @@ func TestGetUserBadHeader(t *testing.T) {
 			desiredCode, w.Code, w.Body.String())
 	}
 
-	expectedBody := []byte("unsupported Content-Type header: \"\"\n")
-	if !bytes.Equal(expectedBody, w.Body.Bytes()) {
-		t.Errorf("bad response body, should be: %q but got: %q", expectedBody, w.Body.String())
-	}
+	checkProblem(t, w, problem.TypeUnsupported, "unsupported Content-Type header: \"\"")
 }
 
 func TestGetUserNoUser(t *testing.T) {
@@ -418,7 +433,7 @@ func TestGetUserNoUser(t *testing.T) {
 		userManager: testManager,
 	}
 
-	err := testManager.AddUser(testFirstName, testLastName, testEmail)
+	err := testManager.AddUser(context.Background(), testFirstName, testLastName, testEmail)
 	if err != nil {
 		t.Fatalf("error inserting test user: %v", err)
 	}
@@ -447,10 +462,7 @@ func TestGetUserNoUser(t *testing.T) {
 			desiredCode, w.Code, w.Body.String())
 	}
 
-	expectedBody := "no users found\n"
-	if w.Body.String() != expectedBody {
-		t.Errorf("bad response body, should be %q but got %q", expectedBody, w.Body.String())
-	}
+	checkProblem(t, w, problem.TypeNotFound, "no users found")
 
 }
 
@@ -463,6 +475,7 @@ func TestConvertUserToUserData(t *testing.T) {
 	}
 
 	testUser := users.User{
+		ID:        "1234",
 		FirstName: testFirstName,
 		LastName:  testLastName,
 		Email:     *testEmail,
@@ -471,6 +484,7 @@ func TestConvertUserToUserData(t *testing.T) {
 	result := convertUserToUserData(&testUser)
 
 	ExpectedUser := &UserData{
+		ID:        "1234",
 		FirstName: testFirstName,
 		LastName:  testLastName,
 		Email:     testEmail.Address,
@@ -480,3 +494,93 @@ func TestConvertUserToUserData(t *testing.T) {
 		t.Errorf("bad conversion\nwant: %+v\ngot: %+v\n", ExpectedUser, result)
 	}
 }
+
+func TestNewUserStore(t *testing.T) {
+	memoryStore, err := newUserStore(config.StoreConfig{Type: "memory"})
+	if err != nil {
+		t.Fatalf("error creating memory store: %v", err)
+	}
+	if _, ok := memoryStore.(*users.MemoryStore); !ok {
+		t.Errorf("bad store type, wanted: %T, got: %T", &users.MemoryStore{}, memoryStore)
+	}
+
+	fileStore, err := newUserStore(config.StoreConfig{Type: "file", Path: filepath.Join(t.TempDir(), "users.json")})
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+	if _, ok := fileStore.(*users.FileStore); !ok {
+		t.Errorf("bad store type, wanted: %T, got: %T", &users.FileStore{}, fileStore)
+	}
+
+	_, err = newUserStore(config.StoreConfig{Type: "carrier-pigeon"})
+	if err == nil {
+		t.Error("no error returned for unknown store type")
+	}
+}
+
+func TestAdminKeyBootstrap(t *testing.T) {
+	manager := users.NewManager()
+	authenticator, err := newAuthenticator(config.AuthConfig{AdminKeySHA256: auth.HashAPIKey("bootstrap-key"), SessionTTL: time.Hour}, manager, nil)
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	testServer := &server{userManager: manager, auth: authenticator}
+	handler := testServer.handler()
+
+	// a fresh install has no users, the admin key is the only way in
+	r := newJSONRequest(t, http.MethodPost, "/users", UserData{
+		FirstName: "First",
+		LastName:  "Admin",
+		Email:     "admin@example.com",
+		Password:  "correct horse battery staple",
+	})
+	r.Header.Set(auth.APIKeyHeader, "bootstrap-key")
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad response code creating the first user, expected: %v but got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	r = newJSONRequest(t, http.MethodPut, w.Header().Get("Location")+"/role", RoleChange{Role: string(users.RoleAdmin)})
+	r.Header.Set(auth.APIKeyHeader, "bootstrap-key")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code making the first user an admin, expected: %v but got: %v\nbody: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+// checkProblem decodes a problem+json response and checks its type, status
+// and detail
+func checkProblem(t *testing.T, w *httptest.ResponseRecorder, problemType string, detail string) *problem.Problem {
+	t.Helper()
+
+	contentType := w.Header().Get("Content-Type")
+	if contentType != problem.ContentType {
+		t.Errorf("bad Content-Type, expected: %q but got: %q", problem.ContentType, contentType)
+	}
+
+	var decoded problem.Problem
+	err := json.Unmarshal(w.Body.Bytes(), &decoded)
+	if err != nil {
+		t.Fatalf("error decoding problem: %v\nbody: %s", err, w.Body.String())
+	}
+
+	if decoded.Type != problemType {
+		t.Errorf("bad problem type, expected: %q but got: %q", problemType, decoded.Type)
+	}
+
+	if decoded.Status != w.Code {
+		t.Errorf("problem status %d doesn't match response code %d", decoded.Status, w.Code)
+	}
+
+	if decoded.Detail != detail {
+		t.Errorf("bad problem detail, expected: %q but got: %q", detail, decoded.Detail)
+	}
+
+	return &decoded
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/negotiate"
+	"mycoolserver/internal/openapi"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// apiVersion is the version of the API the OpenAPI document describes
+const apiVersion = "1.0.0"
+
+// routeDoc is what the OpenAPI document says about a route beyond what the
+// route table already knows.  Patterns without a method are documented as
+// GET.
+type routeDoc struct {
+	operationID string
+	summary     string
+	description string
+	tag         string
+	// path parameters come from the pattern, these are the rest
+	parameters []openapi.Parameter
+	// request is the type the body is decoded into, nil for routes that
+	// don't read one
+	request any
+	// consumes are the media types request can be sent as, decodeBody's if
+	// empty
+	consumes []string
+	// requestRequired replaces the fields request's validate tags require,
+	// for handlers that only check some of them.  nil keeps the tags.
+	requestRequired []string
+	// response is the type sent back, nil for routes with no body.  Routes
+	// that don't negotiate send it as the media types in contentTypes, or
+	// JSON.
+	response     any
+	contentTypes []string
+	// status is the success status, 200 if zero
+	status int
+	// etag is set for routes whose success response has an ETag header
+	etag bool
+	// precondition is the conditional header the route checks, If-None-Match
+	// answers with a 304 for GET and a 412 otherwise, If-Match with a 412
+	precondition string
+	deprecated   bool
+}
+
+// requestFormats are the media types decodeBody reads
+var requestFormats = []string{negotiate.JSON, negotiate.XML, negotiate.CBOR, negotiate.Form}
+
+var nameHeaderSchema, _ = openapi.Rules(nameHeaderRules)
+
+// routeDocs has an entry for every pattern in the route table,
+// TestOpenAPICoversRoutes fails for routes that are missing
+var routeDocs = map[string]routeDoc{
+	"GET /metrics": {
+		operationID:  "getMetrics",
+		summary:      "Prometheus metrics",
+		tag:          "operations",
+		response:     "",
+		contentTypes: []string{"text/plain"},
+	},
+	"GET /healthz": {
+		operationID:  "getHealthz",
+		summary:      "Liveness check",
+		tag:          "operations",
+		response:     "",
+		contentTypes: []string{"text/plain"},
+	},
+	"GET /readyz": {
+		operationID:  "getReadyz",
+		summary:      "Readiness check",
+		description:  "Fails with a 503 while the server is draining for shutdown or the user store is unavailable.",
+		tag:          "operations",
+		response:     "",
+		contentTypes: []string{"text/plain"},
+	},
+	"GET /openapi.json": {
+		operationID:  "getOpenAPI",
+		summary:      "This document",
+		tag:          "operations",
+		response:     map[string]any{},
+		contentTypes: []string{negotiate.JSON},
+	},
+	"GET /docs": {
+		operationID:  "getDocs",
+		summary:      "Interactive docs for this document",
+		tag:          "operations",
+		response:     "",
+		contentTypes: []string{negotiate.HTML},
+	},
+
+	"/{$}": {
+		operationID:  "getRoot",
+		summary:      "Homepage",
+		tag:          "hello",
+		response:     "",
+		contentTypes: []string{"text/plain"},
+	},
+	"/goodbye/": {
+		operationID:  "getGoodbye",
+		summary:      "Say goodbye",
+		description:  "Answers any method on any path under /goodbye/.",
+		tag:          "hello",
+		response:     "",
+		contentTypes: []string{"text/plain"},
+	},
+	"/hello/": {
+		operationID: "getHello",
+		summary:     "Say hello",
+		description: "Answers any method on any path under /hello/.",
+		tag:         "hello",
+		parameters: []openapi.Parameter{
+			{Name: "user", In: openapi.InQuery, Description: "who to greet, User if left out", Schema: &openapi.Schema{Type: "string"}},
+		},
+		response: HelloResponse{},
+	},
+	"/responses/{user}/hello/": {
+		operationID: "getUserHello",
+		summary:     "Say hello to the user in the path",
+		tag:         "hello",
+		response:    HelloResponse{},
+	},
+	"POST /user/hello": {
+		operationID: "postUserHello",
+		summary:     "Say hello to a user looked up by name",
+		tag:         "hello",
+		parameters: []openapi.Parameter{
+			{Name: "userFirst", In: openapi.InHeader, Description: "first name of the user", Required: true, Schema: nameHeaderSchema},
+			{Name: "userLast", In: openapi.InHeader, Description: "last name of the user", Required: true, Schema: nameHeaderSchema},
+		},
+		response: HelloResponse{},
+	},
+	"POST /json": {
+		operationID:     "postJSONHello",
+		summary:         "Say hello to the FirstName in the body",
+		description:     "Only reads JSON, whatever the Content-Type header says.",
+		tag:             "hello",
+		request:         UserData{},
+		consumes:        []string{negotiate.JSON},
+		requestRequired: []string{"FirstName"},
+		response:        HelloResponse{},
+	},
+
+	"GET /users": {
+		operationID: "listUsers",
+		summary:     "List users a page at a time",
+		tag:         "users",
+		parameters: []openapi.Parameter{
+			{Name: "limit", In: openapi.InQuery, Description: "most users to return", Schema: &openapi.Schema{Type: "integer", Minimum: floatPointer(1)}},
+			{Name: "cursor", In: openapi.InQuery, Description: "NextCursor from the previous page", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "sort", In: openapi.InQuery, Schema: &openapi.Schema{Type: "string", Enum: []string{
+				string(users.SortByCreated), string(users.SortByLastName), string(users.SortByFirstName),
+			}}},
+			{Name: "order", In: openapi.InQuery, Schema: &openapi.Schema{Type: "string", Enum: []string{"asc", "desc"}}},
+			{Name: "email", In: openapi.InQuery, Description: "only the user with this email", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "emailDomain", In: openapi.InQuery, Description: "only users with emails at this domain", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "namePrefix", In: openapi.InQuery, Description: "only users whose first or last name starts with this", Schema: &openapi.Schema{Type: "string"}},
+		},
+		response: UserList{},
+	},
+	"POST /users": {
+		operationID: "createUser",
+		summary:     "Create a user",
+		tag:         "users",
+		request:     UserData{},
+		response:    UserData{},
+		status:      http.StatusCreated,
+		etag:        true,
+	},
+	"GET /users/{id}": {
+		operationID:  "getUserByID",
+		summary:      "Get a user",
+		tag:          "users",
+		response:     UserData{},
+		etag:         true,
+		precondition: "If-None-Match",
+	},
+	"PUT /users/{id}": {
+		operationID:  "replaceUser",
+		summary:      "Replace a user's details",
+		tag:          "users",
+		request:      UserData{},
+		response:     UserData{},
+		etag:         true,
+		precondition: "If-Match",
+	},
+	"PATCH /users/{id}": {
+		operationID:     "patchUser",
+		summary:         "Change some of a user's details",
+		description:     "Fields that are left out or empty keep their current value. Without If-Match the fields are merged again if the user changes during the update, a 409 means it kept changing.",
+		tag:             "users",
+		request:         UserData{},
+		requestRequired: []string{},
+		response:        UserData{},
+		etag:            true,
+		precondition:    "If-Match",
+	},
+	"DELETE /users/{id}": {
+		operationID:  "deleteUser",
+		summary:      "Delete a user",
+		tag:          "users",
+		status:       http.StatusNoContent,
+		precondition: "If-Match",
+	},
+	"PUT /users/{id}/password": {
+		operationID: "changePassword",
+		summary:     "Change a user's password",
+		description: "CurrentPassword can only be left out by principals allowed to reset passwords. Every session the user has is ended.",
+		tag:         "users",
+		request:     PasswordChange{},
+		status:      http.StatusNoContent,
+	},
+	"PUT /users/{id}/role": {
+		operationID: "setRole",
+		summary:     "Set a user's role",
+		tag:         "users",
+		request:     RoleChange{},
+		response:    UserData{},
+	},
+
+	"POST /login": {
+		operationID: "login",
+		summary:     "Log in, the session is sent back in a cookie",
+		tag:         "sessions",
+		request:     LoginRequest{},
+		response:    LoginResponse{},
+	},
+	"POST /logout": {
+		operationID: "logout",
+		summary:     "Log out and clear the session cookie",
+		tag:         "sessions",
+		status:      http.StatusNoContent,
+	},
+
+	"POST /add-user": {
+		operationID: "addUser",
+		summary:     "Create a user, use POST /users instead",
+		tag:         "users",
+		request:     UserData{},
+		status:      http.StatusCreated,
+		deprecated:  true,
+	},
+	"POST /get-user": {
+		operationID:     "getUserByName",
+		summary:         "Find a user by name, use GET /users instead",
+		tag:             "users",
+		request:         UserData{},
+		requestRequired: []string{"FirstName", "LastName"},
+		response:        UserData{},
+		etag:            true,
+		precondition:    "If-None-Match",
+		deprecated:      true,
+	},
+}
+
+var etagHeader = openapi.Header{
+	Description: "strong entity tag of the representation, for If-None-Match and If-Match",
+	Schema:      &openapi.Schema{Type: "string"},
+}
+
+// securitySchemeNames keeps the security requirements in the same order
+// every time
+var securitySchemeNames = []string{"apiKey", "bearer", "session"}
+
+// security schemes the authenticator accepts, any one of them will do
+var securitySchemes = map[string]openapi.SecurityScheme{
+	"apiKey": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+	"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+	"session": {
+		Type:        "apiKey",
+		In:          "cookie",
+		Name:        auth.SessionCookie,
+		Description: "set by POST /login, requests other than GET and HEAD can only use it from the server's own origin or a CORS origin allowed credentials",
+	},
+}
+
+// openAPIDocument describes every route in the route table
+func (s *server) openAPIDocument() (*openapi.Document, error) {
+	g := openapi.NewGenerator()
+	problemSchema := g.Schema(problem.Problem{})
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "mycoolserver",
+			Version:     apiVersion,
+			Description: "Users, sessions and greetings.  Every error is an RFC 9457 problem.",
+		},
+		Paths: make(map[string]openapi.PathItem),
+		Components: openapi.Components{
+			SecuritySchemes: securitySchemes,
+		},
+	}
+
+	for _, rt := range s.routeTable() {
+		rd, ok := routeDocs[rt.pattern]
+		if !ok {
+			return nil, fmt.Errorf("route %q has no entry in routeDocs", rt.pattern)
+		}
+
+		method, path := openAPIMethodPath(rt.pattern)
+
+		op := &openapi.Operation{
+			OperationID: rd.operationID,
+			Summary:     rd.summary,
+			Description: rd.description,
+			Deprecated:  rd.deprecated,
+			Responses:   make(map[string]openapi.Response),
+			Security:    []openapi.SecurityRequirement{},
+		}
+		if rd.tag != "" {
+			op.Tags = []string{rd.tag}
+		}
+
+		for _, name := range openapi.PathParams(path) {
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name:     name,
+				In:       openapi.InPath,
+				Required: true,
+				Schema:   &openapi.Schema{Type: "string"},
+			})
+		}
+		op.Parameters = append(op.Parameters, rd.parameters...)
+
+		if rd.request != nil {
+			schema := g.Schema(rd.request)
+			if rd.requestRequired != nil {
+				schema = g.Partial(rd.request, rd.requestRequired...)
+			}
+
+			formats := rd.consumes
+			if len(formats) == 0 {
+				formats = requestFormats
+			}
+
+			op.RequestBody = &openapi.RequestBody{Required: true, Content: make(map[string]openapi.MediaType)}
+			for _, mediaType := range formats {
+				op.RequestBody.Content[mediaType] = openapi.MediaType{Schema: schema}
+			}
+		}
+
+		status := rd.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := openapi.Response{Description: http.StatusText(status)}
+		if rd.response != nil {
+			success.Content = responseContent(g, rt, rd)
+		}
+		if rd.etag {
+			success.Headers = map[string]openapi.Header{"ETag": etagHeader}
+		}
+		op.Responses[strconv.Itoa(status)] = success
+
+		problemContent := map[string]openapi.MediaType{problem.ContentType: {Schema: problemSchema}}
+		op.Responses["default"] = openapi.Response{Description: "Error", Content: problemContent}
+
+		switch rd.precondition {
+		case "If-None-Match":
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name:        rd.precondition,
+				In:          openapi.InHeader,
+				Description: "ETags of copies the client already has",
+				Schema:      &openapi.Schema{Type: "string"},
+			})
+			// RFC 9110 only allows a 304 for GET and HEAD
+			if method == http.MethodGet || method == http.MethodHead {
+				op.Responses["304"] = openapi.Response{
+					Description: "The client's copy is current",
+					Headers:     map[string]openapi.Header{"ETag": etagHeader},
+				}
+			} else {
+				op.Responses["412"] = openapi.Response{Description: "The client's copy is current", Content: problemContent}
+			}
+		case "If-Match":
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name:        rd.precondition,
+				In:          openapi.InHeader,
+				Description: "ETags the resource has to still have for the request to go ahead",
+				Schema:      &openapi.Schema{Type: "string"},
+			})
+			op.Responses["412"] = openapi.Response{Description: "The resource has changed", Content: problemContent}
+		}
+
+		if !rt.public {
+			for _, name := range securitySchemeNames {
+				op.Security = append(op.Security, openapi.SecurityRequirement{name: []string{}})
+			}
+			op.Responses["401"] = openapi.Response{Description: "No valid credentials", Content: problemContent}
+			op.Responses["403"] = openapi.Response{Description: "The policy doesn't allow this", Content: problemContent}
+		}
+		if s.rateLimitFor(rt.pattern).Enabled() {
+			op.Responses["429"] = openapi.Response{
+				Description: "Rate limit exceeded",
+				Headers: map[string]openapi.Header{
+					"Retry-After": {Description: "seconds until a request will be allowed", Schema: &openapi.Schema{Type: "integer"}},
+				},
+				Content: problemContent,
+			}
+		}
+		if len(rt.produces) > 0 {
+			op.Responses["406"] = openapi.Response{Description: "None of the media types in Accept are available", Content: problemContent}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(openapi.PathItem)
+		}
+		doc.Paths[path][strings.ToLower(method)] = op
+	}
+
+	doc.Components.Schemas = g.Schemas()
+	return doc, nil
+}
+
+// responseContent has a media type for each format the route responds
+// with, text formats are strings whatever type the JSON is
+func responseContent(g *openapi.Generator, rt route, rd routeDoc) map[string]openapi.MediaType {
+	formats := rt.produces
+	if len(formats) == 0 {
+		formats = rd.contentTypes
+	}
+	if len(formats) == 0 {
+		formats = []string{negotiate.JSON}
+	}
+
+	content := make(map[string]openapi.MediaType, len(formats))
+	for _, mediaType := range formats {
+		if strings.HasPrefix(mediaType, "text/") {
+			content[mediaType] = openapi.MediaType{Schema: &openapi.Schema{Type: "string"}}
+			continue
+		}
+		content[mediaType] = openapi.MediaType{Schema: g.Schema(rd.response)}
+	}
+	return content
+}
+
+// openAPI builds the document the first time it's called
+func (s *server) openAPI() (*openapi.Document, []byte, error) {
+	s.openAPIOnce.Do(func() {
+		s.openAPIDoc, s.openAPIErr = s.openAPIDocument()
+		if s.openAPIErr != nil {
+			return
+		}
+		s.openAPISpec, s.openAPIErr = json.Marshal(s.openAPIDoc)
+	})
+	return s.openAPIDoc, s.openAPISpec, s.openAPIErr
+}
+
+// openAPIMethodPath is where the route registered as pattern is in the
+// document
+func openAPIMethodPath(pattern string) (method string, path string) {
+	method, path = openapi.SplitPattern(pattern)
+	if method == "" {
+		method = http.MethodGet
+	}
+	return method, path
+}
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	_, spec, err := s.openAPI()
+	if err != nil {
+		writeInternalError(w, r, "error building OpenAPI document", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(spec)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error writing OpenAPI document", "err", err)
+	}
+}
+
+// schemaBody decodes bodies for request validation.  JSON is checked as it
+// was sent, other formats are decoded into request, the type the handler
+// reads, and marshalled to JSON so they can be checked the same way.
+func schemaBody(request any) openapi.BodyDecoder {
+	return func(mediaType string, body []byte) (any, bool) {
+		if mediaType == negotiate.JSON {
+			return openapi.DecodeJSON(body)
+		}
+
+		codec, ok := negotiate.Lookup(mediaType)
+		if !ok || request == nil {
+			return nil, false
+		}
+
+		decoded := reflect.New(reflect.TypeOf(request)).Interface()
+		err := codec.Decode(bytes.NewReader(body), decoded)
+		if err != nil {
+			return nil, false
+		}
+
+		marshalled, err := json.Marshal(decoded)
+		if err != nil {
+			return nil, false
+		}
+		return openapi.DecodeJSON(marshalled)
+	}
+}
+
+func floatPointer(f float64) *float64 {
+	return &f
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mycoolserver/internal/openapi"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkResponses fails t for responses that don't match the OpenAPI
+// document, test servers use it so the document can't drift from what the
+// handlers send
+func checkResponses(t *testing.T) func(r *http.Request, errs []openapi.ValidationError) {
+	return func(r *http.Request, errs []openapi.ValidationError) {
+		t.Helper()
+		t.Errorf("response to %s %s doesn't match the OpenAPI document: %v", r.Method, r.URL, errs)
+	}
+}
+
+// TestOpenAPICoversRoutes fails when a route is registered without being
+// documented, or documentation is left behind for a route that's gone
+func TestOpenAPICoversRoutes(t *testing.T) {
+	testServer, _ := newTestServer(t)
+
+	registered := make(map[string]bool)
+	for _, rt := range testServer.routeTable() {
+		registered[rt.pattern] = true
+
+		if _, ok := routeDocs[rt.pattern]; !ok {
+			t.Errorf("route %q has no entry in routeDocs", rt.pattern)
+		}
+	}
+
+	for pattern := range routeDocs {
+		if !registered[pattern] {
+			t.Errorf("routeDocs has an entry for %q, which isn't a route", pattern)
+		}
+	}
+
+	doc, err := testServer.openAPIDocument()
+	if err != nil {
+		t.Fatalf("error building document: %v", err)
+	}
+
+	operationIDs := make(map[string]string)
+	for _, rt := range testServer.routeTable() {
+		op := doc.Operation(openAPIMethodPath(rt.pattern))
+		if op == nil {
+			t.Errorf("route %q has no operation in the document", rt.pattern)
+			continue
+		}
+
+		if op.OperationID == "" {
+			t.Errorf("route %q has no operationId", rt.pattern)
+		}
+		if other, ok := operationIDs[op.OperationID]; ok {
+			t.Errorf("routes %q and %q share the operationId %q", rt.pattern, other, op.OperationID)
+		}
+		operationIDs[op.OperationID] = rt.pattern
+
+		if public := len(op.Security) == 0; public != rt.public {
+			t.Errorf("route %q: bad security, wanted public: %v, got: %v", rt.pattern, rt.public, public)
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad status, wanted: %d, got: %d\nbody: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("bad Content-Type, wanted: application/json, got: %q", contentType)
+	}
+
+	var doc openapi.Document
+	err := json.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("error unmarshalling document: %v", err)
+	}
+
+	if doc.OpenAPI != openapi.Version {
+		t.Errorf("bad openapi version, wanted: %q, got: %q", openapi.Version, doc.OpenAPI)
+	}
+
+	getUser := doc.Operation(http.MethodGet, "/users/{id}")
+	if getUser == nil {
+		t.Fatal("no operation for GET /users/{id}")
+	}
+	if len(getUser.Parameters) != 2 || getUser.Parameters[0].Name != "id" || getUser.Parameters[0].In != openapi.InPath ||
+		getUser.Parameters[1].Name != "If-None-Match" || getUser.Parameters[1].In != openapi.InHeader {
+		t.Errorf("bad parameters, wanted the id path parameter and If-None-Match, got: %+v", getUser.Parameters)
+	}
+	if _, ok := getUser.Responses["304"].Headers["ETag"]; !ok {
+		t.Errorf("bad responses, wanted a 304 with an ETag, got: %+v", getUser.Responses)
+	}
+	for _, mediaType := range userFormats {
+		schema := getUser.Responses["200"].Content[mediaType].Schema
+		if schema == nil || schema.Ref != openapi.RefPrefix+"UserData" {
+			t.Errorf("bad %s response schema, wanted a UserData ref, got: %+v", mediaType, schema)
+		}
+	}
+
+	userData := doc.Components.Schemas["UserData"]
+	if userData == nil {
+		t.Fatal("no UserData schema in the components")
+	}
+	if !userData.Properties["ID"].ReadOnly || !userData.Properties["Password"].WriteOnly {
+		t.Errorf("bad UserData properties, wanted ID read only and Password write only, got: %+v", userData.Properties)
+	}
+
+	patch := doc.Operation(http.MethodPatch, "/users/{id}")
+	if schema := patch.RequestBody.Content["application/json"].Schema; len(schema.Required) != 0 {
+		t.Errorf("bad PATCH body, wanted nothing required, got: %v", schema.Required)
+	}
+
+	hello := doc.Operation(http.MethodPost, "/user/hello")
+	var headers []string
+	for _, param := range hello.Parameters {
+		if param.In == openapi.InHeader && param.Required {
+			headers = append(headers, param.Name)
+		}
+	}
+	if strings.Join(headers, ",") != "userFirst,userLast" {
+		t.Errorf("bad header parameters, wanted: userFirst,userLast, got: %v", headers)
+	}
+}
+
+func TestDocsPage(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad status, wanted: %d, got: %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `data-spec="/openapi.json"`) {
+		t.Errorf("docs page doesn't point at /openapi.json")
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	testServer := &server{
+		userManager:      users.NewManager(),
+		validateRequests: true,
+		checkResponse:    checkResponses(t),
+	}
+	handler := testServer.handler()
+
+	tests := map[string]struct {
+		method      string
+		target      string
+		contentType string
+		body        string
+		headers     map[string]string
+		status      int
+		errors      []problem.FieldError
+	}{
+		"valid": {
+			method: http.MethodPost, target: "/users", contentType: "application/json",
+			body:   `{"FirstName": "Ada", "LastName": "Lovelace", "Email": "ada@example.com", "Password": "correct horse battery"}`,
+			status: http.StatusCreated,
+		},
+		"missing and unknown fields": {
+			method: http.MethodPost, target: "/users", contentType: "application/json",
+			body:   `{"FirstName": "Ada", "Nickname": "Countess"}`,
+			status: http.StatusBadRequest,
+			errors: []problem.FieldError{
+				{Field: "$.LastName", In: "body", Detail: "is required"},
+				{Field: "$.Email", In: "body", Detail: "is required"},
+				{Field: "$.Nickname", In: "body", Detail: "isn't allowed"},
+			},
+		},
+		// decodeBody would accept these names, so the validator has to as well
+		"lower case names": {
+			method: http.MethodPost, target: "/users", contentType: "application/json",
+			body:   `{"firstName": "Ada", "lastname": "Lovelace", "email": "ada@example.org"}`,
+			status: http.StatusCreated,
+		},
+		"lower case name checked": {
+			method: http.MethodPost, target: "/users", contentType: "application/json",
+			body:   `{"firstName": "Ada", "lastname": "Lovelace", "email": "not an email"}`,
+			status: http.StatusBadRequest,
+			errors: []problem.FieldError{{Field: "$.email", In: "body", Detail: "must be an email address"}},
+		},
+		"XML": {
+			method: http.MethodPost, target: "/users", contentType: "application/xml",
+			body:   `<UserData><FirstName>Ada</FirstName><LastName>Lovelace</LastName><Email>not an email</Email></UserData>`,
+			status: http.StatusBadRequest,
+			errors: []problem.FieldError{{Field: "$.Email", In: "body", Detail: "must be an email address"}},
+		},
+		"patch needs nothing": {
+			method: http.MethodPatch, target: "/users/nobody", contentType: "application/json",
+			body:   `{}`,
+			status: http.StatusNotFound,
+		},
+		"query": {
+			method: http.MethodGet, target: "/users?limit=0&sort=age",
+			status: http.StatusBadRequest,
+			errors: []problem.FieldError{
+				{Field: "limit", In: "query", Detail: "must be at least 1"},
+				{Field: "sort", In: "query", Detail: "must be one of created, lastName, firstName"},
+			},
+		},
+		"headers": {
+			method: http.MethodPost, target: "/user/hello",
+			headers: map[string]string{"userLast": strings.Repeat("a", 101)},
+			status:  http.StatusBadRequest,
+			errors: []problem.FieldError{
+				{Field: "userFirst", In: "header", Detail: "is required"},
+				{Field: "userLast", In: "header", Detail: "must be at most 100 characters"},
+			},
+		},
+		"no body": {
+			method: http.MethodPost, target: "/login", contentType: "application/json",
+			status: http.StatusBadRequest,
+			errors: []problem.FieldError{{Field: "$", In: "body", Detail: "a request body is required"}},
+		},
+		// the handler says what's wrong with media types the route doesn't read
+		"unsupported media type": {
+			method: http.MethodPost, target: "/users", contentType: "text/csv",
+			body:   "Ada,Lovelace",
+			status: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for name, test := range tests {
+		var body io.Reader
+		if test.body != "" {
+			body = strings.NewReader(test.body)
+		}
+		req := httptest.NewRequest(test.method, test.target, body)
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		for header, value := range test.headers {
+			req.Header.Set(header, value)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad status, wanted: %d, got: %d\nbody: %s", name, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if test.errors == nil {
+			continue
+		}
+
+		p := checkProblem(t, w, problem.TypeValidation, "request doesn't match the API description")
+		if !reflect.DeepEqual(p.Errors, test.errors) {
+			t.Errorf("%s: bad errors, wanted: %+v, got: %+v", name, test.errors, p.Errors)
+		}
+	}
+}
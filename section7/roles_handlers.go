@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/middleware"
+	"mycoolserver/internal/policy"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+)
+
+// RoleChange is the body of PUT /users/{id}/role, an empty Role takes the
+// user's role away
+type RoleChange struct {
+	Role string
+}
+
+// authorize asks the policy whether the principal auth.Require found may
+// perform action.  The user in the id path value, if there is one, is the
+// owner of what's being acted on.
+func authorize(action policy.Action) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := auth.FromContext(r.Context())
+			ownerID := r.PathValue("id")
+
+			decision := policy.Authorize(principal, action, ownerID)
+			if !decision.Allowed {
+				logging.FromContext(r.Context()).Info("authorization denied",
+					"action", action, "reason", decision.Reason, "user_id", ownerID)
+
+				p := problem.New(problem.TypeForbidden, http.StatusForbidden, decision.Detail)
+				p.Reason = decision.Reason
+				problem.Write(w, r, p)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *server) setRole(w http.ResponseWriter, r *http.Request) {
+	var change RoleChange
+	if !s.decodeBody(w, r, &change) {
+		return
+	}
+
+	user, err := s.userManager.SetRole(r.Context(), r.PathValue("id"), users.Role(change.Role))
+	if err != nil {
+		writeUserError(w, r, fmt.Sprintf("error setting role to %q", change.Role), err, nil)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, convertUserToUserData(user))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/policy"
+	"mycoolserver/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRolesAndOwnership(t *testing.T) {
+	handler, user := newSessionTestServer(t)
+
+	r := newJSONRequest(t, http.MethodPost, "/users", UserData{FirstName: "Other", LastName: "Person", Email: "other@example.com"})
+	r.Header.Set(auth.APIKeyHeader, "admin-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var other UserData
+	err := json.Unmarshal(w.Body.Bytes(), &other)
+	if err != nil {
+		t.Fatalf("error decoding created user: %v", err)
+	}
+
+	cookie := login(t, handler, user.Email, testPassword)
+
+	type step struct {
+		name   string
+		method string
+		path   string
+		body   any
+		apiKey string
+		status int
+		reason string
+	}
+
+	// in order, the user starts without a role and is made a viewer part way
+	steps := []step{
+		{name: "own record", method: http.MethodGet, path: "/users/" + user.ID, status: http.StatusOK},
+		{name: "edit own record", method: http.MethodPatch, path: "/users/" + user.ID, body: UserData{FirstName: "Renamed"}, status: http.StatusOK},
+		{name: "someone else's record", method: http.MethodGet, path: "/users/" + other.ID, status: http.StatusForbidden, reason: policy.ReasonNotOwner},
+		{name: "list without a role", method: http.MethodGet, path: "/users", status: http.StatusForbidden, reason: policy.ReasonRoleNotAllowed},
+		{name: "delete own record", method: http.MethodDelete, path: "/users/" + user.ID, status: http.StatusForbidden, reason: policy.ReasonRoleNotAllowed},
+		{name: "promote self", method: http.MethodPut, path: "/users/" + user.ID + "/role", body: RoleChange{Role: "admin"}, status: http.StatusForbidden, reason: policy.ReasonRoleNotAllowed},
+		{name: "invalid role", method: http.MethodPut, path: "/users/" + user.ID + "/role", body: RoleChange{Role: "superuser"}, apiKey: "admin-key", status: http.StatusBadRequest},
+		{name: "admin makes a viewer", method: http.MethodPut, path: "/users/" + user.ID + "/role", body: RoleChange{Role: "viewer"}, apiKey: "admin-key", status: http.StatusOK},
+		{name: "list as a viewer", method: http.MethodGet, path: "/users", status: http.StatusOK},
+		{name: "read someone else's as a viewer", method: http.MethodGet, path: "/users/" + other.ID, status: http.StatusOK},
+		{name: "edit someone else's as a viewer", method: http.MethodPatch, path: "/users/" + other.ID, body: UserData{FirstName: "Renamed"}, status: http.StatusForbidden, reason: policy.ReasonNotOwner},
+	}
+
+	for _, step := range steps {
+		var r *http.Request
+		if step.body != nil {
+			r = newJSONRequest(t, step.method, step.path, step.body)
+		} else {
+			r = httptest.NewRequest(step.method, step.path, nil)
+		}
+		if step.apiKey != "" {
+			r.Header.Set(auth.APIKeyHeader, step.apiKey)
+		} else {
+			r.AddCookie(cookie)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != step.status {
+			t.Fatalf("%s: bad response code, expected: %v but got: %v\nbody: %s", step.name, step.status, w.Code, w.Body.String())
+		}
+
+		if step.reason != "" {
+			var decoded problem.Problem
+			err := json.Unmarshal(w.Body.Bytes(), &decoded)
+			if err != nil {
+				t.Fatalf("%s: error decoding problem: %v", step.name, err)
+			}
+			if decoded.Type != problem.TypeForbidden || decoded.Reason != step.reason {
+				t.Errorf("%s: bad problem, expected: %s with reason %q but got: %s with reason %q",
+					step.name, problem.TypeForbidden, step.reason, decoded.Type, decoded.Reason)
+			}
+		}
+
+		if step.name == "admin makes a viewer" {
+			var updated UserData
+			err := json.Unmarshal(w.Body.Bytes(), &updated)
+			if err != nil {
+				t.Fatalf("error decoding user: %v", err)
+			}
+			if updated.Role != "viewer" {
+				t.Errorf("bad role, expected: viewer but got: %q", updated.Role)
+			}
+		}
+	}
+}
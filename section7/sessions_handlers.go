@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/policy"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+	"time"
+)
+
+// LoginRequest is the body of POST /login
+type LoginRequest struct {
+	Email    string
+	Password string
+}
+
+// LoginResponse tells the client who they logged in as, the session itself
+// is in the cookie
+type LoginResponse struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// PasswordChange is the body of PUT /users/{id}/password.  CurrentPassword
+// can only be left out by principals allowed to reset passwords.
+type PasswordChange struct {
+	CurrentPassword string `json:",omitempty"`
+	NewPassword     string
+}
+
+// sessionLookup lets the authenticator accept session cookies
+func sessionLookup(manager *users.Manager) auth.SessionLookup {
+	return func(ctx context.Context, token string) (*auth.Principal, error) {
+		session, err := manager.LookupSession(ctx, token)
+		if errors.Is(err, users.ErrInvalidSession) {
+			return nil, fmt.Errorf("%w: %v", auth.ErrInvalidCredentials, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the role is looked up every time so changes to it apply straight away
+		user, err := manager.GetUserByID(ctx, session.UserID)
+		if errors.Is(err, users.ErrNoResultsFound) {
+			return nil, fmt.Errorf("%w: user no longer exists", auth.ErrInvalidCredentials)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &auth.Principal{Subject: session.UserID, Method: auth.MethodSession, Role: string(user.Role)}, nil
+	}
+}
+
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+
+	session, err := s.userManager.Login(r.Context(), req.Email, req.Password)
+	if err != nil {
+		writeUserError(w, r, "error logging in", err, nil)
+		return
+	}
+
+	// HttpOnly keeps scripts away from it and SameSite=Lax keeps other sites
+	// from using it, but not sibling subdomains, which count as the same
+	// site.  auth.Require turns away unsafe requests it comes with from any
+	// other origin, protected routes that change things are never GETs.
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.SessionCookie,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeResponse(w, r, http.StatusOK, LoginResponse{
+		UserID:    session.UserID,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+// logout is public so a client with an expired session can still clear its
+// cookie
+func (s *server) logout(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(auth.SessionCookie)
+	if err == nil && cookie.Value != "" {
+		err = s.userManager.Logout(r.Context(), cookie.Value)
+		if err != nil {
+			writeUserError(w, r, "error logging out", err, nil)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changePassword lets users change their own password by giving the current
+// one, and principals the policy lets reset passwords set anyone's without
+// it.  Either way every session the user has is ended.
+func (s *server) changePassword(w http.ResponseWriter, r *http.Request) {
+	var change PasswordChange
+	if !s.decodeBody(w, r, &change) {
+		return
+	}
+
+	id := r.PathValue("id")
+
+	// the route already checked the principal may change this password.
+	// There's no principal when authentication is disabled, which lets
+	// everyone do everything.
+	principal, ok := auth.FromContext(r.Context())
+	canReset := !ok || policy.Authorize(principal, policy.ActionResetPassword, id).Allowed
+
+	var err error
+	if canReset && change.CurrentPassword == "" {
+		err = s.userManager.SetPassword(r.Context(), id, change.NewPassword)
+	} else {
+		err = s.userManager.ChangePassword(r.Context(), id, change.CurrentPassword, change.NewPassword)
+	}
+
+	// a 401 would look like the session had expired
+	if errors.Is(err, users.ErrInvalidCredentials) {
+		writeProblem(w, r, problem.TypeValidation, http.StatusBadRequest, "error changing password: current password is wrong",
+			problem.FieldError{Field: "CurrentPassword", Detail: "CurrentPassword is wrong"})
+		return
+	}
+	if err != nil {
+		writeUserError(w, r, "error changing password", err, map[string]string{"Password": "NewPassword"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
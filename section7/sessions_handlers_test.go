@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/policy"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testPassword = "correct horse battery staple"
+
+// newSessionTestServer has authentication on, with sessions and an admin API
+// key, a users:write API key, and one user who can log in
+func newSessionTestServer(t *testing.T) (http.Handler, *UserData) {
+	t.Helper()
+
+	manager := users.NewManager()
+	authenticator, err := auth.New(
+		auth.WithSessions(sessionLookup(manager)),
+		auth.WithAPIKey("admin", auth.HashAPIKey("admin-key"), string(users.RoleAdmin)),
+		auth.WithAPIKey("writer", auth.HashAPIKey("writer-key"), "", policy.ScopeUsersRead, policy.ScopeUsersWrite),
+	)
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	testServer := &server{userManager: manager, auth: authenticator, checkResponse: checkResponses(t)}
+	handler := testServer.handler()
+
+	r := newJSONRequest(t, http.MethodPost, "/users", UserData{
+		FirstName: "Test",
+		LastName:  "Man",
+		Email:     "testman@example.com",
+		Password:  testPassword,
+	})
+	r.Header.Set(auth.APIKeyHeader, "admin-key")
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad response code creating user, expected: %v but got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var created UserData
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatalf("error decoding created user: %v", err)
+	}
+	if created.Password != "" {
+		t.Errorf("password sent back to the client: %q", created.Password)
+	}
+
+	return handler, &created
+}
+
+// login returns the session cookie
+func login(t *testing.T, handler http.Handler, email string, password string) *http.Cookie {
+	t.Helper()
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/login", LoginRequest{Email: email, Password: password}))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad response code logging in, expected: %v but got: %v\nbody: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == auth.SessionCookie {
+			return cookie
+		}
+	}
+
+	t.Fatalf("no session cookie in login response")
+	return nil
+}
+
+func TestLoginLogout(t *testing.T) {
+	handler, user := newSessionTestServer(t)
+
+	cookie := login(t, handler, user.Email, testPassword)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie should be HttpOnly and SameSite=Lax, got: %s", cookie.String())
+	}
+
+	passwordChange := func(current string) *httptest.ResponseRecorder {
+		r := newJSONRequest(t, http.MethodPut, "/users/"+user.ID+"/password", PasswordChange{
+			CurrentPassword: current,
+			NewPassword:     "a much better passphrase",
+		})
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// the session authenticates, so the wrong current password is what fails
+	w := passwordChange("not my password")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("bad response code, expected: %v but got: %v\nbody: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	checkProblem(t, w, problem.TypeValidation, "error changing password: current password is wrong")
+
+	// we call this w because it's what would normally be passed to a handler
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.AddCookie(cookie)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("bad response code logging out, expected: %v but got: %v", http.StatusNoContent, w.Code)
+	}
+	if cleared := w.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Errorf("logout didn't clear the cookie, got: %v", cleared)
+	}
+
+	w = passwordChange(testPassword)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("bad response code after logout, expected: %v but got: %v", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestSessionCrossOriginForm(t *testing.T) {
+	handler, user := newSessionTestServer(t)
+	cookie := login(t, handler, user.Email, testPassword)
+
+	// a form post needs no preflight, so any page could send it
+	formPost := func(secFetchSite string, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "http://example.com/users/"+user.ID+"/password",
+			strings.NewReader("CurrentPassword=not+my+password&NewPassword=a+much+better+passphrase"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Sec-Fetch-Site", secFetchSite)
+		r.Header.Set("Origin", origin)
+		r.AddCookie(cookie)
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := formPost("same-site", "https://evil.example.com")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("bad response code for another origin, expected: %v but got: %v\nbody: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+	checkProblem(t, w, problem.TypeForbidden, "the session cookie can't be used from another origin, send an API key or a bearer token instead")
+
+	// from the server's own pages it gets as far as checking the password
+	w = formPost("same-origin", "http://example.com")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad response code for the same origin, expected: %v but got: %v\nbody: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	handler, user := newSessionTestServer(t)
+
+	tests := map[string]LoginRequest{
+		"wrong password": {Email: user.Email, Password: "not my password"},
+		"unknown user":   {Email: "nobody@example.com", Password: testPassword},
+	}
+
+	for name, req := range tests {
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/login", req))
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: bad response code, expected: %v but got: %v", name, http.StatusUnauthorized, w.Code)
+			continue
+		}
+		checkProblem(t, w, problem.TypeUnauthorized, "error logging in: invalid email or password")
+
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("%s: failed login set a cookie", name)
+		}
+	}
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	handler, user := newSessionTestServer(t)
+
+	// another user to try changing the password of
+	r := newJSONRequest(t, http.MethodPost, "/users", UserData{FirstName: "Other", LastName: "Person", Email: "other@example.com"})
+	r.Header.Set(auth.APIKeyHeader, "admin-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var other UserData
+	err := json.Unmarshal(w.Body.Bytes(), &other)
+	if err != nil {
+		t.Fatalf("error decoding created user: %v", err)
+	}
+
+	cookie := login(t, handler, user.Email, testPassword)
+	newPassword := "a much better passphrase"
+
+	tests := []struct {
+		name   string
+		id     string
+		change PasswordChange
+		cookie *http.Cookie
+		apiKey string
+		status int
+	}{
+		{
+			name:   "someone else's",
+			id:     other.ID,
+			change: PasswordChange{CurrentPassword: testPassword, NewPassword: newPassword},
+			cookie: cookie,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "too short",
+			id:     user.ID,
+			change: PasswordChange{CurrentPassword: testPassword, NewPassword: "short"},
+			cookie: cookie,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "without the current password",
+			id:     user.ID,
+			change: PasswordChange{NewPassword: newPassword},
+			cookie: cookie,
+			status: http.StatusBadRequest,
+		},
+		{
+			// it could otherwise take over an admin by resetting their
+			// password and logging in
+			name:   "write scope reset",
+			id:     user.ID,
+			change: PasswordChange{NewPassword: newPassword},
+			apiKey: "writer-key",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "own password",
+			id:     user.ID,
+			change: PasswordChange{CurrentPassword: testPassword, NewPassword: newPassword},
+			cookie: cookie,
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "admin reset",
+			id:     other.ID,
+			change: PasswordChange{NewPassword: newPassword},
+			apiKey: "admin-key",
+			status: http.StatusNoContent,
+		},
+	}
+
+	// in order, the change of the user's own password ends the session
+	for _, test := range tests {
+		r := newJSONRequest(t, http.MethodPut, "/users/"+test.id+"/password", test.change)
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+		if test.apiKey != "" {
+			r.Header.Set(auth.APIKeyHeader, test.apiKey)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad response code, expected: %v but got: %v\nbody: %s", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	// both users log in with the new password now
+	login(t, handler, user.Email, newPassword)
+	login(t, handler, other.Email, newPassword)
+}
+
+func TestUpdateRejectsPassword(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/users", UserData{
+		FirstName: "Test", LastName: "Man", Email: "testman@example.com",
+	}))
+
+	var created UserData
+	err := json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatalf("error decoding created user: %v", err)
+	}
+
+	// we call this w because it's what would normally be passed to a handler
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPatch, "/users/"+created.ID, UserData{Password: testPassword}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad response code, expected: %v but got: %v", http.StatusBadRequest, w.Code)
+	}
+	checkProblem(t, w, problem.TypeValidation, "passwords can't be changed here")
+}
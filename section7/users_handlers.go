@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mycoolserver/internal/conditional"
+	"mycoolserver/internal/logging"
+	"mycoolserver/internal/negotiate"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/users"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// UserList is one page of users, pass NextCursor back as the cursor query
+// parameter to get the next one
+type UserList struct {
+	Users      []*UserData `xml:"User"`
+	NextCursor string      `json:",omitempty" xml:",omitempty"`
+}
+
+// listParamNames maps users.ListOptions fields to their query parameters
+var listParamNames = map[string]string{
+	"Limit":  "limit",
+	"Cursor": "cursor",
+	"SortBy": "sort",
+}
+
+// listUsers supports the query parameters limit, cursor, sort (created,
+// lastName or firstName), order (asc or desc), email, emailDomain and
+// namePrefix
+func (s *server) listUsers(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	opts := users.ListOptions{
+		Cursor:      params.Get("cursor"),
+		SortBy:      users.SortField(params.Get("sort")),
+		Email:       params.Get("email"),
+		EmailDomain: params.Get("emailDomain"),
+		NamePrefix:  params.Get("namePrefix"),
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 1 {
+			writeProblem(w, r, problem.TypeValidation, http.StatusBadRequest, fmt.Sprintf("invalid limit: %q", limit),
+				problem.FieldError{Field: "limit", Detail: "must be a positive number"})
+			return
+		}
+		opts.Limit = parsedLimit
+	}
+
+	switch order := params.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		writeProblem(w, r, problem.TypeValidation, http.StatusBadRequest, fmt.Sprintf("invalid order: %q", order),
+			problem.FieldError{Field: "order", Detail: "must be asc or desc"})
+		return
+	}
+
+	page, err := s.userManager.ListUsers(r.Context(), opts)
+	if err != nil {
+		writeUserError(w, r, "error listing users", err, listParamNames)
+		return
+	}
+
+	result := UserList{
+		Users:      make([]*UserData, 0, len(page.Users)),
+		NextCursor: page.NextCursor,
+	}
+	for i := range page.Users {
+		result.Users = append(result.Users, convertUserToUserData(&page.Users[i]))
+	}
+
+	writeResponse(w, r, http.StatusOK, result)
+}
+
+// getUserByID answers with a 304 when If-None-Match has the user's current
+// ETag
+func (s *server) getUserByID(w http.ResponseWriter, r *http.Request) {
+	user, err := s.userManager.GetUserByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeUserError(w, r, "error retrieving user", err, nil)
+		return
+	}
+
+	writeUserIfModified(w, r, user)
+}
+
+func (s *server) createUser(w http.ResponseWriter, r *http.Request) {
+	var u UserData
+	if !s.decodeBody(w, r, &u) {
+		return
+	}
+
+	user, err := s.userManager.CreateUserWithPassword(r.Context(), u.FirstName, u.LastName, u.Email, u.Password)
+	if err != nil {
+		writeUserError(w, r, "error adding user", err, nil)
+		return
+	}
+
+	w.Header().Set("Location", "/users/"+url.PathEscape(user.ID))
+	writeUser(w, r, http.StatusCreated, user)
+}
+
+// replaceUser handles PUT, every field has to be provided
+func (s *server) replaceUser(w http.ResponseWriter, r *http.Request) {
+	var u UserData
+	if !s.decodeBody(w, r, &u) || !rejectPassword(w, r, &u) {
+		return
+	}
+
+	id := r.PathValue("id")
+
+	version, ok := s.checkIfMatch(w, r, id)
+	if !ok {
+		return
+	}
+
+	user, err := s.userManager.UpdateUser(r.Context(), id, version, u.FirstName, u.LastName, u.Email)
+	if err != nil {
+		writeUserError(w, r, "error updating user", err, nil)
+		return
+	}
+
+	writeUser(w, r, http.StatusOK, user)
+}
+
+// patchAttempts is how many times patchUser merges a PATCH without If-Match
+// into the user before giving up on other changes landing first
+const patchAttempts = 3
+
+// patchUser handles PATCH, fields that are left out or empty keep their
+// current value
+func (s *server) patchUser(w http.ResponseWriter, r *http.Request) {
+	var u UserData
+	if !s.decodeBody(w, r, &u) || !rejectPassword(w, r, &u) {
+		return
+	}
+
+	id := r.PathValue("id")
+	hasIfMatch := len(r.Header.Values("If-Match")) > 0
+
+	for attempt := 1; ; attempt++ {
+		existing, err := s.userManager.GetUserByID(r.Context(), id)
+		if err != nil {
+			writeUserError(w, r, "error retrieving user", err, nil)
+			return
+		}
+
+		if !ifMatchUser(r, existing) {
+			writePreconditionFailed(w, r)
+			return
+		}
+
+		merged := convertUserToUserData(existing)
+		if u.FirstName != "" {
+			merged.FirstName = u.FirstName
+		}
+		if u.LastName != "" {
+			merged.LastName = u.LastName
+		}
+		if u.Email != "" {
+			merged.Email = u.Email
+		}
+
+		// the merge is based on existing, so a change made since it was
+		// read must not be overwritten.  A client that sent If-Match gets
+		// a 412, otherwise the merge is done again on top of the change.
+		user, err := s.userManager.UpdateUser(r.Context(), id, existing.Version, merged.FirstName, merged.LastName, merged.Email)
+		if errors.Is(err, users.ErrVersionMismatch) && !hasIfMatch {
+			if attempt < patchAttempts {
+				continue
+			}
+			writeProblem(w, r, problem.TypeConflict, http.StatusConflict,
+				"the user kept changing while the update was being made, try again")
+			return
+		}
+		if err != nil {
+			writeUserError(w, r, "error updating user", err, nil)
+			return
+		}
+
+		writeUser(w, r, http.StatusOK, user)
+		return
+	}
+}
+
+func (s *server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	version, ok := s.checkIfMatch(w, r, id)
+	if !ok {
+		return
+	}
+
+	err := s.userManager.DeleteUser(r.Context(), id, version)
+	if err != nil {
+		writeUserError(w, r, "error deleting user", err, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userETag is a strong ETag for the user sent as mediaType, every
+// representation of a resource needs its own
+func userETag(u *users.User, mediaType string) string {
+	_, format, _ := strings.Cut(mediaType, "/")
+	return conditional.Strong(strconv.FormatInt(u.Version, 10) + "-" + format)
+}
+
+// writeUser sends a user with its ETag
+func writeUser(w http.ResponseWriter, r *http.Request, status int, u *users.User) {
+	w.Header().Set("ETag", userETag(u, responseCodec(r).MediaType))
+	writeResponse(w, r, status, convertUserToUserData(u))
+}
+
+// writeUserIfModified sends a user unless If-None-Match has its current
+// ETag.  Then GET and HEAD get a 304, RFC 9110 says anything else, like the
+// deprecated POST /get-user, gets a 412.
+func writeUserIfModified(w http.ResponseWriter, r *http.Request, u *users.User) {
+	etag := userETag(u, responseCodec(r).MediaType)
+	if !conditional.IfNoneMatch(r.Header, etag) {
+		w.Header().Set("ETag", etag)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeProblem(w, r, problem.TypePrecondition, http.StatusPreconditionFailed,
+				"the user hasn't changed since the ETag in If-None-Match was sent")
+			return
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeUser(w, r, http.StatusOK, u)
+}
+
+// ifMatchUser reports whether If-Match lets a change to u go ahead.  Any
+// format's ETag for the current version will do, a client can change a
+// user it read as XML with a request that wants JSON back.
+func ifMatchUser(r *http.Request, u *users.User) bool {
+	for _, mediaType := range userFormats {
+		if conditional.IfMatch(r.Header, userETag(u, mediaType)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch evaluates If-Match against the user's current ETag and
+// returns the version the change has to be made to, so one that sneaks in
+// after the check still fails.  The version is users.AnyVersion when
+// there's no If-Match.  If it returns false an error response has already
+// been written.
+func (s *server) checkIfMatch(w http.ResponseWriter, r *http.Request, id string) (int64, bool) {
+	if len(r.Header.Values("If-Match")) == 0 {
+		return users.AnyVersion, true
+	}
+
+	// a user that doesn't exist is a 404 whatever the precondition says,
+	// RFC 9110 only evaluates them when the request would otherwise succeed
+	user, err := s.userManager.GetUserByID(r.Context(), id)
+	if err != nil {
+		writeUserError(w, r, "error retrieving user", err, nil)
+		return 0, false
+	}
+
+	if !ifMatchUser(r, user) {
+		writePreconditionFailed(w, r)
+		return 0, false
+	}
+
+	return user.Version, true
+}
+
+func writePreconditionFailed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, problem.TypePrecondition, http.StatusPreconditionFailed,
+		"the user has changed since the ETag in If-Match was sent, get it again and retry")
+}
+
+// rejectPassword stops updates quietly ignoring a password, changing one
+// needs the current password so it has its own route.  If it returns false
+// an error response has already been written.
+func rejectPassword(w http.ResponseWriter, r *http.Request, u *UserData) bool {
+	if u.Password == "" {
+		return true
+	}
+
+	writeProblem(w, r, problem.TypeValidation, http.StatusBadRequest, "passwords can't be changed here",
+		problem.FieldError{Field: "Password", Detail: "use PUT /users/{id}/password to change a password"})
+	return false
+}
+
+// deprecated marks responses from an old endpoint so clients know to move
+// to its successor.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next(w, r)
+	}
+}
+
+// decodeBody decodes a request body in any format negotiate reads into dst.
+// If it returns false an error response has already been written.
+func (s *server) decodeBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	contentType := r.Header.Get("Content-Type")
+	codec, err := negotiate.ContentType(contentType)
+	if err != nil {
+		logging.FromContext(r.Context()).Debug("unsupported request body", "err", err)
+		writeProblem(w, r, problem.TypeUnsupported, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("unsupported Content-Type header: %q", contentType))
+		return false
+	}
+
+	requestBody := http.MaxBytesReader(w, r.Body, s.bodyLimit())
+
+	err = codec.Decode(requestBody, dst)
+	if err != nil {
+		writeProblem(w, r, problem.TypeBadRequestBody, http.StatusBadRequest, fmt.Sprintf("error decoding request body: %v", err))
+		return false
+	}
+
+	return true
+}
+
+// writeResponse marshals v in the format negotiate.Middleware picked for
+// the route, or JSON if it didn't pick one the codecs can write
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	codec := responseCodec(r)
+
+	marshalled, err := codec.Marshal(v)
+	if err != nil {
+		writeInternalError(w, r, "error marshalling response", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.MediaType)
+	w.WriteHeader(status)
+	_, err = w.Write(marshalled)
+	if err != nil {
+		// headers are set by write call, best we can do is log an error
+		logging.FromContext(r.Context()).Error("error writing response body", "err", err)
+	}
+}
+
+// responseCodec is the codec writeResponse uses
+func responseCodec(r *http.Request) negotiate.Codec {
+	codec, ok := negotiate.Lookup(negotiate.MediaType(r.Context()))
+	if !ok || codec.Marshal == nil {
+		codec, _ = negotiate.Lookup(negotiate.JSON)
+	}
+	return codec
+}
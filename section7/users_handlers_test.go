@@ -0,0 +1,1297 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mycoolserver/internal/auth"
+	"mycoolserver/internal/compression"
+	"mycoolserver/internal/cors"
+	"mycoolserver/internal/metrics"
+	"mycoolserver/internal/negotiate"
+	"mycoolserver/internal/policy"
+	"mycoolserver/internal/problem"
+	"mycoolserver/internal/ratelimit"
+	"mycoolserver/internal/users"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func newTestServer(t *testing.T) (*server, http.Handler) {
+	t.Helper()
+
+	registry := metrics.NewRegistry()
+	testServer := &server{
+		userManager:   users.NewManager(users.WithMetrics(registry)),
+		metrics:       registry,
+		checkResponse: checkResponses(t),
+	}
+
+	return testServer, testServer.handler()
+}
+
+func newJSONRequest(t *testing.T, method string, target string, body any) *http.Request {
+	t.Helper()
+
+	marshalledRequestBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("error marshalling test data: %v", err)
+	}
+
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(marshalledRequestBody))
+	req.Header.Set("Content-Type", "application/json")
+
+	return req
+}
+
+func TestUsersResource(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	// create
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/users", UserData{
+		FirstName: "Test",
+		LastName:  "Man",
+		Email:     "testman@example.com",
+	}))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var created UserData
+	err := json.NewDecoder(w.Body).Decode(&created)
+	if err != nil {
+		t.Fatalf("error decoding response body: %v", err)
+	}
+
+	if created.ID == "" {
+		t.Fatal("created user has no id")
+	}
+
+	location := w.Header().Get("Location")
+	if location != "/users/"+created.ID {
+		t.Errorf("bad Location header, expected: %q but got: %q", "/users/"+created.ID, location)
+	}
+
+	// get
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var fetched UserData
+	err = json.NewDecoder(w.Body).Decode(&fetched)
+	if err != nil {
+		t.Fatalf("error decoding response body: %v", err)
+	}
+
+	if !reflect.DeepEqual(created, fetched) {
+		t.Errorf("bad fetched user\nwanted: %+v\ngot: %+v", created, fetched)
+	}
+
+	// put
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPut, location, UserData{
+		FirstName: "Test",
+		LastName:  "Woman",
+		Email:     "testwoman@example.com",
+	}))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// patch
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPatch, location, UserData{
+		FirstName: "Best",
+	}))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var patched UserData
+	err = json.NewDecoder(w.Body).Decode(&patched)
+	if err != nil {
+		t.Fatalf("error decoding response body: %v", err)
+	}
+
+	expected := UserData{
+		ID:        created.ID,
+		FirstName: "Best",
+		LastName:  "Woman",
+		Email:     "testwoman@example.com",
+		CreatedAt: created.CreatedAt,
+		UpdatedAt: patched.UpdatedAt,
+	}
+	if !reflect.DeepEqual(expected, patched) {
+		t.Errorf("bad patched user\nwanted: %+v\ngot: %+v", expected, patched)
+	}
+
+	if !patched.UpdatedAt.After(created.UpdatedAt) {
+		t.Errorf("UpdatedAt not moved forward, created: %v, patched: %v", created.UpdatedAt, patched.UpdatedAt)
+	}
+
+	// list
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var listed UserList
+	err = json.NewDecoder(w.Body).Decode(&listed)
+	if err != nil {
+		t.Fatalf("error decoding response body: %v", err)
+	}
+
+	expectedList := UserList{Users: []*UserData{&expected}}
+	if !reflect.DeepEqual(expectedList, listed) {
+		t.Errorf("bad user list\nwanted: %+v\ngot: %+v", expectedList, listed)
+	}
+
+	// delete
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, location, nil))
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusNotFound, w.Code, w.Body.String())
+	}
+}
+
+func TestUsersResourceErrors(t *testing.T) {
+	testServer, handler := newTestServer(t)
+
+	err := testServer.userManager.AddUser(context.Background(), "Test", "Man", "testman@example.com")
+	if err != nil {
+		t.Fatalf("error inserting test user: %v", err)
+	}
+
+	tests := map[string]struct {
+		req          *http.Request
+		expectedCode int
+		expectedType string
+		expectedErrs []problem.FieldError
+	}{
+		"duplicate email": {
+			req: newJSONRequest(t, http.MethodPost, "/users", UserData{
+				FirstName: "Other",
+				LastName:  "Man",
+				Email:     "testman@example.com",
+			}),
+			expectedCode: http.StatusConflict,
+			expectedType: problem.TypeDuplicate,
+			expectedErrs: []problem.FieldError{{Field: "Email", Detail: users.ErrDuplicateEmail.Error()}},
+		},
+		"invalid email": {
+			req: newJSONRequest(t, http.MethodPost, "/users", UserData{
+				FirstName: "Other",
+				LastName:  "Man",
+				Email:     "foobar",
+			}),
+			expectedCode: http.StatusBadRequest,
+			expectedType: problem.TypeValidation,
+			expectedErrs: []problem.FieldError{{Field: "Email", Detail: "Email must be a valid email address"}},
+		},
+		"every invalid field": {
+			req: newJSONRequest(t, http.MethodPost, "/users", UserData{
+				FirstName: " ",
+				LastName:  "Man<script>",
+				Email:     "foobar",
+			}),
+			expectedCode: http.StatusBadRequest,
+			expectedType: problem.TypeValidation,
+			expectedErrs: []problem.FieldError{
+				{Field: "FirstName", Detail: "FirstName is required"},
+				{Field: "LastName", Detail: "LastName contains invalid character '<'"},
+				{Field: "Email", Detail: "Email must be a valid email address"},
+			},
+		},
+		"get missing user": {
+			req:          httptest.NewRequest(http.MethodGet, "/users/nope", nil),
+			expectedCode: http.StatusNotFound,
+			expectedType: problem.TypeNotFound,
+		},
+		"update missing user": {
+			req: newJSONRequest(t, http.MethodPut, "/users/nope", UserData{
+				FirstName: "Other",
+				LastName:  "Man",
+				Email:     "other@example.com",
+			}),
+			expectedCode: http.StatusNotFound,
+			expectedType: problem.TypeNotFound,
+		},
+		"patch missing user": {
+			req:          newJSONRequest(t, http.MethodPatch, "/users/nope", UserData{FirstName: "Other"}),
+			expectedCode: http.StatusNotFound,
+			expectedType: problem.TypeNotFound,
+		},
+		"delete missing user": {
+			req:          httptest.NewRequest(http.MethodDelete, "/users/nope", nil),
+			expectedCode: http.StatusNotFound,
+			expectedType: problem.TypeNotFound,
+		},
+		"missing content type": {
+			req:          httptest.NewRequest(http.MethodPost, "/users", nil),
+			expectedCode: http.StatusUnsupportedMediaType,
+			expectedType: problem.TypeUnsupported,
+		},
+	}
+
+	for name, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, test.req)
+
+		if w.Code != test.expectedCode {
+			t.Errorf("%s: bad response code, expected: %v but got: %v\nbody: %s\n",
+				name, test.expectedCode, w.Code, w.Body.String())
+		}
+
+		var decoded problem.Problem
+		err := json.Unmarshal(w.Body.Bytes(), &decoded)
+		if err != nil {
+			t.Errorf("%s: error decoding problem: %v\nbody: %s", name, err, w.Body.String())
+			continue
+		}
+
+		if decoded.Type != test.expectedType {
+			t.Errorf("%s: bad problem type, expected: %q but got: %q", name, test.expectedType, decoded.Type)
+		}
+
+		if !reflect.DeepEqual(decoded.Errors, test.expectedErrs) {
+			t.Errorf("%s: bad field errors\nwanted: %+v\ngot: %+v", name, test.expectedErrs, decoded.Errors)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/users", UserData{
+		FirstName: "Test",
+		LastName:  "Man",
+		Email:     "testman@example.com",
+	}))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad response code creating a user, wanted: %v, got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	location := w.Header().Get("Location")
+	created := w.Header().Get("ETag")
+	if created != `"1-json"` {
+		t.Errorf("bad ETag for a new user, wanted: %q, got: %q", `"1-json"`, created)
+	}
+
+	send := func(r *http.Request, header string, value string) *httptest.ResponseRecorder {
+		if value != "" {
+			r.Header.Set(header, value)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	replacement := UserData{FirstName: "Test", LastName: "Woman", Email: "testwoman@example.com"}
+
+	// the copy from the create is current
+	w = send(httptest.NewRequest(http.MethodGet, location, nil), "If-None-Match", created)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("bad response to a current If-None-Match, wanted: %v and no body, got: %v\nbody: %s", http.StatusNotModified, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != created {
+		t.Errorf("bad ETag on a 304, wanted: %q, got: %q", created, got)
+	}
+
+	// each format is its own representation
+	r := httptest.NewRequest(http.MethodGet, location, nil)
+	r.Header.Set("Accept", negotiate.XML)
+	w = send(r, "If-None-Match", created)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1-xml"` {
+		t.Errorf("bad response to an If-None-Match for another format, wanted: %v with %q, got: %v with %q", http.StatusOK, `"1-xml"`, w.Code, w.Header().Get("ETag"))
+	}
+
+	w = send(newJSONRequest(t, http.MethodPut, location, replacement), "If-Match", created)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad response to a current If-Match, wanted: %v, got: %v\nbody: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	updated := w.Header().Get("ETag")
+	if updated != `"2-json"` {
+		t.Errorf("bad ETag after an update, wanted: %q, got: %q", `"2-json"`, updated)
+	}
+
+	// a client still holding the first version has missed the update
+	tests := map[string]*http.Request{
+		"put":    newJSONRequest(t, http.MethodPut, location, replacement),
+		"patch":  newJSONRequest(t, http.MethodPatch, location, UserData{FirstName: "Best"}),
+		"delete": httptest.NewRequest(http.MethodDelete, location, nil),
+	}
+	for name, r := range tests {
+		w := send(r, "If-Match", created)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s: bad response to a stale If-Match, wanted: %v, got: %v\nbody: %s", name, http.StatusPreconditionFailed, w.Code, w.Body.String())
+			continue
+		}
+
+		var p problem.Problem
+		err := json.NewDecoder(w.Body).Decode(&p)
+		if err != nil {
+			t.Fatalf("%s: error decoding problem: %v", name, err)
+		}
+		if p.Type != problem.TypePrecondition {
+			t.Errorf("%s: bad problem type, wanted: %q, got: %q", name, problem.TypePrecondition, p.Type)
+		}
+	}
+
+	w = send(httptest.NewRequest(http.MethodGet, location, nil), "If-None-Match", created)
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response to a stale If-None-Match, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	// an ETag from any format will do for a change
+	w = send(newJSONRequest(t, http.MethodPatch, location, UserData{FirstName: "Best"}), "If-Match", `"2-cbor", "9-json"`)
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response to an If-Match from another format, wanted: %v, got: %v\nbody: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = send(httptest.NewRequest(http.MethodDelete, location, nil), "If-Match", "*")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("bad response to If-Match *, wanted: %v, got: %v\nbody: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	w = send(httptest.NewRequest(http.MethodDelete, location, nil), "If-Match", "*")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bad response to If-Match for a deleted user, wanted: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestConditionalRequestsUnversioned(t *testing.T) {
+	store := users.NewMemoryStore()
+	registry := metrics.NewRegistry()
+	handler := (&server{
+		userManager:   users.NewManager(users.WithStore(store), users.WithMetrics(registry)),
+		metrics:       registry,
+		checkResponse: checkResponses(t),
+	}).handler()
+
+	// stored before users had versions, so its ETag is "0-json"
+	err := store.Create(users.User{ID: "old", FirstName: "Test", LastName: "Man", Email: mail.Address{Address: "testman@example.com"}})
+	if err != nil {
+		t.Fatalf("error adding test user: %v", err)
+	}
+
+	workers := 20
+
+	var wg sync.WaitGroup
+	codes := make(chan int, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := newJSONRequest(t, http.MethodPut, "/users/old", UserData{FirstName: "Test", LastName: "Woman", Email: "testwoman@example.com"})
+			r.Header.Set("If-Match", `"0-json"`)
+			// we call this w because it's what would normally be passed to a handler
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			codes <- w.Code
+		}()
+	}
+
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	expected := map[int]int{http.StatusOK: 1, http.StatusPreconditionFailed: workers - 1}
+	if !reflect.DeepEqual(expected, counts) {
+		t.Errorf("bad responses to updates from the same ETag, wanted: %v, got: %v", expected, counts)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/users/old", nil)
+	r.Header.Set("If-Match", `"0-json"`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("bad response to a stale delete, wanted: %v, got: %v\nbody: %s", http.StatusPreconditionFailed, w.Code, w.Body.String())
+	}
+}
+
+// racingStore changes the user every time it's read, for the next races
+// reads, like another write landing just after each one
+type racingStore struct {
+	users.Store
+	races int
+}
+
+func (s *racingStore) GetByID(id string) (*users.User, error) {
+	u, err := s.Store.GetByID(id)
+	if err != nil || s.races == 0 {
+		return u, err
+	}
+	s.races--
+
+	changed := *u
+	changed.LastName += "x"
+	changed.Version++
+	return u, s.Store.Update(changed)
+}
+
+func TestPatchRacingWrite(t *testing.T) {
+	tests := map[string]struct {
+		races    int
+		ifMatch  string
+		status   int
+		lastName string
+	}{
+		"merged again": {
+			races:    1,
+			status:   http.StatusOK,
+			lastName: "Manx",
+		},
+		"keeps changing": {
+			races:  patchAttempts * 2,
+			status: http.StatusConflict,
+		},
+		"with If-Match": {
+			races:   1,
+			ifMatch: `"1-json"`,
+			status:  http.StatusPreconditionFailed,
+		},
+	}
+
+	for name, test := range tests {
+		store := &racingStore{Store: users.NewMemoryStore()}
+		registry := metrics.NewRegistry()
+		handler := (&server{
+			userManager:   users.NewManager(users.WithStore(store), users.WithMetrics(registry)),
+			metrics:       registry,
+			checkResponse: checkResponses(t),
+		}).handler()
+
+		err := store.Create(users.User{ID: "1", FirstName: "Test", LastName: "Man", Email: mail.Address{Address: "testman@example.com"}, Version: 1})
+		if err != nil {
+			t.Fatalf("%s: error adding test user: %v", name, err)
+		}
+		store.races = test.races
+
+		r := newJSONRequest(t, http.MethodPatch, "/users/1", UserData{FirstName: "Best"})
+		if test.ifMatch != "" {
+			r.Header.Set("If-Match", test.ifMatch)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad response code, wanted: %v, got: %v\nbody: %s", name, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var got UserData
+		err = json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("%s: error decoding user: %v", name, err)
+		}
+		// the other write's change survives alongside the patch
+		if got.FirstName != "Best" || got.LastName != test.lastName {
+			t.Errorf("%s: bad user, wanted: Best %s, got: %s %s", name, test.lastName, got.FirstName, got.LastName)
+		}
+	}
+}
+
+func TestDeprecatedEndpoints(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/add-user", UserData{
+		FirstName: "Test",
+		LastName:  "Man",
+		Email:     "testman@example.com",
+	}))
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	if w.Header().Get("Deprecation") != "true" {
+		t.Errorf("missing Deprecation header, got: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/get-user", UserData{
+		FirstName: "Test",
+		LastName:  "Man",
+	}))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code, expected: %v but got: %v\nbody: %s\n",
+			http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if w.Header().Get("Deprecation") != "true" {
+		t.Errorf("missing Deprecation header, got: %v", w.Header())
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag != `"1-json"` {
+		t.Errorf("bad ETag, expected: %q but got: %q", `"1-json"`, etag)
+	}
+
+	r := newJSONRequest(t, http.MethodPost, "/get-user", UserData{
+		FirstName: "Test",
+		LastName:  "Man",
+	})
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	// it's a POST, so RFC 9110 doesn't allow a 304
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("bad response to a current If-None-Match, expected: %v but got: %v\nbody: %s\n",
+			http.StatusPreconditionFailed, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("bad ETag on a 412, expected: %q but got: %q", etag, got)
+	}
+}
+
+func TestListUsersPaging(t *testing.T) {
+	testServer, handler := newTestServer(t)
+
+	for _, name := range []string{"Carol", "Alice", "Bob"} {
+		err := testServer.userManager.AddUser(context.Background(), name, "Tester", strings.ToLower(name)+"@example.com")
+		if err != nil {
+			t.Fatalf("error inserting test user: %v", err)
+		}
+	}
+	err := testServer.userManager.AddUser(context.Background(), "Dave", "Tester", "dave@example.org")
+	if err != nil {
+		t.Fatalf("error inserting test user: %v", err)
+	}
+
+	var names []string
+	target := "/users?limit=2&sort=firstName&emailDomain=example.com"
+	for pages := 0; target != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination doesn't end")
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("bad response code, expected: %v but got: %v\nbody: %s\n",
+				http.StatusOK, w.Code, w.Body.String())
+		}
+
+		var listed UserList
+		err = json.NewDecoder(w.Body).Decode(&listed)
+		if err != nil {
+			t.Fatalf("error decoding response body: %v", err)
+		}
+
+		for _, u := range listed.Users {
+			names = append(names, u.FirstName)
+		}
+
+		target = ""
+		if listed.NextCursor != "" {
+			target = "/users?limit=2&sort=firstName&emailDomain=example.com&cursor=" + url.QueryEscape(listed.NextCursor)
+		}
+	}
+
+	expected := []string{"Alice", "Bob", "Carol"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("bad paged names\nwanted: %v\ngot: %v", expected, names)
+	}
+
+	badParams := map[string]string{
+		"/users?limit=0":        "limit",
+		"/users?limit=abc":      "limit",
+		"/users?limit=100000":   "limit",
+		"/users?order=sideways": "order",
+		"/users?sort=shoeSize":  "sort",
+		"/users?cursor=garbage": "cursor",
+	}
+
+	for target, field := range badParams {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: bad response code, expected: %v but got: %v\nbody: %s\n",
+				target, http.StatusBadRequest, w.Code, w.Body.String())
+		}
+
+		var decoded problem.Problem
+		err := json.Unmarshal(w.Body.Bytes(), &decoded)
+		if err != nil {
+			t.Errorf("%s: error decoding problem: %v\nbody: %s", target, err, w.Body.String())
+			continue
+		}
+
+		if len(decoded.Errors) != 1 || decoded.Errors[0].Field != field {
+			t.Errorf("%s: bad field errors, expected one for %q but got: %+v", target, field, decoded.Errors)
+		}
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	testServer := &server{
+		userManager: users.NewManager(),
+		// every request is already out of time when it reaches the manager
+		requestTimeout: time.Nanosecond,
+		routeTimeouts:  map[string]time.Duration{"GET /users": 0},
+	}
+	handler := testServer.handler()
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newJSONRequest(t, http.MethodPost, "/users", UserData{
+		FirstName: "Test", LastName: "Man", Email: "testman@example.com",
+	}))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bad response code, wanted: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	checkProblem(t, w, problem.TypeTimeout, "error adding user: request took too long")
+
+	// GET /users has its own timeout, no limit at all
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("bad response code for route without a timeout, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// parameters on the Content-Type used to get a 415
+	r := newJSONRequest(t, http.MethodPost, "/add-user", UserData{FirstName: "Json", LastName: "Person", Email: "json@example.com"})
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := serve(r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("bad response code with a charset, wanted: %v, got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(
+		"<UserData><FirstName>Xml</FirstName><LastName>Person</LastName><Email>xml@example.com</Email></UserData>"))
+	r.Header.Set("Content-Type", "application/xml")
+	r.Header.Set("Accept", "application/xml")
+	w = serve(r)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != negotiate.XML {
+		t.Fatalf("bad XML response, wanted: %v %s, got: %v %s\nbody: %s", http.StatusCreated, negotiate.XML, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	var created UserData
+	err := xml.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatalf("error decoding XML response: %v", err)
+	}
+	if created.Email != "xml@example.com" || created.ID == "" {
+		t.Errorf("bad user from XML response, got: %+v", created)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("FirstName=Form&LastName=Person&Email=form%40example.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = serve(r)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != negotiate.JSON {
+		t.Errorf("bad form response, wanted: %v %s, got: %v %s\nbody: %s", http.StatusCreated, negotiate.JSON, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/users/"+created.ID, nil)
+	r.Header.Set("Accept", "application/cbor")
+	w = serve(r)
+
+	var fetched UserData
+	err = cbor.Unmarshal(w.Body.Bytes(), &fetched)
+	if err != nil {
+		t.Fatalf("error decoding CBOR response: %v", err)
+	}
+	if fetched.ID != created.ID || !fetched.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("bad user from CBOR response, wanted: %+v, got: %+v", created, fetched)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("Accept", "text/csv")
+	w = serve(r)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("bad response code for text/csv, wanted: %v, got: %v", http.StatusNotAcceptable, w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("FirstName,LastName"))
+	r.Header.Set("Content-Type", "text/csv")
+	w = serve(r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("bad response code for a text/csv body, wanted: %v, got: %v", http.StatusUnsupportedMediaType, w.Code)
+	}
+}
+
+func TestHelloFormats(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	tests := map[string]struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		"default": {
+			contentType: "text/plain; charset=utf-8",
+			body:        "Hello, <b>Test</b>!\n",
+		},
+		"json": {
+			accept:      "application/json",
+			contentType: "application/json",
+			body:        `{"Message":"Hello, \u003cb\u003eTest\u003c/b\u003e!"}`,
+		},
+		"html": {
+			accept:      "text/html",
+			contentType: "text/html; charset=utf-8",
+			body:        "<!DOCTYPE html>\n<html><head><title>Hello</title></head><body><p>Hello, &lt;b&gt;Test&lt;/b&gt;!</p></body></html>\n",
+		},
+	}
+
+	for name, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/hello/?user="+url.QueryEscape("<b>Test</b>"), nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s: bad Content-Type, wanted: %q, got: %q", name, test.contentType, w.Header().Get("Content-Type"))
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("%s: bad body, wanted: %q, got: %q", name, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	authenticator, err := auth.New(
+		auth.WithAPIKey("first", auth.HashAPIKey("first-key"), string(users.RoleEditor)),
+		auth.WithAPIKey("second", auth.HashAPIKey("second-key"), string(users.RoleEditor)),
+	)
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	testServer := &server{
+		userManager: users.NewManager(),
+		auth:        authenticator,
+		// one request and then nothing for the rest of the test
+		routeRateLimits: map[string]ratelimit.Limit{"POST /add-user": {Rate: 0.001, Burst: 1}},
+	}
+	handler := testServer.handler()
+
+	addUser := func(apiKey string, email string) *httptest.ResponseRecorder {
+		r := newJSONRequest(t, http.MethodPost, "/add-user", UserData{FirstName: "Test", LastName: "Man", Email: email})
+		r.Header.Set(auth.APIKeyHeader, apiKey)
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := addUser("first-key", "first@example.com")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad response code, wanted: %v, got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w.Header().Get(ratelimit.HeaderRemaining) != "0" {
+		t.Errorf("bad %s header, wanted: 0, got: %q", ratelimit.HeaderRemaining, w.Header().Get(ratelimit.HeaderRemaining))
+	}
+
+	w = addUser("first-key", "again@example.com")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("bad response code, wanted: %v, got: %v", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	checkProblem(t, w, problem.TypeRateLimited, "too many requests, try again in 1000 seconds")
+
+	// each API key has its own bucket even from the same address
+	w = addUser("second-key", "second@example.com")
+	if w.Code != http.StatusCreated {
+		t.Errorf("bad response code for another API key, wanted: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	// routes without a limit don't get the headers
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set(auth.APIKeyHeader, "first-key")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get(ratelimit.HeaderLimit) != "" {
+		t.Errorf("bad response for route without a limit, wanted: %v without rate limit headers, got: %v %v", http.StatusOK, w.Code, w.Header())
+	}
+}
+
+func TestRateLimitsBadCredentials(t *testing.T) {
+	authenticator, err := auth.New(auth.WithAPIKey("viewer", auth.HashAPIKey("viewer-key"), string(users.RoleViewer)))
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	testServer := &server{
+		userManager:     users.NewManager(),
+		auth:            authenticator,
+		routeRateLimits: map[string]ratelimit.Limit{"GET /users": {Rate: 0.001, Burst: 3}},
+	}
+	handler := testServer.handler()
+
+	listUsers := func(apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.Header.Set(auth.APIKeyHeader, apiKey)
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// requests with credentials only count against the key's own bucket
+	for i := range 3 {
+		if w := listUsers("viewer-key"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: bad response code, wanted: %v, got: %v", i, http.StatusOK, w.Code)
+		}
+	}
+
+	// guessing keys runs out, it isn't free just because the guesses never
+	// get as far as the per principal limit
+	var codes []int
+	for i := range 5 {
+		codes = append(codes, listUsers(fmt.Sprintf("guess-%d", i)).Code)
+	}
+
+	expected := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized,
+		http.StatusTooManyRequests, http.StatusTooManyRequests}
+	if !reflect.DeepEqual(expected, codes) {
+		t.Errorf("bad response codes for bad keys, wanted: %v, got: %v", expected, codes)
+	}
+}
+
+func TestPasswordHashingBusy(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+
+	writeUserError(w, r, "error logging in", fmt.Errorf("error checking password: %w", users.ErrBusy), nil)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bad response code, wanted: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	testServer, handler := newTestServer(t)
+
+	err := testServer.userManager.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("error shutting down user manager: %v", err)
+	}
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bad response code, wanted: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	checkProblem(t, w, problem.TypeUnavailable, "server is shutting down")
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	newUser := UserData{FirstName: "Test", LastName: "Man", Email: "testman@example.com"}
+	requests := []*http.Request{
+		newJSONRequest(t, http.MethodPost, "/users", newUser),
+		newJSONRequest(t, http.MethodPost, "/users", newUser),
+		httptest.NewRequest(http.MethodGet, "/users/nope", nil),
+	}
+	for _, r := range requests {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad response code, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	if w.Header().Get("Content-Type") != metrics.ContentType {
+		t.Errorf("bad content type, wanted: %q, got: %q", metrics.ContentType, w.Header().Get("Content-Type"))
+	}
+
+	expectedLines := []string{
+		`http_requests_total{pattern="POST /users",status_class="2xx"} 1`,
+		`http_requests_total{pattern="POST /users",status_class="4xx"} 1`,
+		`http_requests_total{pattern="GET /users/{id}",status_class="4xx"} 1`,
+		`http_request_duration_seconds_count{pattern="POST /users",status_class="2xx"} 1`,
+		// the scrape itself
+		`http_requests_in_flight{pattern="GET /metrics"} 1`,
+		`users_add_failures_total{reason="duplicate_email"} 1`,
+		`users_lookups_total{by="id",result="miss"} 1`,
+		`users_stored 1`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics missing line: %s", line)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	authenticator, err := auth.New(
+		auth.WithAPIKey("reader", auth.HashAPIKey("reader-key"), "", policy.ScopeUsersRead),
+		auth.WithAPIKey("writer", auth.HashAPIKey("writer-key"), "", policy.ScopeUsersRead, policy.ScopeUsersWrite),
+		auth.WithAPIKey("editor", auth.HashAPIKey("editor-key"), string(users.RoleEditor)),
+	)
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	testServer := &server{
+		userManager: users.NewManager(),
+		auth:        authenticator,
+	}
+	handler := testServer.handler()
+
+	newUser := UserData{FirstName: "Test", LastName: "Man", Email: "testman@example.com"}
+	tests := map[string]struct {
+		request     *http.Request
+		apiKey      string
+		status      int
+		problemType string
+		reason      string
+	}{
+		"public route": {
+			request: httptest.NewRequest(http.MethodGet, "/hello/?user=Test", nil),
+			status:  http.StatusOK,
+		},
+		"no credentials": {
+			request:     newJSONRequest(t, http.MethodPost, "/users", newUser),
+			status:      http.StatusUnauthorized,
+			problemType: problem.TypeUnauthorized,
+		},
+		"missing scope": {
+			request:     newJSONRequest(t, http.MethodPost, "/users", newUser),
+			apiKey:      "reader-key",
+			status:      http.StatusForbidden,
+			problemType: problem.TypeForbidden,
+			reason:      policy.ReasonRoleNotAllowed,
+		},
+		"deprecated route": {
+			request:     newJSONRequest(t, http.MethodPost, "/add-user", newUser),
+			apiKey:      "reader-key",
+			status:      http.StatusForbidden,
+			problemType: problem.TypeForbidden,
+			reason:      policy.ReasonRoleNotAllowed,
+		},
+		"editor role": {
+			request: newJSONRequest(t, http.MethodPost, "/users", UserData{FirstName: "Other", LastName: "Person", Email: "other@example.com"}),
+			apiKey:  "editor-key",
+			status:  http.StatusCreated,
+		},
+		"editor can't delete": {
+			request:     httptest.NewRequest(http.MethodDelete, "/users/1", nil),
+			apiKey:      "editor-key",
+			status:      http.StatusForbidden,
+			problemType: problem.TypeForbidden,
+			reason:      policy.ReasonRoleNotAllowed,
+		},
+		"write scope can't set roles": {
+			request:     newJSONRequest(t, http.MethodPut, "/users/1/role", RoleChange{Role: "admin"}),
+			apiKey:      "writer-key",
+			status:      http.StatusForbidden,
+			problemType: problem.TypeForbidden,
+			reason:      policy.ReasonRoleNotAllowed,
+		},
+		"allowed": {
+			request: newJSONRequest(t, http.MethodPost, "/users", newUser),
+			apiKey:  "writer-key",
+			status:  http.StatusCreated,
+		},
+		"read scope": {
+			request: httptest.NewRequest(http.MethodGet, "/users", nil),
+			apiKey:  "reader-key",
+			status:  http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		if test.apiKey != "" {
+			test.request.Header.Set(auth.APIKeyHeader, test.apiKey)
+		}
+
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, test.request)
+
+		if w.Code != test.status {
+			t.Errorf("%s: bad response code, wanted: %v, got: %v\nbody: %s", name, test.status, w.Code, w.Body.String())
+			continue
+		}
+
+		if test.problemType == "" {
+			continue
+		}
+
+		var decoded problem.Problem
+		err := json.Unmarshal(w.Body.Bytes(), &decoded)
+		if err != nil {
+			t.Errorf("%s: error decoding problem: %v", name, err)
+			continue
+		}
+		if decoded.Type != test.problemType {
+			t.Errorf("%s: bad problem type, wanted: %s, got: %s", name, test.problemType, decoded.Type)
+		}
+		if decoded.Reason != test.reason {
+			t.Errorf("%s: bad reason, wanted: %q, got: %q", name, test.reason, decoded.Reason)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	corsHandler, err := cors.New(cors.Options{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Content-Type", "X-API-Key"},
+	})
+	if err != nil {
+		t.Fatalf("error creating CORS: %v", err)
+	}
+	authenticator, err := auth.New()
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	testServer := &server{userManager: users.NewManager(), auth: authenticator, cors: corsHandler}
+	handler := testServer.handler()
+
+	// preflights don't carry credentials, so they're answered before
+	// authentication
+	r := httptest.NewRequest(http.MethodOptions, "/add-user", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "content-type,x-api-key")
+
+	// we call this w because it's what would normally be passed to a handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("bad response code for preflight, wanted: %v, got: %v\nbody: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "POST" {
+		t.Errorf("bad Access-Control-Allow-Methods, wanted: POST, got: %q", got)
+	}
+
+	// errors need the headers too or scripts can't read them
+	r = newJSONRequest(t, http.MethodPost, "/add-user", UserData{FirstName: "Test", LastName: "Man", Email: "testman@example.com"})
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("bad response code, wanted: %v, got: %v", http.StatusUnauthorized, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("bad Access-Control-Allow-Origin, wanted: https://app.example.com, got: %q", got)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	compressor, err := compression.New(compression.Options{Encodings: compression.DefaultEncodings, MaxRequestBytes: defaultMaxBodyBytes})
+	if err != nil {
+		t.Fatalf("error creating compressor: %v", err)
+	}
+
+	testServer := &server{userManager: users.NewManager(), compression: compressor, checkResponse: checkResponses(t)}
+	handler := testServer.handler()
+
+	// request bodies can be compressed too
+	for i := range 20 {
+		user := UserData{
+			FirstName: "Test",
+			LastName:  "Man",
+			Email:     fmt.Sprintf("testman%d@example.com", i),
+			Password:  "correct horse battery staple",
+		}
+		marshalled, err := json.Marshal(user)
+		if err != nil {
+			t.Fatalf("error marshalling user: %v", err)
+		}
+
+		var body bytes.Buffer
+		gw := gzip.NewWriter(&body)
+		gw.Write(marshalled)
+		gw.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/users", &body)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Encoding", "gzip")
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("bad response code creating a user, wanted: %v, got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad response code, wanted: %v, got: %v", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("bad Content-Encoding, wanted: gzip, got: %q", got)
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("error decompressing response: %v", err)
+	}
+	var list UserList
+	err = json.NewDecoder(gr).Decode(&list)
+	if err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if len(list.Users) != 20 {
+		t.Errorf("bad number of users, wanted: 20, got: %d", len(list.Users))
+	}
+
+	// small responses aren't worth it
+	r = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("bad Content-Encoding for a small response, wanted none, got: %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("bad Vary, wanted: Accept-Encoding, got: %q", got)
+	}
+}
+
+func TestCompressedETagIfMatch(t *testing.T) {
+	// small enough that a single user is compressed
+	compressor, err := compression.New(compression.Options{Encodings: compression.DefaultEncodings, MinSize: 1, MaxRequestBytes: defaultMaxBodyBytes})
+	if err != nil {
+		t.Fatalf("error creating compressor: %v", err)
+	}
+
+	testServer := &server{userManager: users.NewManager(), compression: compressor, checkResponse: checkResponses(t)}
+	handler := testServer.handler()
+
+	send := func(r *http.Request, acceptEncoding string, ifMatch string) *httptest.ResponseRecorder {
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		// we call this w because it's what would normally be passed to a handler
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send(newJSONRequest(t, http.MethodPost, "/users", UserData{FirstName: "Test", LastName: "Man", Email: "testman@example.com"}), "", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad response code creating a user, wanted: %v, got: %v\nbody: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	w = send(httptest.NewRequest(http.MethodGet, location, nil), "gzip", "")
+	etag := w.Header().Get("ETag")
+	if w.Header().Get("Content-Encoding") != "gzip" || etag != `"1-json-gzip"` {
+		t.Fatalf("bad compressed response, wanted gzip with %q, got: %q with %q", `"1-json-gzip"`, w.Header().Get("Content-Encoding"), etag)
+	}
+
+	// the change is sent without Accept-Encoding, but it's the same user
+	w = send(newJSONRequest(t, http.MethodPut, location, UserData{FirstName: "Test", LastName: "Woman", Email: "testwoman@example.com"}), "", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad response to an If-Match from a compressed GET, wanted: %v, got: %v\nbody: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = send(httptest.NewRequest(http.MethodDelete, location, nil), "br", `"2-json-gzip"`)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("bad response to an If-Match from another encoding, wanted: %v, got: %v\nbody: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+}
+
+// a protected route without an action would be denied to everyone but
+// admins, every route has to say what it does
+func TestRoutesDeclareAccess(t *testing.T) {
+	testServer, _ := newTestServer(t)
+
+	for _, rt := range testServer.routeTable() {
+		if !rt.public && rt.action == "" {
+			t.Errorf("route %q is neither public nor declares an action", rt.pattern)
+		}
+	}
+}